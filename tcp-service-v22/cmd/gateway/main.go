@@ -1,19 +1,54 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
+	"strings"
 	tcp_service_v22 "tcp-service-go/tcp-service-v22"
 	"tcp-service-go/tcp-service-v22/internal/gateway"
 	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
 	"tcp-service-go/tcp-service-v22/internal/service"
+	"tcp-service-go/tcp-service-v22/internal/tool/hotrestart"
 	"tcp-service-go/tcp-service-v22/internal/tool/signal"
+	"tcp-service-go/tcp-service-v22/internal/tool/tlsconfig"
+	"time"
 )
 
+// shutdownTimeout 优雅关闭的最长等待时间，超过之后强制关闭
+const shutdownTimeout = 10 * time.Second
+
 var p1innerService *service.TCPService
 var p1openService *service.TCPService
 
+// innerListen 内部服务监听的地址，同一台机器上的服务提供者可以用 Unix domain socket 连接网关
+var innerListen = flag.String("inner-listen", "", "listen URLs of the inner service, comma separated, e.g. tcp4://127.0.0.1:9501,unix:///tmp/gw.sock")
+
+// openReusePortNum HTTP 服务用 SO_REUSEPORT 打开几个 listener，多个 CPU 核心一起 Accept
+var openReusePortNum = flag.Int("open-reuseport", 0, "number of SO_REUSEPORT listeners of the HTTP service, linux only")
+
+// isOpenProxyProtocol HTTP 服务在 L4 负载均衡后面，连接以 PROXY protocol 头开始，日志中记录真实的客户端地址
+var isOpenProxyProtocol = flag.Bool("open-proxy-protocol", false, "HTTP service connections start with a PROXY protocol v1/v2 header")
+
+// openCompressMinSize HTTP 响应体至少多少字节才压缩（按 Accept-Encoding 用 gzip 或者 deflate），小于 0 时不压缩
+var openCompressMinSize = flag.Int("open-compress-min-size", 1024, "compress HTTP responses of at least this many bytes with gzip or deflate (0 means 1024), negative disables")
+
+// muxListen 一个端口同时接收服务提供者（Stream 协议）和外部 HTTP 请求，为空时不开启。
+// 服务提供者要先发送 Stream 协议的 Magic（cmd/user 的 -inner-magic）
+var muxListen = flag.String("mux-listen", "", "listen URL accepting both providers (stream) and HTTP clients, e.g. tcp4://127.0.0.1:9500")
+
+// TLS 配置，证书和私钥为空的时候不加密
+var openCertFile = flag.String("open-cert", "", "TLS certificate file of the HTTP service")
+var openKeyFile = flag.String("open-key", "", "TLS key file of the HTTP service")
+var innerCertFile = flag.String("inner-cert", "", "TLS certificate file of the inner service")
+var innerKeyFile = flag.String("inner-key", "", "TLS key file of the inner service")
+var innerClientCAFile = flag.String("inner-client-ca", "", "CA file for verifying service providers, enables mutual TLS")
+
 func main() {
+	flag.Parse()
 	log.Println("version: ", tcp_service_v22.Version)
 
 	gateway.P1gateway.SetDebugStatusOn()
@@ -21,6 +56,24 @@ func main() {
 	p1innerService := service.NewTCPService(protocol.StreamStr, "127.0.0.1", 9501)
 	p1innerService.SetName(fmt.Sprintf("%s-service-gateway", protocol.StreamStr))
 	p1innerService.SetDebugStatusOn()
+	if "" != *innerListen {
+		p1innerService.SetListenURL(strings.Split(*innerListen, ",")...)
+	}
+	if "" != *innerCertFile {
+		p1tlsConfig, err := tlsconfig.NewServerConfig(*innerCertFile, *innerKeyFile)
+		if nil != err {
+			log.Fatalln("inner tls:", err)
+		}
+		if "" != *innerClientCAFile {
+			// 双向认证，只有带着 CA 签发的证书的服务提供者才能注册
+			p1clientCAs, err := tlsconfig.LoadCertPool(*innerClientCAFile)
+			if nil != err {
+				log.Fatalln("inner tls:", err)
+			}
+			tlsconfig.RequireClientCert(p1tlsConfig, p1clientCAs)
+		}
+		p1innerService.SetTLSConfig(p1tlsConfig)
+	}
 
 	p1innerService.OnServiceStart = func(p1service *service.TCPService) {
 		if p1service.IsDebug() {
@@ -49,6 +102,39 @@ func main() {
 	p1openService := service.NewTCPService(protocol.HTTPStr, "127.0.0.1", 9502)
 	p1openService.SetName(fmt.Sprintf("%s-service-gateway", protocol.HTTPStr))
 	p1openService.SetDebugStatusOn()
+	var p1openTLSConfig *tls.Config
+	if "" != *openCertFile {
+		var err error
+		p1openTLSConfig, err = tlsconfig.NewServerConfig(*openCertFile, *openKeyFile)
+		if nil != err {
+			log.Fatalln("open tls:", err)
+		}
+		p1openService.SetTLSConfig(p1openTLSConfig)
+	}
+	p1openService.SetReusePortNum(*openReusePortNum)
+	if *isOpenProxyProtocol {
+		p1openService.SetProxyProtocolOn()
+	}
+	// 超过最大连接数时，回复 503
+	p1openService.SetAdmitPolicy(service.AdmitPolicyReply)
+	// 外部 HTTP 连接的超时，卡住的客户端不能一直占着连接
+	p1openService.SetIdleTimeout(60 * time.Second)
+	p1openService.SetReadHeaderTimeout(5 * time.Second)
+	p1openService.SetReadTimeout(10 * time.Second)
+	p1openService.SetWriteTimeout(10 * time.Second)
+	// HTTP keep-alive，空闲的长连接 15 秒之后关闭，每个连接最多处理 1000 个请求
+	p1openService.SetKeepAliveTimeout(15 * time.Second)
+	p1openService.SetMaxRequestNum(1000)
+	// 服务提供者的 JSON 响应按 Accept-Encoding 压缩
+	if *openCompressMinSize >= 0 {
+		gateway.P1gateway.SetCompressConfig(&http.CompressConfig{MinSize: *openCompressMinSize})
+	}
+
+	if nil == p1openTLSConfig {
+		// 不加密的 HTTP/2（h2c），prior knowledge 和 Upgrade: h2c 都支持，每个 stream 和 HTTP/1.x 的请求一样处理。
+		// 配置了证书的时候不识别协议，连接都要 TLS 握手
+		p1openService.AddSniffProtocol(protocol.HTTP2Str, nil)
+	}
 
 	p1openService.OnConnRequest = func(p1conn *service.TCPConnection) {
 		if p1innerService.IsDebug() {
@@ -56,8 +142,61 @@ func main() {
 		}
 		gateway.P1gateway.DispatchOpenRequest(p1conn)
 	}
+	// 外部连接关闭之后，还在等服务提供者响应的请求不用再响应了
+	p1openService.OnConnClose = gateway.P1gateway.DeleteOpenRequest
 
 	go p1openService.Start()
 
-	signal.WaitForShutdown()
+	var p1muxService *service.TCPService
+	if "" != *muxListen {
+		// 识别不出来的连接当成 HTTP，Stream 协议的连接用服务提供者的回调，HTTP/2 的和 HTTP 的一样
+		p1muxService = service.NewTCPService(protocol.HTTPStr, "127.0.0.1", 0)
+		p1muxService.SetName("mux-service-gateway")
+		p1muxService.SetDebugStatusOn()
+		p1muxService.SetListenURL(*muxListen)
+		p1muxService.SetReadHeaderTimeout(5 * time.Second)
+		if nil != p1openTLSConfig {
+			// TLS 和不加密的连接都可以接收，不加密的要明确打开
+			p1muxService.SetTLSConfig(p1openTLSConfig)
+			p1muxService.SetSniffPlaintextOn()
+		}
+		p1muxService.AddSniffProtocol(protocol.StreamStr, &service.ProtocolHandler{
+			OnConnRequest: gateway.P1gateway.DispatchInnerRequest,
+			OnConnClose:   gateway.P1gateway.DeleteServiceProvider,
+		})
+		p1muxService.AddSniffProtocol(protocol.HTTP2Str, nil)
+		p1muxService.OnConnRequest = gateway.P1gateway.DispatchOpenRequest
+		p1muxService.OnConnClose = gateway.P1gateway.DeleteOpenRequest
+		go p1muxService.Start()
+	}
+
+	for {
+		_, isRestart := signal.WaitForShutdownOrRestart()
+		if !isRestart {
+			break
+		}
+		// 热重启，新进程继承 listener 开始 Accept，旧进程优雅关闭，处理完已有的连接再退出
+		p1process, err := hotrestart.Restart()
+		if nil != err {
+			log.Println("restart:", err)
+			continue
+		}
+		log.Println("new process started, pid:", p1process.Pid)
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// 先停止外部流量，再断开服务提供者
+	if err := p1openService.Shutdown(ctx); nil != err {
+		log.Println(p1openService.GetName(), "shutdown:", err)
+	}
+	if nil != p1muxService {
+		if err := p1muxService.Shutdown(ctx); nil != err {
+			log.Println(p1muxService.GetName(), "shutdown:", err)
+		}
+	}
+	if err := p1innerService.Shutdown(ctx); nil != err {
+		log.Println(p1innerService.GetName(), "shutdown:", err)
+	}
 }
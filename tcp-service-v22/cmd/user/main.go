@@ -1,23 +1,62 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	tcp_service_v22 "tcp-service-go/tcp-service-v22"
 	"tcp-service-go/tcp-service-v22/internal/client"
 	"tcp-service-go/tcp-service-v22/internal/protocol"
 	"tcp-service-go/tcp-service-v22/internal/tool/signal"
+	"tcp-service-go/tcp-service-v22/internal/tool/tlsconfig"
 	"tcp-service-go/tcp-service-v22/internal/user"
+	"time"
 )
 
+// shutdownTimeout 优雅关闭的最长等待时间，超过之后强制关闭
+const shutdownTimeout = 10 * time.Second
+
 var p1innerClient *client.TCPClient
 
+// innerAddr 网关的地址，为空时连接 127.0.0.1:9501
+var innerAddr = flag.String("inner-addr", "", "URL of the gateway inner service, e.g. unix:///tmp/gw.sock")
+
+// TLS 配置，CA 为空的时候不加密
+var innerCAFile = flag.String("inner-ca", "", "CA file for verifying the gateway, enables TLS")
+var innerCertFile = flag.String("inner-cert", "", "TLS client certificate file, for mutual TLS")
+var innerKeyFile = flag.String("inner-key", "", "TLS client key file, for mutual TLS")
+var innerServerName = flag.String("inner-server-name", "", "server name of the gateway certificate")
+
+// isInnerMagic 连接之后先发送 Stream 协议的 Magic，连接网关的 mux 端口（一个端口支持多个协议）时要打开
+var isInnerMagic = flag.Bool("inner-magic", false, "send the stream magic first, required by the gateway mux port")
+
+// isWorkerUnordered worker pool 并行处理同一个连接上的请求，请求的处理顺序和收到的顺序可能不一样
+var isWorkerUnordered = flag.Bool("worker-unordered", false, "handle requests from the gateway in parallel instead of in the order they arrive")
+
 func main() {
+	flag.Parse()
 	log.Println("version: ", tcp_service_v22.Version)
 
 	p1innerClient := client.NewTCPClient(protocol.StreamStr, "127.0.0.1", 9501)
 	p1innerClient.SetName(fmt.Sprintf("%s-client-user", protocol.StreamStr))
 	p1innerClient.SetDebugStatusOn()
+	if "" != *innerAddr {
+		p1innerClient.SetDialURL(*innerAddr)
+	}
+	if *isInnerMagic {
+		p1innerClient.SetSendMagicOn()
+	}
+	if "" != *innerCAFile {
+		p1tlsConfig, err := tlsconfig.NewClientConfig(*innerCAFile, *innerCertFile, *innerKeyFile, *innerServerName)
+		if nil != err {
+			log.Fatalln("inner tls:", err)
+		}
+		p1innerClient.SetTLSConfig(p1tlsConfig)
+	}
+	// 请求交给 worker pool 处理，慢的请求不会卡住读数据。
+	// 默认按收到的顺序处理；网关用 API 包里的 Id 对应请求和响应，请求之间没有依赖的时候可以用 -worker-unordered 并行处理
+	p1innerClient.SetWorkerPool(8, 0, *isWorkerUnordered)
 
 	p1innerClient.OnClientStart = func(p1client *client.TCPClient) {
 		if p1client.IsDebug() {
@@ -39,7 +78,13 @@ func main() {
 		}
 		user.P1UserService.DispatchRequest(p1conn)
 	}
-	p1innerClient.Start()
+	go p1innerClient.Start()
 
 	signal.WaitForShutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := p1innerClient.Shutdown(ctx); nil != err {
+		log.Println(p1innerClient.GetName(), "shutdown:", err)
+	}
 }
@@ -17,7 +17,7 @@ const (
 // 自定义的交互数据包
 type APIPackage struct {
   // 数据包的 ID
-  // 一般来说是 TCP 连接的 IP，用于区分这个数据包是谁的
+  // 一般来说是 TCP 连接的 ID，用于区分这个数据包是谁的
   Id string
   // Type 数据包类型，详见 Type 开头的常量
   Type uint8
@@ -25,6 +25,10 @@ type APIPackage struct {
   Action string
   // 数据（经过 json 格式化的结构体）
   Data string
+  // IsMore 响应比较大的时候，服务提供者可以把 Data 分成多个数据包发送，除了最后一个，都为 true
+  IsMore bool `json:",omitempty"`
+  // StatusCode 服务提供者的响应对应的 HTTP 状态码，为 0 时是 200。分成多个数据包的，以第一个数据包的为准
+  StatusCode uint16 `json:",omitempty"`
 }
 
 // ReqInRegisteServiceProvider，ActionRegisteServiceProvider 对应的数据结构
@@ -1,10 +1,18 @@
 package client
 
 import (
+  "context"
+  "crypto/tls"
+  "errors"
   "fmt"
   "net"
-  "strconv"
   "sync"
+  "sync/atomic"
+  "time"
+  "tcp-service-go/tcp-service-v22/internal/protocol"
+  "tcp-service-go/tcp-service-v22/internal/tool/netaddr"
+  "tcp-service-go/tcp-service-v22/internal/tool/workerpool"
+  "tcp-service-go/tcp-service-v22/internal/tool/writequeue"
 
   pkgErrors "github.com/pkg/errors"
 )
@@ -38,6 +46,18 @@ func defaultOnClientError(p1service *TCPClient, err error) {
   fmt.Println(fmt.Sprintf("%s", err))
 }
 
+func defaultOnConnTimeout(p1conn *TCPConnection, timeoutType uint8) {
+  if p1conn.p1client.IsDebug() {
+    fmt.Println(fmt.Sprintf("%s.OnConnTimeout, timeoutType: %d", p1conn.p1client.name, timeoutType))
+  }
+}
+
+func defaultOnRequestRejected(p1conn *TCPConnection) {
+  if p1conn.p1client.IsDebug() {
+    fmt.Println(fmt.Sprintf("%s.OnRequestRejected", p1conn.p1client.name))
+  }
+}
+
 func defaultOnConnConnect(p1conn *TCPConnection) {
   if p1conn.p1client.IsDebug() {
     fmt.Println(fmt.Sprintf("%s.OnConnConnect", p1conn.p1client.name))
@@ -60,8 +80,8 @@ func defaultOnConnClose(p1conn *TCPConnection) {
 type TCPClient struct {
   // name 客户端名称
   name string
-  // runStatus 运行状态，详见 RunStatus 开头的常量
-  runStatus uint8
+  // runStatus 运行状态，详见 RunStatus 开头的常量，用 atomic 读写
+  runStatus uint32
   // debugStatus debug 开关状态，详见 DebugStatus 开头的常量
   debugStatus uint8
 
@@ -72,14 +92,55 @@ type TCPClient struct {
   address string
   // port 端口号
   port uint16
+  // dialURL 连接的地址，URL 形式，为空时连接 address 和 port（IPv4）
+  dialURL string
 
   // TCP 连接
   p1conn *TCPConnection
+  // mutex 保护 p1conn
+  mutex sync.Mutex
+  // chanDone TCP 连接处理结束（HandleConnection 返回）之后关闭，Do 重新连接的时候换成新的
+  chanDone chan struct{}
+
+  // idleTimeout 空闲超时，等待新报文的最长时间，0 表示不限制
+  idleTimeout time.Duration
+  // readHeaderTimeout 读报文头超时，从报文的第 1 个字节开始计算，0 表示不限制
+  readHeaderTimeout time.Duration
+  // readTimeout 读报文超时，从报文的第 1 个字节开始计算，0 表示不限制
+  readTimeout time.Duration
+  // writeTimeout 写超时，每次发送数据的最长时间，0 表示不限制
+  writeTimeout time.Duration
+  // requestTimeout HTTP 请求超时，Do 从发送请求到收到响应的最长时间，0 表示不限制
+  requestTimeout time.Duration
+  // maxMsgSize 单条报文最大多少字节，0 表示使用协议的设置，详见 protocol.Codec.MaxMsgSize
+  maxMsgSize int
+  // writeQueueSize 发送队列能放多少条数据
+  writeQueueSize int
+  // writeQueuePolicy 发送队列满了怎么办，详见 writequeue 包中 Policy 开头的常量
+  writeQueuePolicy uint8
+
+  // p1tlsConfig TLS 配置，nil 表示不加密
+  p1tlsConfig *tls.Config
+  // isSendMagic 连接建立之后是不是先发送协议的 Magic，详见 SetSendMagicOn
+  isSendMagic bool
+
+  // workerNum worker pool 中 worker 的数量，0 表示不用 worker pool，OnConnRequest 在读数据的 goroutine 中执行
+  workerNum int
+  // workerQueueSize worker pool 中每个任务队列能放多少个请求
+  workerQueueSize int
+  // isWorkerUnordered 是否允许请求被并行处理，不保证顺序
+  isWorkerUnordered bool
+  // p1workerPool worker pool，Start 的时候创建
+  p1workerPool *workerpool.WorkerPool
 
   // OnClientStart 客户端启动事件回调
   OnClientStart func(*TCPClient)
   // OnClientError 客户端错误事件回调
   OnClientError func(*TCPClient, error)
+  // OnConnTimeout TCP 连接，超时事件回调，超时类型详见 protocol 包中 TimeoutType 开头的常量，回调之后连接会被关闭
+  OnConnTimeout func(*TCPConnection, uint8)
+  // OnRequestRejected TCP 连接，worker pool 满了请求被拒绝事件回调，参数是请求视图，回调之后这条消息会被丢掉
+  OnRequestRejected func(*TCPConnection)
   // OnConnConnect TCP 连接，连接事件回调
   OnConnConnect func(*TCPConnection)
   // OnConnRequest TCP 连接，请求事件回调
@@ -92,17 +153,24 @@ type TCPClient struct {
 func NewTCPClient(protocolName string, address string, port uint16) *TCPClient {
   return &TCPClient{
     name:         defaultName,
-    runStatus:    RunStatusOn,
+    runStatus:    uint32(RunStatusOn),
     debugStatus:  DebugStatusOff,
     protocolName: protocolName,
     address:      address,
     port:         port,
 
-    OnClientStart: defaultOnClientStart,
-    OnClientError: defaultOnClientError,
-    OnConnConnect: defaultOnConnConnect,
-    OnConnRequest: defaultOnConnRequest,
-    OnConnClose:   defaultOnConnClose,
+    chanDone: make(chan struct{}),
+
+    writeQueueSize:   writequeue.DefaultSize,
+    writeQueuePolicy: writequeue.PolicyBlock,
+
+    OnClientStart:     defaultOnClientStart,
+    OnClientError:     defaultOnClientError,
+    OnConnTimeout:     defaultOnConnTimeout,
+    OnRequestRejected: defaultOnRequestRejected,
+    OnConnConnect:     defaultOnConnConnect,
+    OnConnRequest:     defaultOnConnRequest,
+    OnConnClose:       defaultOnConnClose,
   }
 }
 
@@ -116,6 +184,11 @@ func (p1this *TCPClient) GetName() string {
   return p1this.name
 }
 
+// IsRun 客户端是不是正在运行
+func (p1this *TCPClient) IsRun() bool {
+  return uint32(RunStatusOn) == atomic.LoadUint32(&p1this.runStatus)
+}
+
 // SetDebugStatusOn 打开 debug
 func (p1this *TCPClient) SetDebugStatusOn() {
   p1this.debugStatus = DebugStatusOn
@@ -126,25 +199,215 @@ func (p1this *TCPClient) IsDebug() bool {
   return DebugStatusOn == p1this.debugStatus
 }
 
+// SetIdleTimeout 设置空闲超时
+func (p1this *TCPClient) SetIdleTimeout(idleTimeout time.Duration) {
+  p1this.idleTimeout = idleTimeout
+}
+
+// SetReadHeaderTimeout 设置读报文头超时（比如 HTTP 的响应头）
+func (p1this *TCPClient) SetReadHeaderTimeout(readHeaderTimeout time.Duration) {
+  p1this.readHeaderTimeout = readHeaderTimeout
+}
+
+// SetReadTimeout 设置读报文超时（比如 HTTP 的响应头加响应体）
+func (p1this *TCPClient) SetReadTimeout(readTimeout time.Duration) {
+  p1this.readTimeout = readTimeout
+}
+
+// SetWriteTimeout 设置写超时
+func (p1this *TCPClient) SetWriteTimeout(writeTimeout time.Duration) {
+  p1this.writeTimeout = writeTimeout
+}
+
+// SetRequestTimeout 设置 HTTP 请求超时，详见 Do
+func (p1this *TCPClient) SetRequestTimeout(requestTimeout time.Duration) {
+  p1this.requestTimeout = requestTimeout
+}
+
+// SetMaxMsgSize 设置单条报文最大多少字节，接收缓冲区最多扩容到这么大，0 表示使用协议的设置
+func (p1this *TCPClient) SetMaxMsgSize(maxMsgSize int) {
+  p1this.maxMsgSize = maxMsgSize
+}
+
+// SetWriteQueueSize 设置发送队列能放多少条数据
+func (p1this *TCPClient) SetWriteQueueSize(writeQueueSize int) {
+  p1this.writeQueueSize = writeQueueSize
+}
+
+// SetWriteQueuePolicy 设置发送队列满了怎么办，详见 writequeue 包中 Policy 开头的常量
+func (p1this *TCPClient) SetWriteQueuePolicy(writeQueuePolicy uint8) {
+  p1this.writeQueuePolicy = writeQueuePolicy
+}
+
+// SetDialURL 设置连接的地址，URL 形式，和 TCPService.SetListenURL 一样，
+// 比如 "tcp://[::1]:9501"、"tcp4://127.0.0.1:9501"、"unix:///run/gw.sock"。
+// 设置之后不再连接 NewTCPClient 的 address 和 port。
+func (p1this *TCPClient) SetDialURL(rawURL string) {
+  p1this.dialURL = rawURL
+}
+
+// DialAddr 获取连接的地址
+func (p1this *TCPClient) DialAddr() (netaddr.Addr, error) {
+  if "" == p1this.dialURL {
+    return netaddr.FromHostPort(p1this.address, p1this.port), nil
+  }
+  return netaddr.Parse(p1this.dialURL)
+}
+
+// SetTLSConfig 设置 TLS 配置，设置之后连接用 TLS 加密。
+// ServerName 为空时用连接地址中的 host 校验服务端证书，双向认证时在 Certificates 中放客户端证书。
+func (p1this *TCPClient) SetTLSConfig(p1tlsConfig *tls.Config) {
+  p1this.p1tlsConfig = p1tlsConfig
+}
+
+// SetSendMagicOn 连接建立之后先发送协议的 Magic（比如 Stream 协议的），
+// 服务端用 AddSniffProtocol 在一个端口上支持多个协议的时候要打开，不识别协议的服务端不一定认识 Magic
+func (p1this *TCPClient) SetSendMagicOn() {
+  p1this.isSendMagic = true
+}
+
+// SetWorkerPool 设置 worker pool，workerNum 为 0 表示不用 worker pool。
+// 用 worker pool 的时候，服务端发来的报文在 worker 的 goroutine 中交给 OnConnRequest，参数是请求视图，详见 TCPConnection.RequestView。
+// TCPClient.Do 的响应直接交给 Do，不经过 worker pool。
+// 默认请求按顺序处理，isUnordered 为 true 时，请求可以并行处理。
+func (p1this *TCPClient) SetWorkerPool(workerNum int, queueSize int, isUnordered bool) {
+  p1this.workerNum = workerNum
+  p1this.workerQueueSize = queueSize
+  p1this.isWorkerUnordered = isUnordered
+}
+
+// GetWorkerPoolStats 获取 worker pool 的运行指标，没有 worker pool 的时候返回 false
+func (p1this *TCPClient) GetWorkerPoolStats() (workerpool.Stats, bool) {
+  if nil == p1this.p1workerPool {
+    return workerpool.Stats{}, false
+  }
+  return p1this.p1workerPool.GetStats(), true
+}
+
 // GetTCPConn 获取 TCP 客户端内部的 TCP 连接
 func (p1this *TCPClient) GetTCPConn() *TCPConnection {
+  p1this.mutex.Lock()
+  defer p1this.mutex.Unlock()
   return p1this.p1conn
 }
 
 func (p1this *TCPClient) Start() {
   p1this.OnClientStart(p1this)
 
-  p1conn, err := net.Dial("tcp4", p1this.address+":"+strconv.Itoa(int(p1this.port)))
+  if !protocol.IsSupported(p1this.protocolName) {
+    err := errors.New("protocol not supported: " + p1this.protocolName)
+    p1this.OnClientError(p1this, pkgErrors.WithMessage(err, "TCPClient.Start"))
+    return
+  }
+
+  p1conn, err := p1this.dial()
   if nil != err {
-    p1this.OnClientError(p1this, pkgErrors.WithMessage(err, "TCPClient.StartListen"))
+    p1this.OnClientError(p1this, err)
     return
   }
 
-  p1this.p1conn = NewTCPConnection(p1this, p1conn)
-  p1this.OnConnConnect(p1this.p1conn)
+  p1this.mutex.Lock()
+  if !p1this.IsRun() {
+    // 连上之前就已经关闭了
+    p1this.mutex.Unlock()
+    p1conn.Close()
+    return
+  }
+  if p1this.workerNum > 0 {
+    p1this.p1workerPool = workerpool.NewWorkerPool(p1this.workerNum, p1this.workerQueueSize, !p1this.isWorkerUnordered)
+  }
+  p1tcpConn := NewTCPConnection(p1this, p1conn)
+  p1this.p1conn = p1tcpConn
+  chanDone := p1this.chanDone
+  p1this.mutex.Unlock()
 
-  var wg sync.WaitGroup
-  wg.Add(1)
-  go p1this.p1conn.HandleConnection(wg.Done)
-  wg.Wait()
+  // OnConnConnect 在 HandleConnection 中调用，协议需要先发送的消息发送之后
+  go p1tcpConn.HandleConnection(func() {
+    close(chanDone)
+  })
+  <-chanDone
+  p1this.StopWorkerPool()
+}
+
+// dial 连接服务端，需要的话进行 TLS 握手
+func (p1this *TCPClient) dial() (net.Conn, error) {
+  addr, err := p1this.DialAddr()
+  if nil != err {
+    return nil, pkgErrors.WithMessage(err, "TCPClient.Start")
+  }
+  p1conn, err := netaddr.Dial(addr)
+  if nil != err {
+    return nil, pkgErrors.WithMessage(err, "TCPClient.StartListen")
+  }
+  if nil != p1this.p1tlsConfig {
+    p1conn, err = p1this.StartTLS(p1conn, addr.Host())
+    if nil != err {
+      return nil, pkgErrors.WithMessage(err, "TCPClient.StartTLS")
+    }
+  }
+  return p1conn, nil
+}
+
+// StartTLS 在连接上进行 TLS 握手，握手失败的时候关闭连接。
+// 先握手再交给 TCPConnection，证书校验失败（比如服务端要求双向认证）能马上发现。
+// TLS 配置中没有 ServerName 的时候用 host。
+func (p1this *TCPClient) StartTLS(p1netConn net.Conn, host string) (net.Conn, error) {
+  p1tlsConfig := p1this.p1tlsConfig
+  if "" == p1tlsConfig.ServerName {
+    p1tlsConfig = p1tlsConfig.Clone()
+    p1tlsConfig.ServerName = host
+  }
+  p1tlsConn := tls.Client(p1netConn, p1tlsConfig)
+  err := p1tlsConn.Handshake()
+  if nil != err {
+    p1netConn.Close()
+    return nil, err
+  }
+  return p1tlsConn, nil
+}
+
+// StopWorkerPool 等 worker pool 中的请求处理完，然后停止 worker pool
+func (p1this *TCPClient) StopWorkerPool() {
+  p1this.mutex.Lock()
+  p1workerPool := p1this.p1workerPool
+  p1this.mutex.Unlock()
+  if nil != p1workerPool {
+    p1workerPool.Stop()
+  }
+}
+
+// Shutdown 优雅关闭客户端。
+// 等正在执行的 OnConnRequest 处理完，发送完待发送的数据，触发 OnConnClose 之后关闭连接。
+// ctx 到期的时候，还没关闭的连接会被强制关闭，这时返回 ctx.Err()。
+func (p1this *TCPClient) Shutdown(ctx context.Context) error {
+  p1this.mutex.Lock()
+  atomic.StoreUint32(&p1this.runStatus, uint32(RunStatusOff))
+  p1conn := p1this.p1conn
+  chanDone := p1this.chanDone
+  p1this.mutex.Unlock()
+
+  if nil == p1conn {
+    // 还没有连上服务端
+    return nil
+  }
+
+  // 打断阻塞中的 Read，HandleConnection 处理完手上的消息之后，就会关闭连接退出
+  p1conn.StopRead()
+
+  chanStop := make(chan struct{})
+  go func() {
+    <-chanDone
+    // 不会再有新的请求了，等 worker pool 中的请求处理完
+    p1this.StopWorkerPool()
+    close(chanStop)
+  }()
+
+  select {
+  case <-chanStop:
+    return nil
+  case <-ctx.Done():
+    // 时间到了，强制关闭
+    p1conn.ForceClose()
+    return ctx.Err()
+  }
 }
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+	"tcp-service-go/tcp-service-v22/internal/service"
+)
+
+// testServer 测试用的 HTTP 服务端，监听 Unix domain socket
+type testServer struct {
+	p1service *service.TCPService
+	// listenURL 客户端 SetDialURL 用的地址
+	listenURL string
+	// connNum 建立过多少个连接
+	connNum int32
+	// isDropNext 为 1 的时候，下一个请求不响应，直接关闭连接
+	isDropNext int32
+}
+
+// startTestServer 启动服务端，响应体是请求的 Path，"/host" 的响应体是请求头 Host，"/hang" 不响应。
+// 响应在别的 goroutine 中随机等一会儿再发送，测试结束的时候关闭服务端
+func startTestServer(t *testing.T) *testServer {
+	t.Helper()
+	p1server := &testServer{listenURL: "unix://" + filepath.Join(t.TempDir(), "http.sock")}
+	p1service := service.NewTCPService(protocol.HTTPStr, "", 0)
+	p1service.SetListenURL(p1server.listenURL)
+	p1service.OnConnConnect = func(*service.TCPConnection) {
+		atomic.AddInt32(&p1server.connNum, 1)
+	}
+	p1service.OnConnClose = func(*service.TCPConnection) {}
+	p1service.OnConnRequest = func(p1conn *service.TCPConnection) {
+		if atomic.CompareAndSwapInt32(&p1server.isDropNext, 1, 0) {
+			p1conn.CloseConnection()
+			return
+		}
+		p1http := p1conn.GetProtocol().(*http.HTTP).Clone()
+		if "/hang" == p1http.Path {
+			return
+		}
+		requestSeq := p1conn.GetRequestSeq()
+		go func() {
+			time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+			resp := http.NewResponse()
+			resp.SetStatusCode(http.StatusOk)
+			if "/host" == p1http.Path {
+				resp.SetBody([]byte(p1http.GetHeader("Host")))
+			} else {
+				resp.SetBody([]byte(p1http.Path))
+			}
+			sli1resp, _ := p1http.EncodeResponse(resp)
+			p1conn.SendResponse(requestSeq, sli1resp)
+		}()
+	}
+	chanStart := make(chan struct{})
+	p1service.OnServiceStart = func(*service.TCPService) { close(chanStart) }
+	chanStop := make(chan struct{})
+	go func() {
+		defer close(chanStop)
+		p1service.Start()
+	}()
+	select {
+	case <-chanStart:
+	case <-time.After(5 * time.Second):
+		t.Fatal("start: timeout")
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		p1service.Shutdown(ctx)
+		<-chanStop
+	})
+	p1server.p1service = p1service
+	return p1server
+}
+
+// newTestClient 连接 p1server 的 HTTP 客户端，测试结束的时候关闭
+func newTestClient(t *testing.T, p1server *testServer) *TCPClient {
+	p1client := NewTCPClient(protocol.HTTPStr, "", 0)
+	p1client.SetDialURL(p1server.listenURL)
+	p1client.OnConnConnect = func(*TCPConnection) {}
+	p1client.OnConnClose = func(*TCPConnection) {}
+	p1client.OnConnTimeout = func(*TCPConnection, uint8) {}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		p1client.Shutdown(ctx)
+	})
+	return p1client
+}
+
+// TestDoPipelining 多个 goroutine 同时调用 Do，请求在一个连接上按顺序发送，每个 Do 拿到自己的响应
+func TestDoPipelining(t *testing.T) {
+	p1server := startTestServer(t)
+	p1client := newTestClient(t, p1server)
+
+	const callNum = 50
+	var wg sync.WaitGroup
+	sli1err := make([]error, callNum)
+	for i := 0; i < callNum; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := fmt.Sprintf("/call/%d", i)
+			p1response, err := p1client.Do(http.NewRequest("GET", path))
+			if nil != err {
+				sli1err[i] = err
+				return
+			}
+			if http.StatusOk != p1response.GetStatusCode() || path != string(p1response.GetBody()) {
+				sli1err[i] = fmt.Errorf("response = %d %q", p1response.GetStatusCode(), p1response.GetBody())
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range sli1err {
+		if nil != err {
+			t.Fatalf("call %d: %v", i, err)
+		}
+	}
+	if connNum := atomic.LoadInt32(&p1server.connNum); 1 != connNum {
+		t.Fatalf("%d connections, want 1", connNum)
+	}
+}
+
+// TestDoTimeout 超时返回 ErrRequestTimeout 并关闭连接，同一个连接上还在等的不是幂等的请求返回 ErrConnClosed，之后的请求用新的连接
+func TestDoTimeout(t *testing.T) {
+	p1server := startTestServer(t)
+	p1client := newTestClient(t, p1server)
+	p1client.SetRequestTimeout(100 * time.Millisecond)
+
+	if _, err := p1client.Do(http.NewRequest("GET", "/a")); nil != err {
+		t.Fatal("Do:", err)
+	}
+	p1conn := p1client.GetTCPConn()
+	chanErr := make(chan error, 1)
+	go func() {
+		// 排在超时的请求后面，幂等的请求会换一个连接重新发送，用 POST
+		time.Sleep(20 * time.Millisecond)
+		_, err := p1client.Do(http.NewRequest("POST", "/b"))
+		chanErr <- err
+	}()
+	if _, err := p1client.Do(http.NewRequest("GET", "/hang")); ErrRequestTimeout != err {
+		t.Fatalf("Do(/hang) = %v, want ErrRequestTimeout", err)
+	}
+	if err := <-chanErr; ErrConnClosed != err {
+		t.Fatalf("Do(/b) = %v, want ErrConnClosed", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for p1conn.IsRun() {
+		if time.Now().After(deadline) {
+			t.Fatal("connection is not closed after the timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p1response, err := p1client.Do(http.NewRequest("GET", "/c"))
+	if nil != err || "/c" != string(p1response.GetBody()) {
+		t.Fatalf("Do(/c) = %v", err)
+	}
+	if p1conn == p1client.GetTCPConn() || 2 != atomic.LoadInt32(&p1server.connNum) {
+		t.Fatal("Do() after the timeout should use a new connection")
+	}
+}
+
+// TestDoRetry 复用的连接被服务端关闭了，幂等的请求换一个新的连接重新发送一次，不是幂等的返回 ErrConnClosed
+func TestDoRetry(t *testing.T) {
+	p1server := startTestServer(t)
+	p1client := newTestClient(t, p1server)
+
+	sli1test := []struct {
+		method  string
+		isRetry bool
+	}{
+		{"GET", true},
+		{"PUT", true},
+		{"POST", false},
+	}
+	for i, t1test := range sli1test {
+		// 先发一个请求，后面的请求复用这个连接
+		if _, err := p1client.Do(http.NewRequest("GET", "/a")); nil != err {
+			t.Fatalf("%s: Do(/a): %v", t1test.method, err)
+		}
+		atomic.StoreInt32(&p1server.isDropNext, 1)
+		p1response, err := p1client.Do(http.NewRequest(t1test.method, "/retry"))
+		if !t1test.isRetry {
+			if ErrConnClosed != err {
+				t.Fatalf("%s: Do() = %v, want ErrConnClosed", t1test.method, err)
+			}
+			continue
+		}
+		if nil != err || "/retry" != string(p1response.GetBody()) {
+			t.Fatalf("%s: Do() = %v, want the response from a new connection", t1test.method, err)
+		}
+		if connNum := atomic.LoadInt32(&p1server.connNum); int32(i+2) != connNum {
+			t.Fatalf("%s: %d connections, want %d", t1test.method, connNum, i+2)
+		}
+	}
+}
+
+// TestDoHost 请求没有设置 Host 的时候用连接的地址发送，调用方的请求不修改
+func TestDoHost(t *testing.T) {
+	p1server := startTestServer(t)
+	p1client := newTestClient(t, p1server)
+
+	p1request := http.NewRequest("GET", "/host")
+	sli1before := p1request.Encode()
+	p1response, err := p1client.Do(p1request)
+	if nil != err {
+		t.Fatal("Do:", err)
+	}
+	if "localhost" != string(p1response.GetBody()) {
+		t.Fatalf("Host = %q, want localhost", p1response.GetBody())
+	}
+	if "" != p1request.GetHeader("Host") || !bytes.Equal(sli1before, p1request.Encode()) {
+		t.Fatalf("request is modified: %q", p1request.Encode())
+	}
+
+	p1request.SetHeader("Host", "example.com")
+	if p1response, err = p1client.Do(p1request); nil != err {
+		t.Fatal("Do:", err)
+	}
+	if "example.com" != string(p1response.GetBody()) {
+		t.Fatalf("Host = %q, want example.com", p1response.GetBody())
+	}
+}
+
+// TestDoNotHTTP 不是 HTTP 协议的客户端不能用 Do
+func TestDoNotHTTP(t *testing.T) {
+	p1client := NewTCPClient(protocol.StreamStr, "127.0.0.1", 1)
+	if _, err := p1client.Do(http.NewRequest("GET", "/")); ErrNotHTTP != err {
+		t.Fatalf("Do() = %v, want ErrNotHTTP", err)
+	}
+}
@@ -1,74 +1,147 @@
 package client
 
 import (
+  "crypto/tls"
   "errors"
   "fmt"
   "io"
   "net"
+  "sync"
+  "sync/atomic"
+  "time"
   "tcp-service-go/tcp-service-v22/internal/protocol"
-  "tcp-service-go/tcp-service-v22/internal/protocol/http"
-  "tcp-service-go/tcp-service-v22/internal/protocol/stream"
   "tcp-service-go/tcp-service-v22/internal/protocol/websocket"
-)
+  "tcp-service-go/tcp-service-v22/internal/tool/recvbuffer"
+  "tcp-service-go/tcp-service-v22/internal/tool/writequeue"
 
-const (
-	// 接收缓冲区最大大小
-	RecvBufferMax uint64 = 10 * 1048576
+  // 注册内置的协议
+  _ "tcp-service-go/tcp-service-v22/internal/protocol/http"
+  _ "tcp-service-go/tcp-service-v22/internal/protocol/stream"
 )
 
+var _ protocol.Conn = &TCPConnection{}
+
 // TCPConnection TCP 连接
 type TCPConnection struct {
-	// 连接状态，详见 RunStatus 开头的常量
-	runStatus uint8
+	// 连接状态，详见 RunStatus 开头的常量，用 atomic 读写
+	runStatus uint32
 
 	// TCP 连接所属 TCP 客户端
 	p1client *TCPClient
 
 	// 协议名称
 	protocolName string
+	// 协议的编解码器
+	p1codec *protocol.Codec
 	// protocol.Protocol
 	p1protocol protocol.Protocol
 
 	// net.Conn
 	p1conn net.Conn
-	// 接收缓冲区
-	sli1recvBuffer []byte
-	// 接收缓冲区最大大小
-	recvBufferMax uint64
-	// 接收缓冲区当前大小
-	recvBufferNow uint64
+	// 接收缓冲区，只在 HandleConnection 的 goroutine 中读写
+	p1recvBuffer *recvbuffer.RecvBuffer
+	// 发送队列，数据由发送队列的 goroutine 发送
+	p1writeQueue *writequeue.WriteQueue
+
+	// 当前报文开始接收的时间，用于计算读超时
+	msgStartTime time.Time
+	// 当前报文的报文头是不是已经接收完了
+	isMsgHeaderDone bool
+	// 当前读超时的类型，详见 protocol 包中 TimeoutType 开头的常量
+	readTimeoutType uint8
+	// 是否已经停止读取新数据，用 atomic 读写，详见 StopRead
+	isStopRead uint32
+
+	// 服务端关闭、超时或者出错之后置 1，不再接收服务端的报文，用 atomic 读写，详见 closeFromRead
+	isReadClosed uint32
+	// requestMutex 保护 requestNum 和 funcAfterRequest
+	requestMutex sync.Mutex
+	// requestNum worker pool 中还没处理完的请求数量
+	requestNum int
+	// funcAfterRequest worker pool 中的请求都处理完之后要做的事情，详见 AfterRequest
+	funcAfterRequest func()
+
+	// sendMutex TCPClient.Do 发送请求的时候加锁，保证发送的顺序和 sli1call 中的一样
+	sendMutex sync.Mutex
+	// callMutex 保护 sli1call 和 isCallClosed
+	callMutex sync.Mutex
+	// sli1call 用 TCPClient.Do 发送、还在等响应的请求，按发送的顺序，详见 addCall
+	sli1call []*httpCall
+	// isCallClosed 连接已经不会再收到响应了，不能再用 TCPClient.Do 发送请求
+	isCallClosed bool
+
+	// p1origin 用 worker pool 异步处理请求时，交给 OnConnRequest 的是请求视图，p1origin 指向真正的连接。
+	// 客户端的请求视图只带着服务端发来的这条报文，SendMsg、CloseConnection 等操作都转给真正的连接。
+	p1origin *TCPConnection
 }
 
 // NewTCPConnection 创建 TCPConnection
 func NewTCPConnection(p1client *TCPClient, p1netConn net.Conn) *TCPConnection {
 	p1tcpConn := &TCPConnection{
-		runStatus:      RunStatusOn,
-		p1client:       p1client,
-		protocolName:   "",
-		p1protocol:     nil,
-		p1conn:         p1netConn,
-		sli1recvBuffer: make([]byte, RecvBufferMax),
-		recvBufferMax:  RecvBufferMax,
-		recvBufferNow:  0,
+		runStatus:    uint32(RunStatusOn),
+		p1client:     p1client,
+		protocolName: "",
+		p1codec:      nil,
+		p1protocol:   nil,
+		p1conn:       p1netConn,
 	}
 
 	p1tcpConn.protocolName = p1client.protocolName
+	p1tcpConn.p1writeQueue = writequeue.NewWriteQueue(p1client.writeQueueSize, p1client.writeQueuePolicy, p1tcpConn.writeNow, p1tcpConn.onWriteError)
+
+	// 协议是否支持，在客户端启动的时候已经判断过了
+	p1tcpConn.p1codec, _ = protocol.GetCodec(p1tcpConn.protocolName)
+	p1tcpConn.p1protocol = p1tcpConn.p1codec.NewProtocol()
+	if p1webSocket, ok := p1tcpConn.p1protocol.(*websocket.WebSocket); ok {
+		// 握手请求是 HTTP/1.1 的，要有 Host
+		if addr, err := p1client.DialAddr(); nil == err {
+			p1webSocket.Host = hostHeader(addr)
+		}
+	}
 
-	switch p1tcpConn.protocolName {
-	case protocol.HTTPStr:
-		p1tcpConn.p1protocol = http.NewHTTP()
-	case protocol.StreamStr:
-		p1tcpConn.p1protocol = stream.NewStream()
-	case protocol.WebSocketStr:
-		p1tcpConn.p1protocol = websocket.NewWebSocket()
+	maxMsgSize := p1client.maxMsgSize
+	if maxMsgSize <= 0 {
+		maxMsgSize = p1tcpConn.p1codec.GetMaxMsgSize()
 	}
+	p1tcpConn.p1recvBuffer = recvbuffer.NewRecvBuffer(maxMsgSize)
 
 	return p1tcpConn
 }
 
 // IsRun TCP 连接是不是正在运行
 func (p1this *TCPConnection) IsRun() bool {
-	return RunStatusOn == p1this.runStatus
+	return uint32(RunStatusOn) == atomic.LoadUint32(&p1this.origin().runStatus)
+}
+
+// IsRequestView 是不是请求视图，详见 RequestView
+func (p1this *TCPConnection) IsRequestView() bool {
+	return nil != p1this.p1origin
+}
+
+// GetOrigin 获取真正的连接，不是请求视图的时候返回自己
+func (p1this *TCPConnection) GetOrigin() *TCPConnection {
+	return p1this.origin()
+}
+
+// origin 获取真正的连接
+func (p1this *TCPConnection) origin() *TCPConnection {
+	if nil != p1this.p1origin {
+		return p1this.p1origin
+	}
+	return p1this
+}
+
+// RequestView 创建请求视图，协议实例用 p1protocol，其他的和真正的连接共用
+func (p1this *TCPConnection) RequestView(p1protocol protocol.Protocol) *TCPConnection {
+	return &TCPConnection{
+		p1client:     p1this.p1client,
+		protocolName: p1this.protocolName,
+		p1codec:      p1this.p1codec,
+		p1protocol:   p1protocol,
+		p1conn:       p1this.p1conn,
+		p1writeQueue: p1this.p1writeQueue,
+		p1origin:     p1this.origin(),
+	}
 }
 
 // TCPClient.IsDebug
@@ -81,6 +154,21 @@ func (p1this *TCPConnection) GetClient() *TCPClient {
 	return p1this.p1client
 }
 
+// GetSide 客户端的连接
+func (p1this *TCPConnection) GetSide() uint8 {
+	return protocol.SideClient
+}
+
+// IsSendMagic 连接建立之后是不是先发送协议的 Magic，详见 TCPClient.SetSendMagicOn
+func (p1this *TCPConnection) IsSendMagic() bool {
+	return p1this.p1client.isSendMagic
+}
+
+// GetName 获取连接所属客户端的名称
+func (p1this *TCPConnection) GetName() string {
+	return p1this.p1client.name
+}
+
 // 获取连接的协议名称
 func (p1this *TCPConnection) GetProtocolName() string {
 	return p1this.protocolName
@@ -96,148 +184,334 @@ func (p1this *TCPConnection) GetNetConnRemoteAddr() string {
 	return p1this.p1conn.RemoteAddr().String()
 }
 
+// GetTLSConnectionState 获取 TLS 连接的状态（协商的版本、服务端证书等），不是 TLS 连接时返回 false
+func (p1this *TCPConnection) GetTLSConnectionState() (tls.ConnectionState, bool) {
+	t1p1tlsConn, ok := p1this.p1conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return t1p1tlsConn.ConnectionState(), true
+}
+
 // HandleConnection 处理连接
 func (p1this *TCPConnection) HandleConnection(deferFunc func()) {
 	defer func() {
+		// 连接处理结束之后，接收缓冲区还回去
+		p1this.p1recvBuffer.Release()
+		// 不会再收到响应了，还在等响应的请求都失败
+		p1this.closeCall()
 		deferFunc()
 	}()
 
-	// 连上服务端之后，发送测试消息
-	// 这里就不发送测试消息了，消息由外部请求触发发送
-	switch p1this.protocolName {
-	case protocol.HTTPStr:
-		// 发送 HTTP 消息
-		// resp := http.NewResponse()
-		// resp.SetStatusCode(http.StatusOk)
-		// respStr := resp.MakeResponse(fmt.Sprintf("this is %s.", p1this.p1client.name))
-		// p1this.SendMsg([]byte(respStr))
-	case protocol.StreamStr:
-		// 发送自定义字节流消息
-		// t1p1protocol := p1this.p1protocol.(*stream.Stream)
-		// t1p1protocol.SetDecodeMsg(fmt.Sprintf("this is %s.", p1this.p1client.name))
-		// p1this.SendMsg([]byte{})
-	case protocol.WebSocketStr:
-		// 发送 WebSocket 握手消息
-		t1p1protocol := p1this.p1protocol.(*websocket.WebSocket)
-		sli1respMsg, _ := t1p1protocol.MakeHandShakeReq()
-		p1this.WriteData(sli1respMsg)
+	// 连上服务端之后，有的协议需要先发送消息（比如 WebSocket 握手、Stream 的 Magic），
+	// 要在 OnConnConnect 中发送的消息之前
+	if nil != p1this.p1codec.OnConnConnect {
+		err := p1this.p1codec.OnConnConnect(p1this)
+		if nil != err {
+			p1this.p1client.OnClientError(p1this.p1client, err)
+			p1this.CloseConnection()
+			return
+		}
 	}
+	p1this.p1client.OnConnConnect(p1this)
 
 	// 发送完了之后等待服务端响应
 	for p1this.IsRun() {
-		byteNum, err := p1this.p1conn.Read(p1this.sli1recvBuffer[p1this.recvBufferNow:])
+		p1this.SetReadDeadline()
+		byteNum, err := p1this.p1recvBuffer.ReadOnce(p1this.p1conn)
 
 		if p1this.IsDebug() {
 			fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleConnection.byteNum: %d", p1this.p1client.name, byteNum))
 		}
 
 		if nil != err {
+			if recvbuffer.ErrMsgTooLarge == err {
+				// 缓冲区已经最大了，还是放不下 1 条完整的报文
+				p1this.p1client.OnClientError(p1this.p1client, err)
+				p1this.closeFromRead(p1this.CloseConnection)
+				return
+			}
 			if err == io.EOF {
-				// 对端关闭了连接
-				p1this.CloseConnection()
+				// 对端关闭了连接，有的协议剩下的数据到这里就是一条完整的报文了
+				p1this.HandleEOF()
+				p1this.closeFromRead(p1this.CloseConnection)
+				return
+			}
+			if !p1this.IsRun() {
+				// 连接已经在别的 goroutine 里关闭了
+				return
+			}
+			if !p1this.p1client.IsRun() {
+				// 客户端正在关闭，StopRead 打断了 Read
+				p1this.closeFromRead(p1this.CloseConnection)
+				return
+			}
+			if t1err, ok := err.(net.Error); ok && t1err.Timeout() {
+				timeoutType := p1this.readTimeoutType
+				p1this.closeFromRead(func() {
+					if p1this.IsRun() {
+						p1this.HandleTimeout(timeoutType)
+					}
+				})
 				return
 			}
 			p1this.p1client.OnClientError(p1this.p1client, err)
+			p1this.closeFromRead(p1this.CloseConnection)
 			return
 		}
 
-		p1this.recvBufferNow += uint64(byteNum)
+		if byteNum > 0 && byteNum == p1this.p1recvBuffer.Len() {
+			// 新报文的第 1 个字节到了
+			p1this.StartMsg()
+		}
 
 		if p1this.IsDebug() {
-			fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleConnection.recvBufferNow: %d", p1this.p1client.name, p1this.recvBufferNow))
+			fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleConnection.recvBufferNow: %d", p1this.p1client.name, p1this.p1recvBuffer.Len()))
 			fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleConnection.sli1recvBuffer:", p1this.p1client.name))
-			fmt.Println(string(p1this.sli1recvBuffer[0:p1this.recvBufferNow]))
+			fmt.Println(string(p1this.p1recvBuffer.Bytes()))
 		}
 
 		p1this.HandleBuffer()
+		if p1this.IsReadClosed() {
+			return
+		}
 	}
 }
 
 // HandleBuffer 处理缓冲区
 func (p1this *TCPConnection) HandleBuffer() {
-	sli1Copy := p1this.sli1recvBuffer[0:p1this.recvBufferNow]
-	for p1this.recvBufferNow > 0 {
-		firstMsgLength, err := p1this.p1protocol.FirstMsgLength(sli1Copy)
-		sli1firstMsg := p1this.sli1recvBuffer[0:firstMsgLength]
-
-		switch p1this.protocolName {
-		case protocol.HTTPStr:
-			// HTTP 1.1 协议的消息，解析之后由外部实现的 OnConnRequest 继续处理
-			t1p1protocol := p1this.p1protocol.(*http.HTTP)
-			t1p1protocol.Decode(sli1firstMsg)
-
-			if p1this.IsDebug() {
-				fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleBuffer.StreamStr.Decode: ", p1this.p1client.name))
-				fmt.Println(fmt.Sprintf("%+v", t1p1protocol))
-			}
-			p1this.p1client.OnConnRequest(p1this)
-		case protocol.StreamStr:
-			// 自定义 Stream 协议的消息，解析之后由外部实现的 OnConnRequest 继续处理
-			t1p1protocol := p1this.p1protocol.(*stream.Stream)
-			t1p1protocol.Decode(sli1firstMsg)
-
-			if p1this.IsDebug() {
-				fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleBuffer.StreamStr.Decode: ", p1this.p1client.name))
-				fmt.Println(fmt.Sprintf("%+v", t1p1protocol))
-			}
-			p1this.p1client.OnConnRequest(p1this)
-		case protocol.WebSocketStr:
-			// WebSocket 协议的消息，需要判断是握手消息还是测试消息
-			t1p1protocol := p1this.p1protocol.(*websocket.WebSocket)
-			t1p1protocol.Decode(sli1firstMsg)
-
-			if t1p1protocol.IsHandshakeStatusNo() {
-				// 握手消息，校验一下服务端响应的握手消息
-				err = t1p1protocol.CheckHandShakeResp()
-				if err == nil {
-					t1p1protocol.SetHandshakeStatusYes()
-					t1p1protocol.SetDecodeMsg(fmt.Sprintf("this is %s.", p1this.p1client.name))
-					p1this.SendMsg([]byte{})
-				} else {
-					p1this.CloseConnection()
-				}
-			} else {
-				// 测试消息，解析之后直接输出
-				if p1this.IsDebug() {
-					fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleBuffer.WebSocketStr.Decode: ", p1this.p1client.name))
-					fmt.Println(fmt.Sprintf("%+v", t1p1protocol))
-					p1this.p1client.OnConnRequest(p1this)
-				}
+	for p1this.p1recvBuffer.Len() > 0 {
+		sli1recv := p1this.p1recvBuffer.Bytes()
+		firstMsgLength, err := p1this.p1protocol.FirstMsgLength(sli1recv)
+		if nil != err {
+			errType := p1this.p1codec.ErrType(p1this, err)
+			if protocol.ErrTypeFatal == errType {
+				// 明显出错
+				p1this.closeFromRead(p1this.CloseConnection)
 			}
+			// 否则继续接收
+			p1this.isMsgHeaderDone = protocol.ErrTypeHeaderIncomplete != errType
+			break
+		}
+		// 取出第 1 条完整的消息，解析之后由外部实现的 OnConnRequest 继续处理
+		if firstMsgLength > uint64(len(sli1recv)) {
+			// 协议算出来的长度不对，当成没接收完
+			break
+		}
+		sli1firstMsg := sli1recv[0:firstMsgLength]
+		msgAction, err := p1this.p1codec.MsgReady(p1this, sli1firstMsg)
+		if nil != err {
+			p1this.closeFromRead(p1this.CloseConnection)
+			return
+		}
+		if protocol.MsgActionSkip != msgAction {
+			p1this.DispatchRequest()
+		}
+		if protocol.MsgActionRequestLast == msgAction {
+			// 对端不再发送数据了（比如 HTTP 的 "Connection: close"），处理完之后关闭连接
+			p1this.closeFromRead(p1this.CloseConnection)
+			return
+		}
+		if !p1this.IsRun() || p1this.IsReadClosed() {
+			return
 		}
 
-		p1this.sli1recvBuffer = p1this.sli1recvBuffer[firstMsgLength:]
-		// recvBufferNow 是 uint64 类型的，做减法的时候小心溢出
-		if p1this.recvBufferNow <= firstMsgLength {
-			p1this.recvBufferNow = 0
+		// 处理接收缓冲区中剩余的数据
+		p1this.p1recvBuffer.Discard(int(firstMsgLength))
+		if 0 == p1this.p1recvBuffer.Len() {
 			break
 		} else {
-			p1this.recvBufferNow -= firstMsgLength
+			// 剩下的数据是下一条报文的
+			p1this.StartMsg()
+		}
+
+		if protocol.MsgActionRequestStop == msgAction {
+			return
+		}
+	}
+}
+
+// HandleEOF 对端关闭连接的时候，接收缓冲区中剩下的数据如果是一条完整的报文，照常处理，详见 protocol.Codec.EOFMsgLength
+func (p1this *TCPConnection) HandleEOF() {
+	sli1recv := p1this.p1recvBuffer.Bytes()
+	msgLength := p1this.p1codec.MsgLengthAtEOF(p1this, sli1recv)
+	if 0 == msgLength || msgLength > uint64(len(sli1recv)) {
+		return
+	}
+	msgAction, err := p1this.p1codec.MsgReady(p1this, sli1recv[0:msgLength])
+	if nil == err && protocol.MsgActionSkip != msgAction {
+		p1this.DispatchRequest()
+	}
+	p1this.p1recvBuffer.Discard(int(msgLength))
+}
+
+// DispatchRequest 把解码之后的报文交给 OnConnRequest 处理。
+// 是 TCPClient.Do 发送的请求的响应的时候，交给 Do，不交给 OnConnRequest。
+// 没有 worker pool（或者协议实例不能复制）时，在 HandleConnection 的 goroutine 中处理完再读下一条报文。
+// 有的话，用复制的协议实例创建请求视图，交给 worker pool 异步处理，有序模式下请求按顺序处理。
+func (p1this *TCPConnection) DispatchRequest() {
+	if p1this.doneCall() {
+		return
+	}
+	p1workerPool := p1this.p1client.p1workerPool
+	if nil == p1workerPool || !p1this.p1codec.CanClone() {
+		p1this.p1client.OnConnRequest(p1this)
+		return
+	}
+
+	p1view := p1this.RequestView(p1this.p1codec.Clone(p1this.p1protocol))
+	p1this.requestMutex.Lock()
+	p1this.requestNum++
+	p1this.requestMutex.Unlock()
+	err := p1workerPool.Submit(0, func() {
+		p1this.p1client.OnConnRequest(p1view)
+		p1this.requestDone()
+	})
+	if nil == err {
+		return
+	}
+
+	// worker pool 满了，请求被拒绝，丢掉这条消息
+	p1this.requestDone()
+	p1this.p1client.OnRequestRejected(p1view)
+}
+
+// requestDone worker pool 中的一个请求处理完了
+func (p1this *TCPConnection) requestDone() {
+	var funcAfterRequest func()
+	p1this.requestMutex.Lock()
+	p1this.requestNum--
+	if 0 == p1this.requestNum {
+		funcAfterRequest = p1this.funcAfterRequest
+		p1this.funcAfterRequest = nil
+	}
+	p1this.requestMutex.Unlock()
+	if nil != funcAfterRequest {
+		funcAfterRequest()
+	}
+}
+
+// AfterRequest f 在 worker pool 中的请求都处理完之后执行，没有还没处理完的请求时，马上在当前 goroutine 中执行
+func (p1this *TCPConnection) AfterRequest(f func()) {
+	p1this = p1this.origin()
+	p1this.requestMutex.Lock()
+	if 0 == p1this.requestNum {
+		p1this.requestMutex.Unlock()
+		f()
+		return
+	}
+	if nil == p1this.funcAfterRequest {
+		p1this.funcAfterRequest = f
+	} else {
+		funcBefore := p1this.funcAfterRequest
+		p1this.funcAfterRequest = func() {
+			funcBefore()
+			f()
 		}
 	}
+	p1this.requestMutex.Unlock()
+}
+
+// IsReadClosed 是不是已经不再接收服务端的报文了，请求视图返回真正的连接的状态，详见 closeFromRead
+func (p1this *TCPConnection) IsReadClosed() bool {
+	return 1 == atomic.LoadUint32(&p1this.origin().isReadClosed)
+}
+
+// closeFromRead 读的这边要关闭连接（对端关闭、超时、出错等）。
+// 停止读取新数据，等 worker pool 中的请求都处理完之后，再执行 f。只有第一次调用生效。
+func (p1this *TCPConnection) closeFromRead(f func()) {
+	if !atomic.CompareAndSwapUint32(&p1this.isReadClosed, 0, 1) {
+		return
+	}
+	p1this.AfterRequest(f)
 }
 
-// SendMsg 发送数据
+// SendMsg 发送数据，数据经过协议编码之后再发送
 func (p1this *TCPConnection) SendMsg(sli1msg []byte) {
-	switch p1this.protocolName {
-	case protocol.TCPStr, protocol.HTTPStr:
-		if p1this.IsDebug() {
-			fmt.Println(fmt.Sprintf("%s.TCPConnection.SendMsg: ", p1this.p1client.name))
-			fmt.Println(string(sli1msg))
+	t1sli1msg, err := p1this.p1codec.EncodeMsg(p1this, sli1msg)
+	if nil != err {
+		p1this.p1client.OnClientError(p1this.p1client, err)
+		return
+	}
+	if p1this.IsDebug() {
+		fmt.Println(fmt.Sprintf("%s.TCPConnection.SendMsg: ", p1this.p1client.name))
+		fmt.Println(string(t1sli1msg))
+	}
+	p1this.WriteData(t1sli1msg)
+}
+
+// StartMsg 开始接收新报文
+func (p1this *TCPConnection) StartMsg() {
+	p1this.msgStartTime = time.Now()
+	p1this.isMsgHeaderDone = false
+}
+
+// SetReadDeadline 根据接收缓冲区的状态设置读超时。
+// 缓冲区为空时是空闲超时，否则是从报文开始接收时算起的读报文头超时或者读报文超时，取先到期的那个。
+func (p1this *TCPConnection) SetReadDeadline() {
+	p1client := p1this.p1client
+	var deadline time.Time
+	if 0 == p1this.p1recvBuffer.Len() {
+		if p1client.idleTimeout > 0 {
+			deadline = time.Now().Add(p1client.idleTimeout)
+			p1this.readTimeoutType = protocol.TimeoutTypeIdle
 		}
-		p1this.WriteData(sli1msg)
-	case protocol.StreamStr, protocol.WebSocketStr:
-		t1sli1msg, _ := p1this.p1protocol.Encode()
-		if p1this.IsDebug() {
-			fmt.Println(fmt.Sprintf("%s.TCPConnection.SendMsg: ", p1this.p1client.name))
-			fmt.Println(string(t1sli1msg))
+	} else {
+		if p1client.readTimeout > 0 {
+			deadline = p1this.msgStartTime.Add(p1client.readTimeout)
+			p1this.readTimeoutType = protocol.TimeoutTypeRead
+		}
+		if !p1this.isMsgHeaderDone && p1client.readHeaderTimeout > 0 {
+			t1deadline := p1this.msgStartTime.Add(p1client.readHeaderTimeout)
+			if deadline.IsZero() || t1deadline.Before(deadline) {
+				deadline = t1deadline
+				p1this.readTimeoutType = protocol.TimeoutTypeReadHeader
+			}
 		}
-		p1this.WriteData(t1sli1msg)
+	}
+	// deadline 为零值时表示不限制
+	p1this.p1conn.SetReadDeadline(deadline)
+	if 1 == atomic.LoadUint32(&p1this.isStopRead) {
+		// StopRead 设置的超时不能被覆盖
+		p1this.p1conn.SetReadDeadline(time.Now())
 	}
 }
 
-// WriteData 发送数据
-func (p1this *TCPConnection) WriteData(sli1data []byte) (err error) {
+// HandleTimeout 处理超时，先触发 OnConnTimeout，读超时的时候按协议回复一条消息，然后关闭连接
+func (p1this *TCPConnection) HandleTimeout(timeoutType uint8) {
+	p1this.p1client.OnConnTimeout(p1this, timeoutType)
+	if protocol.TimeoutTypeWrite != timeoutType && nil != p1this.p1codec.TimeoutMsg {
+		sli1msg := p1this.p1codec.TimeoutMsg(p1this, timeoutType)
+		if len(sli1msg) > 0 {
+			p1this.WriteData(sli1msg)
+		}
+	}
+	p1this.CloseConnection()
+}
+
+// GetWriteQueueLen 获取发送队列中待发送的数据有多少条
+func (p1this *TCPConnection) GetWriteQueueLen() int {
+	return p1this.p1writeQueue.Len()
+}
+
+// WriteData 发送数据，数据不经过编码，放进发送队列之后就返回，调用方不能再修改 sli1data。
+// 发送队列满了的时候，按 TCPClient 设置的策略处理，详见 writequeue 包中 Policy 开头的常量。
+func (p1this *TCPConnection) WriteData(sli1data []byte) error {
+	err := p1this.p1writeQueue.Push(sli1data)
+	if writequeue.ErrQueueFull == err {
+		p1this.p1client.OnClientError(p1this.p1client, err)
+		if writequeue.PolicyClose == p1this.p1client.writeQueuePolicy {
+			p1this.CloseConnection()
+		}
+	}
+	return err
+}
+
+// writeNow 发送数据，只在发送队列的 goroutine 中调用
+func (p1this *TCPConnection) writeNow(sli1data []byte) error {
+	if p1this.p1client.writeTimeout > 0 {
+		p1this.p1conn.SetWriteDeadline(time.Now().Add(p1this.p1client.writeTimeout))
+	}
 	byteNum, err := p1this.p1conn.Write(sli1data)
 
 	if p1this.IsDebug() {
@@ -245,20 +519,52 @@ func (p1this *TCPConnection) WriteData(sli1data []byte) (err error) {
 	}
 
 	if nil != err {
-		p1this.p1client.OnClientError(p1this.p1client, err)
-		p1this.CloseConnection()
+		return err
 	}
-
 	if byteNum != len(sli1data) {
 		return errors.New("write byte != data length")
 	}
 	return nil
 }
 
-// CloseConnection 关闭连接
+// onWriteError 发送出错，只在发送队列的 goroutine 中调用
+func (p1this *TCPConnection) onWriteError(err error) {
+	if !p1this.IsRun() {
+		// 连接已经关闭了（比如强制关闭）
+		return
+	}
+	if t1err, ok := err.(net.Error); ok && t1err.Timeout() {
+		p1this.HandleTimeout(protocol.TimeoutTypeWrite)
+		return
+	}
+	p1this.p1client.OnClientError(p1this.p1client, err)
+	p1this.CloseConnection()
+}
+
+// StopRead 打断阻塞中的 Read，并且不再读取新数据，用于优雅关闭
+func (p1this *TCPConnection) StopRead() {
+	p1this = p1this.origin()
+	atomic.StoreUint32(&p1this.isStopRead, 1)
+	p1this.p1conn.SetReadDeadline(time.Now())
+}
+
+// ForceClose 强制关闭连接，不等发送队列中的数据发送完
+func (p1this *TCPConnection) ForceClose() {
+	p1this = p1this.origin()
+	// 先关闭 net.Conn，阻塞中的 Write 会马上出错返回
+	p1this.p1conn.Close()
+	p1this.CloseConnection()
+}
+
+// CloseConnection 关闭连接，可以在任意 goroutine 中调用，重复调用只有第一次生效
 func (p1this *TCPConnection) CloseConnection() {
-	p1this.runStatus = RunStatusOff
-	p1this.recvBufferNow = 0
+	p1this = p1this.origin()
+	if !atomic.CompareAndSwapUint32(&p1this.runStatus, uint32(RunStatusOn), uint32(RunStatusOff)) {
+		return
+	}
+	// 先把发送队列中的数据发送完，再关闭连接
+	p1this.p1writeQueue.Close()
+	p1this.p1writeQueue.Flush()
 	p1this.p1client.OnConnClose(p1this)
 	p1this.p1conn.Close()
 }
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"errors"
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+	"tcp-service-go/tcp-service-v22/internal/tool/netaddr"
+	"tcp-service-go/tcp-service-v22/internal/tool/workerpool"
+	"time"
+)
+
+var (
+	// ErrNotHTTP 不是 HTTP 协议的客户端不能用 Do
+	ErrNotHTTP = errors.New("client protocol is not http.")
+	// ErrClientClosed 客户端已经关闭了
+	ErrClientClosed = errors.New("client is closed.")
+	// ErrRequestTimeout 超过 SetRequestTimeout 设置的时间还没有收到响应
+	ErrRequestTimeout = errors.New("http request timeout.")
+	// ErrConnClosed 收到响应之前连接就关闭了
+	ErrConnClosed = errors.New("connection closed before response.")
+)
+
+// httpCall 一次 Do 调用，等待响应
+type httpCall struct {
+	// p1response 收到的响应，连接关闭了没有收到的时候为 nil
+	p1response *http.Response
+	// chanDone 收到响应或者连接关闭之后关闭
+	chanDone chan struct{}
+}
+
+// Do 发送 HTTP 请求，等待响应，超时时间详见 SetRequestTimeout。
+// 不用调用 Start，第一次调用的时候连接服务端，之后服务端保持连接的话一直用这个连接，连接关闭了再重新连接。
+// 多个 goroutine 可以同时调用，请求在同一个连接上按顺序发送（pipelining），响应按顺序对应。
+// 请求没有设置 Host 的时候，用连接的地址。
+// 超时的时候连接会被关闭，同一个连接上还在等响应的请求返回 ErrConnClosed。
+// 复用的连接刚好被服务端关闭的时候，请求还没发送或者是幂等的，换一个新的连接重新发送一次。
+func (p1this *TCPClient) Do(p1request *http.Request) (*http.Response, error) {
+	if protocol.HTTPStr != p1this.protocolName {
+		return nil, ErrNotHTTP
+	}
+	// 不修改调用方的请求，同一个请求可能在多个 goroutine 中同时发送
+	host := ""
+	if "" == p1request.GetHeader("Host") {
+		addr, err := p1this.DialAddr()
+		if nil != err {
+			return nil, err
+		}
+		host = hostHeader(addr)
+	}
+
+	for isRetried := false; ; isRetried = true {
+		p1conn, isReused, err := p1this.httpConn()
+		if nil != err {
+			return nil, err
+		}
+		p1response, isSent, err := p1this.roundTrip(p1conn, p1request, host)
+		if ErrConnClosed == err && isReused && !isRetried && (!isSent || p1request.IsIdempotent()) {
+			continue
+		}
+		return p1response, err
+	}
+}
+
+// roundTrip 在连接上发送请求，等待响应，isSent 表示请求是不是已经放进发送队列了。
+// 请求没有设置 Host 的时候，用 host
+func (p1this *TCPClient) roundTrip(p1conn *TCPConnection, p1request *http.Request, host string) (*http.Response, bool, error) {
+	p1call, err := p1conn.addCall(p1request, host)
+	if nil != err {
+		return nil, false, err
+	}
+
+	var chanTimeout <-chan time.Time
+	if p1this.requestTimeout > 0 {
+		p1timer := time.NewTimer(p1this.requestTimeout)
+		defer p1timer.Stop()
+		chanTimeout = p1timer.C
+	}
+	select {
+	case <-p1call.chanDone:
+		if nil == p1call.p1response {
+			return nil, true, ErrConnClosed
+		}
+		return p1call.p1response, true, nil
+	case <-chanTimeout:
+		// 这个响应晚到的话，后面的响应就对不上了，只能关闭连接
+		p1conn.CloseConnection()
+		return nil, true, ErrRequestTimeout
+	}
+}
+
+// httpConn 获取 Do 用的连接，现在的连接还能用的话直接用（isReused 为 true），否则重新连接
+func (p1this *TCPClient) httpConn() (*TCPConnection, bool, error) {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	if !p1this.IsRun() {
+		return nil, false, ErrClientClosed
+	}
+	if nil != p1this.p1conn && p1this.p1conn.IsRun() && !p1this.p1conn.IsReadClosed() {
+		return p1this.p1conn, true, nil
+	}
+
+	p1netConn, err := p1this.dial()
+	if nil != err {
+		return nil, false, err
+	}
+	if p1this.workerNum > 0 && nil == p1this.p1workerPool {
+		// 不是 Do 发送的请求的报文，还是交给 OnConnRequest 处理
+		p1this.p1workerPool = workerpool.NewWorkerPool(p1this.workerNum, p1this.workerQueueSize, !p1this.isWorkerUnordered)
+	}
+	p1this.p1conn = NewTCPConnection(p1this, p1netConn)
+	chanDone := make(chan struct{})
+	p1this.chanDone = chanDone
+	go p1this.p1conn.HandleConnection(func() {
+		close(chanDone)
+	})
+	return p1this.p1conn, false, nil
+}
+
+// hostHeader 请求头 Host 的值，Unix domain socket 没有 host，用 localhost
+func hostHeader(addr netaddr.Addr) string {
+	if netaddr.SchemeUnix == addr.Network {
+		return "localhost"
+	}
+	return addr.Address
+}
+
+// addCall 发送 Do 的请求，记下来等响应，连接已经不能用的时候返回 ErrConnClosed。
+// sendMutex 保证请求发送的顺序和 sli1call 中的一样
+func (p1this *TCPConnection) addCall(p1request *http.Request, host string) (*httpCall, error) {
+	p1call := &httpCall{chanDone: make(chan struct{})}
+
+	p1this.sendMutex.Lock()
+	defer p1this.sendMutex.Unlock()
+	p1this.callMutex.Lock()
+	if p1this.isCallClosed || p1this.IsReadClosed() {
+		p1this.callMutex.Unlock()
+		return nil, ErrConnClosed
+	}
+	p1this.sli1call = append(p1this.sli1call, p1call)
+	p1this.callMutex.Unlock()
+
+	p1this.p1protocol.(*http.HTTP).AddRequest(p1request)
+	if err := p1this.WriteData(p1request.EncodeWithHost(host)); nil != err {
+		// 发送队列满了，请求和响应对不上了
+		p1this.CloseConnection()
+	}
+	return p1call, nil
+}
+
+// doneCall 收到的报文交给等响应的 Do，没有在等的时候返回 false
+func (p1this *TCPConnection) doneCall() bool {
+	p1this.callMutex.Lock()
+	if 0 == len(p1this.sli1call) {
+		p1this.callMutex.Unlock()
+		return false
+	}
+	p1call := p1this.sli1call[0]
+	p1this.sli1call = p1this.sli1call[1:]
+	p1this.callMutex.Unlock()
+
+	p1call.p1response = p1this.p1protocol.(*http.HTTP).CopyResponse()
+	close(p1call.chanDone)
+	return true
+}
+
+// closeCall 连接不会再收到响应了，还在等响应的 Do 都返回 ErrConnClosed
+func (p1this *TCPConnection) closeCall() {
+	p1this.callMutex.Lock()
+	p1this.isCallClosed = true
+	sli1call := p1this.sli1call
+	p1this.sli1call = nil
+	p1this.callMutex.Unlock()
+
+	for _, p1call := range sli1call {
+		close(p1call.chanDone)
+	}
+}
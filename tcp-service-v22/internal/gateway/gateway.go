@@ -3,14 +3,21 @@ package gateway
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"strconv"
+	"sync"
 	"tcp-service-go/tcp-service-v22/internal/api"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http2"
 	"tcp-service-go/tcp-service-v22/internal/service"
 	"time"
 )
 
 const defaultName string = "default-gateway"
 
+// defaultOpenRequestTimeout 外部请求默认等服务提供者多久，超时的回复 504
+const defaultOpenRequestTimeout time.Duration = 30 * time.Second
+
 const (
 	DebugStatusOff uint8 = iota // debug 关
 	DebugStatusOn               // debug 开
@@ -25,7 +32,9 @@ func init() {
 		mapInnerConnPool:  make(map[string][]*service.TCPConnection),
 		mapInnerConnCount: make(map[string]uint64),
 		mapConnToPing:     make(map[string]*service.TCPConnection),
-		mapOpenConn:       make(map[string]*service.TCPConnection),
+		mapOpenRequest:    make(map[string]*openRequest),
+
+		openRequestTimeout: defaultOpenRequestTimeout,
 	}
 }
 
@@ -39,18 +48,56 @@ type Gateway struct {
 	// p1innerService 需要一个内部 TCP 服务端为服务提供者提供服务。
 	p1innerService *service.TCPService
 
+	// innerMutex 保护 mapInnerConnPool、mapInnerConnCount、mapConnToPing，
+	// 内部服务的连接注册、断开，外部请求查找服务提供者，心跳都会用到
+	innerMutex sync.Mutex
 	// mapInnerConnPool 不同服务提供者的 TCP 连接池。
 	// 一个服务提供者注册之后，在这里会变成多个键值对。
 	// 服务提供者提供的每个 api 都会对应服务提供者的 TCP 连接。
 	mapInnerConnPool map[string][]*service.TCPConnection
 	// mapInnerConnCount 记录每个 api 被调用的次数，用于实现简单的负载均衡。
 	mapInnerConnCount map[string]uint64
-	// mapConnToPing 需要保持心跳的 TCP 连接
+	// mapConnToPing 需要保持心跳的 TCP 连接，键是连接 ID
 	mapConnToPing map[string]*service.TCPConnection
 
-	// mapOpenConn 外部请求的 TCP 连接。
-	// 一个外部请求连接上之后，在这里保存 IP 和 TCP 连接的关系，用于发送响应数据。
-	mapOpenConn map[string]*service.TCPConnection
+	// openRequestMutex 保护 mapOpenRequest，外部连接、服务提供者的连接和超时的 timer 在不同的 goroutine 中读写
+	openRequestMutex sync.Mutex
+	// mapOpenRequest 等待服务提供者响应的外部请求。
+	// 一个连接上可以有多个请求（keep-alive、pipelining），键是连接 ID 加请求序号，详见 RequestKey。
+	mapOpenRequest map[string]*openRequest
+	// openRequestTimeout 外部请求等服务提供者的第一个数据包最多等多久，详见 SetOpenRequestTimeout
+	openRequestTimeout time.Duration
+
+	// p1compressConfig 外部请求的响应压缩的配置，为 nil 时不压缩，详见 SetCompressConfig
+	p1compressConfig *http.CompressConfig
+}
+
+// openRequest 等待服务提供者响应的外部请求
+type openRequest struct {
+	// p1conn 外部请求的 TCP 连接
+	p1conn *service.TCPConnection
+	// requestSeq 请求在连接上的序号，响应按请求的顺序发送
+	requestSeq uint64
+	// isKeepAlive 响应之后是不是保持连接
+	isKeepAlive bool
+	// isChunkedAllowed 能不能分块响应，HTTP/1.0 的客户端不支持 chunked 编码，HEAD 请求的响应不发送响应体，都不能
+	isChunkedAllowed bool
+	// acceptEncoding 请求的 Accept-Encoding，压缩响应的时候用
+	acceptEncoding string
+	// statusCode 服务提供者响应的状态码，收到第一个数据包之前为 0。
+	// 在 openRequestMutex 里面设置，设置之后请求归服务提供者的连接处理，超时不再回复 504
+	statusCode uint16
+	// p1timer 等服务提供者响应的超时
+	p1timer *time.Timer
+	// p1stream HTTP/2 的请求所在的 stream，响应用 HTTP/2 的帧发送，HTTP/1.x 的请求为 nil
+	p1stream *http2.Stream
+	// p1msg HTTP/1.x 的请求，响应按它构造，详见 http.HTTP.EncodeResponse。
+	// 连接上的协议实例会被下一条请求复用，不是请求视图的时候是复制的，HTTP/2 的请求为 nil
+	p1msg *http.HTTP
+	// p1writer 服务提供者的响应分成多个数据包时，分块响应，详见 StreamOpenResponse
+	p1writer io.WriteCloser
+	// sli1body 不支持 chunked 编码的客户端，先存起来的响应数据
+	sli1body []byte
 }
 
 // SetDebugStatusOn 打开 debug
@@ -63,14 +110,44 @@ func (p1this *Gateway) IsDebug() bool {
 	return DebugStatusOn == p1this.debugStatus
 }
 
+// ConnKey 用连接 ID 作为 map 的键，远端地址不一定是唯一的
+func ConnKey(p1conn *service.TCPConnection) string {
+	return strconv.FormatUint(p1conn.ID(), 10)
+}
+
+// RequestKey 用连接 ID 加请求序号作为 map 的键，同一个连接上的请求不会重复
+func RequestKey(p1conn *service.TCPConnection) string {
+	return ConnKey(p1conn) + "-" + strconv.FormatUint(p1conn.GetRequestSeq(), 10)
+}
+
+// SetCompressConfig 设置外部请求的响应压缩的配置，按请求的 Accept-Encoding 用 gzip 或者 deflate 压缩，为 nil 时不压缩
+func (p1this *Gateway) SetCompressConfig(p1config *http.CompressConfig) {
+	p1this.p1compressConfig = p1config
+}
+
+// SetOpenRequestTimeout 设置外部请求等服务提供者的第一个数据包最多等多久，超时的回复 504。
+// 服务提供者开始分块响应之后，不再受这个超时的限制
+func (p1this *Gateway) SetOpenRequestTimeout(timeout time.Duration) {
+	p1this.openRequestTimeout = timeout
+}
+
 // SetInnerService 设置内部 TCP 服务端
 func (p1this *Gateway) SetInnerService(p1service *service.TCPService) {
 	p1this.p1innerService = p1service
 }
 
+// StartPingConn 每 10 秒给注册过的服务提供者发一次心跳
 func (p1this *Gateway) StartPingConn() {
 	for {
+		// 发送的时候不拿着锁，发送队列满了也不影响注册和断开
+		p1this.innerMutex.Lock()
+		mapConnToPing := make(map[string]*service.TCPConnection, len(p1this.mapConnToPing))
 		for t1addr, t1conn := range p1this.mapConnToPing {
+			mapConnToPing[t1addr] = t1conn
+		}
+		p1this.innerMutex.Unlock()
+
+		for t1addr, t1conn := range mapConnToPing {
 			p1apipkg := &api.APIPackage{}
 			p1apipkg.Id = t1addr
 			p1apipkg.Type = api.TypeRequest
@@ -88,6 +165,9 @@ func (p1this *Gateway) RegisteServiceProvider(p1conn *service.TCPConnection, p1a
 	p1req := &api.ReqInRegisteServiceProvider{}
 	json.Unmarshal([]byte(p1apipkg.Data), p1req)
 
+	p1this.innerMutex.Lock()
+	defer p1this.innerMutex.Unlock()
+
 	// 服务提供者的每个 api，都要生成一个键值对
 	// 这样查找服务提供者的逻辑，就可以直接用 api 来查找
 	for _, api := range p1req.Sli1Route {
@@ -106,11 +186,14 @@ func (p1this *Gateway) RegisteServiceProvider(p1conn *service.TCPConnection, p1a
 	}
 
 	// 添加服务提供者的连接到心跳列表
-	p1this.mapConnToPing[p1conn.GetNetConnRemoteAddr()] = p1conn
+	p1this.mapConnToPing[ConnKey(p1conn)] = p1conn
 }
 
 // GetInnerConn 获取 api 对应的服务提供者的 TCP 连接
 func (p1this *Gateway) GetInnerConn(api string) *service.TCPConnection {
+	p1this.innerMutex.Lock()
+	defer p1this.innerMutex.Unlock()
+
 	sli1conn, ok := p1this.mapInnerConnPool[api]
 	if !ok {
 		return nil
@@ -128,15 +211,19 @@ func (p1this *Gateway) GetInnerConn(api string) *service.TCPConnection {
 func (p1this *Gateway) DeleteServiceProvider(p1conn *service.TCPConnection) {
 	// 将服务提供者的连接移出心跳列表
 	t1addr := p1conn.GetNetConnRemoteAddr()
-	delete(p1this.mapConnToPing, t1addr)
+	p1this.innerMutex.Lock()
+	defer p1this.innerMutex.Unlock()
+	delete(p1this.mapConnToPing, ConnKey(p1conn))
 	// 因为注册的时候服务提供者的每个 api 都会单独注册
 	// 所以移除的时候也需要针对每个 api 去移除
 	for api, sli1Conn := range p1this.mapInnerConnPool {
 		for index, t1p1Conn := range sli1Conn {
-			// 在池子里找到 ip 对应的那个 TCP 连接
-			if t1addr == t1p1Conn.GetNetConnRemoteAddr() {
-				sli1Conn := append(sli1Conn[0:index], sli1Conn[index+1:]...)
-				p1this.mapInnerConnPool[api] = sli1Conn
+			// 在池子里找到连接 ID 对应的那个 TCP 连接
+			if p1conn.ID() == t1p1Conn.ID() {
+				// 不在原来的数组上删除，GetInnerConn 之前返回的切片不受影响
+				t1sli1Conn := make([]*service.TCPConnection, 0, len(sli1Conn)-1)
+				t1sli1Conn = append(t1sli1Conn, sli1Conn[:index]...)
+				p1this.mapInnerConnPool[api] = append(t1sli1Conn, sli1Conn[index+1:]...)
 
 				if p1this.IsDebug() {
 					fmt.Println(fmt.Sprintf("%s.DeleteServiceProvider, api: %s, ip: %s", p1this.name, api, t1addr))
@@ -145,5 +232,65 @@ func (p1this *Gateway) DeleteServiceProvider(p1conn *service.TCPConnection) {
 				break
 			}
 		}
-  }
+	}
+}
+
+// addOpenRequest 记录等待服务提供者响应的外部请求，超过 openRequestTimeout 没有收到第一个数据包的回复 504
+func (p1this *Gateway) addOpenRequest(msgId string, p1request *openRequest) {
+	p1this.openRequestMutex.Lock()
+	defer p1this.openRequestMutex.Unlock()
+	p1this.mapOpenRequest[msgId] = p1request
+	if p1this.openRequestTimeout > 0 {
+		p1request.p1timer = time.AfterFunc(p1this.openRequestTimeout, func() {
+			p1this.openRequestMutex.Lock()
+			t1p1request, ok := p1this.mapOpenRequest[msgId]
+			if !ok || t1p1request != p1request || 0 != p1request.statusCode {
+				// 已经响应完了，或者服务提供者已经开始响应了
+				p1this.openRequestMutex.Unlock()
+				return
+			}
+			delete(p1this.mapOpenRequest, msgId)
+			p1this.openRequestMutex.Unlock()
+			p1this.SendOpenResponse(p1request, http.StatusGatewayTimeout, "", "service provider timeout.")
+		})
+	}
+}
+
+// takeOpenRequest 收到服务提供者的数据包，取出对应的外部请求，第一个数据包的时候记下状态码。
+// isEnd 为 true 时是最后一个数据包，外部请求从 mapOpenRequest 中移除。找不到的（超时了、外部连接关闭了）返回 nil
+func (p1this *Gateway) takeOpenRequest(msgId string, statusCode uint16, isEnd bool) *openRequest {
+	p1this.openRequestMutex.Lock()
+	defer p1this.openRequestMutex.Unlock()
+	p1request, ok := p1this.mapOpenRequest[msgId]
+	if !ok {
+		return nil
+	}
+	if 0 == p1request.statusCode {
+		p1request.statusCode = statusCode
+		if 0 == p1request.statusCode {
+			p1request.statusCode = http.StatusOk
+		}
+	}
+	if isEnd {
+		delete(p1this.mapOpenRequest, msgId)
+		if nil != p1request.p1timer {
+			p1request.p1timer.Stop()
+		}
+	}
+	return p1request
+}
+
+// DeleteOpenRequest 外部连接关闭的时候，移除这个连接上还在等服务提供者响应的请求
+func (p1this *Gateway) DeleteOpenRequest(p1conn *service.TCPConnection) {
+	p1this.openRequestMutex.Lock()
+	defer p1this.openRequestMutex.Unlock()
+	for msgId, p1request := range p1this.mapOpenRequest {
+		if p1request.p1conn.ID() != p1conn.ID() {
+			continue
+		}
+		delete(p1this.mapOpenRequest, msgId)
+		if nil != p1request.p1timer {
+			p1request.p1timer.Stop()
+		}
+	}
 }
@@ -32,24 +32,23 @@ func (p1this *Gateway) DispatchInnerRequest(p1conn *service.TCPConnection) {
 				fmt.Println(fmt.Sprintf("%s.TCPConnection.ActionPong: ip: %s", p1this.name, p1conn.GetNetConnRemoteAddr()))
 			}
 		default:
-			resp := http.NewResponse()
-			resp.SetStatusCode(http.StatusOk)
-			respStr := resp.MakeResponse(p1apipkg.Data)
-
-			t1p1connection := p1this.mapOpenConn[p1apipkg.Id]
-			t1p1connection.SendMsg([]byte(respStr))
-			t1p1connection.CloseConnection()
-			// 移除失效的外部请求的 TCP 连接
-			delete(p1this.mapOpenConn, p1apipkg.Id)
+			p1request := p1this.takeOpenRequest(p1apipkg.Id, p1apipkg.StatusCode, !p1apipkg.IsMore)
+			if nil == p1request {
+				return
+			}
+			if p1apipkg.IsMore || nil != p1request.p1writer || len(p1request.sli1body) > 0 {
+				// 服务提供者的响应分成了多个数据包，边收边发，不用等所有的数据包
+				p1this.StreamOpenResponse(p1request, p1apipkg.Data, !p1apipkg.IsMore)
+			} else {
+				p1this.SendOpenResponse(p1request, p1request.statusCode, http.StrApplicationJSON, p1apipkg.Data)
+			}
 		}
 	}
 }
 
-// SendInnerResponse 向内部服务发送响应
+// SendInnerResponse 向内部服务发送响应。
+// 外部连接、心跳会同时给同一个服务提供者发送，数据直接交给 SendMsg，不经过连接的协议实例
 func (p1this *Gateway) SendInnerResponse(p1conn *service.TCPConnection, p1apipkg *api.APIPackage) {
 	p1apipkgJson, _ := json.Marshal(p1apipkg)
-
-	t1p1protocol := p1conn.GetProtocol().(*stream.Stream)
-	t1p1protocol.SetDecodeMsg(string(p1apipkgJson))
-	p1conn.SendMsg([]byte{})
+	p1conn.SendMsg(p1apipkgJson)
 }
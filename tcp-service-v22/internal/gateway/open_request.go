@@ -2,34 +2,132 @@ package gateway
 
 import (
 	"fmt"
+	"strconv"
 	"tcp-service-go/tcp-service-v22/internal/api"
 	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http2"
 	"tcp-service-go/tcp-service-v22/internal/service"
 )
 
+// DispatchOpenRequest 把外部请求转给服务提供者。HTTP/2 的连接上每个 stream 是一个请求，和 HTTP/1.x 的一样处理
 func (p1this *Gateway) DispatchOpenRequest(p1conn *service.TCPConnection) {
-	msg := p1conn.GetProtocol().(*http.HTTP)
+	var msg *http.HTTP
+	var p1stream *http2.Stream
+	if t1p1protocol, ok := p1conn.GetProtocol().(*http2.HTTP2); ok {
+		p1stream = t1p1protocol.GetStream()
+		msg = p1stream.GetRequest()
+	} else {
+		msg = p1conn.GetProtocol().(*http.HTTP)
+	}
+
+	p1request := &openRequest{
+		p1conn:      p1conn,
+		requestSeq:  p1conn.GetRequestSeq(),
+		isKeepAlive: p1conn.IsKeepAlive(),
+		p1stream:    p1stream,
+
+		isChunkedAllowed: "HTTP/1.0" != msg.Version && "HEAD" != msg.Method,
+		acceptEncoding:   msg.GetHeader("accept-encoding"),
+	}
+	if nil == p1stream {
+		p1request.p1msg = msg
+		if !p1conn.IsRequestView() {
+			p1request.p1msg = msg.Clone()
+		}
+	}
 
-	t1p1conn := p1this.GetInnerConn(msg.Uri)
+	t1p1conn := p1this.GetInnerConn(msg.Path)
 	// 如果找不到 api 对应的服务提供者，就直接报错给外部连接
 	if nil == t1p1conn {
-		resp := http.NewResponse()
-		resp.SetStatusCode(http.StatusBadRequest)
-		respStr := resp.MakeResponse("api not found.")
-
-		p1conn.SendMsg([]byte(respStr))
-		p1conn.CloseConnection()
+		p1this.SendOpenResponse(p1request, http.StatusNotFound, "", "api not found.")
 		return
 	}
 
-	msgId := p1conn.GetNetConnRemoteAddr()
-	p1this.mapOpenConn[msgId] = p1conn
+	msgId := RequestKey(p1conn)
+	p1this.addOpenRequest(msgId, p1request)
 
 	p1apipkg := &api.APIPackage{}
 	p1apipkg.Id = msgId
 	p1apipkg.Type = api.TypeRequest
-	p1apipkg.Action = msg.Uri
-	p1apipkg.Data = fmt.Sprintf("{\"id\":%s}", msg.MapQuery["id"])
+	p1apipkg.Action = msg.Path
+	// id 是数字，不是数字的当成 0，解码之后的参数不能直接拼到 JSON 里
+	id, _ := strconv.ParseUint(msg.MapQuery.Get("id"), 10, 64)
+	p1apipkg.Data = fmt.Sprintf("{\"id\":%d}", id)
 
 	p1this.SendInnerResponse(t1p1conn, p1apipkg)
 }
+
+// SendOpenResponse 响应外部请求，同一个连接上的响应按请求的顺序发送，不保持连接的请求响应之后关闭连接。
+// contentType 为空时用 http.DefaultContentType
+func (p1this *Gateway) SendOpenResponse(p1request *openRequest, statusCode uint16, contentType string, body string) {
+	resp := newOpenResponse(p1request, statusCode, contentType)
+	resp.SetBody([]byte(body))
+	if nil != p1this.p1compressConfig {
+		// 压缩失败的时候响应体不变，照常发送
+		if err := resp.Compress(p1request.acceptEncoding, p1this.p1compressConfig); nil != err && p1this.IsDebug() {
+			fmt.Println(fmt.Sprintf("%s.SendOpenResponse.Compress: %s", p1this.name, err))
+		}
+	}
+
+	if nil != p1request.p1stream {
+		p1request.p1conn.SendResponse(p1request.requestSeq, p1request.p1stream.MakeResponse(resp))
+		return
+	}
+	sli1data, err := p1request.p1msg.EncodeResponse(resp)
+	if nil != err {
+		if p1this.IsDebug() {
+			fmt.Println(fmt.Sprintf("%s.SendOpenResponse.EncodeResponse: %s", p1this.name, err))
+		}
+		sli1data = resp.Encode()
+	}
+	p1request.p1conn.SendResponse(p1request.requestSeq, sli1data)
+}
+
+// StreamOpenResponse 分块响应外部请求，服务提供者的响应分成多个数据包时，收到一个发送一个，isEnd 为 true 时是最后一个。
+// 不能分块响应的（详见 openRequest.isChunkedAllowed），先存起来，最后一起响应。HTTP/2 的请求用 DATA 帧分块发送，不压缩。
+func (p1this *Gateway) StreamOpenResponse(p1request *openRequest, data string, isEnd bool) {
+	if !p1request.isChunkedAllowed {
+		p1request.sli1body = append(p1request.sli1body, data...)
+		if isEnd {
+			p1this.SendOpenResponse(p1request, p1request.statusCode, http.StrApplicationJSON, string(p1request.sli1body))
+		}
+		return
+	}
+
+	if nil == p1request.p1writer {
+		resp := newOpenResponse(p1request, p1request.statusCode, http.StrApplicationJSON)
+		send := func(sli1data []byte, isEnd bool) {
+			p1request.p1conn.SendResponsePart(p1request.requestSeq, sli1data, isEnd)
+		}
+		if nil != p1request.p1stream {
+			p1request.p1writer = p1request.p1stream.NewWriter(resp, send)
+		} else {
+			p1writer := http.NewChunkedWriter(resp, send)
+			if nil != p1this.p1compressConfig {
+				if err := p1writer.SetCompress(p1request.acceptEncoding, p1this.p1compressConfig); nil != err && p1this.IsDebug() {
+					fmt.Println(fmt.Sprintf("%s.StreamOpenResponse.SetCompress: %s", p1this.name, err))
+				}
+			}
+			p1request.p1writer = p1writer
+		}
+	}
+	p1request.p1writer.Write([]byte(data))
+	if isEnd {
+		p1request.p1writer.Close()
+	}
+}
+
+// newOpenResponse 创建外部请求的响应，按请求设置 Connection 响应头，HTTP/2 的响应发送的时候会去掉
+func newOpenResponse(p1request *openRequest, statusCode uint16, contentType string) *http.Response {
+	resp := http.NewResponse()
+	resp.SetStatusCode(statusCode)
+	if "" != contentType {
+		resp.SetHeader("Content-Type", contentType)
+	}
+	if p1request.isKeepAlive {
+		resp.SetHeader("Connection", "keep-alive")
+	} else {
+		resp.SetHeader("Connection", "close")
+	}
+	return resp
+}
@@ -0,0 +1,290 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	goErrors "errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+)
+
+// multipartTempFileName multipart/form-data 中大文件的临时文件名，详见 os.CreateTemp
+const multipartTempFileName string = "tcp-service-multipart-*"
+
+var (
+	// ErrNotJSON 请求体不是 JSON（Content-Type 不是 application/json 或者 +json 结尾的）
+	ErrNotJSON = goErrors.New("request body is not JSON")
+	// ErrNotMultipart 请求体不是 multipart/form-data，或者没有 boundary
+	ErrNotMultipart = goErrors.New("request body is not multipart/form-data")
+	// ErrBodyTooLarge 请求体超过了 BodyLimit 的限制
+	ErrBodyTooLarge = goErrors.New("request body too large")
+)
+
+// BodyLimit 解析请求体的限制，为 0 的字段用 DefaultBodyLimit 的
+type BodyLimit struct {
+	// FormSizeMax application/x-www-form-urlencoded 的请求体最多多少字节，超过的不解析
+	FormSizeMax int
+	// JSONSizeMax JSON 请求体最多多少字节
+	JSONSizeMax int
+	// MultipartPartNumMax multipart/form-data 最多多少个 part
+	MultipartPartNumMax int
+	// MultipartValueSizeMax multipart/form-data 中不是文件的 part 加起来最多多少字节
+	MultipartValueSizeMax int64
+	// MultipartFileSizeMax multipart/form-data 中单个文件最多多少字节
+	MultipartFileSizeMax int64
+	// MultipartMemoryMax multipart/form-data 中的文件，超过这个大小的写到临时文件，不放在内存中
+	MultipartMemoryMax int64
+	// DecompressSizeMax 压缩过的报文体（Content-Encoding: gzip）解压之后最多多少字节，防止解压炸弹
+	DecompressSizeMax int64
+}
+
+// DefaultBodyLimit 默认的请求体限制，服务启动之前可以修改
+var DefaultBodyLimit = BodyLimit{
+	FormSizeMax:           1 << 20,
+	JSONSizeMax:           1 << 20,
+	MultipartPartNumMax:   100,
+	MultipartValueSizeMax: 1 << 20,
+	MultipartFileSizeMax:  int64(protocol.DefaultMaxMsgSize),
+	MultipartMemoryMax:    32 << 10,
+	DecompressSizeMax:     int64(protocol.DefaultMaxMsgSize),
+}
+
+// Multipart 解析之后的 multipart/form-data
+type Multipart struct {
+	// MapValue 不是文件的 part，键是字段名
+	MapValue map[string][]string
+	// MapFile 文件，键是字段名
+	MapFile map[string][]*MultipartFile
+}
+
+// MultipartFile multipart/form-data 中的文件，小的放在内存中，大的放在临时文件中
+type MultipartFile struct {
+	// FieldName 字段名
+	FieldName string
+	// FileName 文件名
+	FileName string
+	// MapHeader part 的头
+	MapHeader textproto.MIMEHeader
+	// Size 文件大小
+	Size int64
+
+	// sli1content 放在内存中的文件内容
+	sli1content []byte
+	// tempPath 临时文件的路径，为空时文件内容在内存中
+	tempPath string
+}
+
+// Open 打开文件，调用方负责关闭
+func (p1this *MultipartFile) Open() (io.ReadCloser, error) {
+	if "" == p1this.tempPath {
+		return io.NopCloser(bytes.NewReader(p1this.sli1content)), nil
+	}
+	return os.Open(p1this.tempPath)
+}
+
+// RemoveAll 删除临时文件，处理完请求之后调用
+func (p1this *Multipart) RemoveAll() error {
+	var err error
+	for _, sli1file := range p1this.MapFile {
+		for _, p1file := range sli1file {
+			if "" == p1file.tempPath {
+				continue
+			}
+			if t1err := os.Remove(p1file.tempPath); nil != t1err && nil == err {
+				err = t1err
+			}
+			p1file.tempPath = ""
+		}
+	}
+	return err
+}
+
+// SetBodyLimit 设置这个请求解析请求体的限制，在 DecodeJSON 和 ParseMultipart 之前调用，为 nil 时用 DefaultBodyLimit
+func (p1this *HTTP) SetBodyLimit(p1limit *BodyLimit) {
+	p1this.p1bodyLimit = p1limit
+}
+
+// bodyLimit 获取解析请求体的限制，没有设置的字段用 DefaultBodyLimit 的
+func (p1this *HTTP) bodyLimit() BodyLimit {
+	limit := DefaultBodyLimit
+	if nil == p1this.p1bodyLimit {
+		return limit
+	}
+	t1limit := *p1this.p1bodyLimit
+	if 0 == t1limit.FormSizeMax {
+		t1limit.FormSizeMax = limit.FormSizeMax
+	}
+	if 0 == t1limit.JSONSizeMax {
+		t1limit.JSONSizeMax = limit.JSONSizeMax
+	}
+	if 0 == t1limit.MultipartPartNumMax {
+		t1limit.MultipartPartNumMax = limit.MultipartPartNumMax
+	}
+	if 0 == t1limit.MultipartValueSizeMax {
+		t1limit.MultipartValueSizeMax = limit.MultipartValueSizeMax
+	}
+	if 0 == t1limit.MultipartFileSizeMax {
+		t1limit.MultipartFileSizeMax = limit.MultipartFileSizeMax
+	}
+	if 0 == t1limit.MultipartMemoryMax {
+		t1limit.MultipartMemoryMax = limit.MultipartMemoryMax
+	}
+	if 0 == t1limit.DecompressSizeMax {
+		t1limit.DecompressSizeMax = limit.DecompressSizeMax
+	}
+	return t1limit
+}
+
+// parseContentType 解析 Content-Type，媒体类型转成小写，参数（比如 charset、boundary）的键名也是小写
+func (p1this *HTTP) parseContentType() {
+	p1this.ContentType = ""
+	p1this.MapContentTypeParam = nil
+	c7t4 := p1this.GetHeader("content-type")
+	if "" == c7t4 {
+		return
+	}
+	mediaType, mapParam, err := mime.ParseMediaType(c7t4)
+	if nil != err && mime.ErrInvalidMediaParameter != err {
+		return
+	}
+	p1this.ContentType = mediaType
+	p1this.MapContentTypeParam = mapParam
+}
+
+// parseBody 解析请求体，表单的键值对解析到 MapBody。JSON 和 multipart/form-data 用到的时候再解析，详见 DecodeJSON 和 ParseMultipart
+func (p1this *HTTP) parseBody(body string) {
+	p1this.parseContentType()
+	p1this.p1multipart = nil
+	switch p1this.ContentType {
+	case StrXWWWFormUrlencoded:
+		if len(body) <= p1this.bodyLimit().FormSizeMax {
+			p1this.MapBody = parseValues(body)
+		}
+	}
+}
+
+// IsJSON 请求体是不是 JSON，Content-Type 是 application/json 或者 +json 结尾的（比如 application/problem+json）
+func (p1this *HTTP) IsJSON() bool {
+	return StrApplicationJSON == p1this.ContentType ||
+		(strings.HasPrefix(p1this.ContentType, "application/") && strings.HasSuffix(p1this.ContentType, "+json"))
+}
+
+// DecodeJSON 把 JSON 请求体解码到 v，用到的时候才解码，请求体超过 BodyLimit.JSONSizeMax 时返回 ErrBodyTooLarge
+func (p1this *HTTP) DecodeJSON(v interface{}) error {
+	if !p1this.IsJSON() {
+		return ErrNotJSON
+	}
+	if len(p1this.Sli1Body) > p1this.bodyLimit().JSONSizeMax {
+		return ErrBodyTooLarge
+	}
+	return json.Unmarshal(p1this.Sli1Body, v)
+}
+
+// ParseMultipart 解析 multipart/form-data 请求体，用到的时候才解析，解析过的直接返回上次的结果。
+// 文件超过 BodyLimit.MultipartMemoryMax 的写到临时文件，处理完请求之后要调用 Multipart.RemoveAll 删除。
+// 超过 part 数量、字段大小、文件大小的限制时返回 ErrBodyTooLarge，已经写的临时文件会删掉。
+func (p1this *HTTP) ParseMultipart() (*Multipart, error) {
+	if nil != p1this.p1multipart {
+		return p1this.p1multipart, nil
+	}
+	boundary := p1this.MapContentTypeParam["boundary"]
+	if StrMultipartFormData != p1this.ContentType || "" == boundary {
+		return nil, ErrNotMultipart
+	}
+
+	limit := p1this.bodyLimit()
+	p1multipart := &Multipart{
+		MapValue: make(map[string][]string),
+		MapFile:  make(map[string][]*MultipartFile),
+	}
+	p1reader := multipart.NewReader(bytes.NewReader(p1this.Sli1Body), boundary)
+	partNum := 0
+	var valueSize int64
+	for {
+		p1part, err := p1reader.NextPart()
+		if io.EOF == err {
+			break
+		}
+		if nil != err {
+			p1multipart.RemoveAll()
+			return nil, err
+		}
+		partNum++
+		if partNum > limit.MultipartPartNumMax {
+			p1multipart.RemoveAll()
+			return nil, ErrBodyTooLarge
+		}
+
+		fieldName := p1part.FormName()
+		if "" == p1part.FileName() {
+			// 不是文件，剩下的字段大小多读 1 个字节，读满了就是超过了
+			sli1value, err := io.ReadAll(io.LimitReader(p1part, limit.MultipartValueSizeMax-valueSize+1))
+			if nil != err {
+				p1multipart.RemoveAll()
+				return nil, err
+			}
+			valueSize += int64(len(sli1value))
+			if valueSize > limit.MultipartValueSizeMax {
+				p1multipart.RemoveAll()
+				return nil, ErrBodyTooLarge
+			}
+			p1multipart.MapValue[fieldName] = append(p1multipart.MapValue[fieldName], string(sli1value))
+			continue
+		}
+
+		p1file, err := readMultipartFile(p1part, limit)
+		if nil != err {
+			p1multipart.RemoveAll()
+			return nil, err
+		}
+		p1multipart.MapFile[fieldName] = append(p1multipart.MapFile[fieldName], p1file)
+	}
+	p1this.p1multipart = p1multipart
+	return p1multipart, nil
+}
+
+// readMultipartFile 读取文件 part，小的放在内存中，超过 MultipartMemoryMax 的写到临时文件
+func readMultipartFile(p1part *multipart.Part, limit BodyLimit) (*MultipartFile, error) {
+	p1file := &MultipartFile{
+		FieldName: p1part.FormName(),
+		FileName:  p1part.FileName(),
+		MapHeader: p1part.Header,
+	}
+	// 内存的限制多读 1 个字节，读满了就要写到临时文件
+	var buffer bytes.Buffer
+	size, err := io.CopyN(&buffer, p1part, limit.MultipartMemoryMax+1)
+	if nil != err && io.EOF != err {
+		return nil, err
+	}
+	if size > limit.MultipartFileSizeMax {
+		return nil, ErrBodyTooLarge
+	}
+	if size <= limit.MultipartMemoryMax {
+		p1file.sli1content = buffer.Bytes()
+		p1file.Size = size
+		return p1file, nil
+	}
+
+	p1tempFile, err := os.CreateTemp("", multipartTempFileName)
+	if nil != err {
+		return nil, err
+	}
+	defer p1tempFile.Close()
+	// 文件大小的限制多读 1 个字节，读满了就是超过了
+	size, err = io.Copy(p1tempFile, io.LimitReader(io.MultiReader(&buffer, p1part), limit.MultipartFileSizeMax+1))
+	if nil == err && size > limit.MultipartFileSizeMax {
+		err = ErrBodyTooLarge
+	}
+	if nil != err {
+		os.Remove(p1tempFile.Name())
+		return nil, err
+	}
+	p1file.tempPath = p1tempFile.Name()
+	p1file.Size = size
+	return p1file, nil
+}
@@ -0,0 +1,243 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// decodeBody 解析一条带请求体的 POST 请求
+func decodeBody(t *testing.T, p1limit *BodyLimit, contentType string, body string) *HTTP {
+	t.Helper()
+	p1http := NewHTTP()
+	p1http.SetBodyLimit(p1limit)
+	decodeRequest(t, p1http, "POST / HTTP/1.1\r\nHost: x\r\nContent-Type: "+contentType+
+		"\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+	return p1http
+}
+
+func TestParseContentType(t *testing.T) {
+	sli1test := []struct {
+		name        string
+		contentType string
+		mediaType   string
+		isJSON      bool
+	}{
+		{"json", "application/json", "application/json", true},
+		{"json with charset", "Application/JSON; charset=utf-8", "application/json", true},
+		{"json suffix", "application/problem+json", "application/problem+json", true},
+		{"text json is not json", "text/json+json", "text/json+json", false},
+		{"form", "application/x-www-form-urlencoded", "application/x-www-form-urlencoded", false},
+		{"bad parameter keeps media type", "application/json; charset", "application/json", true},
+		{"malformed", "/json", "", false},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1http := decodeBody(t, nil, t1test.contentType, "{}")
+			if t1test.mediaType != p1http.ContentType || t1test.isJSON != p1http.IsJSON() {
+				t.Fatalf("ContentType = %q, IsJSON = %v, want %q, %v", p1http.ContentType, p1http.IsJSON(), t1test.mediaType, t1test.isJSON)
+			}
+		})
+	}
+	p1http := decodeBody(t, nil, "application/json; Charset=UTF-8", "{}")
+	if "UTF-8" != p1http.MapContentTypeParam["charset"] {
+		t.Fatalf("MapContentTypeParam = %v", p1http.MapContentTypeParam)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	sli1test := []struct {
+		name        string
+		contentType string
+		body        string
+		limit       int
+		isErr       bool
+		errWant     error
+	}{
+		{"object", "application/json", `{"a":1}`, 0, false, nil},
+		{"at limit", "application/json", `{"a":1}`, 7, false, nil},
+		{"over limit", "application/json", `{"a":1}`, 6, true, ErrBodyTooLarge},
+		{"not json", "text/plain", `{"a":1}`, 0, true, ErrNotJSON},
+		{"malformed", "application/json", `{"a":`, 0, true, nil},
+		{"wrong type", "application/json", `{"a":"x"}`, 0, true, nil},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1http := decodeBody(t, &BodyLimit{JSONSizeMax: t1test.limit}, t1test.contentType, t1test.body)
+			var v struct{ A int }
+			err := p1http.DecodeJSON(&v)
+			if !t1test.isErr {
+				if nil != err || 1 != v.A {
+					t.Fatalf("DecodeJSON() = %v, %+v", err, v)
+				}
+				return
+			}
+			if nil == err || (nil != t1test.errWant && t1test.errWant != err) {
+				t.Fatalf("DecodeJSON() = %v, want %v", err, t1test.errWant)
+			}
+		})
+	}
+}
+
+// TestFormSizeMax 超过 FormSizeMax 的表单不解析
+func TestFormSizeMax(t *testing.T) {
+	p1http := decodeBody(t, &BodyLimit{FormSizeMax: 3}, StrXWWWFormUrlencoded, "a=1")
+	if "1" != p1http.MapBody.Get("a") {
+		t.Fatalf("MapBody at the limit = %v", p1http.MapBody)
+	}
+	p1http = decodeBody(t, &BodyLimit{FormSizeMax: 3}, StrXWWWFormUrlencoded, "a=12")
+	if nil != p1http.MapBody {
+		t.Fatalf("MapBody over the limit = %v", p1http.MapBody)
+	}
+}
+
+// multipartPart 构造 multipart/form-data 请求体用的 part，fileName 为空的是普通字段
+type multipartPart struct {
+	fieldName string
+	fileName  string
+	content   string
+}
+
+// makeMultipart 构造 multipart/form-data 请求体，返回 Content-Type 和请求体
+func makeMultipart(t *testing.T, sli1part []multipartPart) (string, string) {
+	t.Helper()
+	var buffer bytes.Buffer
+	p1writer := multipart.NewWriter(&buffer)
+	for _, part := range sli1part {
+		var p1part io.Writer
+		var err error
+		if "" == part.fileName {
+			p1part, err = p1writer.CreateFormField(part.fieldName)
+		} else {
+			p1part, err = p1writer.CreateFormFile(part.fieldName, part.fileName)
+		}
+		if nil != err {
+			t.Fatal(err)
+		}
+		io.WriteString(p1part, part.content)
+	}
+	p1writer.Close()
+	return p1writer.FormDataContentType(), buffer.String()
+}
+
+func TestParseMultipart(t *testing.T) {
+	// 临时文件都放在这个目录里，检查有没有删掉
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	limit := BodyLimit{
+		MultipartPartNumMax:   3,
+		MultipartValueSizeMax: 8,
+		MultipartFileSizeMax:  16,
+		MultipartMemoryMax:    4,
+	}
+	sli1test := []struct {
+		name     string
+		sli1part []multipartPart
+		errWant  error
+	}{
+		{"values", []multipartPart{{"a", "", "1"}, {"a", "", "2"}, {"b", "", "3"}}, nil},
+		{"file in memory", []multipartPart{{"f", "a.txt", "abcd"}}, nil},
+		{"file in temp file", []multipartPart{{"f", "a.txt", "abcde"}, {"f", "b.txt", strings.Repeat("x", 16)}}, nil},
+		{"empty", nil, nil},
+
+		{"too many parts", []multipartPart{{"a", "", "1"}, {"a", "", "2"}, {"a", "", "3"}, {"a", "", "4"}}, ErrBodyTooLarge},
+		{"values too large", []multipartPart{{"a", "", "12345"}, {"b", "", "6789"}}, ErrBodyTooLarge},
+		{"file too large", []multipartPart{{"f", "a.txt", strings.Repeat("x", 17)}}, ErrBodyTooLarge},
+		{"file too large after a temp file", []multipartPart{{"f", "a.txt", "abcdef"}, {"f", "b.txt", strings.Repeat("x", 17)}}, ErrBodyTooLarge},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			contentType, body := makeMultipart(t, t1test.sli1part)
+			p1http := decodeBody(t, &limit, contentType, body)
+			p1multipart, err := p1http.ParseMultipart()
+			if t1test.errWant != err {
+				t.Fatalf("ParseMultipart() = %v, want %v", err, t1test.errWant)
+			}
+			if nil == err {
+				for _, part := range t1test.sli1part {
+					if "" == part.fileName {
+						if !containsString(p1multipart.MapValue[part.fieldName], part.content) {
+							t.Fatalf("MapValue[%s] = %v, want %q", part.fieldName, p1multipart.MapValue[part.fieldName], part.content)
+						}
+						continue
+					}
+					if content := readMultipartFileContent(t, p1multipart, part.fieldName, part.fileName); part.content != content {
+						t.Fatalf("file %s = %q, want %q", part.fileName, content, part.content)
+					}
+				}
+				// 解析过的直接返回上次的结果
+				if p1again, _ := p1http.ParseMultipart(); p1again != p1multipart {
+					t.Fatal("ParseMultipart() should return the parsed result")
+				}
+				if err = p1multipart.RemoveAll(); nil != err {
+					t.Fatal(err)
+				}
+			}
+			if sli1entry, _ := os.ReadDir(tempDir); 0 != len(sli1entry) {
+				t.Fatalf("%d temp files left", len(sli1entry))
+			}
+		})
+	}
+}
+
+func TestParseMultipartMalformed(t *testing.T) {
+	sli1test := []struct {
+		name        string
+		contentType string
+		body        string
+		errWant     error
+	}{
+		{"not multipart", "application/json", "{}", ErrNotMultipart},
+		{"no boundary", "multipart/form-data", "--x\r\n\r\n--x--\r\n", ErrNotMultipart},
+		{"truncated", "multipart/form-data; boundary=x", "--x\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n1", nil},
+		{"bad part header", "multipart/form-data; boundary=x", "--x\r\nbad header\r\n\r\n1\r\n--x--\r\n", nil},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1http := decodeBody(t, nil, t1test.contentType, t1test.body)
+			_, err := p1http.ParseMultipart()
+			if nil == err || (nil != t1test.errWant && t1test.errWant != err) {
+				t.Fatalf("ParseMultipart() = %v, want %v", err, t1test.errWant)
+			}
+		})
+	}
+}
+
+func containsString(sli1s []string, s string) bool {
+	for _, v := range sli1s {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// readMultipartFileContent 读出字段 fieldName 中名字是 fileName 的文件
+func readMultipartFileContent(t *testing.T, p1multipart *Multipart, fieldName string, fileName string) string {
+	t.Helper()
+	for _, p1file := range p1multipart.MapFile[fieldName] {
+		if fileName != p1file.FileName {
+			continue
+		}
+		p1reader, err := p1file.Open()
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer p1reader.Close()
+		sli1content, err := io.ReadAll(p1reader)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if int64(len(sli1content)) != p1file.Size {
+			t.Fatalf("Size = %d, content is %d bytes", p1file.Size, len(sli1content))
+		}
+		return string(sli1content)
+	}
+	t.Fatalf("file %s not found in %s", fileName, fieldName)
+	return ""
+}
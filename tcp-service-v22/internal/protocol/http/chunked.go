@@ -0,0 +1,158 @@
+package http
+
+import (
+	"bytes"
+	goErrors "errors"
+	"strconv"
+	"strings"
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+)
+
+const (
+	// ChunkSizeMax 单个块最大多少字节，超过的当成解析出错，防止块大小溢出或者对端声明一个超大的块
+	ChunkSizeMax uint64 = uint64(protocol.DefaultMaxMsgSize)
+	// ChunkLineMax 块大小那一行（包括扩展）最多多少字节
+	ChunkLineMax int = 4096
+	// TrailerSizeMax trailer 最多多少字节
+	TrailerSizeMax int = 8 * 1024
+)
+
+var (
+	// errChunkedIncomplete chunked 编码的请求体没接收完
+	errChunkedIncomplete = goErrors.New("chunked body incomplete")
+	// errChunkedMalformed chunked 编码的请求体格式错误或者超过了限制
+	errChunkedMalformed = goErrors.New("malformed chunked body")
+)
+
+// parseChunked 解析 chunked 编码的请求体，返回请求体在报文中的长度（包括最后一个块和 trailer）。
+// isDecode 为 true 时，同时返回解码之后的请求体和 trailer（键名全部转成小写）。
+// 数据不完整时返回 errChunkedIncomplete，格式错误或者超过限制时返回 errChunkedMalformed。
+func parseChunked(sli1data []byte, isDecode bool) (int, []byte, map[string]string, error) {
+	var sli1body []byte
+	offset := 0
+	for {
+		// 块大小[;扩展]\r\n
+		lineEnd := bytes.Index(sli1data[offset:], []byte("\r\n"))
+		if lineEnd < 0 {
+			if len(sli1data)-offset > ChunkLineMax {
+				return 0, nil, nil, errChunkedMalformed
+			}
+			return 0, nil, nil, errChunkedIncomplete
+		}
+		if lineEnd > ChunkLineMax {
+			return 0, nil, nil, errChunkedMalformed
+		}
+		chunkSize, ok := parseChunkSize(sli1data[offset : offset+lineEnd])
+		if !ok {
+			return 0, nil, nil, errChunkedMalformed
+		}
+		offset += lineEnd + 2
+
+		if 0 == chunkSize {
+			// 最后一个块，后面是 trailer，以空行结束
+			trailerLength, mapTrailer, err := parseTrailer(sli1data[offset:], isDecode)
+			if nil != err {
+				return 0, nil, nil, err
+			}
+			if isDecode && nil == sli1body {
+				sli1body = []byte{}
+			}
+			return offset + trailerLength, sli1body, mapTrailer, nil
+		}
+
+		// 块数据\r\n
+		if uint64(len(sli1data)-offset) < chunkSize+2 {
+			return 0, nil, nil, errChunkedIncomplete
+		}
+		dataEnd := offset + int(chunkSize)
+		if '\r' != sli1data[dataEnd] || '\n' != sli1data[dataEnd+1] {
+			return 0, nil, nil, errChunkedMalformed
+		}
+		if isDecode {
+			sli1body = append(sli1body, sli1data[offset:dataEnd]...)
+		}
+		offset = dataEnd + 2
+	}
+}
+
+// parseChunkSize 解析块大小那一行，忽略扩展，块大小是十六进制
+func parseChunkSize(sli1line []byte) (uint64, bool) {
+	line := string(sli1line)
+	if index := strings.IndexByte(line, ';'); index >= 0 {
+		line = line[:index]
+	}
+	line = strings.TrimRight(line, " \t")
+	if "" == line {
+		return 0, false
+	}
+	chunkSize, err := strconv.ParseUint(line, 16, 64)
+	if nil != err || chunkSize > ChunkSizeMax {
+		return 0, false
+	}
+	return chunkSize, true
+}
+
+// parseTrailer 解析 trailer，返回 trailer 的长度（包括结束的空行）
+func parseTrailer(sli1data []byte, isDecode bool) (int, map[string]string, error) {
+	var mapTrailer map[string]string
+	offset := 0
+	for {
+		lineEnd := bytes.Index(sli1data[offset:], []byte("\r\n"))
+		if lineEnd < 0 {
+			if len(sli1data) > TrailerSizeMax {
+				return 0, nil, errChunkedMalformed
+			}
+			return 0, nil, errChunkedIncomplete
+		}
+		sli1line := sli1data[offset : offset+lineEnd]
+		offset += lineEnd + 2
+		if offset > TrailerSizeMax {
+			return 0, nil, errChunkedMalformed
+		}
+		if 0 == len(sli1line) {
+			return offset, mapTrailer, nil
+		}
+		// 和请求头一样，键名是 token，值不能有控制字符
+		index := bytes.IndexByte(sli1line, ':')
+		if index <= 0 || !isToken(string(sli1line[:index])) {
+			return 0, nil, errChunkedMalformed
+		}
+		value := strings.Trim(string(sli1line[index+1:]), " \t")
+		if !isFieldValue(value) {
+			return 0, nil, errChunkedMalformed
+		}
+		if isDecode {
+			if nil == mapTrailer {
+				mapTrailer = make(map[string]string)
+			}
+			mapTrailer[strings.ToLower(string(sli1line[:index]))] = value
+		}
+	}
+}
+
+// checkTransferEncoding 检查 Transfer-Encoding，有多个值的时候合起来看，只支持 chunked 一个编码。
+// 最后一个编码不是 chunked 的不知道报文在哪里结束，chunked 出现了多次的也不行，都返回 ErrAmbiguousLength（RFC 9112 6.3）；
+// 有其他编码的（比如 "gzip, chunked"），解不出来，返回 ErrTransferCodingNotImplemented（RFC 9112 6.1）
+func checkTransferEncoding(sli1value []string) error {
+	sli1coding := make([]string, 0, len(sli1value))
+	for _, value := range sli1value {
+		for _, coding := range strings.Split(value, ",") {
+			// 列表中的空元素忽略（RFC 9110 5.6.1）
+			if coding = strings.ToLower(strings.Trim(coding, " \t")); "" != coding {
+				sli1coding = append(sli1coding, coding)
+			}
+		}
+	}
+	if 0 == len(sli1coding) || "chunked" != sli1coding[len(sli1coding)-1] {
+		return ErrAmbiguousLength
+	}
+	for _, coding := range sli1coding[:len(sli1coding)-1] {
+		if "chunked" == coding {
+			return ErrAmbiguousLength
+		}
+	}
+	if len(sli1coding) > 1 {
+		return ErrTransferCodingNotImplemented
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package http
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseChunked(t *testing.T) {
+	sli1test := []struct {
+		name       string
+		data       string
+		err        error
+		length     int
+		body       string
+		mapTrailer map[string]string
+	}{
+		{"empty body", "0\r\n\r\n", nil, 5, "", nil},
+		{"one chunk", "5\r\nhello\r\n0\r\n\r\n", nil, 15, "hello", nil},
+		{"two chunks", "3\r\nhel\r\n2\r\nlo\r\n0\r\n\r\n", nil, 20, "hello", nil},
+		{"hex size", "A\r\n0123456789\r\n0\r\n\r\n", nil, 20, "0123456789", nil},
+		{"upper and lower hex", "a\r\n0123456789\r\n0\r\n\r\n", nil, 20, "0123456789", nil},
+		{"extension ignored", "5;name=value\r\nhello\r\n0;x\r\n\r\n", nil, 28, "hello", nil},
+		{"trailer", "5\r\nhello\r\n0\r\nX-Sum: abc\r\nX-B:  b \r\n\r\n", nil, 37, "hello", map[string]string{"x-sum": "abc", "x-b": "b"}},
+		{"data after the body is not included", "0\r\n\r\nGET /", nil, 5, "", nil},
+
+		{"no data", "", errChunkedIncomplete, 0, "", nil},
+		{"size line incomplete", "5", errChunkedIncomplete, 0, "", nil},
+		{"chunk data incomplete", "5\r\nhel", errChunkedIncomplete, 0, "", nil},
+		{"chunk crlf incomplete", "5\r\nhello\r", errChunkedIncomplete, 0, "", nil},
+		{"last chunk incomplete", "5\r\nhello\r\n0\r\n", errChunkedIncomplete, 0, "", nil},
+		{"trailer incomplete", "0\r\nX-A: a\r\n", errChunkedIncomplete, 0, "", nil},
+
+		{"bad size", "zz\r\nhello\r\n0\r\n\r\n", errChunkedMalformed, 0, "", nil},
+		{"empty size", "\r\nhello\r\n0\r\n\r\n", errChunkedMalformed, 0, "", nil},
+		{"negative size", "-5\r\nhello\r\n0\r\n\r\n", errChunkedMalformed, 0, "", nil},
+		{"size overflow", "10000000000000000\r\n", errChunkedMalformed, 0, "", nil},
+		{"size too large", strconv.FormatUint(ChunkSizeMax+1, 16) + "\r\n", errChunkedMalformed, 0, "", nil},
+		{"data longer than size", "3\r\nhello\r\n0\r\n\r\n", errChunkedMalformed, 0, "", nil},
+		{"size line too long", "5;" + strings.Repeat("x", ChunkLineMax) + "\r\n", errChunkedMalformed, 0, "", nil},
+		{"size line too long without crlf", strings.Repeat("1", ChunkLineMax+1), errChunkedMalformed, 0, "", nil},
+		{"trailer without colon", "0\r\nX-A\r\n\r\n", errChunkedMalformed, 0, "", nil},
+		{"trailer with empty name", "0\r\n: a\r\n\r\n", errChunkedMalformed, 0, "", nil},
+		{"trailer name not a token", "0\r\nX A: a\r\n\r\n", errChunkedMalformed, 0, "", nil},
+		{"trailer value with nul", "0\r\nX-A: a\x00\r\n\r\n", errChunkedMalformed, 0, "", nil},
+		{"trailer too large", "0\r\nX-A: " + strings.Repeat("a", TrailerSizeMax) + "\r\n\r\n", errChunkedMalformed, 0, "", nil},
+		{"trailer too large without crlf", "0\r\nX-A: " + strings.Repeat("a", TrailerSizeMax), errChunkedMalformed, 0, "", nil},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			length, sli1body, mapTrailer, err := parseChunked([]byte(t1test.data), true)
+			if t1test.err != err {
+				t.Fatalf("err = %v, want %v", err, t1test.err)
+			}
+			if nil != err {
+				return
+			}
+			if t1test.length != length || t1test.body != string(sli1body) {
+				t.Fatalf("parseChunked() = %d, %q, want %d, %q", length, sli1body, t1test.length, t1test.body)
+			}
+			if !reflect.DeepEqual(t1test.mapTrailer, mapTrailer) {
+				t.Fatalf("trailer = %v, want %v", mapTrailer, t1test.mapTrailer)
+			}
+			// 不解码的时候只算长度
+			if length, _, _, err = parseChunked([]byte(t1test.data), false); nil != err || t1test.length != length {
+				t.Fatalf("parseChunked(isDecode false) = %d, %v", length, err)
+			}
+		})
+	}
+}
+
+func TestChunkedRequestTrailer(t *testing.T) {
+	p1http := NewHTTP()
+	decodeRequest(t, p1http, "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nab\r\n1\r\nc\r\n0\r\nX-Checksum: 123\r\n\r\n")
+	if !p1http.IsChunked || "abc" != string(p1http.Sli1Body) || "123" != p1http.MapTrailer["x-checksum"] {
+		t.Fatalf("IsChunked = %v, body = %q, trailer = %v", p1http.IsChunked, p1http.Sli1Body, p1http.MapTrailer)
+	}
+	// 请求体是解码之后新分配的，Clone 之后不指向接收缓冲区
+	p1clone := p1http.Clone()
+	if "abc" != string(p1clone.Sli1Body) || "123" != p1clone.MapTrailer["x-checksum"] {
+		t.Fatalf("Clone body = %q, trailer = %v", p1clone.Sli1Body, p1clone.MapTrailer)
+	}
+}
+
+// TestChunkedWriter ChunkedWriter 发送的数据，用客户端的协议实例能解析回来
+func TestChunkedWriter(t *testing.T) {
+	sli1test := []struct {
+		name       string
+		sli1write  []string
+		mapTrailer map[string]string
+	}{
+		{"no data", nil, nil},
+		{"empty writes skipped", []string{"", "a", ""}, nil},
+		{"several chunks", []string{"hello", " ", "world"}, nil},
+		{"trailer", []string{"hello"}, map[string]string{"X-Sum": "1"}},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			var sli1sent []byte
+			endNum := 0
+			resp := NewResponse()
+			resp.SetStatusCode(StatusOk)
+			p1writer := NewChunkedWriter(resp, func(sli1data []byte, isEnd bool) {
+				sli1sent = append(sli1sent, sli1data...)
+				if isEnd {
+					endNum++
+				}
+			})
+			for key, val := range t1test.mapTrailer {
+				p1writer.SetTrailer(key, val)
+			}
+			for _, data := range t1test.sli1write {
+				if _, err := p1writer.Write([]byte(data)); nil != err {
+					t.Fatal(err)
+				}
+			}
+			if err := p1writer.Close(); nil != err {
+				t.Fatal(err)
+			}
+			// 重复 Close 不再发送，Close 之后不能 Write
+			p1writer.Close()
+			if _, err := p1writer.Write([]byte("x")); ErrChunkedWriterClosed != err {
+				t.Fatalf("Write after Close = %v, want ErrChunkedWriterClosed", err)
+			}
+			if 1 != endNum {
+				t.Fatalf("isEnd sent %d times, want 1", endNum)
+			}
+
+			p1http := NewHTTP()
+			p1http.SetClientSide()
+			msgLen, err := p1http.FirstMsgLength(sli1sent)
+			if nil != err || int(msgLen) != len(sli1sent) {
+				t.Fatalf("FirstMsgLength(%q) = %d, %v", sli1sent, msgLen, err)
+			}
+			if err = p1http.Decode(sli1sent); nil != err {
+				t.Fatal(err)
+			}
+			if want := strings.Join(t1test.sli1write, ""); !p1http.IsChunked || want != string(p1http.Sli1Body) {
+				t.Fatalf("body = %q, want %q", p1http.Sli1Body, want)
+			}
+			for key, val := range t1test.mapTrailer {
+				if val != p1http.MapTrailer[strings.ToLower(key)] {
+					t.Fatalf("trailer %s = %q, want %q", key, p1http.MapTrailer[strings.ToLower(key)], val)
+				}
+				if !strings.Contains(p1http.GetHeader("Trailer"), key) {
+					t.Fatalf("Trailer header = %q, want %s declared", p1http.GetHeader("Trailer"), key)
+				}
+			}
+		})
+	}
+}
+
+func TestMakeChunk(t *testing.T) {
+	if nil != MakeChunk(nil) {
+		t.Fatal("MakeChunk(nil) should be empty, a zero size chunk ends the body")
+	}
+	if sli1chunk := MakeChunk(bytes.Repeat([]byte("a"), 26)); !bytes.HasPrefix(sli1chunk, []byte("1a\r\n")) || !bytes.HasSuffix(sli1chunk, []byte("a\r\n")) {
+		t.Fatalf("MakeChunk() = %q", sli1chunk)
+	}
+	// trailer 中的换行替换掉，不能注入头字段
+	if sli1chunk := MakeLastChunk(map[string]string{"X-A": "a\r\nX-B: b"}); bytes.Contains(sli1chunk, []byte("\r\nX-B")) {
+		t.Fatalf("MakeLastChunk() = %q, CRLF not removed", sli1chunk)
+	}
+}
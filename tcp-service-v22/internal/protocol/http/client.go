@@ -0,0 +1,83 @@
+package http
+
+import (
+	"sort"
+	"sync"
+)
+
+// requestQueue 客户端已经发送、还没收到响应的请求的方法，按发送的顺序。
+// 发送请求和解析响应在不同的 goroutine 中，要加锁
+type requestQueue struct {
+	mutex      sync.Mutex
+	sli1method []string
+}
+
+// push 发送了一个请求
+func (p1this *requestQueue) push(method string) {
+	p1this.mutex.Lock()
+	p1this.sli1method = append(p1this.sli1method, method)
+	p1this.mutex.Unlock()
+}
+
+// front 第 1 个还没收到响应的请求的方法，没有的时候返回空字符串
+func (p1this *requestQueue) front() string {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	if 0 == len(p1this.sli1method) {
+		return ""
+	}
+	return p1this.sli1method[0]
+}
+
+// pop 第 1 个请求收到响应了
+func (p1this *requestQueue) pop() {
+	p1this.mutex.Lock()
+	if len(p1this.sli1method) > 0 {
+		p1this.sli1method = p1this.sli1method[1:]
+	}
+	p1this.mutex.Unlock()
+}
+
+// SetClientSide 设置成客户端的连接，只解析响应。客户端的 HTTP 连接在连上服务端的时候设置，
+// 协议内部用来握手的 HTTP（比如 WebSocket 的）要自己设置
+func (p1this *HTTP) SetClientSide() {
+	p1this.isClientSide = true
+}
+
+// AddRequest 客户端发送请求的时候调用，按顺序记下请求的方法，解析响应的时候要用（HEAD 请求的响应没有响应体）。
+// 可以在任意 goroutine 中调用，要和发送请求的顺序一样
+func (p1this *HTTP) AddRequest(p1request *Request) {
+	p1this.p1requestQueue.push(p1request.GetMethod())
+}
+
+// EOFMsgLength 对端关闭连接的时候，没有长度的响应到这里就结束了，返回整个响应的长度。
+// 不是这种响应的时候返回 0
+func (p1this *HTTP) EOFMsgLength(sli1recv []byte) uint64 {
+	if !p1this.isClientSide || !p1this.isUntilClose || ParseStatusIncomplete != p1this.ParseStatus {
+		return 0
+	}
+	return uint64(len(sli1recv))
+}
+
+// CopyResponse 把解析出来的响应复制成 Response，响应体也复制一份，可以在 OnConnRequest 返回之后使用。
+// 键名是小写的，同名的头字段按收到的顺序排在一起
+func (p1this *HTTP) CopyResponse() *Response {
+	p1response := NewResponse()
+	p1response.statusCode = p1this.StatusCode
+	p1response.reason = p1this.Reason
+
+	sli1key := make([]string, 0, len(p1this.MapHeader))
+	for key := range p1this.MapHeader {
+		sli1key = append(sli1key, key)
+	}
+	sort.Strings(sli1key)
+	for _, key := range sli1key {
+		for _, val := range p1this.MapHeader[key] {
+			p1response.sli1field = append(p1response.sli1field, headerField{key: key, val: val})
+		}
+	}
+	if len(p1this.Sli1Body) > 0 {
+		p1response.sli1body = append([]byte(nil), p1this.Sli1Body...)
+	}
+	return p1response
+}
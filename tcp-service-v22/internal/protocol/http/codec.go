@@ -0,0 +1,174 @@
+package http
+
+import (
+	goErrors "errors"
+	"fmt"
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+)
+
+func init() {
+	protocol.Register(protocol.HTTPStr, &protocol.Codec{
+		NewProtocol:   func() protocol.Protocol { return NewHTTP() },
+		OnConnConnect: onConnConnect,
+		OnMsgReady:    onMsgReady,
+		Encode:        encode,
+		ClassifyErr:   classifyErr,
+		RejectMsg:     rejectMsg,
+		TimeoutMsg:    timeoutMsg,
+		ErrMsg:        errMsg,
+		EOFMsgLength:  eofMsgLength,
+		Clone:         func(p1protocol protocol.Protocol) protocol.Protocol { return p1protocol.(*HTTP).Clone() },
+		Sniff:         SniffRequest,
+		// 优雅关闭的时候等已经收到的请求响应完
+		IsRequestResponse: true,
+	})
+}
+
+// onConnConnect 客户端连上服务端之后，协议实例设置成客户端的，只解析响应
+func onConnConnect(p1conn protocol.Conn) error {
+	if protocol.SideClient == p1conn.GetSide() {
+		p1conn.GetProtocol().(*HTTP).SetClientSide()
+	}
+	return nil
+}
+
+// onMsgReady 解析 HTTP 报文，解析之后由外部实现的 OnConnRequest 继续处理
+func onMsgReady(p1conn protocol.Conn, sli1msg []byte) (uint8, error) {
+	t1p1protocol := p1conn.GetProtocol().(*HTTP)
+	if err := t1p1protocol.Decode(sli1msg); nil != err {
+		// 请求体解压失败，服务端按 ParseErrMsg 回复之后关闭连接
+		return protocol.MsgActionSkip, err
+	}
+
+	if p1conn.IsDebug() {
+		fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleHTTPMsg.Decode: ", p1conn.GetName()))
+		fmt.Println(fmt.Sprintf("%+v", t1p1protocol))
+	}
+
+	if protocol.SideClient == p1conn.GetSide() {
+		if t1p1protocol.StatusCode < 200 && StatusSwitchingProtocols != t1p1protocol.StatusCode {
+			// 1xx 的临时响应（比如 100 Continue）后面还有最终的响应
+			return protocol.MsgActionSkip, nil
+		}
+		t1p1protocol.p1requestQueue.pop()
+		if !t1p1protocol.IsKeepAlive() || StatusSwitchingProtocols == t1p1protocol.StatusCode {
+			// 服务端不保持连接，或者切换了协议（这里处理不了），这是最后一个响应
+			return protocol.MsgActionRequestLast, nil
+		}
+		return protocol.MsgActionRequest, nil
+	}
+
+	if !t1p1protocol.IsKeepAlive() {
+		// 不保持连接的请求，后面的数据不再处理，响应发送完之后关闭连接
+		return protocol.MsgActionRequestLast, nil
+	}
+	return protocol.MsgActionRequest, nil
+}
+
+// eofMsgLength 客户端的连接被服务端关闭的时候，没有长度的响应到这里就结束了
+func eofMsgLength(p1conn protocol.Conn, sli1recv []byte) uint64 {
+	return p1conn.GetProtocol().(*HTTP).EOFMsgLength(sli1recv)
+}
+
+// encode 参数不为空的时候是构造好的报文（比如 ChunkedWriter 发送的块），直接发送；为空的时候发送 HTTP.SetResponse 设置的响应
+func encode(p1conn protocol.Conn, sli1msg []byte) ([]byte, error) {
+	if len(sli1msg) > 0 {
+		return sli1msg, nil
+	}
+	return p1conn.GetProtocol().Encode()
+}
+
+// classifyErr 根据解析状态，判断是继续接收还是明显出错
+func classifyErr(p1conn protocol.Conn, err error) uint8 {
+	switch p1conn.GetProtocol().(*HTTP).ParseStatus {
+	case ParseStatusParseErr:
+		return protocol.ErrTypeFatal
+	case ParseStatusRecvBufferEmpty, ParseStatusNotHTTP:
+		// 还没找到 \r\n\r\n，请求头没接收完
+		return protocol.ErrTypeHeaderIncomplete
+	}
+	return protocol.ErrTypeIncomplete
+}
+
+// sli1method HTTP 请求方法和后面的空格，用于识别协议
+var sli1method = []string{"GET ", "POST ", "PUT ", "DELETE ", "HEAD ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// SniffRequest 判断连接开头的数据是不是 HTTP 请求，以请求方法和空格开头的就是
+func SniffRequest(sli1head []byte) uint8 {
+	result := protocol.SniffNoMatch
+	for _, method := range sli1method {
+		if len(sli1head) >= len(method) {
+			if method == string(sli1head[:len(method)]) {
+				return protocol.SniffMatch
+			}
+		} else if method[:len(sli1head)] == string(sli1head) {
+			// 可能是这个方法，数据还不够
+			result = protocol.SniffNeedMore
+		}
+	}
+	return result
+}
+
+// rejectMsg 服务端超过最大连接数时，回复 503
+func rejectMsg() []byte {
+	resp := NewResponse()
+	resp.SetStatusCode(StatusServiceUnavailable)
+	resp.SetHeader("Connection", "close")
+	resp.SetBody([]byte("service unavailable."))
+	return resp.Encode()
+}
+
+// errMsg 服务端解析请求出错的时候，按错误回复，详见 ParseErrMsg
+func errMsg(p1conn protocol.Conn, err error) []byte {
+	if protocol.SideService != p1conn.GetSide() {
+		return nil
+	}
+	return ParseErrMsg(err)
+}
+
+// ParseErrMsg 解析请求出错时回复的消息，详见 ParseErrResponse
+func ParseErrMsg(err error) []byte {
+	return ParseErrResponse(err).Encode()
+}
+
+// ParseErrResponse 解析请求出错时回复的响应，报文头太大回复 431，版本不支持回复 505，Transfer-Encoding 不支持回复 501，
+// 请求体解压之后太大回复 413，请求体的压缩格式不支持回复 415，其他的回复 400
+func ParseErrResponse(err error) *Response {
+	resp := NewResponse()
+	body := "bad request."
+	switch {
+	case goErrors.Is(err, ErrHeaderTooLarge):
+		resp.SetStatusCode(StatusRequestHeaderFieldsTooLarge)
+		body = "request header fields too large."
+	case goErrors.Is(err, ErrBodyTooLarge):
+		resp.SetStatusCode(StatusContentTooLarge)
+		body = "content too large."
+	case goErrors.Is(err, ErrUnsupportedEncoding):
+		resp.SetStatusCode(StatusUnsupportedMediaType)
+		resp.SetHeader("Accept-Encoding", "gzip, deflate")
+		body = "unsupported content encoding."
+	case goErrors.Is(err, ErrVersionNotSupported):
+		resp.SetStatusCode(StatusHTTPVersionNotSupported)
+		body = "http version not supported."
+	case goErrors.Is(err, ErrTransferCodingNotImplemented):
+		resp.SetStatusCode(StatusNotImplemented)
+		body = "transfer coding not implemented."
+	default:
+		resp.SetStatusCode(StatusBadRequest)
+	}
+	resp.SetHeader("Connection", "close")
+	resp.SetBody([]byte(body))
+	return resp
+}
+
+// timeoutMsg 服务端读请求超时的时候，回复 408。空闲超时的时候还没有请求，直接关闭连接。
+func timeoutMsg(p1conn protocol.Conn, timeoutType uint8) []byte {
+	if protocol.SideService != p1conn.GetSide() || protocol.TimeoutTypeIdle == timeoutType {
+		return nil
+	}
+	resp := NewResponse()
+	resp.SetStatusCode(StatusRequestTimeout)
+	resp.SetHeader("Connection", "close")
+	resp.SetBody([]byte("request timeout."))
+	return resp.Encode()
+}
@@ -0,0 +1,268 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	goErrors "errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 内容编码，deflate 是 zlib 格式的（RFC 9110 8.4.1.2）
+	StrGzip     = "gzip"
+	StrDeflate  = "deflate"
+	StrIdentity = "identity"
+)
+
+var (
+	// ErrUnsupportedEncoding 请求体的 Content-Encoding 不支持，回复 415
+	ErrUnsupportedEncoding = goErrors.New("unsupported content encoding")
+)
+
+// CompressConfig 响应压缩的配置，为 0（空）的字段用 DefaultCompressConfig 的
+type CompressConfig struct {
+	// MinSize 响应体至少多少字节才压缩，太小的压缩之后可能更大。分块发送的响应不知道有多大，都压缩
+	MinSize int
+	// Level 压缩级别，1（最快）到 9（最小），详见 compress/flate 中的常量
+	Level int
+	// Sli1ContentType 可以压缩的媒体类型。"/" 结尾的是前缀（比如 "text/"），"+" 开头的是后缀（比如 "+json"）
+	Sli1ContentType []string
+}
+
+// DefaultCompressConfig 默认的响应压缩配置，服务启动之前可以修改
+var DefaultCompressConfig = CompressConfig{
+	MinSize: 1024,
+	Level:   flate.DefaultCompression,
+	Sli1ContentType: []string{
+		"text/", "application/json", "application/javascript", "application/xml", "image/svg+xml", "+json", "+xml",
+	},
+}
+
+// compressConfig 获取响应压缩的配置，没有设置的字段用 DefaultCompressConfig 的
+func compressConfig(p1config *CompressConfig) CompressConfig {
+	config := DefaultCompressConfig
+	if nil == p1config {
+		return config
+	}
+	t1config := *p1config
+	if 0 == t1config.MinSize {
+		t1config.MinSize = config.MinSize
+	}
+	if 0 == t1config.Level {
+		t1config.Level = config.Level
+	}
+	if 0 == len(t1config.Sli1ContentType) {
+		t1config.Sli1ContentType = config.Sli1ContentType
+	}
+	return t1config
+}
+
+// isCompressible 这个媒体类型能不能压缩，contentType 可以带参数
+func (p1this CompressConfig) isCompressible(contentType string) bool {
+	mediaType := contentType
+	if index := strings.IndexByte(mediaType, ';'); index >= 0 {
+		mediaType = mediaType[:index]
+	}
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if "" == mediaType {
+		return false
+	}
+	for _, t1type := range p1this.Sli1ContentType {
+		switch {
+		case strings.HasSuffix(t1type, "/"):
+			if strings.HasPrefix(mediaType, t1type) {
+				return true
+			}
+		case strings.HasPrefix(t1type, "+"):
+			if strings.HasSuffix(mediaType, t1type) {
+				return true
+			}
+		case mediaType == t1type:
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateEncoding 根据请求的 Accept-Encoding 选一个内容编码，返回 StrGzip、StrDeflate，都不接受的时候返回空字符串。
+// q 值大的优先，一样的时候优先 gzip；"*" 表示没有列出来的都接受；没有 Accept-Encoding 的不压缩
+func NegotiateEncoding(acceptEncoding string) string {
+	mapQ := make(map[string]float64, 4)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		sli1param := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(sli1param[0]))
+		if "" == coding {
+			continue
+		}
+		if "x-gzip" == coding {
+			coding = StrGzip
+		}
+		q := 1.0
+		for _, param := range sli1param[1:] {
+			param = strings.TrimSpace(param)
+			if len(param) > 2 && ("q=" == param[:2] || "Q=" == param[:2]) {
+				t1q, err := strconv.ParseFloat(param[2:], 64)
+				if nil != err {
+					t1q = 0
+				}
+				q = t1q
+			}
+		}
+		mapQ[coding] = q
+	}
+
+	encoding := ""
+	maxQ := 0.0
+	for _, coding := range []string{StrGzip, StrDeflate} {
+		q, ok := mapQ[coding]
+		if !ok {
+			q = mapQ["*"]
+		}
+		if q > maxQ {
+			encoding = coding
+			maxQ = q
+		}
+	}
+	return encoding
+}
+
+// Compress 按请求的 Accept-Encoding 压缩响应体，设置 Content-Encoding。
+// 媒体类型可以压缩的响应，不管压不压缩都在 Vary 中加上 Accept-Encoding，缓存要按 Accept-Encoding 区分。
+// 响应体小于 CompressConfig.MinSize、已经有 Content-Encoding、压缩之后没有变小的，不压缩。p1config 为 nil 时用 DefaultCompressConfig
+func (p1this *Response) Compress(acceptEncoding string, p1config *CompressConfig) error {
+	config := compressConfig(p1config)
+	if !p1this.isBodyAllowed() || p1this.hasHeader("Content-Encoding") || !config.isCompressible(p1this.contentType()) {
+		return nil
+	}
+	p1this.AddVary("Accept-Encoding")
+	if len(p1this.sli1body) < config.MinSize {
+		return nil
+	}
+	encoding := NegotiateEncoding(acceptEncoding)
+	if "" == encoding {
+		return nil
+	}
+
+	var buffer bytes.Buffer
+	p1compressor, err := newCompressor(encoding, &buffer, config.Level)
+	if nil != err {
+		return err
+	}
+	p1compressor.Write(p1this.sli1body)
+	if err = p1compressor.Close(); nil != err {
+		return err
+	}
+	if buffer.Len() >= len(p1this.sli1body) {
+		return nil
+	}
+	p1this.sli1body = buffer.Bytes()
+	p1this.SetHeader("Content-Encoding", encoding)
+	return nil
+}
+
+// AddVary 在 Vary 响应头中加上 key，已经有的（或者是 "*"）不重复加
+func (p1this *Response) AddVary(key string) {
+	for _, vary := range p1this.GetHeaderValues("Vary") {
+		for _, token := range strings.Split(vary, ",") {
+			token = strings.TrimSpace(token)
+			if "*" == token || strings.EqualFold(token, key) {
+				return
+			}
+		}
+	}
+	if vary := p1this.GetHeader("Vary"); "" != vary {
+		p1this.SetHeader("Vary", vary+", "+key)
+		return
+	}
+	p1this.AddHeader("Vary", key)
+}
+
+// contentType 响应的 Content-Type，没有设置的时候是发送时会用的 DefaultContentType
+func (p1this *Response) contentType() string {
+	if contentType := p1this.GetHeader("Content-Type"); "" != contentType {
+		return contentType
+	}
+	return DefaultContentType
+}
+
+// compressor 压缩数据的 io.WriteCloser，Flush 把已经写的数据都压缩输出
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newCompressor 创建压缩数据的 compressor，压缩之后的数据写到 w
+func newCompressor(encoding string, w io.Writer, level int) (compressor, error) {
+	switch encoding {
+	case StrGzip:
+		return gzip.NewWriterLevel(w, level)
+	case StrDeflate:
+		return zlib.NewWriterLevel(w, level)
+	}
+	return nil, ErrUnsupportedEncoding
+}
+
+// decompressBody 按 Content-Encoding 解压报文体，支持 gzip 和 deflate，有多个的按相反的顺序解压。
+// 解压之后去掉 Content-Encoding，超过 BodyLimit.DecompressSizeMax 的返回 ErrBodyTooLarge
+func (p1this *HTTP) decompressBody() error {
+	sli1encoding := p1this.MapHeader["content-encoding"]
+	if 0 == len(sli1encoding) || 0 == len(p1this.Sli1Body) {
+		return nil
+	}
+	var sli1coding []string
+	for _, encoding := range sli1encoding {
+		for _, coding := range strings.Split(encoding, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			switch coding {
+			case "", StrIdentity:
+			case StrGzip, "x-gzip", StrDeflate:
+				sli1coding = append(sli1coding, coding)
+			default:
+				return ErrUnsupportedEncoding
+			}
+		}
+	}
+
+	if 0 == len(sli1coding) {
+		return nil
+	}
+
+	sizeMax := p1this.bodyLimit().DecompressSizeMax
+	sli1body := p1this.Sli1Body
+	for i := len(sli1coding) - 1; i >= 0; i-- {
+		var p1reader io.ReadCloser
+		var err error
+		if StrDeflate == sli1coding[i] {
+			p1reader, err = zlib.NewReader(bytes.NewReader(sli1body))
+		} else {
+			p1reader, err = gzip.NewReader(bytes.NewReader(sli1body))
+		}
+		if nil != err {
+			return ErrMalformedMsg
+		}
+		// 多读 1 个字节，判断是不是超过了限制
+		sli1body, err = io.ReadAll(io.LimitReader(p1reader, sizeMax+1))
+		p1reader.Close()
+		if nil != err {
+			return ErrMalformedMsg
+		}
+		if int64(len(sli1body)) > sizeMax {
+			return ErrBodyTooLarge
+		}
+	}
+	p1this.Sli1Body = sli1body
+	p1this.isBodyCopied = true
+	delete(p1this.MapHeader, "content-encoding")
+	return nil
+}
+
+// writerFunc 函数当成 io.Writer 用
+type writerFunc func(sli1data []byte) (int, error)
+
+func (f writerFunc) Write(sli1data []byte) (int, error) {
+	return f(sli1data)
+}
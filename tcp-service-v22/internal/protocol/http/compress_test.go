@@ -0,0 +1,252 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// compressBytes 用 encoding 压缩 sli1data
+func compressBytes(t *testing.T, encoding string, sli1data []byte) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	p1compressor, err := newCompressor(encoding, &buffer, gzip.DefaultCompression)
+	if nil != err {
+		t.Fatal(err)
+	}
+	p1compressor.Write(sli1data)
+	if err = p1compressor.Close(); nil != err {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// decompressBytes 用 encoding 解压 sli1data
+func decompressBytes(t *testing.T, encoding string, sli1data []byte) []byte {
+	t.Helper()
+	var p1reader io.ReadCloser
+	var err error
+	if StrDeflate == encoding {
+		p1reader, err = zlib.NewReader(bytes.NewReader(sli1data))
+	} else {
+		p1reader, err = gzip.NewReader(bytes.NewReader(sli1data))
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer p1reader.Close()
+	sli1result, err := io.ReadAll(p1reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return sli1result
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	sli1test := []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{"", ""},
+		{"gzip", StrGzip},
+		{"GZIP", StrGzip},
+		{"x-gzip", StrGzip},
+		{"deflate", StrDeflate},
+		{"br", ""},
+		{"identity", ""},
+		{"gzip, deflate", StrGzip},
+		{"deflate, gzip", StrGzip},
+		{"gzip;q=0.5, deflate", StrDeflate},
+		{"gzip; q=0.5, deflate;Q=0.8", StrDeflate},
+		{"gzip;q=0", ""},
+		{"gzip;q=0, *", StrDeflate},
+		{"*", StrGzip},
+		{"*;q=0", ""},
+		{"gzip;q=abc, deflate;q=0.1", StrDeflate},
+		{" , ,gzip", StrGzip},
+	}
+	for _, t1test := range sli1test {
+		if encoding := NegotiateEncoding(t1test.acceptEncoding); t1test.encoding != encoding {
+			t.Errorf("NegotiateEncoding(%q) = %q, want %q", t1test.acceptEncoding, encoding, t1test.encoding)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat("hello world ", 200)
+	sli1test := []struct {
+		name           string
+		statusCode     uint16
+		contentType    string
+		contentEnc     string
+		body           string
+		acceptEncoding string
+		encoding       string
+		vary           string
+	}{
+		{"gzip", StatusOk, "text/html; charset=utf-8", "", body, "gzip, deflate", StrGzip, "Accept-Encoding"},
+		{"deflate", StatusOk, "application/json", "", body, "deflate", StrDeflate, "Accept-Encoding"},
+		{"suffix type", StatusOk, "application/problem+json", "", body, "gzip", StrGzip, "Accept-Encoding"},
+		{"default content type", StatusOk, "", "", body, "gzip", StrGzip, "Accept-Encoding"},
+		{"not accepted", StatusOk, "text/plain", "", body, "br", "", "Accept-Encoding"},
+		{"too small", StatusOk, "text/plain", "", "hello", "gzip", "", "Accept-Encoding"},
+		{"incompressible data not smaller", StatusOk, "text/plain", "", string(compressBytes(t, StrGzip, []byte(body))), "gzip", "", "Accept-Encoding"},
+		{"type not compressible", StatusOk, "image/png", "", body, "gzip", "", ""},
+		{"already encoded", StatusOk, "text/plain", "br", body, "gzip", "br", ""},
+		{"no body allowed", StatusNoContent, "text/plain", "", body, "gzip", "", ""},
+	}
+	p1config := &CompressConfig{MinSize: 100}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			resp := NewResponse()
+			resp.SetStatusCode(t1test.statusCode)
+			if "" != t1test.contentType {
+				resp.SetHeader("Content-Type", t1test.contentType)
+			}
+			if "" != t1test.contentEnc {
+				resp.SetHeader("Content-Encoding", t1test.contentEnc)
+			}
+			resp.SetBody([]byte(t1test.body))
+			if err := resp.Compress(t1test.acceptEncoding, p1config); nil != err {
+				t.Fatal(err)
+			}
+			if t1test.encoding != resp.GetHeader("Content-Encoding") || t1test.vary != resp.GetHeader("Vary") {
+				t.Fatalf("Content-Encoding = %q, Vary = %q, want %q, %q",
+					resp.GetHeader("Content-Encoding"), resp.GetHeader("Vary"), t1test.encoding, t1test.vary)
+			}
+			if t1test.encoding != t1test.contentEnc {
+				if sli1body := decompressBytes(t, t1test.encoding, resp.GetBody()); t1test.body != string(sli1body) {
+					t.Fatal("decompressed body is different")
+				}
+			} else if t1test.body != string(resp.GetBody()) {
+				t.Fatal("body changed without compression")
+			}
+		})
+	}
+}
+
+func TestAddVary(t *testing.T) {
+	sli1test := []struct {
+		sli1vary []string
+		want     string
+	}{
+		{nil, "Accept-Encoding"},
+		{[]string{"Origin"}, "Origin, Accept-Encoding"},
+		{[]string{"Origin, accept-encoding"}, "Origin, accept-encoding"},
+		{[]string{"*"}, "*"},
+	}
+	for _, t1test := range sli1test {
+		resp := NewResponse()
+		for _, vary := range t1test.sli1vary {
+			resp.AddHeader("Vary", vary)
+		}
+		resp.AddVary("Accept-Encoding")
+		resp.AddVary("Accept-Encoding")
+		if vary := strings.Join(resp.GetHeaderValues("Vary"), ", "); t1test.want != vary {
+			t.Errorf("Vary %v = %q, want %q", t1test.sli1vary, vary, t1test.want)
+		}
+	}
+}
+
+// TestDecompressBody 请求体按 Content-Encoding 解压，解压之后太大的（解压炸弹）回复 413，不支持的编码回复 415
+func TestDecompressBody(t *testing.T) {
+	body := []byte(strings.Repeat("a", 1000))
+	// 1 MiB 的 0，压缩之后只有 1 KiB 左右
+	sli1bomb := compressBytes(t, StrGzip, make([]byte, 1<<20))
+	sli1test := []struct {
+		name            string
+		contentEncoding string
+		sli1body        []byte
+		statusCode      uint16
+		body            []byte
+	}{
+		{"gzip", "gzip", compressBytes(t, StrGzip, body), 0, body},
+		{"x-gzip", "x-gzip", compressBytes(t, StrGzip, body), 0, body},
+		{"deflate", "Deflate", compressBytes(t, StrDeflate, body), 0, body},
+		{"identity", "identity", body, 0, body},
+		{"gzip and identity", "identity, gzip", compressBytes(t, StrGzip, body), 0, body},
+		{"stacked in reverse order", "deflate, gzip", compressBytes(t, StrGzip, compressBytes(t, StrDeflate, body)), 0, body},
+		{"at the limit", "gzip", compressBytes(t, StrGzip, make([]byte, 4096)), 0, make([]byte, 4096)},
+
+		{"bomb", "gzip", sli1bomb, StatusContentTooLarge, nil},
+		{"over the limit by one byte", "gzip", compressBytes(t, StrGzip, make([]byte, 4097)), StatusContentTooLarge, nil},
+		{"stacked bomb", "gzip, gzip", compressBytes(t, StrGzip, sli1bomb), StatusContentTooLarge, nil},
+		{"unsupported", "br", body, StatusUnsupportedMediaType, nil},
+		{"unsupported in a list", "gzip, compress", body, StatusUnsupportedMediaType, nil},
+		{"not gzip", "gzip", body, StatusBadRequest, nil},
+		{"truncated", "gzip", compressBytes(t, StrGzip, body)[:20], StatusBadRequest, nil},
+		{"wrong format", "deflate", compressBytes(t, StrGzip, body), StatusBadRequest, nil},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			raw := "POST / HTTP/1.1\r\nHost: x\r\nContent-Encoding: " + t1test.contentEncoding +
+				"\r\nContent-Length: " + strconv.Itoa(len(t1test.sli1body)) + "\r\n\r\n" + string(t1test.sli1body)
+			p1http := NewHTTP()
+			p1http.SetBodyLimit(&BodyLimit{DecompressSizeMax: 4096})
+			if _, err := p1http.FirstMsgLength([]byte(raw)); nil != err {
+				t.Fatal(err)
+			}
+			err := p1http.Decode([]byte(raw))
+			if 0 != t1test.statusCode {
+				if nil == err {
+					t.Fatal("Decode() should fail")
+				}
+				if statusCode := ParseErrResponse(err).GetStatusCode(); t1test.statusCode != statusCode {
+					t.Fatalf("status code = %d, want %d (%v)", statusCode, t1test.statusCode, err)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(t1test.body, p1http.Sli1Body) {
+				t.Fatalf("body is %d bytes, want %d", len(p1http.Sli1Body), len(t1test.body))
+			}
+			if "" != p1http.GetHeader("content-encoding") && "identity" != t1test.contentEncoding {
+				t.Fatalf("Content-Encoding %q should be removed", p1http.GetHeader("content-encoding"))
+			}
+			// 解压之后的请求体是新分配的，Clone 之后还在
+			if p1clone := p1http.Clone(); !bytes.Equal(t1test.body, p1clone.Sli1Body) {
+				t.Fatal("body of the clone is different")
+			}
+		})
+	}
+}
+
+// TestChunkedWriterCompress 分块发送的响应每次 Write 压缩之后马上发送，客户端解压之后和原来的一样
+func TestChunkedWriterCompress(t *testing.T) {
+	for _, encoding := range []string{StrGzip, StrDeflate} {
+		var sli1sent []byte
+		resp := NewResponse()
+		resp.SetStatusCode(StatusOk)
+		resp.SetHeader("Content-Type", "text/plain")
+		p1writer := NewChunkedWriter(resp, func(sli1data []byte, isEnd bool) {
+			sli1sent = append(sli1sent, sli1data...)
+		})
+		if err := p1writer.SetCompress(encoding, nil); nil != err {
+			t.Fatal(err)
+		}
+		p1writer.Write([]byte("hello "))
+		if 0 == len(sli1sent) {
+			t.Fatalf("%s: data should be sent after Write", encoding)
+		}
+		p1writer.Write([]byte("world"))
+		p1writer.Close()
+
+		p1http := NewHTTP()
+		p1http.SetClientSide()
+		if _, err := p1http.FirstMsgLength(sli1sent); nil != err {
+			t.Fatal(err)
+		}
+		if err := p1http.Decode(sli1sent); nil != err {
+			t.Fatal(err)
+		}
+		if "hello world" != string(p1http.Sli1Body) || !strings.Contains(p1http.GetHeader("vary"), "Accept-Encoding") {
+			t.Fatalf("%s: body = %q, Vary = %q", encoding, p1http.Sli1Body, p1http.GetHeader("vary"))
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package http
+
+import (
+  "strings"
+)
+
+// headerField 一个头字段
+type headerField struct {
+  key string
+  val string
+}
+
+// header 按顺序保存的头字段，同名的可以有多个，Request 和 Response 共用
+type header struct {
+  sli1field []headerField
+}
+
+// SetHeader 设置头字段，已经有的同名头字段（不区分大小写）会被替换，位置不变
+func (p1this *header) SetHeader(key string, val string) {
+  key = headerReplacer.Replace(key)
+  val = headerReplacer.Replace(val)
+  isSet := false
+  sli1field := p1this.sli1field[:0]
+  for _, field := range p1this.sli1field {
+    if strings.EqualFold(field.key, key) {
+      if isSet {
+        continue
+      }
+      isSet = true
+      field = headerField{key: key, val: val}
+    }
+    sli1field = append(sli1field, field)
+  }
+  p1this.sli1field = sli1field
+  if !isSet {
+    p1this.sli1field = append(p1this.sli1field, headerField{key: key, val: val})
+  }
+}
+
+// AddHeader 添加头字段，不替换已经有的同名头字段，比如多个 Set-Cookie
+func (p1this *header) AddHeader(key string, val string) {
+  p1this.sli1field = append(p1this.sli1field, headerField{key: headerReplacer.Replace(key), val: headerReplacer.Replace(val)})
+}
+
+// DelHeader 删除头字段，键名不区分大小写
+func (p1this *header) DelHeader(key string) {
+  sli1field := p1this.sli1field[:0]
+  for _, field := range p1this.sli1field {
+    if !strings.EqualFold(field.key, key) {
+      sli1field = append(sli1field, field)
+    }
+  }
+  p1this.sli1field = sli1field
+}
+
+// GetHeader 获取头字段的第 1 个值，键名不区分大小写，没有的时候返回空字符串
+func (p1this *header) GetHeader(key string) string {
+  for _, field := range p1this.sli1field {
+    if strings.EqualFold(field.key, key) {
+      return field.val
+    }
+  }
+  return ""
+}
+
+// GetHeaderValues 获取头字段的所有值，键名不区分大小写
+func (p1this *header) GetHeaderValues(key string) []string {
+  var sli1value []string
+  for _, field := range p1this.sli1field {
+    if strings.EqualFold(field.key, key) {
+      sli1value = append(sli1value, field.val)
+    }
+  }
+  return sli1value
+}
+
+// RangeHeader 按顺序遍历头字段，f 返回 false 时停止
+func (p1this *header) RangeHeader(f func(key string, val string) bool) {
+  for _, field := range p1this.sli1field {
+    if !f(field.key, field.val) {
+      return
+    }
+  }
+}
+
+// hasHeader 是不是设置了头字段
+func (p1this *header) hasHeader(key string) bool {
+  for _, field := range p1this.sli1field {
+    if strings.EqualFold(field.key, key) {
+      return true
+    }
+  }
+  return false
+}
+
+// appendFields 把头字段按顺序加到报文后面，sli1skip 中的（不区分大小写）跳过
+func (p1this *header) appendFields(sli1msg []byte, sli1skip ...string) []byte {
+  for _, field := range p1this.sli1field {
+    isSkip := false
+    for _, key := range sli1skip {
+      if strings.EqualFold(field.key, key) {
+        isSkip = true
+        break
+      }
+    }
+    if !isSkip {
+      sli1msg = appendHeaderField(sli1msg, field.key, field.val)
+    }
+  }
+  return sli1msg
+}
+
+func appendHeaderField(sli1msg []byte, key string, val string) []byte {
+  sli1msg = append(sli1msg, key...)
+  sli1msg = append(sli1msg, ": "...)
+  sli1msg = append(sli1msg, val...)
+  return append(sli1msg, "\r\n"...)
+}
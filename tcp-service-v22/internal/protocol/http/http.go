@@ -1,8 +1,9 @@
 package http
 
 import (
+	"bytes"
 	goErrors "errors"
-	"strconv"
+	"net/url"
 	"strings"
 	"tcp-service-go/tcp-service-v22/internal/protocol"
 
@@ -16,9 +17,14 @@ const (
 	ParseStatusParseErr                     // 解析出错
 )
 
+// ErrNoResponse 没有用 SetResponse 设置响应就调用了 Encode
+var ErrNoResponse = goErrors.New("http response is not set.")
+
 const (
 	// content-type
 	StrXWWWFormUrlencoded = "application/x-www-form-urlencoded"
+	StrApplicationJSON    = "application/json"
+	StrMultipartFormData  = "multipart/form-data"
 )
 
 var _ protocol.Protocol = &HTTP{}
@@ -30,29 +36,71 @@ type HTTP struct {
 
 	// HeaderLength 请求头数据长度
 	HeaderLength uint32
-	// ContentLength 请求体数据长度
+	// ContentLength 请求体数据长度，chunked 编码的请求为 0
 	ContentLength uint32
+	// IsChunked 请求体是不是 chunked 编码（Transfer-Encoding: chunked）
+	IsChunked bool
 
 	// Sli1Msg 请求报文
 	Sli1Msg []byte
 
-	// Method 请求方法
+	// Method 请求方法，响应为空
 	Method string
-	// Uri 请求路由
+	// Uri 请求目标，原样保留（包括查询参数），响应为空
 	Uri string
+	// Path 请求目标中的路径，URL 解码之后的，用于路由
+	Path string
+	// RawQuery 请求目标中 "?" 后面的查询参数，没有解码
+	RawQuery string
 	// Version 版本
 	Version string
+	// StatusCode 响应的状态码，请求为 0
+	StatusCode uint16
+	// Reason 响应的原因短语，请求为空
+	Reason string
+
+	// MapHeader 解析后的报文头，键名全部转成小写，同名的头字段有多个值，详见 GetHeader
+	MapHeader map[string][]string
+	// MapQuery 解析后的查询参数，URL 解码之后的，键名保留大小写，同名的键有多个值
+	MapQuery url.Values
+	// Sli1Body 请求体，chunked 编码的是解码之后的，压缩过的（Content-Encoding）是解压之后的
+	Sli1Body []byte
+	// ContentType 请求体的媒体类型，Content-Type 中分号前面的部分，转成小写
+	ContentType string
+	// MapContentTypeParam Content-Type 中的参数（比如 charset、boundary），键名是小写
+	MapContentTypeParam map[string]string
+	// MapBody 解析后的请求体（表单），和 MapQuery 一样
+	MapBody url.Values
+	// MapTrailer chunked 编码的请求体后面的 trailer，键名全部转成小写
+	MapTrailer map[string]string
+
+	// p1bodyLimit 解析请求体的限制，为 nil 时用 DefaultBodyLimit，详见 SetBodyLimit
+	p1bodyLimit *BodyLimit
+	// p1multipart 解析过的 multipart/form-data，详见 ParseMultipart
+	p1multipart *Multipart
+	// p1response 这条请求的响应，详见 SetResponse
+	p1response *Response
+	// sli1response SetResponse 的时候按这条请求构造好的响应报文，Encode 的时候发送
+	sli1response []byte
+	// errResponse 构造 sli1response 出错的时候的错误
+	errResponse error
+	// p1compressConfig 响应压缩的配置，为 nil 时不压缩，详见 SetCompressConfig
+	p1compressConfig *CompressConfig
 
-	// MapHeader 解析后的请求头
-	MapHeader map[string]string
-	// MapQuery 解析后的查询参数
-	MapQuery map[string]string
-	// MapBody 解析后的请求体
-	MapBody map[string]string
+	// isBodyCopied Sli1Body 是不是新分配的（chunked 解码或者解压之后的），不是的话指向 Sli1Msg
+	isBodyCopied bool
+	// isClientSide 是不是客户端的连接，客户端解析响应，服务端解析请求
+	isClientSide bool
+	// isUntilClose 响应没有长度，响应体到连接关闭为止，详见 EOFMsgLength
+	isUntilClose bool
+	// p1requestQueue 客户端已经发送、还没收到响应的请求，详见 AddRequest
+	p1requestQueue *requestQueue
 }
 
 func NewHTTP() *HTTP {
-	return &HTTP{}
+	return &HTTP{
+		p1requestQueue: &requestQueue{},
+	}
 }
 
 // Protocol.FirstMsgLength
@@ -64,117 +112,204 @@ func (p1this *HTTP) FirstMsgLength(sli1recv []byte) (uint64, error) {
 		p1this.ParseStatus = ParseStatusRecvBufferEmpty
 		return firstMsgLen, goErrors.New("ParseStatusRecvBufferEmpty")
 	}
-	recvStr := string(sli1recv)
 
-	// 找到 \r\n\r\n 的位置，用这个位置可以分隔请求头和请求体
-	rnrnIndex := strings.Index(recvStr, "\r\n\r\n")
-	if rnrnIndex <= 0 {
-		p1this.ParseStatus = ParseStatusNotHTTP
-		return firstMsgLen, goErrors.New("ParseStatusNotHTTP")
+	// 起始行前面的空行忽略（RFC 9112 2.2），比如客户端在上一个请求体后面多发的 \r\n
+	startIndex := 0
+	for bytes.HasPrefix(sli1recv[startIndex:], []byte("\r\n")) {
+		startIndex += 2
 	}
-	// 请求头长度等于 \r\n\r\n 的位置下标加上 \r\n\r\n 的长度
-	p1this.HeaderLength = uint32(rnrnIndex + 4)
-
-	// 找到 Content-Length 的位置
-	c7l6Index := strings.Index(recvStr, "Content-Length: ")
-	if c7l6Index > 0 {
-		// "Content-Length: "，16 个字节
-		t1recvStr := recvStr[c7l6Index+16:]
-		indexR := strings.IndexByte(t1recvStr, '\r')
-		// 截取 Content-Length 的字符串值
-		c7l6Str := t1recvStr[0:indexR]
-		c7l6Int, err := strconv.Atoi(c7l6Str)
-		if nil != err {
+
+	// 找到 \r\n\r\n 的位置，用这个位置可以分隔报文头和报文体
+	rnrnIndex := bytes.Index(sli1recv[startIndex:], []byte("\r\n\r\n"))
+	if rnrnIndex < 0 {
+		if recvLen > uint64(HeaderSizeMax) {
+			// 报文头太大了，不用再等了
 			p1this.ParseStatus = ParseStatusParseErr
-			return firstMsgLen, pkgErrors.WithMessage(err, "ParseStatusParseErr")
+			return firstMsgLen, pkgErrors.WithMessage(ErrHeaderTooLarge, "ParseStatusParseErr")
 		}
-		p1this.ContentLength = uint32(c7l6Int)
+		p1this.ParseStatus = ParseStatusNotHTTP
+		return firstMsgLen, goErrors.New("ParseStatusNotHTTP")
+	}
+	// 报文头长度等于 \r\n\r\n 的位置下标加上 \r\n\r\n 的长度
+	headerLength := startIndex + rnrnIndex + 4
+	if headerLength > HeaderSizeMax {
+		p1this.ParseStatus = ParseStatusParseErr
+		return firstMsgLen, pkgErrors.WithMessage(ErrHeaderTooLarge, "ParseStatusParseErr")
+	}
+	p1this.HeaderLength = uint32(headerLength)
+	if err := p1this.parseHeader(string(sli1recv[startIndex : headerLength-4])); nil != err {
+		p1this.ParseStatus = ParseStatusParseErr
+		return firstMsgLen, pkgErrors.WithMessage(err, "ParseStatusParseErr")
 	}
 
-	firstMsgLen = uint64(p1this.HeaderLength + p1this.ContentLength)
+	bodyLength, err := p1this.parseBodyLength(sli1recv[headerLength:])
+	if errChunkedIncomplete == err || errBodyUntilClose == err {
+		p1this.ParseStatus = ParseStatusIncomplete
+		return firstMsgLen, goErrors.New("ParseStatusIncomplete")
+	}
+	if nil != err {
+		p1this.ParseStatus = ParseStatusParseErr
+		return firstMsgLen, pkgErrors.WithMessage(err, "ParseStatusParseErr")
+	}
+
+	firstMsgLen = uint64(headerLength) + bodyLength
 	if firstMsgLen > recvLen {
 		// 计算出来的报文长度大于接收缓冲区中数据长度
 		p1this.ParseStatus = ParseStatusIncomplete
 		return firstMsgLen, goErrors.New("ParseStatusIncomplete")
 	}
 
-	return uint64(firstMsgLen), nil
+	return firstMsgLen, nil
 }
 
-// Protocol.Decode
+// Clone 复制一份，请求报文指向接收缓冲区，需要复制。chunked 解码或者解压之后的请求体是新分配的，可以共用
+func (p1this *HTTP) Clone() *HTTP {
+	t1http := *p1this
+	t1http.Sli1Msg = append([]byte(nil), p1this.Sli1Msg...)
+	if !p1this.isBodyCopied {
+		t1http.Sli1Body = t1http.Sli1Msg[p1this.HeaderLength:]
+	}
+	return &t1http
+}
+
+// Protocol.Decode，报文头在 FirstMsgLength 中已经解析过了
 func (p1this *HTTP) Decode(sli1msg []byte) error {
 	p1this.Sli1Msg = sli1msg
-	msg := string(p1this.Sli1Msg)
-	header := msg[0:p1this.HeaderLength]
-	body := msg[p1this.HeaderLength:]
-	p1this.parseHeader(header)
-	p1this.parseBody(body)
+	// 保持连接的时候协议实例是复用的，上一条请求解析出来的数据要清掉
+	p1this.MapQuery = nil
+	p1this.MapBody = nil
+	p1this.MapTrailer = nil
+	p1this.resetResponse()
+	p1this.MapQuery = parseValues(p1this.RawQuery)
+	if p1this.IsChunked {
+		// FirstMsgLength 已经检查过格式了
+		_, p1this.Sli1Body, p1this.MapTrailer, _ = parseChunked(p1this.Sli1Msg[p1this.HeaderLength:], true)
+	} else {
+		p1this.Sli1Body = p1this.Sli1Msg[p1this.HeaderLength:]
+	}
+	p1this.isBodyCopied = p1this.IsChunked
+	if err := p1this.decompressBody(); nil != err {
+		return err
+	}
+	p1this.parseBody(string(p1this.Sli1Body))
 
 	return nil
 }
 
-// Protocol.Encode
+// DecodeRequest 用已经解析出来的请求方法、请求目标、请求头和请求体解码请求，解码之后和 Decode 的一样用。
+// 用于 HTTP/2 这种不是文本格式的协议，mapHeader 的键名必须是小写，sli1body 不会被复制
+func (p1this *HTTP) DecodeRequest(method string, uri string, version string, mapHeader map[string][]string, sli1body []byte) error {
+	p1this.Method, p1this.Uri, p1this.Version = method, uri, version
+	p1this.Path, p1this.RawQuery = "", ""
+	p1this.StatusCode, p1this.Reason = 0, ""
+	if err := p1this.parseTarget(uri); nil != err {
+		return err
+	}
+	p1this.MapHeader = mapHeader
+	p1this.HeaderLength = 0
+	p1this.ContentLength = uint32(len(sli1body))
+	p1this.IsChunked = false
+	p1this.Sli1Msg = nil
+	p1this.MapQuery = parseValues(p1this.RawQuery)
+	p1this.MapBody = nil
+	p1this.MapTrailer = nil
+	p1this.resetResponse()
+	p1this.Sli1Body = sli1body
+	p1this.isBodyCopied = true
+	if err := p1this.decompressBody(); nil != err {
+		return err
+	}
+	p1this.parseBody(string(p1this.Sli1Body))
+	return nil
+}
+
+// SetResponse 设置这条请求的响应，之后用空数据调用 SendMsg 或者 SendResponse，就会通过 Encode 发送。
+// 设置的时候就按这条请求构造好响应报文（详见 EncodeResponse），之后再修改 p1response 不会生效。
+// 没有 worker pool 的时候，协议实例在连接上是复用的，下一条请求解码的时候会清掉，所以要在 OnConnRequest 返回之前调用。
+// 要在 OnConnRequest 返回之后异步响应的，先用 Clone 复制请求，之后用复制的实例 EncodeResponse，再用 SendResponse 发送构造好的报文
+func (p1this *HTTP) SetResponse(p1response *Response) {
+	p1this.p1response = p1response
+	p1this.sli1response, p1this.errResponse = p1this.EncodeResponse(p1response)
+}
+
+func (p1this *HTTP) GetResponse() *Response {
+	return p1this.p1response
+}
+
+// SetCompressConfig 设置响应压缩的配置，设置之后 Encode 按请求的 Accept-Encoding 压缩响应，为 nil 时不压缩。
+// 保持连接的时候协议实例是复用的，连接建立的时候设置一次就行
+func (p1this *HTTP) SetCompressConfig(p1config *CompressConfig) {
+	p1this.p1compressConfig = p1config
+}
+
+// Protocol.Encode，返回 SetResponse 的时候构造好的响应报文
 func (p1this *HTTP) Encode() ([]byte, error) {
-	return []byte{}, nil
-}
-
-// parseHeader 解析请求头
-func (p1this *HTTP) parseHeader(header string) {
-	p1this.MapHeader = make(map[string]string, 2)
-	sli1header := strings.Split(header, "\r\n")
-	firstLine := sli1header[0]
-	// 第 1 行
-	sli1firstLine := strings.Split(firstLine, " ")
-	p1this.Method = sli1firstLine[0]
-	p1this.Uri = sli1firstLine[1]
-	p1this.Version = sli1firstLine[2]
-	p1this.parseQuery(p1this.Uri)
-	// 剩下的行
-	for _, val := range sli1header[1:] {
-		// 用 ": " 切成键值
-		sli1kv := strings.Split(val, ": ")
-		if 2 == len(sli1kv) {
-			// 键名全部转成小写
-			p1this.MapHeader[strings.ToLower(sli1kv[0])] = sli1kv[1]
-		}
+	if nil == p1this.p1response {
+		return nil, ErrNoResponse
 	}
+	return p1this.sli1response, p1this.errResponse
 }
 
-// parseQuery 解析查询参数
-func (p1this *HTTP) parseQuery(uri string) {
-	index := strings.Index(uri, "?")
-	if index > 0 {
-		// 有 "?"
-		p1this.Uri = uri[:index]
-		query := uri[index+1:]
-		if "" != query {
-			// 有查询参数
-			p1this.MapQuery = make(map[string]string)
-			sli1query := strings.Split(query, "&")
-			for _, val := range sli1query {
-				arr1kv := strings.Split(val, "=")
-				if 2 == len(arr1kv) {
-					p1this.MapQuery[strings.ToLower(arr1kv[0])] = arr1kv[1]
-				}
-			}
+// EncodeResponse 按这条请求构造响应报文，用 SendResponse 发送。
+// 没有设置 Connection 的，按请求补上：不保持连接的回复 close，HTTP/1.0 保持连接的回复 keep-alive。HEAD 请求的响应不发送响应体。
+// 设置了 SetCompressConfig 的，按请求的 Accept-Encoding 压缩响应体
+func (p1this *HTTP) EncodeResponse(p1response *Response) ([]byte, error) {
+	if nil != p1this.p1compressConfig && "" != p1this.Method {
+		if err := p1response.Compress(p1this.GetHeader("accept-encoding"), p1this.p1compressConfig); nil != err {
+			return nil, err
 		}
 	}
+	if "" != p1this.Method && "" == p1response.GetHeader("Connection") {
+		if !p1this.IsKeepAlive() {
+			p1response.SetHeader("Connection", "close")
+		} else if "HTTP/1.0" == p1this.Version {
+			p1response.SetHeader("Connection", "keep-alive")
+		}
+	}
+	return p1response.encode("HEAD" == p1this.Method), nil
+}
+
+// resetResponse 清掉上一条请求的响应
+func (p1this *HTTP) resetResponse() {
+	p1this.p1response = nil
+	p1this.sli1response = nil
+	p1this.errResponse = nil
 }
 
-// parseBody 解析请求体
-func (p1this *HTTP) parseBody(body string) {
-	c7t4, ok := p1this.MapHeader["content-type"]
-	if ok {
-		switch c7t4 {
-		case StrXWWWFormUrlencoded:
-			p1this.MapBody = make(map[string]string)
-			sli1Body := strings.Split(body, "&")
-			for _, val := range sli1Body {
-				arr1kv := strings.Split(val, "=")
-				if 2 == len(arr1kv) {
-					p1this.MapBody[strings.ToLower(arr1kv[0])] = arr1kv[1]
-				}
+// GetHeader 获取头字段的第 1 个值，键名不区分大小写，没有的时候返回空字符串
+func (p1this *HTTP) GetHeader(key string) string {
+	sli1value := p1this.MapHeader[strings.ToLower(key)]
+	if 0 == len(sli1value) {
+		return ""
+	}
+	return sli1value[0]
+}
+
+// GetHeaderValues 获取头字段的所有值，键名不区分大小写
+func (p1this *HTTP) GetHeaderValues(key string) []string {
+	return p1this.MapHeader[strings.ToLower(key)]
+}
+
+// IsKeepAlive 处理完这条请求之后是不是保持连接。
+// HTTP/1.1 默认保持连接，除非请求头有 "Connection: close"；HTTP/1.0 默认不保持连接，除非请求头有 "Connection: keep-alive"。
+func (p1this *HTTP) IsKeepAlive() bool {
+	isKeepAlive := "HTTP/1.0" != p1this.Version
+	for _, connection := range p1this.MapHeader["connection"] {
+		for _, token := range strings.Split(strings.ToLower(connection), ",") {
+			switch strings.TrimSpace(token) {
+			case "close":
+				return false
+			case "keep-alive":
+				isKeepAlive = true
 			}
 		}
 	}
+	return isKeepAlive
+}
+
+// parseValues 解析 "k=v&k=v" 形式的数据，键和值都要 URL 解码，键名保留大小写，同名的键有多个值。
+// 格式错误的键值对（比如 "%zz"）忽略，其他的照常解析
+func parseValues(data string) url.Values {
+	values, _ := url.ParseQuery(data)
+	return values
 }
@@ -0,0 +1,189 @@
+package http
+
+import (
+	"bytes"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// decodeRequest 用服务端的协议实例解析一条完整的请求
+func decodeRequest(t *testing.T, p1http *HTTP, raw string) {
+	t.Helper()
+	msgLen, err := p1http.FirstMsgLength([]byte(raw))
+	if nil != err {
+		t.Fatalf("FirstMsgLength(%q): %v", raw, err)
+	}
+	if int(msgLen) != len(raw) {
+		t.Fatalf("FirstMsgLength(%q) = %d, want %d", raw, msgLen, len(raw))
+	}
+	if err = p1http.Decode([]byte(raw)); nil != err {
+		t.Fatalf("Decode(%q): %v", raw, err)
+	}
+}
+
+func newTestResponse(body string) *Response {
+	resp := NewResponse()
+	resp.SetStatusCode(StatusOk)
+	resp.SetBody([]byte(body))
+	return resp
+}
+
+// TestSetResponseBoundToRequest 响应在 SetResponse 的时候按那条请求构造，下一条请求解码之后不会用错请求方法和版本
+func TestSetResponseBoundToRequest(t *testing.T) {
+	p1http := NewHTTP()
+	decodeRequest(t, p1http, "HEAD /a HTTP/1.0\r\nHost: x\r\n\r\n")
+	p1http.SetResponse(newTestResponse("hello"))
+	sli1head, err := p1http.Encode()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// 下一条请求解码之后，上一条的响应清掉了
+	decodeRequest(t, p1http, "GET /b HTTP/1.1\r\nHost: x\r\n\r\n")
+	if _, err = p1http.Encode(); ErrNoResponse != err {
+		t.Fatalf("Encode() after the next request = %v, want ErrNoResponse", err)
+	}
+	if !strings.HasSuffix(string(sli1head), "\r\n\r\n") || !strings.Contains(string(sli1head), "Content-Length: 5\r\n") {
+		t.Fatalf("HEAD response should have Content-Length but no body: %q", sli1head)
+	}
+	if !strings.Contains(string(sli1head), "Connection: close\r\n") {
+		t.Fatalf("HTTP/1.0 request without keep-alive should get Connection: close: %q", sli1head)
+	}
+
+	p1http.SetResponse(newTestResponse("hello"))
+	sli1get, err := p1http.Encode()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(sli1get), "\r\n\r\nhello") {
+		t.Fatalf("GET response should have the body: %q", sli1get)
+	}
+}
+
+// TestEncodeResponseOnClone 异步响应的时候用复制的请求构造响应，连接上的协议实例已经在解析后面的请求了
+func TestEncodeResponseOnClone(t *testing.T) {
+	p1http := NewHTTP()
+	decodeRequest(t, p1http, "HEAD /a HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	p1clone := p1http.Clone()
+	decodeRequest(t, p1http, "GET /b HTTP/1.0\r\nHost: x\r\nConnection: keep-alive\r\n\r\n")
+
+	sli1msg, err := p1clone.EncodeResponse(newTestResponse("hello"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(sli1msg, []byte("\r\n\r\n")) || !bytes.Contains(sli1msg, []byte("Connection: close\r\n")) {
+		t.Fatalf("response of the cloned HEAD request = %q", sli1msg)
+	}
+	sli1msg, err = p1http.EncodeResponse(newTestResponse("hello"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(sli1msg, []byte("hello")) || !bytes.Contains(sli1msg, []byte("Connection: keep-alive\r\n")) {
+		t.Fatalf("response of the GET request = %q", sli1msg)
+	}
+}
+
+// TestDecodeValues 查询参数和表单都 URL 解码，键名保留大小写，同名的键保留所有的值
+func TestDecodeValues(t *testing.T) {
+	sli1test := []struct {
+		name    string
+		data    string
+		mapWant url.Values
+	}{
+		{"empty", "", url.Values{}},
+		{"decoded", "name=a%20b&c=d+e", url.Values{"name": {"a b"}, "c": {"d e"}}},
+		{"repeated keys", "tag=x&tag=y&tag=", url.Values{"tag": {"x", "y", ""}}},
+		{"key case kept", "Name=a&name=b", url.Values{"Name": {"a"}, "name": {"b"}}},
+		{"encoded key", "a%26b=1", url.Values{"a&b": {"1"}}},
+		{"no value", "a&b=", url.Values{"a": {""}, "b": {""}}},
+		{"equals in value", "a=1=2", url.Values{"a": {"1=2"}}},
+		{"empty pairs skipped", "&&a=1&", url.Values{"a": {"1"}}},
+		{"bad pair skipped", "a=%zz&b=1", url.Values{"b": {"1"}}},
+		{"semicolon pair skipped", "a=1;b=2&c=3", url.Values{"c": {"3"}}},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			// 查询参数
+			p1http := NewHTTP()
+			decodeRequest(t, p1http, "GET /q?"+t1test.data+" HTTP/1.1\r\nHost: x\r\n\r\n")
+			if !reflect.DeepEqual(t1test.mapWant, p1http.MapQuery) {
+				t.Fatalf("MapQuery = %v, want %v", p1http.MapQuery, t1test.mapWant)
+			}
+			// 表单
+			p1http = NewHTTP()
+			decodeRequest(t, p1http, "POST /f HTTP/1.1\r\nHost: x\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: "+
+				strconv.Itoa(len(t1test.data))+"\r\n\r\n"+t1test.data)
+			if !reflect.DeepEqual(t1test.mapWant, p1http.MapBody) {
+				t.Fatalf("MapBody = %v, want %v", p1http.MapBody, t1test.mapWant)
+			}
+		})
+	}
+}
+
+// TestDecodeValuesReset 保持连接的时候协议实例是复用的，上一条请求的查询参数和表单不能留到下一条
+func TestDecodeValuesReset(t *testing.T) {
+	p1http := NewHTTP()
+	decodeRequest(t, p1http, "POST /a?x=1 HTTP/1.1\r\nHost: x\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 3\r\n\r\ny=2")
+	if "1" != p1http.MapQuery.Get("x") || "2" != p1http.MapBody.Get("y") {
+		t.Fatalf("MapQuery = %v, MapBody = %v", p1http.MapQuery, p1http.MapBody)
+	}
+	decodeRequest(t, p1http, "GET /b HTTP/1.1\r\nHost: x\r\n\r\n")
+	if 0 != len(p1http.MapQuery) || nil != p1http.MapBody || "/b" != p1http.Path || "" != p1http.RawQuery {
+		t.Fatalf("MapQuery = %v, MapBody = %v, Path = %q, RawQuery = %q", p1http.MapQuery, p1http.MapBody, p1http.Path, p1http.RawQuery)
+	}
+	// 不是表单的请求体不解析
+	decodeRequest(t, p1http, "POST /c HTTP/1.1\r\nHost: x\r\nContent-Type: text/plain\r\nContent-Length: 3\r\n\r\ny=2")
+	if nil != p1http.MapBody {
+		t.Fatalf("MapBody of text/plain = %v", p1http.MapBody)
+	}
+}
+
+// TestDecodeRequestTarget HTTP/2 用 DecodeRequest 解码，路径和查询参数和 HTTP/1.1 的一样解析
+func TestDecodeRequestTarget(t *testing.T) {
+	p1http := NewHTTP()
+	err := p1http.DecodeRequest("GET", "/a%20b?tag=x&tag=y", "HTTP/2.0", map[string][]string{}, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "/a b" != p1http.Path || "tag=x&tag=y" != p1http.RawQuery || !reflect.DeepEqual([]string{"x", "y"}, p1http.MapQuery["tag"]) {
+		t.Fatalf("Path = %q, RawQuery = %q, MapQuery = %v", p1http.Path, p1http.RawQuery, p1http.MapQuery)
+	}
+	if err = p1http.DecodeRequest("GET", "a%zz", "HTTP/2.0", map[string][]string{}, nil); ErrMalformedMsg != err {
+		t.Fatalf("DecodeRequest() with a bad target = %v, want ErrMalformedMsg", err)
+	}
+}
+
+// TestEncodeWithHost 没有设置 Host 的时候用 defaultHost，不修改请求
+func TestEncodeWithHost(t *testing.T) {
+	sli1test := []struct {
+		name        string
+		host        string
+		defaultHost string
+		want        string
+	}{
+		{"default host", "", "example.com:8080", "Host: example.com:8080\r\n"},
+		{"host set", "a.com", "example.com", "Host: a.com\r\n"},
+		{"no host", "", "", ""},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1request := NewRequest("GET", "/")
+			if "" != t1test.host {
+				p1request.SetHeader("Host", t1test.host)
+			}
+			sli1msg := string(p1request.EncodeWithHost(t1test.defaultHost))
+			if want := "GET / HTTP/1.1\r\n" + t1test.want; !strings.HasPrefix(sli1msg, want) {
+				t.Fatalf("EncodeWithHost() = %q, want prefix %q", sli1msg, want)
+			}
+			if "" == t1test.want && strings.Contains(sli1msg, "Host:") {
+				t.Fatalf("EncodeWithHost() = %q, want no Host", sli1msg)
+			}
+			if t1test.host != p1request.GetHeader("Host") {
+				t.Fatalf("request Host = %q, want %q", p1request.GetHeader("Host"), t1test.host)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package http
+
+import (
+	goErrors "errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// HeaderSizeMax 报文头（起始行加上所有的头字段）最多多少字节，超过的回复 431
+	HeaderSizeMax int = 16 * 1024
+	// HeaderNumMax 报文头最多多少个头字段，超过的回复 431
+	HeaderNumMax int = 100
+)
+
+var (
+	// ErrMalformedMsg 报文格式错误，回复 400
+	ErrMalformedMsg = goErrors.New("malformed HTTP message")
+	// ErrHeaderTooLarge 报文头太大或者头字段太多，回复 431
+	ErrHeaderTooLarge = goErrors.New("HTTP header too large")
+	// ErrAmbiguousLength 报文长度有歧义（Content-Length 和 Transfer-Encoding 同时存在，或者多个不同的 Content-Length），回复 400。
+	// 前后两个服务对报文长度的理解不一样，可以被用来走私请求，所以直接拒绝
+	ErrAmbiguousLength = goErrors.New("ambiguous HTTP message length")
+	// ErrVersionNotSupported HTTP 版本不是 1.x，回复 505
+	ErrVersionNotSupported = goErrors.New("HTTP version not supported")
+	// ErrTransferCodingNotImplemented Transfer-Encoding 中有 chunked 以外的编码（比如 "gzip, chunked"），回复 501
+	ErrTransferCodingNotImplemented = goErrors.New("HTTP transfer coding not implemented")
+
+	// errBodyUntilClose 响应没有 Content-Length 和 Transfer-Encoding，响应体到连接关闭为止（RFC 9112 6.3）
+	errBodyUntilClose = goErrors.New("HTTP body until close")
+)
+
+// parseHeader 解析报文头，header 是起始行和头字段，用 "\r\n" 分隔，不包括结束的空行。
+// 起始行以 "HTTP/" 开头的是响应（状态行），否则是请求（请求行）。头字段的键名全部转成小写，同名的头字段有多个值。
+func (p1this *HTTP) parseHeader(header string) error {
+	sli1line := strings.Split(header, "\r\n")
+	if len(sli1line)-1 > HeaderNumMax {
+		return ErrHeaderTooLarge
+	}
+	if err := p1this.parseStartLine(sli1line[0]); nil != err {
+		return err
+	}
+
+	p1this.MapHeader = make(map[string][]string, len(sli1line)-1)
+	for _, line := range sli1line[1:] {
+		if "" == line || ' ' == line[0] || '\t' == line[0] {
+			// 以空白开头的是 obs-fold（一个头字段折成多行），RFC 9112 已经废弃，直接拒绝
+			return ErrMalformedMsg
+		}
+		// 键名和冒号之间不能有空白，值前后的空白（OWS）去掉
+		index := strings.IndexByte(line, ':')
+		if index <= 0 || !isToken(line[:index]) {
+			return ErrMalformedMsg
+		}
+		value := strings.Trim(line[index+1:], " \t")
+		if !isFieldValue(value) {
+			return ErrMalformedMsg
+		}
+		key := strings.ToLower(line[:index])
+		p1this.MapHeader[key] = append(p1this.MapHeader[key], value)
+	}
+	if len(p1this.MapHeader["host"]) > 1 {
+		return ErrMalformedMsg
+	}
+	if !p1this.isClientSide && "HTTP/1.0" != p1this.Version && 0 == len(p1this.MapHeader["host"]) {
+		// HTTP/1.1 的请求必须有 Host（RFC 9112 3.2）
+		return ErrMalformedMsg
+	}
+	return nil
+}
+
+// parseStartLine 解析起始行。请求行：方法 SP 请求目标 SP 版本；状态行：版本 SP 状态码 SP [原因短语]
+func (p1this *HTTP) parseStartLine(line string) error {
+	p1this.Method, p1this.Uri, p1this.Version = "", "", ""
+	p1this.Path, p1this.RawQuery = "", ""
+	p1this.StatusCode, p1this.Reason = 0, ""
+
+	if p1this.isClientSide != strings.HasPrefix(line, "HTTP/") {
+		// 客户端只接收响应，服务端只接收请求
+		return ErrMalformedMsg
+	}
+	if p1this.isClientSide {
+		sli1field := strings.SplitN(line, " ", 3)
+		if len(sli1field) < 2 || 3 != len(sli1field[1]) {
+			return ErrMalformedMsg
+		}
+		if err := checkVersion(sli1field[0]); nil != err {
+			return err
+		}
+		statusCode, err := strconv.ParseUint(sli1field[1], 10, 16)
+		if nil != err || statusCode < 100 {
+			return ErrMalformedMsg
+		}
+		p1this.Version = sli1field[0]
+		p1this.StatusCode = uint16(statusCode)
+		if 3 == len(sli1field) {
+			p1this.Reason = sli1field[2]
+		}
+		return nil
+	}
+
+	sli1field := strings.Split(line, " ")
+	if 3 != len(sli1field) || !isToken(sli1field[0]) || !isRequestTarget(sli1field[1]) {
+		return ErrMalformedMsg
+	}
+	if err := checkVersion(sli1field[2]); nil != err {
+		return err
+	}
+	p1this.Method = sli1field[0]
+	p1this.Uri = sli1field[1]
+	p1this.Version = sli1field[2]
+	return p1this.parseTarget(p1this.Uri)
+}
+
+// parseTarget 解析请求目标，分成 URL 解码之后的路径和原始的查询参数。
+// 一般是 origin-form（"/path?query"），也支持代理用的 absolute-form、OPTIONS 的 "*" 和 CONNECT 的 authority-form（没有路径）
+func (p1this *HTTP) parseTarget(target string) error {
+	if "*" == target {
+		p1this.Path = target
+		return nil
+	}
+	if "CONNECT" == p1this.Method {
+		return nil
+	}
+	p1url, err := url.ParseRequestURI(target)
+	if nil != err {
+		return ErrMalformedMsg
+	}
+	p1this.Path = p1url.Path
+	p1this.RawQuery = p1url.RawQuery
+	return nil
+}
+
+// checkVersion 检查版本，格式是 HTTP/数字.数字，只支持 1.x
+func checkVersion(version string) error {
+	if 8 != len(version) || !strings.HasPrefix(version, "HTTP/") || '.' != version[6] ||
+		!isDigit(version[5]) || !isDigit(version[7]) {
+		return ErrMalformedMsg
+	}
+	if '1' != version[5] {
+		return ErrVersionNotSupported
+	}
+	return nil
+}
+
+// parseBodyLength 根据 Transfer-Encoding 和 Content-Length 计算报文体在 sli1body 中的长度。
+// chunked 编码的要解析完所有的块才知道在哪里结束，没接收完的时候返回 errChunkedIncomplete。
+// 没有长度的响应，响应体到连接关闭为止，返回 errBodyUntilClose。
+func (p1this *HTTP) parseBodyLength(sli1body []byte) (uint64, error) {
+	p1this.ContentLength = 0
+	p1this.IsChunked = false
+	p1this.isUntilClose = false
+
+	if p1this.isClientSide && (p1this.StatusCode < 200 || StatusNoContent == p1this.StatusCode ||
+		StatusNotModified == p1this.StatusCode || "HEAD" == p1this.p1requestQueue.front()) {
+		// 1xx、204、304 和 HEAD 请求的响应没有响应体，有 Content-Length 和 Transfer-Encoding 也不管（RFC 9112 6.3）
+		return 0, nil
+	}
+
+	sli1te := p1this.MapHeader["transfer-encoding"]
+	sli1cl := p1this.MapHeader["content-length"]
+	if len(sli1te) > 0 {
+		if len(sli1cl) > 0 {
+			return 0, ErrAmbiguousLength
+		}
+		if "HTTP/1.0" == p1this.Version {
+			// HTTP/1.0 没有 Transfer-Encoding
+			return 0, ErrAmbiguousLength
+		}
+		if err := checkTransferEncoding(sli1te); nil != err {
+			return 0, err
+		}
+		p1this.IsChunked = true
+		bodyLength, _, _, err := parseChunked(sli1body, false)
+		return uint64(bodyLength), err
+	}
+
+	if p1this.isClientSide && 0 == len(sli1cl) {
+		p1this.isUntilClose = true
+		return 0, errBodyUntilClose
+	}
+	if len(sli1cl) > 0 {
+		contentLength, err := parseContentLength(sli1cl)
+		if nil != err {
+			return 0, err
+		}
+		p1this.ContentLength = contentLength
+	}
+	return uint64(p1this.ContentLength), nil
+}
+
+// parseContentLength 解析 Content-Length，有多个（或者一个值里用逗号分隔了多个）的时候必须都一样
+func parseContentLength(sli1value []string) (uint32, error) {
+	contentLength := ""
+	for _, value := range sli1value {
+		for _, t1value := range strings.Split(value, ",") {
+			t1value = strings.Trim(t1value, " \t")
+			if "" != contentLength && t1value != contentLength {
+				return 0, ErrAmbiguousLength
+			}
+			contentLength = t1value
+		}
+	}
+	if "" == contentLength {
+		return 0, ErrMalformedMsg
+	}
+	for i := 0; i < len(contentLength); i++ {
+		if !isDigit(contentLength[i]) {
+			return 0, ErrMalformedMsg
+		}
+	}
+	t1contentLength, err := strconv.ParseUint(contentLength, 10, 32)
+	if nil != err {
+		return 0, ErrMalformedMsg
+	}
+	return uint32(t1contentLength), nil
+}
+
+// isToken 是不是 token（方法名、头字段的键名），RFC 9110 5.6.2
+func isToken(token string) bool {
+	if "" == token {
+		return false
+	}
+	for i := 0; i < len(token); i++ {
+		char := token[i]
+		if isDigit(char) || ('a' <= char && char <= 'z') || ('A' <= char && char <= 'Z') {
+			continue
+		}
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(char)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isRequestTarget 请求目标不能为空，不能有空白和控制字符
+func isRequestTarget(target string) bool {
+	if "" == target {
+		return false
+	}
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || 0x7f == target[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isFieldValue 头字段的值不能有控制字符（HTAB 除外），防止 CR、LF、NUL 混进去
+func isFieldValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if (value[i] < ' ' && '\t' != value[i]) || 0x7f == value[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isDigit 是不是数字
+func isDigit(char byte) bool {
+	return '0' <= char && char <= '9'
+}
@@ -0,0 +1,166 @@
+package http
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestParseRequest 服务端解析请求，格式错误的按 ParseErrResponse 回复对应的状态码，0 表示解析成功
+func TestParseRequest(t *testing.T) {
+	sli1test := []struct {
+		name       string
+		raw        string
+		statusCode uint16
+		body       string
+	}{
+		{"get", "GET /a?b=c HTTP/1.1\r\nHost: x\r\n\r\n", 0, ""},
+		{"leading empty lines", "\r\n\r\nGET / HTTP/1.1\r\nHost: x\r\n\r\n", 0, ""},
+		{"content length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello", 0, "hello"},
+		{"chunked", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", 0, "hello"},
+		{"chunked case insensitive", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: Chunked\r\n\r\n0\r\n\r\n", 0, ""},
+		{"chunked with empty list elements", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: , chunked,\r\n\r\n0\r\n\r\n", 0, ""},
+		{"same content length twice", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello", 0, "hello"},
+		{"same content length in a list", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5, 5\r\n\r\nhello", 0, "hello"},
+		{"http/1.0 without host", "GET / HTTP/1.0\r\n\r\n", 0, ""},
+
+		// Host
+		{"http/1.1 without host", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\n", StatusBadRequest, ""},
+		{"two hosts", "GET / HTTP/1.1\r\nHost: x\r\nHost: y\r\n\r\n", StatusBadRequest, ""},
+
+		// 请求走私：报文长度有歧义的都拒绝
+		{"content length and transfer encoding", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", StatusBadRequest, ""},
+		{"transfer encoding and content length", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nContent-Length: 0\r\n\r\n0\r\n\r\n", StatusBadRequest, ""},
+		{"different content lengths", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!", StatusBadRequest, ""},
+		{"different content lengths in a list", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5, 6\r\n\r\nhello!", StatusBadRequest, ""},
+		{"signed content length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: +5\r\n\r\nhello", StatusBadRequest, ""},
+		{"empty content length", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: \r\n\r\n", StatusBadRequest, ""},
+		{"content length overflow", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 99999999999\r\n\r\n", StatusBadRequest, ""},
+		{"obs-fold", "GET / HTTP/1.1\r\nHost: x\r\nX-A: a\r\n b\r\n\r\n", StatusBadRequest, ""},
+		{"obs-fold with tab", "GET / HTTP/1.1\r\nHost: x\r\nX-A: a\r\n\tb\r\n\r\n", StatusBadRequest, ""},
+		{"obs-fold transfer encoding", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding:\r\n chunked\r\n\r\n0\r\n\r\n", StatusBadRequest, ""},
+		{"space before colon", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n", StatusBadRequest, ""},
+		{"chunked not last", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked, gzip\r\n\r\n0\r\n\r\n", StatusBadRequest, ""},
+		{"chunked twice", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n", StatusBadRequest, ""},
+		{"chunked twice in two fields", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", StatusBadRequest, ""},
+		{"unknown transfer coding", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: identity\r\n\r\n", StatusBadRequest, ""},
+		{"transfer encoding in http/1.0", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", StatusBadRequest, ""},
+
+		// chunked 以外的编码
+		{"gzip then chunked", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", StatusNotImplemented, ""},
+		{"gzip then chunked in two fields", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", StatusNotImplemented, ""},
+
+		// 起始行和头字段
+		{"http/2.0", "GET / HTTP/2.0\r\nHost: x\r\n\r\n", StatusHTTPVersionNotSupported, ""},
+		{"bad version", "GET / HTTP/1\r\nHost: x\r\n\r\n", StatusBadRequest, ""},
+		{"extra space in request line", "GET  / HTTP/1.1\r\nHost: x\r\n\r\n", StatusBadRequest, ""},
+		{"response on the service side", "HTTP/1.1 200 OK\r\nHost: x\r\n\r\n", StatusBadRequest, ""},
+		{"bad header name", "GET / HTTP/1.1\r\nHost: x\r\nX(A): a\r\n\r\n", StatusBadRequest, ""},
+		{"nul in header value", "GET / HTTP/1.1\r\nHost: x\r\nX-A: a\x00b\r\n\r\n", StatusBadRequest, ""},
+		{"too many headers", "GET / HTTP/1.1\r\nHost: x\r\n" + strings.Repeat("X-A: a\r\n", HeaderNumMax) + "\r\n", StatusRequestHeaderFieldsTooLarge, ""},
+		{"header too large", "GET / HTTP/1.1\r\nHost: x\r\nX-A: " + strings.Repeat("a", HeaderSizeMax) + "\r\n\r\n", StatusRequestHeaderFieldsTooLarge, ""},
+		{"malformed chunk size", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n\r\n", StatusBadRequest, ""},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1http := NewHTTP()
+			msgLen, err := p1http.FirstMsgLength([]byte(t1test.raw))
+			if 0 != t1test.statusCode {
+				if nil == err {
+					t.Fatalf("FirstMsgLength() = %d, want an error", msgLen)
+				}
+				if ParseStatusParseErr != p1http.ParseStatus {
+					t.Fatalf("ParseStatus = %d, want ParseStatusParseErr (%v)", p1http.ParseStatus, err)
+				}
+				if statusCode := ParseErrResponse(err).GetStatusCode(); t1test.statusCode != statusCode {
+					t.Fatalf("status code = %d, want %d (%v)", statusCode, t1test.statusCode, err)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("FirstMsgLength(): %v", err)
+			}
+			if int(msgLen) != len(t1test.raw) {
+				t.Fatalf("FirstMsgLength() = %d, want %d", msgLen, len(t1test.raw))
+			}
+			if err = p1http.Decode([]byte(t1test.raw)); nil != err {
+				t.Fatalf("Decode(): %v", err)
+			}
+			if t1test.body != string(p1http.Sli1Body) {
+				t.Fatalf("body = %q, want %q", p1http.Sli1Body, t1test.body)
+			}
+		})
+	}
+}
+
+// TestParseRequestIncomplete 没接收完的请求，等后面的数据，不是解析出错
+func TestParseRequestIncomplete(t *testing.T) {
+	sli1raw := []string{
+		"",
+		"GET / HTTP/1.1\r\nHost: x\r\n",
+		"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhell",
+		"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel",
+		"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n",
+	}
+	for _, raw := range sli1raw {
+		p1http := NewHTTP()
+		if _, err := p1http.FirstMsgLength([]byte(raw)); nil == err || ParseStatusParseErr == p1http.ParseStatus {
+			t.Errorf("FirstMsgLength(%q) = %v, status %d, want incomplete", raw, err, p1http.ParseStatus)
+		}
+	}
+}
+
+// TestParsePipelined 一次收到多条请求，FirstMsgLength 只返回第一条的长度
+func TestParsePipelined(t *testing.T) {
+	first := "POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 2\r\n\r\nab"
+	second := "GET /b HTTP/1.1\r\nHost: x\r\n\r\n"
+	p1http := NewHTTP()
+	msgLen, err := p1http.FirstMsgLength([]byte(first + second))
+	if nil != err || int(msgLen) != len(first) {
+		t.Fatalf("FirstMsgLength() = %d, %v, want %d", msgLen, err, len(first))
+	}
+}
+
+// TestParseTarget 请求目标分成 URL 解码之后的路径和原始的查询参数，Uri 原样保留
+func TestParseTarget(t *testing.T) {
+	sli1test := []struct {
+		name     string
+		method   string
+		target   string
+		isErr    bool
+		path     string
+		rawQuery string
+	}{
+		{"origin form", "GET", "/a/b", false, "/a/b", ""},
+		{"with query", "GET", "/a?x=1&y=2", false, "/a", "x=1&y=2"},
+		{"empty query", "GET", "/a?", false, "/a", ""},
+		{"percent encoded path", "GET", "/a%20b/%E4%B8%AD", false, "/a b/中", ""},
+		{"encoded slash decoded", "GET", "/a%2Fb", false, "/a/b", ""},
+		{"query not decoded", "GET", "/a?name=a%20b", false, "/a", "name=a%20b"},
+		{"absolute form", "GET", "http://example.com/a?x=1", false, "/a", "x=1"},
+		{"asterisk form", "OPTIONS", "*", false, "*", ""},
+		{"authority form", "CONNECT", "example.com:443", false, "", ""},
+
+		{"relative path", "GET", "a/b", true, "", ""},
+		{"bad percent encoding", "GET", "/a%zz", true, "", ""},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			raw := t1test.method + " " + t1test.target + " HTTP/1.1\r\nHost: x\r\n\r\n"
+			p1http := NewHTTP()
+			_, err := p1http.FirstMsgLength([]byte(raw))
+			if t1test.isErr {
+				if nil == err || StatusBadRequest != ParseErrResponse(err).GetStatusCode() {
+					t.Fatalf("FirstMsgLength(%q) = %v, want 400", raw, err)
+				}
+				return
+			}
+			if nil != err {
+				t.Fatalf("FirstMsgLength(%q): %v", raw, err)
+			}
+			if t1test.target != p1http.Uri || t1test.path != p1http.Path || t1test.rawQuery != p1http.RawQuery {
+				t.Fatalf("Uri, Path, RawQuery = %q, %q, %q, want %q, %q, %q",
+					p1http.Uri, p1http.Path, p1http.RawQuery, t1test.target, t1test.path, t1test.rawQuery)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package http
+
+import (
+  "encoding/json"
+  "net/url"
+  "strconv"
+  "strings"
+)
+
+var (
+  // DefaultUserAgent 请求头 User-Agent 的默认值，为空时不发送
+  DefaultUserAgent = "tcp-service-go"
+)
+
+// Request 客户端发送的请求
+type Request struct {
+  // 请求头，按设置的顺序发送，同名的可以有多个
+  header
+  // method 请求方法
+  method string
+  // target 请求目标，一般是路径加查询参数，比如 "/api/user_name?id=1"
+  target string
+  // sli1body 请求体
+  sli1body []byte
+}
+
+// NewRequest 创建请求，target 是请求目标（比如 "/api/user_name?id=1"），为空时是 "/"。
+// 没有设置 Host 的时候，发送的时候用连接的地址，详见 client.TCPClient.Do
+func NewRequest(method string, target string) *Request {
+  if "" == target {
+    target = "/"
+  }
+  return &Request{
+    header: header{sli1field: make([]headerField, 0, 4)},
+    method: strings.ToUpper(method),
+    target: target,
+  }
+}
+
+func (p1this *Request) GetMethod() string {
+  return p1this.method
+}
+
+func (p1this *Request) GetTarget() string {
+  return p1this.target
+}
+
+// SetQuery 用 values 替换请求目标中的查询参数
+func (p1this *Request) SetQuery(values url.Values) {
+  path := p1this.target
+  if index := strings.IndexByte(path, '?'); index >= 0 {
+    path = path[:index]
+  }
+  if query := values.Encode(); "" != query {
+    path += "?" + query
+  }
+  p1this.target = path
+}
+
+// AddCookie 在 Cookie 请求头中添加一个 cookie，只发送名字和值，名字不合法的 cookie 忽略
+func (p1this *Request) AddCookie(p1cookie *Cookie) {
+  cookie := (&Cookie{Name: p1cookie.Name, Value: p1cookie.Value}).String()
+  if "" == cookie {
+    return
+  }
+  if old := p1this.GetHeader("Cookie"); "" != old {
+    cookie = old + "; " + cookie
+  }
+  p1this.SetHeader("Cookie", cookie)
+}
+
+// SetBody 设置请求体，contentType 为空时不设置 Content-Type
+func (p1this *Request) SetBody(contentType string, sli1body []byte) {
+  if "" != contentType {
+    p1this.SetHeader("Content-Type", contentType)
+  }
+  p1this.sli1body = sli1body
+}
+
+func (p1this *Request) GetBody() []byte {
+  return p1this.sli1body
+}
+
+// SetForm 请求体设置成 application/x-www-form-urlencoded 的表单
+func (p1this *Request) SetForm(values url.Values) {
+  p1this.SetBody(StrXWWWFormUrlencoded, []byte(values.Encode()))
+}
+
+// SetJSON 请求体设置成 v 的 JSON
+func (p1this *Request) SetJSON(v interface{}) error {
+  sli1body, err := json.Marshal(v)
+  if nil != err {
+    return err
+  }
+  p1this.SetBody(StrApplicationJSON, sli1body)
+  return nil
+}
+
+// Encode 构造请求报文。Content-Length 按请求体计算，设置过的会被忽略；没有设置 User-Agent 的时候自动添加。
+// HTTP/1.1 的请求必须有 Host，调用之前要设置好，或者用 EncodeWithHost
+func (p1this *Request) Encode() []byte {
+  return p1this.EncodeWithHost("")
+}
+
+// EncodeWithHost 和 Encode 一样，没有设置 Host 的时候用 defaultHost，不修改请求
+func (p1this *Request) EncodeWithHost(defaultHost string) []byte {
+  sli1msg := make([]byte, 0, 256+len(p1this.sli1body))
+  sli1msg = append(sli1msg, p1this.method...)
+  sli1msg = append(sli1msg, ' ')
+  sli1msg = append(sli1msg, headerReplacer.Replace(strings.ReplaceAll(p1this.target, " ", "%20"))...)
+  sli1msg = append(sli1msg, " HTTP/1.1\r\n"...)
+
+  // Host 放在最前面（RFC 9112 3.2）
+  host := p1this.GetHeader("Host")
+  if "" == host {
+    host = defaultHost
+  }
+  if "" != host {
+    sli1msg = appendHeaderField(sli1msg, "Host", host)
+  }
+  if "" != DefaultUserAgent && !p1this.hasHeader("User-Agent") {
+    sli1msg = appendHeaderField(sli1msg, "User-Agent", DefaultUserAgent)
+  }
+  sli1msg = p1this.appendFields(sli1msg, "Host", "Content-Length", "Transfer-Encoding")
+  if len(p1this.sli1body) > 0 || p1this.isBodyExpected() {
+    sli1msg = append(sli1msg, "Content-Length: "...)
+    sli1msg = strconv.AppendInt(sli1msg, int64(len(p1this.sli1body)), 10)
+    sli1msg = append(sli1msg, "\r\n"...)
+  }
+  sli1msg = append(sli1msg, "\r\n"...)
+  return append(sli1msg, p1this.sli1body...)
+}
+
+// isBodyExpected 这个方法一般带请求体，没有请求体的时候也发送 "Content-Length: 0"（RFC 9110 8.6）
+func (p1this *Request) isBodyExpected() bool {
+  return "POST" == p1this.method || "PUT" == p1this.method || "PATCH" == p1this.method
+}
+
+// IsIdempotent 请求是不是幂等的，幂等的请求在连接被对端关闭的时候可以重新发送（RFC 9110 9.2.2）
+func (p1this *Request) IsIdempotent() bool {
+  switch p1this.method {
+  case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+    return true
+  }
+  return false
+}
@@ -1,63 +1,441 @@
 package http
 
-import "fmt"
+import (
+  "errors"
+  goHttp "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+const (
+  // 状态码，RFC 9110 15 和 IANA 登记的
+  StatusContinue           uint16 = 100
+  StatusSwitchingProtocols uint16 = 101
+  StatusProcessing         uint16 = 102
+  StatusEarlyHints         uint16 = 103
+
+  StatusOk                   uint16 = 200
+  StatusCreated              uint16 = 201
+  StatusAccepted             uint16 = 202
+  StatusNonAuthoritativeInfo uint16 = 203
+  StatusNoContent            uint16 = 204
+  StatusResetContent         uint16 = 205
+  StatusPartialContent       uint16 = 206
+  StatusMultiStatus          uint16 = 207
+  StatusAlreadyReported      uint16 = 208
+  StatusIMUsed               uint16 = 226
+
+  StatusMultipleChoices   uint16 = 300
+  StatusMovedPermanently  uint16 = 301
+  StatusFound             uint16 = 302
+  StatusSeeOther          uint16 = 303
+  StatusNotModified       uint16 = 304
+  StatusUseProxy          uint16 = 305
+  StatusTemporaryRedirect uint16 = 307
+  StatusPermanentRedirect uint16 = 308
+
+  StatusBadRequest                  uint16 = 400
+  StatusUnauthorized                uint16 = 401
+  StatusPaymentRequired             uint16 = 402
+  StatusForbidden                   uint16 = 403
+  StatusNotFound                    uint16 = 404
+  StatusMethodNotAllowed            uint16 = 405
+  StatusNotAcceptable               uint16 = 406
+  StatusProxyAuthRequired           uint16 = 407
+  StatusRequestTimeout              uint16 = 408
+  StatusConflict                    uint16 = 409
+  StatusGone                        uint16 = 410
+  StatusLengthRequired              uint16 = 411
+  StatusPreconditionFailed          uint16 = 412
+  StatusContentTooLarge             uint16 = 413
+  StatusURITooLong                  uint16 = 414
+  StatusUnsupportedMediaType        uint16 = 415
+  StatusRangeNotSatisfiable         uint16 = 416
+  StatusExpectationFailed           uint16 = 417
+  StatusTeapot                      uint16 = 418
+  StatusMisdirectedRequest          uint16 = 421
+  StatusUnprocessableContent        uint16 = 422
+  StatusLocked                      uint16 = 423
+  StatusFailedDependency            uint16 = 424
+  StatusTooEarly                    uint16 = 425
+  StatusUpgradeRequired             uint16 = 426
+  StatusPreconditionRequired        uint16 = 428
+  StatusTooManyRequests             uint16 = 429
+  StatusRequestHeaderFieldsTooLarge uint16 = 431
+  StatusUnavailableForLegalReasons  uint16 = 451
+
+  StatusInternalServerError           uint16 = 500
+  StatusNotImplemented                uint16 = 501
+  StatusBadGateway                    uint16 = 502
+  StatusServiceUnavailable            uint16 = 503
+  StatusGatewayTimeout                uint16 = 504
+  StatusHTTPVersionNotSupported       uint16 = 505
+  StatusVariantAlsoNegotiates         uint16 = 506
+  StatusInsufficientStorage           uint16 = 507
+  StatusLoopDetected                  uint16 = 508
+  StatusNotExtended                   uint16 = 510
+  StatusNetworkAuthenticationRequired uint16 = 511
+)
 
 const (
-  // 状态码
-  StatusOk                  uint16 = 200
-  StatusBadRequest          uint16 = 400
-  StatusNotFound            uint16 = 404
-  StatusInternalServerError uint16 = 500
+  // Cookie 的 SameSite 属性
+  SameSiteDefaultMode = goHttp.SameSiteDefaultMode
+  SameSiteLaxMode     = goHttp.SameSiteLaxMode
+  SameSiteStrictMode  = goHttp.SameSiteStrictMode
+  SameSiteNoneMode    = goHttp.SameSiteNoneMode
 )
 
 var (
+  // ErrChunkedWriterClosed ChunkedWriter 已经结束了，不能再发送
+  ErrChunkedWriterClosed = errors.New("chunked writer is closed.")
+
+  // DefaultServer 响应头 Server 的默认值，为空时不发送
+  DefaultServer = "tcp-service-go"
+  // DefaultContentType 有响应体但是没有设置 Content-Type 的时候用的默认值
+  DefaultContentType = "text/plain; charset=utf-8"
+
   // 状态码的文案
   statusText = map[uint16]string{
-    StatusOk:                  "OK",
-    StatusBadRequest:          "Bad Request",
-    StatusNotFound:            "Not Found",
-    StatusInternalServerError: "Internal Server Error",
+    StatusContinue:           "Continue",
+    StatusSwitchingProtocols: "Switching Protocols",
+    StatusProcessing:         "Processing",
+    StatusEarlyHints:         "Early Hints",
+
+    StatusOk:                   "OK",
+    StatusCreated:              "Created",
+    StatusAccepted:             "Accepted",
+    StatusNonAuthoritativeInfo: "Non-Authoritative Information",
+    StatusNoContent:            "No Content",
+    StatusResetContent:         "Reset Content",
+    StatusPartialContent:       "Partial Content",
+    StatusMultiStatus:          "Multi-Status",
+    StatusAlreadyReported:      "Already Reported",
+    StatusIMUsed:               "IM Used",
+
+    StatusMultipleChoices:   "Multiple Choices",
+    StatusMovedPermanently:  "Moved Permanently",
+    StatusFound:             "Found",
+    StatusSeeOther:          "See Other",
+    StatusNotModified:       "Not Modified",
+    StatusUseProxy:          "Use Proxy",
+    StatusTemporaryRedirect: "Temporary Redirect",
+    StatusPermanentRedirect: "Permanent Redirect",
+
+    StatusBadRequest:                  "Bad Request",
+    StatusUnauthorized:                "Unauthorized",
+    StatusPaymentRequired:             "Payment Required",
+    StatusForbidden:                   "Forbidden",
+    StatusNotFound:                    "Not Found",
+    StatusMethodNotAllowed:            "Method Not Allowed",
+    StatusNotAcceptable:               "Not Acceptable",
+    StatusProxyAuthRequired:           "Proxy Authentication Required",
+    StatusRequestTimeout:              "Request Timeout",
+    StatusConflict:                    "Conflict",
+    StatusGone:                        "Gone",
+    StatusLengthRequired:              "Length Required",
+    StatusPreconditionFailed:          "Precondition Failed",
+    StatusContentTooLarge:             "Content Too Large",
+    StatusURITooLong:                  "URI Too Long",
+    StatusUnsupportedMediaType:        "Unsupported Media Type",
+    StatusRangeNotSatisfiable:         "Range Not Satisfiable",
+    StatusExpectationFailed:           "Expectation Failed",
+    StatusTeapot:                      "I'm a teapot",
+    StatusMisdirectedRequest:          "Misdirected Request",
+    StatusUnprocessableContent:        "Unprocessable Content",
+    StatusLocked:                      "Locked",
+    StatusFailedDependency:            "Failed Dependency",
+    StatusTooEarly:                    "Too Early",
+    StatusUpgradeRequired:             "Upgrade Required",
+    StatusPreconditionRequired:        "Precondition Required",
+    StatusTooManyRequests:             "Too Many Requests",
+    StatusRequestHeaderFieldsTooLarge: "Request Header Fields Too Large",
+    StatusUnavailableForLegalReasons:  "Unavailable For Legal Reasons",
+
+    StatusInternalServerError:           "Internal Server Error",
+    StatusNotImplemented:                "Not Implemented",
+    StatusBadGateway:                    "Bad Gateway",
+    StatusServiceUnavailable:            "Service Unavailable",
+    StatusGatewayTimeout:                "Gateway Timeout",
+    StatusHTTPVersionNotSupported:       "HTTP Version Not Supported",
+    StatusVariantAlsoNegotiates:         "Variant Also Negotiates",
+    StatusInsufficientStorage:           "Insufficient Storage",
+    StatusLoopDetected:                  "Loop Detected",
+    StatusNotExtended:                   "Not Extended",
+    StatusNetworkAuthenticationRequired: "Network Authentication Required",
   }
+
+  // headerReplacer 头字段里的换行换成空格，防止拼出额外的头字段
+  headerReplacer = strings.NewReplacer("\r", " ", "\n", " ")
 )
 
+// Cookie 用 Response.SetCookie 发送的 cookie，字段和 net/http 的一样
+type Cookie = goHttp.Cookie
+
+// StatusText 状态码的文案，不认识的状态码返回空字符串
+func StatusText(statusCode uint16) string {
+  return statusText[statusCode]
+}
+
 // Response 响应
 type Response struct {
-  // 状态码
+  // 响应头，按设置的顺序发送，同名的可以有多个
+  header
+  // 状态码，默认 200
   statusCode uint16
-  // 响应头
-  mapHeader map[string]string
+  // 原因短语，为空时用 StatusText，解析出来的响应是对端发送的
+  reason string
+  // 响应体
+  sli1body []byte
 }
 
 func NewResponse() *Response {
   return &Response{
-    mapHeader: make(map[string]string, 2),
+    header:     header{sli1field: make([]headerField, 0, 4)},
+    statusCode: StatusOk,
   }
 }
 
-// SetHeader 设置状态码
+// SetStatusCode 设置状态码
 func (p1this *Response) SetStatusCode(statusCode uint16) {
   p1this.statusCode = statusCode
 }
 
-// SetHeader 设置响应头
-func (p1this *Response) SetHeader(key string, val string) {
-  p1this.mapHeader[key] = val
+func (p1this *Response) GetStatusCode() uint16 {
+  return p1this.statusCode
+}
+
+// GetReason 获取原因短语，没有的时候用 StatusText
+func (p1this *Response) GetReason() string {
+  if "" != p1this.reason {
+    return p1this.reason
+  }
+  return StatusText(p1this.statusCode)
+}
+
+// SetCookie 添加一个 Set-Cookie 响应头，名字不合法的 cookie 忽略
+func (p1this *Response) SetCookie(p1cookie *Cookie) {
+  if cookie := p1cookie.String(); "" != cookie {
+    p1this.AddHeader("Set-Cookie", cookie)
+  }
+}
+
+// DelCookie 让客户端删除 cookie，path 要和设置的时候一样
+func (p1this *Response) DelCookie(name string, path string) {
+  p1this.SetCookie(&Cookie{Name: name, Path: path, MaxAge: -1})
+}
+
+// SetBody 设置响应体
+func (p1this *Response) SetBody(sli1body []byte) {
+  p1this.sli1body = sli1body
+}
+
+func (p1this *Response) GetBody() []byte {
+  return p1this.sli1body
 }
 
-// MakeMsg 构造响应报文
+// Encode 构造响应报文。Content-Length 按响应体计算，设置过的会被忽略；没有设置 Date、Server 的时候自动添加。
+// 1xx、204、304 的响应没有响应体。
+func (p1this *Response) Encode() []byte {
+  return p1this.encode(false)
+}
+
+// encode 构造响应报文，isBodyOmitted 为 true 时不发送响应体（比如 HEAD 请求的响应），Content-Length 照常发送
+func (p1this *Response) encode(isBodyOmitted bool) []byte {
+  sli1body := p1this.sli1body
+  isBodyAllowed := p1this.isBodyAllowed()
+  if !isBodyAllowed {
+    sli1body = nil
+  }
+
+  sli1msg := p1this.appendHeader(make([]byte, 0, 256+len(sli1body)), len(sli1body) > 0)
+  if isBodyAllowed {
+    sli1msg = append(sli1msg, "Content-Length: "...)
+    sli1msg = strconv.AppendInt(sli1msg, int64(len(sli1body)), 10)
+    sli1msg = append(sli1msg, "\r\n"...)
+  }
+  sli1msg = append(sli1msg, "\r\n"...)
+  if !isBodyOmitted {
+    sli1msg = append(sli1msg, sli1body...)
+  }
+  return sli1msg
+}
+
+// MakeResponse 设置响应体并构造响应报文，详见 Encode
 func (p1this *Response) MakeResponse(body string) string {
-  respStr := fmt.Sprintf("HTTP/1.1 %d %v\r\n", p1this.statusCode, statusText[p1this.statusCode])
+  p1this.SetBody([]byte(body))
+  return string(p1this.Encode())
+}
 
-  _, ok := p1this.mapHeader["Content-Type"]
-  if !ok {
-    p1this.mapHeader["Content-Type"] = "text/html; charset=utf8"
+// MakeChunkedHeader 构造 chunked 编码的响应头，响应体用 MakeChunk 分块发送，最后用 MakeLastChunk 结束。
+// HTTP/1.0 的客户端不支持 chunked 编码。
+func (p1this *Response) MakeChunkedHeader() string {
+  sli1msg := p1this.appendHeader(make([]byte, 0, 256), true)
+  sli1msg = append(sli1msg, "Transfer-Encoding: chunked\r\n\r\n"...)
+  return string(sli1msg)
+}
+
+// isBodyAllowed 这个状态码的响应能不能有响应体（RFC 9110 6.4.1）
+func (p1this *Response) isBodyAllowed() bool {
+  return p1this.statusCode >= 200 && StatusNoContent != p1this.statusCode && StatusNotModified != p1this.statusCode
+}
+
+// appendHeader 构造状态行和响应头，不包括表示响应体长度的响应头和结束的空行。
+// isWithBody 为 true 时，没有设置 Content-Type 的用 DefaultContentType
+func (p1this *Response) appendHeader(sli1msg []byte, isWithBody bool) []byte {
+  sli1msg = append(sli1msg, "HTTP/1.1 "...)
+  sli1msg = strconv.AppendUint(sli1msg, uint64(p1this.statusCode), 10)
+  sli1msg = append(sli1msg, ' ')
+  sli1msg = append(sli1msg, p1this.GetReason()...)
+  sli1msg = append(sli1msg, "\r\n"...)
+
+  if !p1this.hasHeader("Date") {
+    sli1msg = appendHeaderField(sli1msg, "Date", time.Now().UTC().Format(goHttp.TimeFormat))
+  }
+  if "" != DefaultServer && !p1this.hasHeader("Server") {
+    sli1msg = appendHeaderField(sli1msg, "Server", DefaultServer)
+  }
+  // Content-Length 和 Transfer-Encoding 由 Encode 和 MakeChunkedHeader 决定
+  sli1msg = p1this.appendFields(sli1msg, "Content-Length", "Transfer-Encoding")
+  if isWithBody && p1this.isBodyAllowed() && !p1this.hasHeader("Content-Type") {
+    sli1msg = appendHeaderField(sli1msg, "Content-Type", DefaultContentType)
+  }
+
+  return sli1msg
+}
+
+// MakeChunk 构造一个块。长度为 0 的块表示响应体结束，所以空数据返回空
+func MakeChunk(sli1data []byte) []byte {
+  if 0 == len(sli1data) {
+    return nil
   }
+  sli1chunk := make([]byte, 0, len(sli1data)+20)
+  sli1chunk = strconv.AppendUint(sli1chunk, uint64(len(sli1data)), 16)
+  sli1chunk = append(sli1chunk, "\r\n"...)
+  sli1chunk = append(sli1chunk, sli1data...)
+  sli1chunk = append(sli1chunk, "\r\n"...)
+  return sli1chunk
+}
+
+// MakeLastChunk 构造最后一个块和 trailer，mapTrailer 可以为 nil
+func MakeLastChunk(mapTrailer map[string]string) []byte {
+  sli1chunk := []byte("0\r\n")
+  for key, val := range mapTrailer {
+    sli1chunk = appendHeaderField(sli1chunk, headerReplacer.Replace(key), headerReplacer.Replace(val))
+  }
+  return append(sli1chunk, "\r\n"...)
+}
+
+// ChunkedWriter 用 chunked 编码分块发送响应体，响应体比较大或者边生成边发送的时候用，不用把整个响应体放在内存中。
+// 响应头在第一次 Write（或者 Close）的时候发送，之后不能再修改 Response。
+type ChunkedWriter struct {
+  // p1response 响应头
+  p1response *Response
+  // send 发送数据，isEnd 为 true 时是这个响应的最后一部分，比如 service.TCPConnection.SendResponsePart
+  send func(sli1data []byte, isEnd bool)
+  // isHeaderSent 响应头是不是已经发送了
+  isHeaderSent bool
+  // isClosed 是不是已经结束了
+  isClosed bool
+  // mapTrailer 最后一个块后面的 trailer
+  mapTrailer map[string]string
+  // p1compressor 压缩响应体，为 nil 时不压缩，详见 SetCompress
+  p1compressor compressor
+}
 
-  for key, val := range p1this.mapHeader {
-    respStr += fmt.Sprintf("%s: %s\r\n", key, val)
+func NewChunkedWriter(p1response *Response, send func(sli1data []byte, isEnd bool)) *ChunkedWriter {
+  return &ChunkedWriter{
+    p1response: p1response,
+    send:       send,
   }
+}
 
-  respStr += fmt.Sprintf("Content-Length: %v\r\n\r\n%s", len(body), body)
+// SetTrailer 设置 trailer，在 Close 之前调用。在第一次 Write 之前设置的，会在响应头中用 Trailer 声明
+func (p1this *ChunkedWriter) SetTrailer(key string, val string) {
+  if nil == p1this.mapTrailer {
+    p1this.mapTrailer = make(map[string]string, 2)
+  }
+  p1this.mapTrailer[key] = val
+}
 
-  return respStr
+// SetCompress 按请求的 Accept-Encoding 压缩响应体，在第一次 Write 之前调用，详见 Response.Compress。
+// 不知道响应体有多大，不管 CompressConfig.MinSize。每次 Write 的数据压缩之后马上发送，不等后面的数据
+func (p1this *ChunkedWriter) SetCompress(acceptEncoding string, p1config *CompressConfig) error {
+  if p1this.isHeaderSent {
+    return nil
+  }
+  config := compressConfig(p1config)
+  p1response := p1this.p1response
+  if !p1response.isBodyAllowed() || p1response.hasHeader("Content-Encoding") || !config.isCompressible(p1response.contentType()) {
+    return nil
+  }
+  p1response.AddVary("Accept-Encoding")
+  encoding := NegotiateEncoding(acceptEncoding)
+  if "" == encoding {
+    return nil
+  }
+  p1compressor, err := newCompressor(encoding, writerFunc(p1this.writeChunk), config.Level)
+  if nil != err {
+    return err
+  }
+  p1this.p1compressor = p1compressor
+  p1response.SetHeader("Content-Encoding", encoding)
+  return nil
+}
+
+// Write 发送一个块，实现 io.Writer。sli1data 会被复制，返回之后调用方可以修改
+func (p1this *ChunkedWriter) Write(sli1data []byte) (int, error) {
+  if p1this.isClosed {
+    return 0, ErrChunkedWriterClosed
+  }
+  if 0 == len(sli1data) {
+    return 0, nil
+  }
+  if nil != p1this.p1compressor {
+    if _, err := p1this.p1compressor.Write(sli1data); nil != err {
+      return 0, err
+    }
+    return len(sli1data), p1this.p1compressor.Flush()
+  }
+  return p1this.writeChunk(sli1data)
+}
+
+// Close 发送最后一个块和 trailer，结束响应，重复调用只有第一次生效
+func (p1this *ChunkedWriter) Close() error {
+  if p1this.isClosed {
+    return nil
+  }
+  var err error
+  if nil != p1this.p1compressor {
+    // 压缩剩下的数据和结尾
+    err = p1this.p1compressor.Close()
+  }
+  p1this.isClosed = true
+  p1this.send(append(p1this.header(), MakeLastChunk(p1this.mapTrailer)...), true)
+  return err
+}
+
+// writeChunk 把数据作为一个块发送，第一次发送的时候带上响应头
+func (p1this *ChunkedWriter) writeChunk(sli1data []byte) (int, error) {
+  if 0 == len(sli1data) {
+    return 0, nil
+  }
+  p1this.send(append(p1this.header(), MakeChunk(sli1data)...), false)
+  return len(sli1data), nil
+}
+
+// header 第一次调用的时候返回响应头，之后返回空
+func (p1this *ChunkedWriter) header() []byte {
+  if p1this.isHeaderSent {
+    return nil
+  }
+  p1this.isHeaderSent = true
+  if len(p1this.mapTrailer) > 0 {
+    sli1key := make([]string, 0, len(p1this.mapTrailer))
+    for key := range p1this.mapTrailer {
+      sli1key = append(sli1key, key)
+    }
+    p1this.p1response.SetHeader("Trailer", strings.Join(sli1key, ", "))
+  }
+  return []byte(p1this.p1response.MakeChunkedHeader())
 }
@@ -0,0 +1,153 @@
+package http2
+
+import (
+	"bytes"
+	goErrors "errors"
+	"fmt"
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+)
+
+// ErrClientSide HTTP/2 只支持服务端
+var ErrClientSide = goErrors.New("http2 client side is not supported.")
+
+func init() {
+	protocol.Register(protocol.HTTP2Str, &protocol.Codec{
+		NewProtocol:   func() protocol.Protocol { return NewHTTP2() },
+		OnConnConnect: onConnConnect,
+		OnMsgReady:    onMsgReady,
+		ClassifyErr:   classifyErr,
+		ErrMsg:        errMsg,
+		TimeoutMsg:    timeoutMsg,
+		Encode:        encode,
+		Clone:         func(p1protocol protocol.Protocol) protocol.Protocol { return p1protocol.(*HTTP2).Clone() },
+		Sniff:         sniff,
+		// 多个 stream 的响应不用按顺序发送
+		IsMultiplexed: true,
+		// 优雅关闭的时候等已经收到的请求响应完
+		IsRequestResponse: true,
+	})
+}
+
+// onConnConnect 只支持服务端，客户端的连接直接关闭
+func onConnConnect(p1conn protocol.Conn) error {
+	if protocol.SideService != p1conn.GetSide() {
+		return ErrClientSide
+	}
+	return nil
+}
+
+// onMsgReady 连接开头处理连接序言或者升级请求，之后一个帧一个帧地处理，请求接收完的时候交给 OnConnRequest
+func onMsgReady(p1conn protocol.Conn, sli1msg []byte) (uint8, error) {
+	t1p1protocol := p1conn.GetProtocol().(*HTTP2)
+	p1state := t1p1protocol.p1state
+	switch p1state.stage {
+	case stageStart, stagePreface:
+		if nil != p1state.p1upgrade {
+			return t1p1protocol.onUpgrade(p1conn, sli1msg)
+		}
+		return t1p1protocol.onPreface(p1conn)
+	}
+
+	if err := t1p1protocol.Decode(sli1msg); nil != err {
+		return protocol.MsgActionSkip, err
+	}
+	if p1conn.IsDebug() {
+		fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleHTTP2Frame: %+v", p1conn.GetName(), t1p1protocol.header))
+	}
+	return t1p1protocol.onFrame(p1conn)
+}
+
+// classifyErr 升级请求用 HTTP 的解析状态判断，之后帧头没接收完的是报文头不完整，连接错误的关闭连接
+func classifyErr(p1conn protocol.Conn, err error) uint8 {
+	t1p1protocol := p1conn.GetProtocol().(*HTTP2)
+	if p1upgrade := t1p1protocol.p1state.p1upgrade; nil != p1upgrade {
+		switch p1upgrade.ParseStatus {
+		case http.ParseStatusParseErr:
+			return protocol.ErrTypeFatal
+		case http.ParseStatusRecvBufferEmpty, http.ParseStatusNotHTTP:
+			return protocol.ErrTypeHeaderIncomplete
+		}
+		return protocol.ErrTypeIncomplete
+	}
+	switch err {
+	case errFrameHeaderIncomplete:
+		return protocol.ErrTypeHeaderIncomplete
+	case errFrameIncomplete:
+		return protocol.ErrTypeIncomplete
+	}
+	return protocol.ErrTypeFatal
+}
+
+// errMsg 升级请求出错的时候和 HTTP 一样回复，之后的连接错误回复 GOAWAY
+func errMsg(p1conn protocol.Conn, err error) []byte {
+	p1state := p1conn.GetProtocol().(*HTTP2).p1state
+	var t1upgradeErr upgradeErr
+	if goErrors.As(err, &t1upgradeErr) {
+		resp := http.NewResponse()
+		resp.SetStatusCode(http.StatusBadRequest)
+		resp.SetHeader("Connection", "close")
+		resp.SetBody([]byte(fmt.Sprintf("this is %s. h2c upgrade err: %s", p1conn.GetName(), t1upgradeErr.error)))
+		return resp.Encode()
+	}
+	if nil != p1state.p1upgrade {
+		return http.ParseErrMsg(err)
+	}
+	errCode := ErrCodeInternal
+	var t1connErr connError
+	if goErrors.As(err, &t1connErr) {
+		errCode = t1connErr.code
+	}
+	return appendGoAway(nil, p1state.lastStreamID, errCode, err.Error())
+}
+
+// timeoutMsg 收到连接序言之后超时的，回复 GOAWAY，告诉对端哪些 stream 处理过了
+func timeoutMsg(p1conn protocol.Conn, timeoutType uint8) []byte {
+	p1state := p1conn.GetProtocol().(*HTTP2).p1state
+	if p1state.stage < stageSettings {
+		return nil
+	}
+	return appendGoAway(nil, p1state.lastStreamID, ErrCodeNo, "timeout")
+}
+
+// encode 发送的是 Stream.MakeResponse 这些方法构造好的帧，参数为空的时候发送 SetResponse 设置的响应。
+// 帧按发送窗口直接放进发送队列，返回空，详见 connState.writeFrames
+func encode(p1conn protocol.Conn, sli1msg []byte) ([]byte, error) {
+	t1p1protocol := p1conn.GetProtocol().(*HTTP2)
+	if 0 == len(sli1msg) {
+		var err error
+		sli1msg, err = t1p1protocol.Encode()
+		if nil != err {
+			return nil, err
+		}
+	}
+	return nil, t1p1protocol.p1state.writeFrames(p1conn, sli1msg)
+}
+
+// sniff 判断连接开头的数据是不是 HTTP/2：连接序言开头的（prior knowledge），
+// 或者是请求头接收完整，并且有 "Upgrade: h2c" 的 HTTP/1.1 请求
+func sniff(sli1head []byte) uint8 {
+	if isPreface(sli1head) {
+		if len(sli1head) < len(ClientPreface) {
+			return protocol.SniffNeedMore
+		}
+		return protocol.SniffMatch
+	}
+	result := http.SniffRequest(sli1head)
+	if protocol.SniffMatch != result {
+		return result
+	}
+	index := bytes.Index(sli1head, []byte("\r\n\r\n"))
+	if index < 0 {
+		return protocol.SniffNeedMore
+	}
+	for _, sli1line := range bytes.Split(sli1head[:index], []byte("\r\n"))[1:] {
+		sli1kv := bytes.SplitN(sli1line, []byte(":"), 2)
+		if 2 == len(sli1kv) && bytes.EqualFold(bytes.TrimSpace(sli1kv[0]), []byte("upgrade")) {
+			if hasToken([]string{string(sli1kv[1])}, "h2c") {
+				return protocol.SniffMatch
+			}
+		}
+	}
+	return protocol.SniffNoMatch
+}
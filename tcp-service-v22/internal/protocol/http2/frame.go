@@ -0,0 +1,186 @@
+package http2
+
+import (
+	"encoding/binary"
+	goErrors "errors"
+	"fmt"
+)
+
+const (
+	// ClientPreface 客户端的连接序言（RFC 9113 3.4），后面跟着 SETTINGS 帧
+	ClientPreface string = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	// frameHeaderLen 帧头的长度：长度 3 字节、类型 1 字节、标志 1 字节、stream ID 4 字节
+	frameHeaderLen int = 9
+	// DefaultMaxFrameSize 帧负载默认最多多少字节（SETTINGS_MAX_FRAME_SIZE 的默认值），发送的帧都不超过这个
+	DefaultMaxFrameSize int = 16384
+	// maxFrameSizeLimit SETTINGS_MAX_FRAME_SIZE 最大能设置成多少
+	maxFrameSizeLimit uint32 = 1<<24 - 1
+	// DefaultInitialWindowSize 流量控制窗口的初始大小（SETTINGS_INITIAL_WINDOW_SIZE 的默认值）
+	DefaultInitialWindowSize int64 = 65535
+	// maxWindowSize 流量控制窗口最大多少
+	maxWindowSize int64 = 1<<31 - 1
+)
+
+// 帧类型
+const (
+	FrameData         uint8 = 0x0
+	FrameHeaders      uint8 = 0x1
+	FramePriority     uint8 = 0x2
+	FrameRSTStream    uint8 = 0x3
+	FrameSettings     uint8 = 0x4
+	FramePushPromise  uint8 = 0x5
+	FramePing         uint8 = 0x6
+	FrameGoAway       uint8 = 0x7
+	FrameWindowUpdate uint8 = 0x8
+	FrameContinuation uint8 = 0x9
+)
+
+// 帧的标志，不同的帧类型含义不同
+const (
+	FlagEndStream  uint8 = 0x1  // DATA、HEADERS：这个 stream 上这边不再发送了
+	FlagAck        uint8 = 0x1  // SETTINGS、PING：确认
+	FlagEndHeaders uint8 = 0x4  // HEADERS、CONTINUATION：头块结束了
+	FlagPadded     uint8 = 0x8  // DATA、HEADERS：有填充
+	FlagPriority   uint8 = 0x20 // HEADERS：有优先级
+)
+
+// SETTINGS 的参数
+const (
+	SettingHeaderTableSize      uint16 = 0x1
+	SettingEnablePush           uint16 = 0x2
+	SettingMaxConcurrentStreams uint16 = 0x3
+	SettingInitialWindowSize    uint16 = 0x4
+	SettingMaxFrameSize         uint16 = 0x5
+	SettingMaxHeaderListSize    uint16 = 0x6
+)
+
+// 错误码，RST_STREAM 和 GOAWAY 用
+const (
+	ErrCodeNo                 uint32 = 0x0
+	ErrCodeProtocol           uint32 = 0x1
+	ErrCodeInternal           uint32 = 0x2
+	ErrCodeFlowControl        uint32 = 0x3
+	ErrCodeSettingsTimeout    uint32 = 0x4
+	ErrCodeStreamClosed       uint32 = 0x5
+	ErrCodeFrameSize          uint32 = 0x6
+	ErrCodeRefusedStream      uint32 = 0x7
+	ErrCodeCancel             uint32 = 0x8
+	ErrCodeCompression        uint32 = 0x9
+	ErrCodeConnect            uint32 = 0xa
+	ErrCodeEnhanceYourCalm    uint32 = 0xb
+	ErrCodeInadequateSecurity uint32 = 0xc
+	ErrCodeHTTP11Required     uint32 = 0xd
+)
+
+var (
+	// errFrameHeaderIncomplete 帧头（或者连接序言）都没接收全，继续接收
+	errFrameHeaderIncomplete = goErrors.New("http2 frame header incomplete")
+	// errFrameIncomplete 帧负载没接收全，继续接收
+	errFrameIncomplete = goErrors.New("http2 frame incomplete")
+	// ErrInvalidFrames SendMsg 和 SendResponse 的参数不是完整的帧，详见 Stream.MakeResponse
+	ErrInvalidFrames = goErrors.New("http2 invalid frames")
+)
+
+// connError 连接错误（RFC 9113 5.4.1），回复 GOAWAY 之后关闭连接
+type connError struct {
+	code   uint32
+	reason string
+}
+
+func (p1this connError) Error() string {
+	return fmt.Sprintf("http2 connection error %d: %s", p1this.code, p1this.reason)
+}
+
+// frameHeader 帧头
+type frameHeader struct {
+	// length 负载的长度
+	length uint32
+	// frameType 帧类型，详见 Frame 开头的常量
+	frameType uint8
+	// flags 标志，详见 Flag 开头的常量
+	flags uint8
+	// streamID 帧所属的 stream，0 是整个连接的
+	streamID uint32
+}
+
+// hasFlag 有没有这个标志
+func (p1this frameHeader) hasFlag(flag uint8) bool {
+	return flag == p1this.flags&flag
+}
+
+// parseFrameHeader 解析帧头，sli1data 至少有 frameHeaderLen 字节
+func parseFrameHeader(sli1data []byte) frameHeader {
+	return frameHeader{
+		length:    uint32(sli1data[0])<<16 | uint32(sli1data[1])<<8 | uint32(sli1data[2]),
+		frameType: sli1data[3],
+		flags:     sli1data[4],
+		streamID:  binary.BigEndian.Uint32(sli1data[5:9]) & 0x7fffffff,
+	}
+}
+
+// appendFrame 把 9 字节的帧头（长度、类型、标志、stream ID）和 payload 加到 sli1data 后面，payload 超过 DefaultMaxFrameSize 的由调用方先分成几个帧
+func appendFrame(sli1data []byte, frameType uint8, flags uint8, streamID uint32, sli1payload []byte) []byte {
+	length := len(sli1payload)
+	sli1data = append(sli1data, byte(length>>16), byte(length>>8), byte(length), frameType, flags)
+	sli1data = binary.BigEndian.AppendUint32(sli1data, streamID&0x7fffffff)
+	return append(sli1data, sli1payload...)
+}
+
+// setting SETTINGS 的一个参数
+type setting struct {
+	id    uint16
+	value uint32
+}
+
+// appendSettings 构造 SETTINGS 帧
+func appendSettings(sli1data []byte, sli1setting ...setting) []byte {
+	sli1payload := make([]byte, 0, 6*len(sli1setting))
+	for _, t1setting := range sli1setting {
+		sli1payload = binary.BigEndian.AppendUint16(sli1payload, t1setting.id)
+		sli1payload = binary.BigEndian.AppendUint32(sli1payload, t1setting.value)
+	}
+	return appendFrame(sli1data, FrameSettings, 0, 0, sli1payload)
+}
+
+// parseSettings 解析 SETTINGS 帧的负载
+func parseSettings(sli1payload []byte) ([]setting, error) {
+	if 0 != len(sli1payload)%6 {
+		return nil, connError{ErrCodeFrameSize, "settings length"}
+	}
+	sli1setting := make([]setting, 0, len(sli1payload)/6)
+	for i := 0; i < len(sli1payload); i += 6 {
+		sli1setting = append(sli1setting, setting{
+			id:    binary.BigEndian.Uint16(sli1payload[i:]),
+			value: binary.BigEndian.Uint32(sli1payload[i+2:]),
+		})
+	}
+	return sli1setting, nil
+}
+
+// appendWindowUpdate 构造 WINDOW_UPDATE 帧，streamID 为 0 的是整个连接的
+func appendWindowUpdate(sli1data []byte, streamID uint32, increment uint32) []byte {
+	return appendFrame(sli1data, FrameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, increment))
+}
+
+// appendRSTStream 构造 RST_STREAM 帧
+func appendRSTStream(sli1data []byte, streamID uint32, errCode uint32) []byte {
+	return appendFrame(sli1data, FrameRSTStream, 0, streamID, binary.BigEndian.AppendUint32(nil, errCode))
+}
+
+// appendGoAway 构造 GOAWAY 帧，lastStreamID 是处理过的最大的 stream ID，debug 是给对端看的原因
+func appendGoAway(sli1data []byte, lastStreamID uint32, errCode uint32, debug string) []byte {
+	sli1payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	sli1payload = binary.BigEndian.AppendUint32(sli1payload, errCode)
+	return appendFrame(sli1data, FrameGoAway, 0, 0, append(sli1payload, debug...))
+}
+
+// removePadding 去掉 DATA、HEADERS 的填充，填充长度不对的是连接错误
+func removePadding(header frameHeader, sli1payload []byte) ([]byte, error) {
+	if !header.hasFlag(FlagPadded) {
+		return sli1payload, nil
+	}
+	if 0 == len(sli1payload) || int(sli1payload[0]) >= len(sli1payload) {
+		return nil, connError{ErrCodeProtocol, "padding length"}
+	}
+	return sli1payload[1 : len(sli1payload)-int(sli1payload[0])], nil
+}
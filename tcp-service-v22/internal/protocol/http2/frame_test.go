@@ -0,0 +1,127 @@
+package http2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAppendFrame(t *testing.T) {
+	sli1test := []struct {
+		name        string
+		frameType   uint8
+		flags       uint8
+		streamID    uint32
+		sli1payload []byte
+	}{
+		{"empty", FrameSettings, FlagAck, 0, nil},
+		{"data", FrameData, FlagEndStream | FlagPadded, 1, []byte("hello")},
+		{"max stream id", FrameHeaders, FlagEndHeaders, 1<<31 - 1, []byte{1}},
+		{"max frame size", FrameData, 0, 3, make([]byte, DefaultMaxFrameSize)},
+		{"24 bit length", FrameData, 0, 3, make([]byte, 1<<16+1)},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			sli1frame := appendFrame([]byte("x"), t1test.frameType, t1test.flags, t1test.streamID, t1test.sli1payload)
+			if 'x' != sli1frame[0] || len(sli1frame) != 1+frameHeaderLen+len(t1test.sli1payload) {
+				t.Fatalf("appendFrame() length = %d", len(sli1frame))
+			}
+			header := parseFrameHeader(sli1frame[1:])
+			want := frameHeader{uint32(len(t1test.sli1payload)), t1test.frameType, t1test.flags, t1test.streamID}
+			if want != header {
+				t.Fatalf("parseFrameHeader() = %+v, want %+v", header, want)
+			}
+			if !bytes.Equal(t1test.sli1payload, sli1frame[1+frameHeaderLen:]) && 0 != len(t1test.sli1payload) {
+				t.Fatal("payload is different")
+			}
+		})
+	}
+}
+
+// TestParseFrameHeaderReservedBit stream ID 前面的保留位接收的时候忽略（RFC 9113 4.1）
+func TestParseFrameHeaderReservedBit(t *testing.T) {
+	sli1frame := appendFrame(nil, FrameData, 0, 5, nil)
+	sli1frame[5] |= 0x80
+	if header := parseFrameHeader(sli1frame); 5 != header.streamID {
+		t.Fatalf("streamID = %d, want 5", header.streamID)
+	}
+	// 发送的时候也不带保留位
+	if sli1frame = appendFrame(nil, FrameData, 0, 1<<31|5, nil); 0 != sli1frame[5]&0x80 {
+		t.Fatal("reserved bit is set")
+	}
+}
+
+func TestParseSettings(t *testing.T) {
+	sli1frame := appendSettings(nil, setting{SettingInitialWindowSize, 1 << 20}, setting{SettingMaxFrameSize, 1<<24 - 1}, setting{0xff, 7})
+	sli1setting, err := parseSettings(sli1frame[frameHeaderLen:])
+	if nil != err {
+		t.Fatal(err)
+	}
+	want := []setting{{SettingInitialWindowSize, 1 << 20}, {SettingMaxFrameSize, 1<<24 - 1}, {0xff, 7}}
+	if len(want) != len(sli1setting) {
+		t.Fatalf("parseSettings() = %v, want %v", sli1setting, want)
+	}
+	for i := range want {
+		if want[i] != sli1setting[i] {
+			t.Fatalf("parseSettings() = %v, want %v", sli1setting, want)
+		}
+	}
+	if sli1setting, err = parseSettings(nil); nil != err || 0 != len(sli1setting) {
+		t.Fatalf("parseSettings(nil) = %v, %v", sli1setting, err)
+	}
+
+	for _, length := range []int{1, 5, 7, 13} {
+		_, err = parseSettings(make([]byte, length))
+		if t1err, ok := err.(connError); !ok || ErrCodeFrameSize != t1err.code {
+			t.Errorf("parseSettings() of %d bytes = %v, want FRAME_SIZE_ERROR", length, err)
+		}
+	}
+}
+
+func TestRemovePadding(t *testing.T) {
+	sli1test := []struct {
+		name        string
+		flags       uint8
+		sli1payload []byte
+		isErr       bool
+		sli1want    []byte
+	}{
+		{"not padded", 0, []byte("\x03abc"), false, []byte("\x03abc")},
+		{"padded", FlagPadded, []byte("\x02abc\x00\x00"), false, []byte("abc")},
+		{"zero padding", FlagPadded, []byte("\x00abc"), false, []byte("abc")},
+		{"only padding", FlagPadded, []byte("\x02\x00\x00"), false, []byte{}},
+		{"empty", FlagPadded, nil, true, nil},
+		{"padding fills the payload", FlagPadded, []byte("\x03abc"), false, []byte{}},
+		{"padding equals length", FlagPadded, []byte("\x04abc"), true, nil},
+		{"padding longer than payload", FlagPadded, []byte("\xffabc"), true, nil},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			header := frameHeader{length: uint32(len(t1test.sli1payload)), frameType: FrameData, flags: t1test.flags, streamID: 1}
+			sli1data, err := removePadding(header, t1test.sli1payload)
+			if t1test.isErr {
+				if t1err, ok := err.(connError); !ok || ErrCodeProtocol != t1err.code {
+					t.Fatalf("removePadding() = %v, want PROTOCOL_ERROR", err)
+				}
+				return
+			}
+			if nil != err || !bytes.Equal(t1test.sli1want, sli1data) {
+				t.Fatalf("removePadding() = %q, %v, want %q", sli1data, err, t1test.sli1want)
+			}
+		})
+	}
+}
+
+func TestAppendControlFrames(t *testing.T) {
+	sli1frame := appendWindowUpdate(nil, 3, 1000)
+	if header := parseFrameHeader(sli1frame); (frameHeader{4, FrameWindowUpdate, 0, 3}) != header || !bytes.Equal([]byte{0, 0, 3, 0xe8}, sli1frame[frameHeaderLen:]) {
+		t.Fatalf("appendWindowUpdate() = %x", sli1frame)
+	}
+	sli1frame = appendRSTStream(nil, 3, ErrCodeCancel)
+	if header := parseFrameHeader(sli1frame); (frameHeader{4, FrameRSTStream, 0, 3}) != header || !bytes.Equal([]byte{0, 0, 0, 8}, sli1frame[frameHeaderLen:]) {
+		t.Fatalf("appendRSTStream() = %x", sli1frame)
+	}
+	sli1frame = appendGoAway(nil, 7, ErrCodeProtocol, "bad")
+	if header := parseFrameHeader(sli1frame); (frameHeader{11, FrameGoAway, 0, 0}) != header || !bytes.Equal([]byte("\x00\x00\x00\x07\x00\x00\x00\x01bad"), sli1frame[frameHeaderLen:]) {
+		t.Fatalf("appendGoAway() = %x", sli1frame)
+	}
+}
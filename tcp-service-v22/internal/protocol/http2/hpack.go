@@ -0,0 +1,430 @@
+package http2
+
+import (
+	goErrors "errors"
+)
+
+const (
+	// DefaultHeaderTableSize HPACK 动态表默认最多多少字节（SETTINGS_HEADER_TABLE_SIZE 的默认值）
+	DefaultHeaderTableSize int = 4096
+	// headerFieldOverhead 动态表中每个头字段除了键和值，还要多算 32 字节（RFC 7541 4.1）
+	headerFieldOverhead int = 32
+	// hpackStringLenMax 头字段的键或值最多多少字节，比最大的报文头还长的肯定不对
+	hpackStringLenMax uint64 = 1 << 20
+)
+
+var (
+	// errHpack 请求头块解码出错，回复 COMPRESSION_ERROR 的 GOAWAY
+	errHpack = goErrors.New("hpack decode error")
+)
+
+// hpackField 一个头字段
+type hpackField struct {
+	name  string
+	value string
+}
+
+// size 头字段在动态表中占多少字节
+func (p1this hpackField) size() int {
+	return len(p1this.name) + len(p1this.value) + headerFieldOverhead
+}
+
+// sli1staticTable HPACK 静态表（RFC 7541 附录 A），下标从 1 开始，0 不用
+var sli1staticTable = []hpackField{
+	{},
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+var (
+	// mapStaticField 静态表中键和值都有的头字段的下标，编码的时候用
+	mapStaticField = make(map[hpackField]int, len(sli1staticTable))
+	// mapStaticName 静态表中键名第 1 次出现的下标，编码的时候用
+	mapStaticName = make(map[string]int, len(sli1staticTable))
+)
+
+func init() {
+	for i := len(sli1staticTable) - 1; i > 0; i-- {
+		field := sli1staticTable[i]
+		if "" != field.value {
+			mapStaticField[field] = i
+		}
+		mapStaticName[field.name] = i
+	}
+}
+
+// hpackDecoder HPACK 解码器，每个连接一个，动态表在整个连接上的请求头块之间共用，只在读数据的 goroutine 中用
+type hpackDecoder struct {
+	// sli1dynamic 动态表，新加的在后面
+	sli1dynamic []hpackField
+	// size 动态表现在占多少字节
+	size int
+	// maxSize 动态表最多多少字节，对端可以用动态表大小更新调小
+	maxSize int
+	// maxSizeLimit 动态表大小更新不能超过的值，就是我们的 SETTINGS_HEADER_TABLE_SIZE
+	maxSizeLimit int
+}
+
+func newHpackDecoder() *hpackDecoder {
+	return &hpackDecoder{
+		maxSize:      DefaultHeaderTableSize,
+		maxSizeLimit: DefaultHeaderTableSize,
+	}
+}
+
+// decode 解码一个请求头块，每个头字段调用一次 f，f 返回 error 时停止解码
+func (p1this *hpackDecoder) decode(sli1block []byte, f func(name string, value string) error) error {
+	isFieldDecoded := false
+	for len(sli1block) > 0 {
+		b := sli1block[0]
+		var field hpackField
+		var byteNum int
+		var err error
+		switch {
+		case 0x80 == b&0x80:
+			// 索引头字段
+			var index uint64
+			index, byteNum, err = readInt(sli1block, 7)
+			if nil == err {
+				field, err = p1this.field(index)
+			}
+		case 0x40 == b&0xc0:
+			// 带索引的字面量，解码之后加到动态表
+			field, byteNum, err = p1this.readLiteral(sli1block, 6)
+			if nil == err {
+				p1this.add(field)
+			}
+		case 0x20 == b&0xe0:
+			// 动态表大小更新，只能在头块的开头
+			var maxSize uint64
+			maxSize, byteNum, err = readInt(sli1block, 5)
+			if nil == err && (isFieldDecoded || maxSize > uint64(p1this.maxSizeLimit)) {
+				err = errHpack
+			}
+			if nil == err {
+				p1this.maxSize = int(maxSize)
+				p1this.evict(0)
+			}
+			sli1block = sli1block[byteNum:]
+			if nil != err {
+				return err
+			}
+			continue
+		default:
+			// 不带索引的字面量（0000）和永不索引的字面量（0001），都不加到动态表
+			field, byteNum, err = p1this.readLiteral(sli1block, 4)
+		}
+		if nil != err {
+			return err
+		}
+		sli1block = sli1block[byteNum:]
+		isFieldDecoded = true
+		if err := f(field.name, field.value); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// field 按下标获取头字段，1 到 61 是静态表，后面的是动态表（新加的在前面）
+func (p1this *hpackDecoder) field(index uint64) (hpackField, error) {
+	if 0 == index {
+		return hpackField{}, errHpack
+	}
+	if index < uint64(len(sli1staticTable)) {
+		return sli1staticTable[index], nil
+	}
+	index -= uint64(len(sli1staticTable))
+	if index >= uint64(len(p1this.sli1dynamic)) {
+		return hpackField{}, errHpack
+	}
+	return p1this.sli1dynamic[len(p1this.sli1dynamic)-1-int(index)], nil
+}
+
+// readLiteral 读一个字面量头字段，键名是下标（不为 0）或者字符串，值是字符串
+func (p1this *hpackDecoder) readLiteral(sli1data []byte, prefixBits uint8) (hpackField, int, error) {
+	index, byteNum, err := readInt(sli1data, prefixBits)
+	if nil != err {
+		return hpackField{}, 0, err
+	}
+	var field hpackField
+	if index > 0 {
+		t1field, err := p1this.field(index)
+		if nil != err {
+			return hpackField{}, 0, err
+		}
+		field.name = t1field.name
+	} else {
+		name, t1byteNum, err := readString(sli1data[byteNum:])
+		if nil != err {
+			return hpackField{}, 0, err
+		}
+		field.name = name
+		byteNum += t1byteNum
+	}
+	value, t1byteNum, err := readString(sli1data[byteNum:])
+	if nil != err {
+		return hpackField{}, 0, err
+	}
+	field.value = value
+	return field, byteNum + t1byteNum, nil
+}
+
+// add 把头字段加到动态表，放不下的时候先删掉最早加的，比整个表还大的头字段会清空动态表
+func (p1this *hpackDecoder) add(field hpackField) {
+	size := field.size()
+	if size > p1this.maxSize {
+		p1this.sli1dynamic = p1this.sli1dynamic[:0]
+		p1this.size = 0
+		return
+	}
+	p1this.evict(size)
+	p1this.sli1dynamic = append(p1this.sli1dynamic, field)
+	p1this.size += size
+}
+
+// evict 删掉最早加的头字段，直到动态表能再放下 size 字节
+func (p1this *hpackDecoder) evict(size int) {
+	evictNum := 0
+	for p1this.size+size > p1this.maxSize && evictNum < len(p1this.sli1dynamic) {
+		p1this.size -= p1this.sli1dynamic[evictNum].size()
+		evictNum++
+	}
+	if evictNum > 0 {
+		p1this.sli1dynamic = append(p1this.sli1dynamic[:0], p1this.sli1dynamic[evictNum:]...)
+	}
+}
+
+// readInt 读一个整数（RFC 7541 5.1），prefixBits 是第 1 个字节中整数占几位，返回整数和读了多少字节
+func readInt(sli1data []byte, prefixBits uint8) (uint64, int, error) {
+	if 0 == len(sli1data) {
+		return 0, 0, errHpack
+	}
+	prefixMax := uint64(1)<<prefixBits - 1
+	value := uint64(sli1data[0]) & prefixMax
+	if value < prefixMax {
+		return value, 1, nil
+	}
+	var shift uint
+	for i := 1; i < len(sli1data); i++ {
+		b := sli1data[i]
+		value += uint64(b&0x7f) << shift
+		if 0 == b&0x80 {
+			return value, i + 1, nil
+		}
+		shift += 7
+		if shift > 28 {
+			// 头字段用不到这么大的数，防止溢出
+			return 0, 0, errHpack
+		}
+	}
+	return 0, 0, errHpack
+}
+
+// readString 读一个字符串（RFC 7541 5.2），第 1 位是 1 的是 Huffman 编码的，返回字符串和读了多少字节
+func readString(sli1data []byte) (string, int, error) {
+	if 0 == len(sli1data) {
+		return "", 0, errHpack
+	}
+	isHuffman := 0x80 == sli1data[0]&0x80
+	length, byteNum, err := readInt(sli1data, 7)
+	if nil != err {
+		return "", 0, err
+	}
+	if length > hpackStringLenMax || uint64(len(sli1data)-byteNum) < length {
+		return "", 0, errHpack
+	}
+	sli1str := sli1data[byteNum : byteNum+int(length)]
+	if !isHuffman {
+		return string(sli1str), byteNum + int(length), nil
+	}
+	sli1decoded, err := huffmanDecode(sli1str)
+	if nil != err {
+		return "", 0, err
+	}
+	return string(sli1decoded), byteNum + int(length), nil
+}
+
+// appendInt 写一个整数，first 是第 1 个字节中整数前面的标志位
+func appendInt(sli1data []byte, first byte, prefixBits uint8, value uint64) []byte {
+	prefixMax := uint64(1)<<prefixBits - 1
+	if value < prefixMax {
+		return append(sli1data, first|byte(value))
+	}
+	sli1data = append(sli1data, first|byte(prefixMax))
+	value -= prefixMax
+	for value >= 0x80 {
+		sli1data = append(sli1data, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+	return append(sli1data, byte(value))
+}
+
+// appendString 写一个字符串，Huffman 编码之后更短的用 Huffman 编码
+func appendString(sli1data []byte, str string) []byte {
+	huffmanLen := huffmanEncodedLen(str)
+	if huffmanLen < len(str) {
+		sli1data = appendInt(sli1data, 0x80, 7, uint64(huffmanLen))
+		return appendHuffman(sli1data, str)
+	}
+	sli1data = appendInt(sli1data, 0, 7, uint64(len(str)))
+	return append(sli1data, str...)
+}
+
+// appendHeaderField 编码一个头字段，键名必须是小写。
+// 不用动态表，编码是无状态的，多个 goroutine 可以同时编码：静态表中有的用下标，其他的用不带索引的字面量
+func appendHeaderField(sli1data []byte, name string, value string) []byte {
+	if index, ok := mapStaticField[hpackField{name: name, value: value}]; ok {
+		return appendInt(sli1data, 0x80, 7, uint64(index))
+	}
+	if index, ok := mapStaticName[name]; ok {
+		sli1data = appendInt(sli1data, 0, 4, uint64(index))
+		return appendString(sli1data, value)
+	}
+	sli1data = append(sli1data, 0)
+	sli1data = appendString(sli1data, name)
+	return appendString(sli1data, value)
+}
+
+// huffmanTree Huffman 解码树，每个节点是 0 和 1 两个分支：正数是下一个节点的下标，负数是叶子（-(字节 + 1)），0 是没有
+var huffmanTree = newHuffmanTree()
+
+// newHuffmanTree 用 huffmanCode 构造解码树，0 号节点是根节点
+func newHuffmanTree() [][2]int32 {
+	sli1tree := make([][2]int32, 1, 512)
+	for sym := 0; sym < len(huffmanCode); sym++ {
+		code, length := huffmanCode[sym], int(huffmanCodeLen[sym])
+		node := 0
+		for i := length - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if 0 == i {
+				sli1tree[node][bit] = -int32(sym) - 1
+				break
+			}
+			if 0 == sli1tree[node][bit] {
+				sli1tree = append(sli1tree, [2]int32{})
+				sli1tree[node][bit] = int32(len(sli1tree) - 1)
+			}
+			node = int(sli1tree[node][bit])
+		}
+	}
+	return sli1tree
+}
+
+// huffmanDecode Huffman 解码。结尾的填充必须是 EOS 的前缀（全是 1），而且不能超过 7 位
+func huffmanDecode(sli1data []byte) ([]byte, error) {
+	sli1decoded := make([]byte, 0, len(sli1data)*8/5)
+	node := 0
+	// bitNum 当前这个字节已经读了多少位，isAllOne 读的是不是全是 1
+	bitNum := 0
+	isAllOne := true
+	for _, b := range sli1data {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			next := huffmanTree[node][bit]
+			if next < 0 {
+				sli1decoded = append(sli1decoded, byte(-next-1))
+				node, bitNum, isAllOne = 0, 0, true
+				continue
+			}
+			if 0 == next {
+				// 编码里有 EOS，或者不是合法的编码
+				return nil, errHpack
+			}
+			node = int(next)
+			bitNum++
+			isAllOne = isAllOne && 1 == bit
+		}
+	}
+	if bitNum > 7 || !isAllOne {
+		return nil, errHpack
+	}
+	return sli1decoded, nil
+}
+
+// huffmanEncodedLen Huffman 编码之后有多少字节
+func huffmanEncodedLen(str string) int {
+	bitNum := 0
+	for i := 0; i < len(str); i++ {
+		bitNum += int(huffmanCodeLen[str[i]])
+	}
+	return (bitNum + 7) / 8
+}
+
+// appendHuffman Huffman 编码，最后不满 1 个字节的用 1 填充
+func appendHuffman(sli1data []byte, str string) []byte {
+	var bits uint64
+	var bitNum uint
+	for i := 0; i < len(str); i++ {
+		length := uint(huffmanCodeLen[str[i]])
+		bits = bits<<length | uint64(huffmanCode[str[i]])
+		bitNum += length
+		for bitNum >= 8 {
+			bitNum -= 8
+			sli1data = append(sli1data, byte(bits>>bitNum))
+		}
+	}
+	if bitNum > 0 {
+		sli1data = append(sli1data, byte(bits<<(8-bitNum))|byte(0xff>>bitNum))
+	}
+	return sli1data
+}
@@ -0,0 +1,240 @@
+package http2
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func mustHex(t *testing.T, str string) []byte {
+	t.Helper()
+	sli1data, err := hex.DecodeString(strings.ReplaceAll(str, " ", ""))
+	if nil != err {
+		t.Fatal(err)
+	}
+	return sli1data
+}
+
+// TestInt RFC 7541 C.1 的例子
+func TestInt(t *testing.T) {
+	sli1test := []struct {
+		value      uint64
+		prefixBits uint8
+		encoded    string
+	}{
+		{10, 5, "0a"},
+		{1337, 5, "1f9a0a"},
+		{42, 8, "2a"},
+		{30, 5, "1e"},
+		{31, 5, "1f00"},
+		{127, 7, "7f00"},
+		{1 << 20, 7, "7f81ff3f"},
+	}
+	for _, t1test := range sli1test {
+		sli1encoded := appendInt(nil, 0, t1test.prefixBits, t1test.value)
+		if t1test.encoded != hex.EncodeToString(sli1encoded) {
+			t.Errorf("appendInt(%d, %d) = %x, want %s", t1test.value, t1test.prefixBits, sli1encoded, t1test.encoded)
+		}
+		value, byteNum, err := readInt(append(sli1encoded, 0xff), t1test.prefixBits)
+		if nil != err || t1test.value != value || len(sli1encoded) != byteNum {
+			t.Errorf("readInt(%x) = %d, %d, %v", sli1encoded, value, byteNum, err)
+		}
+	}
+
+	// 没有结束的，或者太大的
+	for _, encoded := range []string{"", "1f", "1f80", "1fffffffff", "1fffffffffff7f"} {
+		if _, _, err := readInt(mustHex(t, encoded), 5); errHpack != err {
+			t.Errorf("readInt(%s) = %v, want errHpack", encoded, err)
+		}
+	}
+}
+
+func TestHuffman(t *testing.T) {
+	// RFC 7541 C.4.1
+	if sli1encoded := appendHuffman(nil, "www.example.com"); "f1e3c2e5f23a6ba0ab90f4ff" != hex.EncodeToString(sli1encoded) {
+		t.Fatalf("appendHuffman() = %x", sli1encoded)
+	}
+	for _, str := range []string{"", "a", "no-cache", "custom-value", "Mon, 21 Oct 2013 20:13:21 GMT", "\x00\xff\x7f\r\n", strings.Repeat("z", 1000)} {
+		sli1encoded := appendHuffman(nil, str)
+		if huffmanEncodedLen(str) != len(sli1encoded) {
+			t.Errorf("huffmanEncodedLen(%q) = %d, encoded %d bytes", str, huffmanEncodedLen(str), len(sli1encoded))
+		}
+		sli1decoded, err := huffmanDecode(sli1encoded)
+		if nil != err || str != string(sli1decoded) {
+			t.Errorf("huffmanDecode(appendHuffman(%q)) = %q, %v", str, sli1decoded, err)
+		}
+	}
+
+	sli1test := []struct {
+		name    string
+		encoded string
+	}{
+		// "a" 是 00011，后面的填充必须都是 1
+		{"padding not all ones", "18"},
+		{"padding longer than 7 bits", "1fff"},
+		{"eos", "ffffffff"},
+	}
+	for _, t1test := range sli1test {
+		if _, err := huffmanDecode(mustHex(t, t1test.encoded)); errHpack != err {
+			t.Errorf("%s: huffmanDecode(%s) = %v, want errHpack", t1test.name, t1test.encoded, err)
+		}
+	}
+}
+
+// decodeBlock 解码一个头块，返回 "name: value" 的列表
+func decodeBlock(p1decoder *hpackDecoder, sli1block []byte) ([]string, error) {
+	var sli1field []string
+	err := p1decoder.decode(sli1block, func(name string, value string) error {
+		sli1field = append(sli1field, name+": "+value)
+		return nil
+	})
+	return sli1field, err
+}
+
+// TestHpackDecode RFC 7541 C.3 和 C.4 的例子，同一个连接上的 3 个请求，动态表在请求之间共用
+func TestHpackDecode(t *testing.T) {
+	sli1want := [][]string{
+		{":method: GET", ":scheme: http", ":path: /", ":authority: www.example.com"},
+		{":method: GET", ":scheme: http", ":path: /", ":authority: www.example.com", "cache-control: no-cache"},
+		{":method: GET", ":scheme: https", ":path: /index.html", ":authority: www.example.com", "custom-key: custom-value"},
+	}
+	sli1size := []int{57, 110, 164}
+	sli1test := []struct {
+		name       string
+		sli1encode []string
+	}{
+		{"without huffman", []string{
+			"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+			"8286 84be 5808 6e6f 2d63 6163 6865",
+			"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+		}},
+		{"with huffman", []string{
+			"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+			"8286 84be 5886 a8eb 1064 9cbf",
+			"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+		}},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1decoder := newHpackDecoder()
+			for i, encoded := range t1test.sli1encode {
+				sli1field, err := decodeBlock(p1decoder, mustHex(t, encoded))
+				if nil != err {
+					t.Fatalf("request %d: %v", i+1, err)
+				}
+				if strings.Join(sli1want[i], "\n") != strings.Join(sli1field, "\n") {
+					t.Fatalf("request %d = %q, want %q", i+1, sli1field, sli1want[i])
+				}
+				if sli1size[i] != p1decoder.size {
+					t.Fatalf("request %d: dynamic table size = %d, want %d", i+1, p1decoder.size, sli1size[i])
+				}
+			}
+		})
+	}
+}
+
+// TestHpackDynamicTableSize 动态表大小更新之后删掉放不下的头字段，新加的头字段放不下的时候删掉最早加的
+func TestHpackDynamicTableSize(t *testing.T) {
+	p1decoder := newHpackDecoder()
+	// custom-key: custom-value 占 54 字节，加 3 个
+	sli1block := mustHex(t, "400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65")
+	for i := 0; i < 3; i++ {
+		if _, err := decodeBlock(p1decoder, sli1block); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if 3 != len(p1decoder.sli1dynamic) || 162 != p1decoder.size {
+		t.Fatalf("dynamic table: %d fields, %d bytes", len(p1decoder.sli1dynamic), p1decoder.size)
+	}
+	// 调小到 110，只剩 2 个
+	if _, err := decodeBlock(p1decoder, appendInt(nil, 0x20, 5, 110)); nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(p1decoder.sli1dynamic) || 108 != p1decoder.size {
+		t.Fatalf("after size update: %d fields, %d bytes", len(p1decoder.sli1dynamic), p1decoder.size)
+	}
+	// 再加 1 个，删掉最早的
+	if _, err := decodeBlock(p1decoder, mustHex(t, "4004 6b65 7931 0176")); nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(p1decoder.sli1dynamic) || "key1" != p1decoder.sli1dynamic[1].name {
+		t.Fatalf("after add: %+v", p1decoder.sli1dynamic)
+	}
+	// 62 是最新加的
+	if sli1field, err := decodeBlock(p1decoder, []byte{0xbe, 0xbf}); nil != err || "key1: v" != sli1field[0] || "custom-key: custom-value" != sli1field[1] {
+		t.Fatalf("indexed fields = %q, %v", sli1field, err)
+	}
+	// 比整个表还大的头字段清空动态表
+	sli1block = append([]byte{0x40}, appendString(nil, strings.Repeat("k", 100))...)
+	sli1block = appendString(sli1block, "v")
+	if _, err := decodeBlock(p1decoder, sli1block); nil != err || 0 != len(p1decoder.sli1dynamic) || 0 != p1decoder.size {
+		t.Fatalf("after a large field: %v, %d fields, %d bytes", err, len(p1decoder.sli1dynamic), p1decoder.size)
+	}
+	// 调成 0 再调回来
+	if _, err := decodeBlock(p1decoder, []byte{0x20, 0x3f, 0xe1, 0x1f}); nil != err || 4096 != p1decoder.maxSize {
+		t.Fatalf("size update to 0 then 4096: %v, maxSize %d", err, p1decoder.maxSize)
+	}
+}
+
+func TestHpackDecodeMalformed(t *testing.T) {
+	sli1test := []struct {
+		name  string
+		block []byte
+	}{
+		{"index 0", []byte{0x80}},
+		{"index not in the dynamic table", []byte{0xbe}},
+		{"index too large", appendInt(nil, 0x80, 7, 1000)},
+		{"literal name index not in the table", appendInt(nil, 0x40, 6, 70)},
+		{"literal without value", []byte{0x44}},
+		{"literal name truncated", []byte{0x40, 0x05, 'a'}},
+		{"literal value truncated", []byte{0x44, 0x05, 'a'}},
+		{"string too long", append([]byte{0x44}, appendInt(nil, 0, 7, hpackStringLenMax+1)...)},
+		{"bad huffman", []byte{0x44, 0x81, 0x18}},
+		{"size update over the limit", appendInt(nil, 0x20, 5, uint64(DefaultHeaderTableSize)+1)},
+		{"size update after a field", []byte{0x82, 0x20}},
+		{"truncated int", []byte{0xff}},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			if _, err := decodeBlock(newHpackDecoder(), t1test.block); errHpack != err {
+				t.Fatalf("decode(%x) = %v, want errHpack", t1test.block, err)
+			}
+		})
+	}
+}
+
+// TestAppendHeaderField 编码之后用解码器解码回来，静态表中有的用下标，不加到动态表
+func TestAppendHeaderField(t *testing.T) {
+	sli1test := []struct {
+		name    string
+		value   string
+		byteNum int
+	}{
+		{":status", "200", 1},
+		{":status", "418", 0},
+		{"content-type", "text/html", 0},
+		{"x-custom", "value", 0},
+		{"x-empty", "", 0},
+		{"x-long", strings.Repeat("a", 300), 0},
+		{"x-binary", "\x01\x02", 0},
+	}
+	for _, t1test := range sli1test {
+		sli1block := appendHeaderField(nil, t1test.name, t1test.value)
+		if 0 != t1test.byteNum && t1test.byteNum != len(sli1block) {
+			t.Errorf("appendHeaderField(%s, %s) = %x, want %d bytes", t1test.name, t1test.value, sli1block, t1test.byteNum)
+		}
+		p1decoder := newHpackDecoder()
+		sli1field, err := decodeBlock(p1decoder, sli1block)
+		if nil != err || 1 != len(sli1field) || t1test.name+": "+t1test.value != sli1field[0] {
+			t.Errorf("decode(appendHeaderField(%s, %s)) = %q, %v", t1test.name, t1test.value, sli1field, err)
+		}
+		if 0 != len(p1decoder.sli1dynamic) {
+			t.Errorf("appendHeaderField(%s, %s) added to the dynamic table", t1test.name, t1test.value)
+		}
+	}
+	// 能用 Huffman 编码的更短
+	if sli1block := appendHeaderField(nil, "x-custom", strings.Repeat("e", 100)); !bytes.Contains(sli1block, []byte{0x80 | 63}) {
+		t.Errorf("long value is not huffman encoded: %x", sli1block)
+	}
+}
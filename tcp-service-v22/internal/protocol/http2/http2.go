@@ -0,0 +1,801 @@
+package http2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	goErrors "errors"
+	"strconv"
+	"strings"
+	"sync"
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+)
+
+const (
+	// MaxConcurrentStreams 一个连接上最多同时有多少个 stream，通过 SETTINGS 告诉对端，超过的回复 REFUSED_STREAM
+	MaxConcurrentStreams int = 100
+	// BodySizeMax 请求体最多多少字节，超过的回复 413
+	BodySizeMax int = protocol.DefaultMaxMsgSize
+	// headerBlockSizeMax 请求头块（HEADERS 加上 CONTINUATION）最多多少字节，超过的是连接错误
+	headerBlockSizeMax int = 4 * http.HeaderSizeMax
+	// Version 交给 OnConnRequest 的请求的版本
+	Version string = "HTTP/2.0"
+)
+
+// 连接的阶段
+const (
+	stageStart    uint8 = iota // 刚建立连接，开头是连接序言（prior knowledge）或者 HTTP/1.1 的升级请求（Upgrade: h2c）
+	stagePreface               // 升级请求已经回复了 101，等待客户端的连接序言
+	stageSettings              // 收到了连接序言，客户端的第 1 个帧必须是 SETTINGS
+	stageFrame                 // 正常收发帧
+)
+
+var (
+	// ErrNoStream 没有交给 OnConnRequest 的 stream 就调用了 Encode
+	ErrNoStream = goErrors.New("http2 stream is not set.")
+	// ErrNoResponse stream 没有用 SetResponse 设置响应，SendResponse 的参数也为空
+	ErrNoResponse = goErrors.New("http2 response is not set.")
+)
+
+// upgradeErr 升级请求（Upgrade: h2c）不符合要求，回复 400 的时候带上原因
+type upgradeErr struct {
+	error
+}
+
+// sli1serverSetting 服务端的 SETTINGS，不支持服务端推送，其他的用默认值
+var sli1serverSetting = []setting{
+	{SettingMaxConcurrentStreams, uint32(MaxConcurrentStreams)},
+	{SettingMaxHeaderListSize, uint32(http.HeaderSizeMax)},
+}
+
+var _ protocol.Protocol = &HTTP2{}
+
+// HTTP2 HTTP/2 协议，只支持服务端不加密的 h2c（RFC 9113）。
+// 一个帧是一条报文，协议内部处理 SETTINGS、PING、WINDOW_UPDATE 这些控制帧，
+// 每个 stream 的请求接收完之后交给 OnConnRequest，和 HTTP/1.1 的请求一样处理，详见 GetStream
+type HTTP2 struct {
+	// p1state 连接的状态，Clone 之后和原来的共用
+	p1state *connState
+	// header 当前帧的帧头
+	header frameHeader
+	// sli1payload 当前帧的负载，指向接收缓冲区
+	sli1payload []byte
+	// p1stream 交给 OnConnRequest 的请求所在的 stream
+	p1stream *Stream
+	// p1response SetResponse 设置的响应，Encode 的时候用
+	p1response *http.Response
+	// p1responseStream SetResponse 的时候交给 OnConnRequest 的 stream，p1response 是它的响应
+	p1responseStream *Stream
+}
+
+// connState HTTP/2 连接的状态，连接上的 stream 共用
+type connState struct {
+	// 下面的只在读数据的 goroutine 中用
+	// stage 连接的阶段，详见 stage 开头的常量
+	stage uint8
+	// p1upgrade 解析升级请求（Upgrade: h2c），不是升级请求的时候为 nil
+	p1upgrade *http.HTTP
+	// p1decoder 请求头的 HPACK 解码器
+	p1decoder *hpackDecoder
+	// lastStreamID 收到的最大的 stream ID，GOAWAY 用
+	lastStreamID uint32
+	// headerStreamID 正在接收头块的 stream，头块没接收完（没有 END_HEADERS）的时候，后面只能是这个 stream 的 CONTINUATION
+	headerStreamID uint32
+	// headerFlags 头块开头的 HEADERS 帧的标志
+	headerFlags uint8
+	// isHeaderNewStream 头块是不是新的 stream 的
+	isHeaderNewStream bool
+	// sli1headerBlock 还没接收完的头块
+	sli1headerBlock []byte
+	// isGoAway 对端是不是发送了 GOAWAY
+	isGoAway bool
+
+	// mutex 保护下面的和 Stream 的发送状态，读数据的 goroutine 和发送响应的 goroutine 都会用
+	mutex sync.Mutex
+	// mapStream 还没关闭的 stream
+	mapStream map[uint32]*Stream
+	// sendWindow 连接的发送窗口
+	sendWindow int64
+	// initialWindowSize 对端设置的 stream 发送窗口的初始大小
+	initialWindowSize int64
+	// sli1blocked 发送窗口不够，还有帧没发送的 stream，按顺序
+	sli1blocked []*Stream
+	// isWaitPreface 升级之后还没收到客户端的连接序言，stream 1 的响应先存起来。
+	// 客户端处理 101 的时候，后面跟着太多数据可能会放不下（比如 curl）
+	isWaitPreface bool
+}
+
+func NewHTTP2() *HTTP2 {
+	return &HTTP2{
+		p1state: &connState{
+			stage:             stageStart,
+			p1decoder:         newHpackDecoder(),
+			mapStream:         make(map[uint32]*Stream),
+			sendWindow:        DefaultInitialWindowSize,
+			initialWindowSize: DefaultInitialWindowSize,
+		},
+	}
+}
+
+// Protocol.FirstMsgLength 连接序言和每个帧都是一条报文，升级请求是一条 HTTP/1.1 的报文
+func (p1this *HTTP2) FirstMsgLength(sli1recv []byte) (uint64, error) {
+	p1state := p1this.p1state
+	switch p1state.stage {
+	case stageStart, stagePreface:
+		if nil != p1state.p1upgrade {
+			return p1state.p1upgrade.FirstMsgLength(sli1recv)
+		}
+		if !isPreface(sli1recv) {
+			if stageStart == p1state.stage {
+				// 不是连接序言，按升级请求解析
+				p1state.p1upgrade = http.NewHTTP()
+				return p1state.p1upgrade.FirstMsgLength(sli1recv)
+			}
+			return 0, connError{ErrCodeProtocol, "invalid connection preface"}
+		}
+		if len(sli1recv) < len(ClientPreface) {
+			return 0, errFrameHeaderIncomplete
+		}
+		return uint64(len(ClientPreface)), nil
+	}
+
+	if len(sli1recv) < frameHeaderLen {
+		return 0, errFrameHeaderIncomplete
+	}
+	header := parseFrameHeader(sli1recv)
+	if header.length > uint32(DefaultMaxFrameSize) {
+		return 0, connError{ErrCodeFrameSize, "frame too large"}
+	}
+	msgLength := uint64(frameHeaderLen) + uint64(header.length)
+	if msgLength > uint64(len(sli1recv)) {
+		return msgLength, errFrameIncomplete
+	}
+	return msgLength, nil
+}
+
+// Protocol.Decode 解析帧头和负载，负载指向接收缓冲区
+func (p1this *HTTP2) Decode(sli1msg []byte) error {
+	if len(sli1msg) < frameHeaderLen {
+		return ErrInvalidFrames
+	}
+	p1this.header = parseFrameHeader(sli1msg)
+	p1this.sli1payload = sli1msg[frameHeaderLen:]
+	return nil
+}
+
+// Protocol.Encode 构造 SetResponse 设置的响应的帧，发给 SetResponse 的时候的 stream，详见 Stream.MakeResponse
+func (p1this *HTTP2) Encode() ([]byte, error) {
+	if nil == p1this.p1response {
+		return nil, ErrNoResponse
+	}
+	if nil == p1this.p1responseStream {
+		return nil, ErrNoStream
+	}
+	return p1this.p1responseStream.MakeResponse(p1this.p1response), nil
+}
+
+// Clone 复制一份，连接的状态共用，帧的负载指向接收缓冲区，不复制
+func (p1this *HTTP2) Clone() *HTTP2 {
+	t1http2 := *p1this
+	t1http2.sli1payload = nil
+	return &t1http2
+}
+
+// GetStream 获取交给 OnConnRequest 的请求所在的 stream，在 OnConnRequest 中调用
+func (p1this *HTTP2) GetStream() *Stream {
+	return p1this.p1stream
+}
+
+// GetRequest 获取交给 OnConnRequest 的请求，详见 Stream.GetRequest
+func (p1this *HTTP2) GetRequest() *http.HTTP {
+	if nil == p1this.p1stream {
+		return nil
+	}
+	return p1this.p1stream.p1request
+}
+
+// SetResponse 设置当前 stream（GetStream）的响应，之后用空数据调用 SendResponse，就会通过 Encode 发送。
+// 没有 worker pool 的时候，协议实例在连接上是复用的，下一个请求会清掉，所以要在 OnConnRequest 返回之前调用；
+// 异步响应的，在 OnConnRequest 中记下 GetStream，之后用 Stream.MakeResponse 构造响应再发送
+func (p1this *HTTP2) SetResponse(p1response *http.Response) {
+	p1this.p1response = p1response
+	p1this.p1responseStream = p1this.p1stream
+}
+
+func (p1this *HTTP2) GetResponse() *http.Response {
+	return p1this.p1response
+}
+
+// onPreface 收到了连接序言，发送服务端的 SETTINGS。升级过来的，服务端的 SETTINGS 已经发送了，发送存起来的响应
+func (p1this *HTTP2) onPreface(p1conn protocol.Conn) (uint8, error) {
+	p1state := p1this.p1state
+	if stagePreface != p1state.stage {
+		p1state.stage = stageSettings
+		return protocol.MsgActionSkip, p1conn.WriteData(appendSettings(nil, sli1serverSetting...))
+	}
+	p1state.stage = stageSettings
+	p1state.mutex.Lock()
+	defer p1state.mutex.Unlock()
+	p1state.isWaitPreface = false
+	sli1out := p1state.flushBlocked(nil)
+	if 0 == len(sli1out) {
+		return protocol.MsgActionSkip, nil
+	}
+	return protocol.MsgActionSkip, p1conn.WriteData(sli1out)
+}
+
+// onUpgrade 处理升级请求（RFC 7540 3.2）：回复 101 和服务端的 SETTINGS，HTTP2-Settings 当成客户端的 SETTINGS，
+// 升级请求当成 stream 1 的请求交给 OnConnRequest，响应用 HTTP/2 发送
+func (p1this *HTTP2) onUpgrade(p1conn protocol.Conn, sli1msg []byte) (uint8, error) {
+	p1state := p1this.p1state
+	p1upgrade := p1state.p1upgrade
+	if err := p1upgrade.Decode(sli1msg); nil != err {
+		return protocol.MsgActionSkip, err
+	}
+	if !hasToken(p1upgrade.GetHeaderValues("upgrade"), "h2c") {
+		return protocol.MsgActionSkip, upgradeErr{goErrors.New("upgrade is not h2c")}
+	}
+	sli1connection := p1upgrade.GetHeaderValues("connection")
+	if !hasToken(sli1connection, "upgrade") || !hasToken(sli1connection, "http2-settings") {
+		return protocol.MsgActionSkip, upgradeErr{goErrors.New("connection must contain upgrade and http2-settings")}
+	}
+	sli1value := p1upgrade.GetHeaderValues("http2-settings")
+	if 1 != len(sli1value) {
+		return protocol.MsgActionSkip, upgradeErr{goErrors.New("there must be exactly one http2-settings")}
+	}
+	sli1payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sli1value[0], "="))
+	if nil != err {
+		return protocol.MsgActionSkip, upgradeErr{goErrors.New("http2-settings is not base64url")}
+	}
+	sli1setting, err := parseSettings(sli1payload)
+	if nil == err {
+		p1state.mutex.Lock()
+		_, err = p1state.applySettings(nil, sli1setting)
+		p1state.mutex.Unlock()
+	}
+	if nil != err {
+		return protocol.MsgActionSkip, upgradeErr{err}
+	}
+
+	p1request := p1upgrade.Clone()
+	p1request.Version = Version
+	for _, key := range []string{"connection", "upgrade", "http2-settings", "keep-alive", "proxy-connection"} {
+		delete(p1request.MapHeader, key)
+	}
+	p1stream := &Stream{id: 1, p1state: p1state, p1request: p1request, isRecvEnd: true}
+	p1state.mutex.Lock()
+	p1stream.sendWindow = p1state.initialWindowSize
+	p1state.mapStream[p1stream.id] = p1stream
+	p1state.isWaitPreface = true
+	p1state.mutex.Unlock()
+	p1state.lastStreamID = p1stream.id
+	p1state.p1upgrade = nil
+	p1state.stage = stagePreface
+
+	sli1data := []byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err := p1conn.WriteData(appendSettings(sli1data, sli1serverSetting...)); nil != err {
+		return protocol.MsgActionSkip, err
+	}
+	p1this.p1stream = p1stream
+	p1this.p1response, p1this.p1responseStream = nil, nil
+	return protocol.MsgActionRequest, nil
+}
+
+// onFrame 处理一个帧，请求接收完的时候返回 MsgActionRequest，其他的返回 MsgActionSkip，返回 error 时是连接错误
+func (p1this *HTTP2) onFrame(p1conn protocol.Conn) (uint8, error) {
+	p1state := p1this.p1state
+	header := p1this.header
+	if stageSettings == p1state.stage && FrameSettings != header.frameType {
+		return protocol.MsgActionSkip, connError{ErrCodeProtocol, "first frame is not settings"}
+	}
+	if 0 != p1state.headerStreamID && FrameContinuation != header.frameType {
+		return protocol.MsgActionSkip, connError{ErrCodeProtocol, "expect continuation"}
+	}
+
+	switch header.frameType {
+	case FrameData:
+		return p1this.onData(p1conn)
+	case FrameHeaders:
+		return p1this.onHeaders(p1conn)
+	case FrameContinuation:
+		return p1this.onContinuation(p1conn)
+	case FramePriority:
+		if 0 == header.streamID {
+			return protocol.MsgActionSkip, connError{ErrCodeProtocol, "priority on stream 0"}
+		}
+		if 5 != header.length {
+			return protocol.MsgActionSkip, p1state.resetStream(p1conn, header.streamID, ErrCodeFrameSize)
+		}
+		// 不按优先级发送，忽略
+		return protocol.MsgActionSkip, nil
+	case FrameRSTStream:
+		return protocol.MsgActionSkip, p1this.onRSTStream()
+	case FrameSettings:
+		return protocol.MsgActionSkip, p1this.onSettings(p1conn)
+	case FramePushPromise:
+		return protocol.MsgActionSkip, connError{ErrCodeProtocol, "push promise from client"}
+	case FramePing:
+		if 0 != header.streamID {
+			return protocol.MsgActionSkip, connError{ErrCodeProtocol, "ping on stream"}
+		}
+		if 8 != header.length {
+			return protocol.MsgActionSkip, connError{ErrCodeFrameSize, "ping length"}
+		}
+		if header.hasFlag(FlagAck) {
+			return protocol.MsgActionSkip, nil
+		}
+		sli1payload := append([]byte(nil), p1this.sli1payload...)
+		return protocol.MsgActionSkip, p1conn.WriteData(appendFrame(nil, FramePing, FlagAck, 0, sli1payload))
+	case FrameGoAway:
+		if 0 != header.streamID {
+			return protocol.MsgActionSkip, connError{ErrCodeProtocol, "goaway on stream"}
+		}
+		if header.length < 8 {
+			return protocol.MsgActionSkip, connError{ErrCodeFrameSize, "goaway length"}
+		}
+		// 对端不会再创建新的 stream，已经有的照常响应，对端处理完之后自己关闭连接
+		p1state.isGoAway = true
+		return protocol.MsgActionSkip, nil
+	case FrameWindowUpdate:
+		return protocol.MsgActionSkip, p1this.onWindowUpdate(p1conn)
+	}
+	// 不认识的帧类型忽略（RFC 9113 4.1）
+	return protocol.MsgActionSkip, nil
+}
+
+// onSettings 应用对端的 SETTINGS，然后回复确认
+func (p1this *HTTP2) onSettings(p1conn protocol.Conn) error {
+	p1state := p1this.p1state
+	header := p1this.header
+	if 0 != header.streamID {
+		return connError{ErrCodeProtocol, "settings on stream"}
+	}
+	if header.hasFlag(FlagAck) {
+		if 0 != header.length {
+			return connError{ErrCodeFrameSize, "settings ack length"}
+		}
+		return nil
+	}
+	sli1setting, err := parseSettings(p1this.sli1payload)
+	if nil != err {
+		return err
+	}
+	p1state.stage = stageFrame
+
+	p1state.mutex.Lock()
+	defer p1state.mutex.Unlock()
+	sli1out := appendFrame(nil, FrameSettings, FlagAck, 0, nil)
+	sli1out, err = p1state.applySettings(sli1out, sli1setting)
+	if nil != err {
+		return err
+	}
+	return p1conn.WriteData(sli1out)
+}
+
+// applySettings 应用对端的 SETTINGS，发送窗口的初始大小变大之后能发送的帧加到 sli1out 后面。在锁里面调用
+func (p1this *connState) applySettings(sli1out []byte, sli1setting []setting) ([]byte, error) {
+	for _, t1setting := range sli1setting {
+		switch t1setting.id {
+		case SettingEnablePush:
+			if t1setting.value > 1 {
+				return sli1out, connError{ErrCodeProtocol, "enable push"}
+			}
+		case SettingInitialWindowSize:
+			if int64(t1setting.value) > maxWindowSize {
+				return sli1out, connError{ErrCodeFlowControl, "initial window size"}
+			}
+			// 已经有的 stream 的发送窗口按差值调整（RFC 9113 6.9.2）
+			delta := int64(t1setting.value) - p1this.initialWindowSize
+			p1this.initialWindowSize = int64(t1setting.value)
+			for _, p1stream := range p1this.mapStream {
+				p1stream.sendWindow += delta
+				if p1stream.sendWindow > maxWindowSize {
+					return sli1out, connError{ErrCodeFlowControl, "window overflow"}
+				}
+			}
+			if delta > 0 {
+				for _, p1stream := range p1this.mapStream {
+					if len(p1stream.sli1pending) > 0 {
+						sli1out = p1this.flush(sli1out, p1stream)
+					}
+				}
+			}
+		case SettingMaxFrameSize:
+			if t1setting.value < uint32(DefaultMaxFrameSize) || t1setting.value > maxFrameSizeLimit {
+				return sli1out, connError{ErrCodeProtocol, "max frame size"}
+			}
+		}
+		// 发送的帧都不超过默认的最大长度，响应头不用动态表，其他的参数不用管
+	}
+	return sli1out, nil
+}
+
+// onWindowUpdate 发送窗口变大了，发送被挡住的帧
+func (p1this *HTTP2) onWindowUpdate(p1conn protocol.Conn) error {
+	p1state := p1this.p1state
+	header := p1this.header
+	if 4 != header.length {
+		return connError{ErrCodeFrameSize, "window update length"}
+	}
+	increment := int64(binary.BigEndian.Uint32(p1this.sli1payload) & 0x7fffffff)
+
+	p1state.mutex.Lock()
+	defer p1state.mutex.Unlock()
+	var sli1out []byte
+	if 0 == header.streamID {
+		if 0 == increment {
+			return connError{ErrCodeProtocol, "window update increment 0"}
+		}
+		p1state.sendWindow += increment
+		if p1state.sendWindow > maxWindowSize {
+			return connError{ErrCodeFlowControl, "window overflow"}
+		}
+		sli1out = p1state.flushBlocked(nil)
+	} else {
+		p1stream, ok := p1state.mapStream[header.streamID]
+		if !ok || p1stream.isSendEnd {
+			// 已经关闭的 stream，忽略
+			return nil
+		}
+		if 0 == increment {
+			return p1state.resetStreamLocked(p1conn, p1stream.id, ErrCodeProtocol)
+		}
+		p1stream.sendWindow += increment
+		if p1stream.sendWindow > maxWindowSize {
+			return p1state.resetStreamLocked(p1conn, p1stream.id, ErrCodeFlowControl)
+		}
+		sli1out = p1state.flush(nil, p1stream)
+	}
+	if 0 == len(sli1out) {
+		return nil
+	}
+	return p1conn.WriteData(sli1out)
+}
+
+// onRSTStream 对端重置了 stream，没发送的帧不再发送
+func (p1this *HTTP2) onRSTStream() error {
+	p1state := p1this.p1state
+	header := p1this.header
+	if 0 == header.streamID || header.streamID > p1state.lastStreamID {
+		return connError{ErrCodeProtocol, "reset idle stream"}
+	}
+	if 4 != header.length {
+		return connError{ErrCodeFrameSize, "reset stream length"}
+	}
+	p1state.mutex.Lock()
+	defer p1state.mutex.Unlock()
+	p1state.closeStream(header.streamID)
+	return nil
+}
+
+// onHeaders 开始接收一个头块，新的 stream 的请求头，或者已经有的 stream 的 trailer
+func (p1this *HTTP2) onHeaders(p1conn protocol.Conn) (uint8, error) {
+	p1state := p1this.p1state
+	header := p1this.header
+	if 0 == header.streamID {
+		return protocol.MsgActionSkip, connError{ErrCodeProtocol, "headers on stream 0"}
+	}
+	sli1block, err := removePadding(header, p1this.sli1payload)
+	if nil != err {
+		return protocol.MsgActionSkip, err
+	}
+	if header.hasFlag(FlagPriority) {
+		if len(sli1block) < 5 {
+			return protocol.MsgActionSkip, connError{ErrCodeFrameSize, "headers priority"}
+		}
+		sli1block = sli1block[5:]
+	}
+	p1state.isHeaderNewStream = header.streamID > p1state.lastStreamID
+	if p1state.isHeaderNewStream {
+		if 0 == header.streamID%2 {
+			// 客户端创建的 stream ID 是奇数
+			return protocol.MsgActionSkip, connError{ErrCodeProtocol, "even stream id"}
+		}
+		p1state.lastStreamID = header.streamID
+	}
+	p1state.headerStreamID = header.streamID
+	p1state.headerFlags = header.flags
+	p1state.sli1headerBlock = append(p1state.sli1headerBlock[:0], sli1block...)
+	if !header.hasFlag(FlagEndHeaders) {
+		return protocol.MsgActionSkip, nil
+	}
+	return p1this.onHeaderBlock(p1conn)
+}
+
+// onContinuation 接收头块剩下的部分
+func (p1this *HTTP2) onContinuation(p1conn protocol.Conn) (uint8, error) {
+	p1state := p1this.p1state
+	header := p1this.header
+	if 0 == p1state.headerStreamID || header.streamID != p1state.headerStreamID {
+		return protocol.MsgActionSkip, connError{ErrCodeProtocol, "unexpected continuation"}
+	}
+	if len(p1state.sli1headerBlock)+len(p1this.sli1payload) > headerBlockSizeMax {
+		return protocol.MsgActionSkip, connError{ErrCodeEnhanceYourCalm, "header block too large"}
+	}
+	p1state.sli1headerBlock = append(p1state.sli1headerBlock, p1this.sli1payload...)
+	if !header.hasFlag(FlagEndHeaders) {
+		return protocol.MsgActionSkip, nil
+	}
+	return p1this.onHeaderBlock(p1conn)
+}
+
+// onHeaderBlock 头块接收完了，解码之后创建 stream，或者当成 trailer。
+// 不管 stream 还要不要，头块都要解码，不然 HPACK 的动态表就和对端的不一样了
+func (p1this *HTTP2) onHeaderBlock(p1conn protocol.Conn) (uint8, error) {
+	p1state := p1this.p1state
+	streamID := p1state.headerStreamID
+	isEndStream := FlagEndStream == p1state.headerFlags&FlagEndStream
+	p1state.headerStreamID = 0
+
+	var sli1field []hpackField
+	headerListSize := 0
+	err := p1state.p1decoder.decode(p1state.sli1headerBlock, func(name string, value string) error {
+		headerListSize += len(name) + len(value) + headerFieldOverhead
+		if headerListSize <= http.HeaderSizeMax {
+			sli1field = append(sli1field, hpackField{name: name, value: value})
+		}
+		return nil
+	})
+	if nil != err {
+		return protocol.MsgActionSkip, connError{ErrCodeCompression, err.Error()}
+	}
+
+	p1state.mutex.Lock()
+	p1stream, ok := p1state.mapStream[streamID]
+	streamNum := len(p1state.mapStream)
+	p1state.mutex.Unlock()
+
+	if ok {
+		// 已经有的 stream 上的第 2 个头块是 trailer，必须结束 stream
+		if p1stream.isDiscard {
+			return protocol.MsgActionSkip, nil
+		}
+		if p1stream.isRecvEnd {
+			return protocol.MsgActionSkip, p1state.resetStream(p1conn, streamID, ErrCodeStreamClosed)
+		}
+		if !isEndStream {
+			return protocol.MsgActionSkip, p1state.resetStream(p1conn, streamID, ErrCodeProtocol)
+		}
+		p1stream.mapTrailer = make(map[string]string, len(sli1field))
+		for _, field := range sli1field {
+			if strings.HasPrefix(field.name, ":") {
+				return protocol.MsgActionSkip, p1state.resetStream(p1conn, streamID, ErrCodeProtocol)
+			}
+			p1stream.mapTrailer[field.name] = field.value
+		}
+		return p1this.onRequestEnd(p1conn, p1stream)
+	}
+	if !p1state.isHeaderNewStream {
+		// 已经关闭的 stream
+		return protocol.MsgActionSkip, p1state.resetStream(p1conn, streamID, ErrCodeStreamClosed)
+	}
+	if streamNum >= MaxConcurrentStreams {
+		return protocol.MsgActionSkip, p1state.resetStream(p1conn, streamID, ErrCodeRefusedStream)
+	}
+
+	p1stream = &Stream{id: streamID, p1state: p1state, contentLength: -1}
+	p1state.mutex.Lock()
+	p1stream.sendWindow = p1state.initialWindowSize
+	p1state.mapStream[streamID] = p1stream
+	p1state.mutex.Unlock()
+	if headerListSize > http.HeaderSizeMax {
+		return protocol.MsgActionSkip, p1this.refuse(p1conn, p1stream, http.ErrHeaderTooLarge, isEndStream)
+	}
+	if err := p1stream.setHeader(sli1field); nil != err {
+		return protocol.MsgActionSkip, p1state.resetStream(p1conn, streamID, ErrCodeProtocol)
+	}
+	if !isEndStream {
+		return protocol.MsgActionSkip, nil
+	}
+	return p1this.onRequestEnd(p1conn, p1stream)
+}
+
+// onData 接收请求体，收到的数据马上用 WINDOW_UPDATE 还给对端，请求体的大小用 BodySizeMax 限制
+func (p1this *HTTP2) onData(p1conn protocol.Conn) (uint8, error) {
+	p1state := p1this.p1state
+	header := p1this.header
+	if 0 == header.streamID || header.streamID > p1state.lastStreamID {
+		return protocol.MsgActionSkip, connError{ErrCodeProtocol, "data on idle stream"}
+	}
+	sli1data, err := removePadding(header, p1this.sli1payload)
+	if nil != err {
+		return protocol.MsgActionSkip, err
+	}
+
+	p1state.mutex.Lock()
+	p1stream, ok := p1state.mapStream[header.streamID]
+	isRecvEnd := ok && p1stream.isRecvEnd
+	isDiscard := ok && p1stream.isDiscard
+	var sli1out []byte
+	if header.length > 0 {
+		// 填充也算在流量控制里面
+		sli1out = appendWindowUpdate(sli1out, 0, header.length)
+		if ok && !isRecvEnd && !isDiscard && !header.hasFlag(FlagEndStream) {
+			sli1out = appendWindowUpdate(sli1out, header.streamID, header.length)
+		}
+	}
+	p1state.mutex.Unlock()
+	if len(sli1out) > 0 {
+		if err := p1conn.WriteData(sli1out); nil != err {
+			return protocol.MsgActionSkip, err
+		}
+	}
+
+	if !ok || isDiscard {
+		// 已经关闭或者已经回复了错误的 stream，数据不要了
+		return protocol.MsgActionSkip, nil
+	}
+	if isRecvEnd {
+		return protocol.MsgActionSkip, p1state.resetStream(p1conn, header.streamID, ErrCodeStreamClosed)
+	}
+	if len(p1stream.sli1body)+len(sli1data) > BodySizeMax {
+		return protocol.MsgActionSkip, p1this.refuse(p1conn, p1stream, http.ErrBodyTooLarge, header.hasFlag(FlagEndStream))
+	}
+	if p1stream.contentLength >= 0 && int64(len(p1stream.sli1body)+len(sli1data)) > p1stream.contentLength {
+		return protocol.MsgActionSkip, p1state.resetStream(p1conn, header.streamID, ErrCodeProtocol)
+	}
+	p1stream.sli1body = append(p1stream.sli1body, sli1data...)
+	if !header.hasFlag(FlagEndStream) {
+		return protocol.MsgActionSkip, nil
+	}
+	return p1this.onRequestEnd(p1conn, p1stream)
+}
+
+// onRequestEnd 请求接收完了，解码之后交给 OnConnRequest
+func (p1this *HTTP2) onRequestEnd(p1conn protocol.Conn, p1stream *Stream) (uint8, error) {
+	p1state := p1this.p1state
+	p1state.mutex.Lock()
+	p1stream.isRecvEnd = true
+	p1state.mutex.Unlock()
+	if p1stream.contentLength >= 0 && int64(len(p1stream.sli1body)) != p1stream.contentLength {
+		return protocol.MsgActionSkip, p1state.resetStream(p1conn, p1stream.id, ErrCodeProtocol)
+	}
+
+	p1request := http.NewHTTP()
+	err := p1request.DecodeRequest(p1stream.method, p1stream.uri, Version, p1stream.mapHeader, p1stream.sli1body)
+	if nil != err {
+		return protocol.MsgActionSkip, p1this.refuse(p1conn, p1stream, err, true)
+	}
+	p1request.MapTrailer = p1stream.mapTrailer
+	p1stream.p1request = p1request
+	p1stream.mapHeader, p1stream.mapTrailer, p1stream.sli1body = nil, nil, nil
+
+	p1this.p1stream = p1stream
+	p1this.p1response, p1this.p1responseStream = nil, nil
+	return protocol.MsgActionRequest, nil
+}
+
+// refuse 请求有问题，不交给 OnConnRequest，直接按错误回复（和 HTTP/1.1 一样，详见 http.ParseErrResponse）。
+// 请求还没接收完的，后面的数据不要了，响应发送完之后用 NO_ERROR 重置 stream，让对端不用再发送了
+func (p1this *HTTP2) refuse(p1conn protocol.Conn, p1stream *Stream, err error, isRecvEnd bool) error {
+	p1state := p1this.p1state
+	p1state.mutex.Lock()
+	p1stream.isDiscard = true
+	p1stream.isRecvEnd = true
+	p1state.mutex.Unlock()
+	if err := p1state.writeFrames(p1conn, p1stream.MakeResponse(http.ParseErrResponse(err))); nil != err {
+		return err
+	}
+	if isRecvEnd {
+		return nil
+	}
+	p1state.mutex.Lock()
+	defer p1state.mutex.Unlock()
+	if len(p1stream.sli1pending) > 0 {
+		// 响应还没发送完，不能重置，后面的数据照样不要
+		return nil
+	}
+	return p1state.resetStreamLocked(p1conn, p1stream.id, ErrCodeNo)
+}
+
+// setHeader 检查请求头（RFC 9113 8.3），伪头字段放到请求方法和请求目标里，其他的放到 mapHeader
+func (p1this *Stream) setHeader(sli1field []hpackField) error {
+	var scheme, path, authority string
+	isRegular := false
+	mapPseudo := make(map[string]bool, 4)
+	p1this.mapHeader = make(map[string][]string, len(sli1field))
+	for _, field := range sli1field {
+		if strings.HasPrefix(field.name, ":") {
+			// 伪头字段只能在前面，不能重复
+			if isRegular || mapPseudo[field.name] {
+				return http.ErrMalformedMsg
+			}
+			mapPseudo[field.name] = true
+			switch field.name {
+			case ":method":
+				p1this.method = field.value
+			case ":scheme":
+				scheme = field.value
+			case ":path":
+				path = field.value
+			case ":authority":
+				authority = field.value
+			default:
+				return http.ErrMalformedMsg
+			}
+			continue
+		}
+		isRegular = true
+		if strings.ToLower(field.name) != field.name || mapConnectionHeader[field.name] {
+			return http.ErrMalformedMsg
+		}
+		if "te" == field.name && "trailers" != field.value {
+			return http.ErrMalformedMsg
+		}
+		p1this.mapHeader[field.name] = append(p1this.mapHeader[field.name], field.value)
+	}
+
+	if "" == p1this.method {
+		return http.ErrMalformedMsg
+	}
+	if "CONNECT" == p1this.method {
+		if "" != scheme || "" != path || "" == authority {
+			return http.ErrMalformedMsg
+		}
+		p1this.uri = authority
+	} else {
+		if "" == scheme || "" == path {
+			return http.ErrMalformedMsg
+		}
+		p1this.uri = path
+	}
+	if "" != authority && 0 == len(p1this.mapHeader["host"]) {
+		p1this.mapHeader["host"] = []string{authority}
+	}
+	if sli1cookie := p1this.mapHeader["cookie"]; len(sli1cookie) > 1 {
+		// 分开发送的 cookie 合成一个（RFC 9113 8.2.3）
+		p1this.mapHeader["cookie"] = []string{strings.Join(sli1cookie, "; ")}
+	}
+	if sli1cl := p1this.mapHeader["content-length"]; len(sli1cl) > 0 {
+		contentLength, err := strconv.ParseInt(sli1cl[0], 10, 64)
+		if nil != err || contentLength < 0 || len(sli1cl) > 1 {
+			return http.ErrMalformedMsg
+		}
+		p1this.contentLength = contentLength
+	}
+	return nil
+}
+
+// resetStream 用 RST_STREAM 重置 stream，没发送的帧不再发送
+func (p1this *connState) resetStream(p1conn protocol.Conn, streamID uint32, errCode uint32) error {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	return p1this.resetStreamLocked(p1conn, streamID, errCode)
+}
+
+// resetStreamLocked 和 resetStream 一样，在锁里面调用
+func (p1this *connState) resetStreamLocked(p1conn protocol.Conn, streamID uint32, errCode uint32) error {
+	p1this.closeStream(streamID)
+	return p1conn.WriteData(appendRSTStream(nil, streamID, errCode))
+}
+
+// closeStream 关闭 stream，没发送的帧不再发送，在锁里面调用
+func (p1this *connState) closeStream(streamID uint32) {
+	if p1stream, ok := p1this.mapStream[streamID]; ok {
+		p1stream.isRecvEnd = true
+		p1stream.isSendEnd = true
+		p1stream.sli1pending = nil
+		delete(p1this.mapStream, streamID)
+	}
+}
+
+// hasToken 逗号分隔的值里有没有这个 token，不区分大小写
+func hasToken(sli1value []string, token string) bool {
+	for _, value := range sli1value {
+		for _, t1token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t1token), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isPreface 数据是不是连接序言开头的，数据不够的时候，是连接序言的前缀也算
+func isPreface(sli1data []byte) bool {
+	if len(sli1data) > len(ClientPreface) {
+		sli1data = sli1data[:len(ClientPreface)]
+	}
+	return bytes.Equal(sli1data, []byte(ClientPreface[:len(sli1data)]))
+}
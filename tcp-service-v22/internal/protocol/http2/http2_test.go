@@ -0,0 +1,645 @@
+package http2
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	goErrors "errors"
+	"strings"
+	"testing"
+
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+	"tcp-service-go/tcp-service-v22/internal/protocol/protocoltest"
+)
+
+// testConn 测试用的服务端连接，接收的数据按 HandleBuffer 的流程处理，p1protocol 是连接上的协议实例
+type testConn struct {
+	*protocoltest.Conn
+	p1protocol *HTTP2
+}
+
+func newTestConn() *testConn {
+	return newSideTestConn(protocol.SideService)
+}
+
+func newSideTestConn(side uint8) *testConn {
+	p1protocol := NewHTTP2()
+	return &testConn{Conn: protocoltest.NewConn(protocol.HTTP2Str, side, p1protocol), p1protocol: p1protocol}
+}
+
+// recv 接收数据，返回请求接收完的 stream。
+// 返回 error 的时候，ErrMsg 构造的回复已经发送
+func (p1this *testConn) recv(sli1data []byte) ([]*Stream, error) {
+	var sli1stream []*Stream
+	err := p1this.Recv(sli1data, func() {
+		sli1stream = append(sli1stream, p1this.p1protocol.GetStream())
+	})
+	return sli1stream, err
+}
+
+// mustRecv 和 recv 一样，出错的时候测试失败
+func (p1this *testConn) mustRecv(t *testing.T, sli1data []byte) []*Stream {
+	t.Helper()
+	sli1stream, err := p1this.recv(sli1data)
+	if nil != err {
+		t.Fatal("recv:", err)
+	}
+	return sli1stream
+}
+
+// takeFrames 取出发送的数据，按帧分开
+func (p1this *testConn) takeFrames(t *testing.T) []testFrame {
+	t.Helper()
+	return parseTestFrames(t, p1this.TakeWritten())
+}
+
+// testFrame 一个帧
+type testFrame struct {
+	frameHeader
+	sli1payload []byte
+}
+
+func parseTestFrames(t *testing.T, sli1data []byte) []testFrame {
+	t.Helper()
+	var sli1frame []testFrame
+	for len(sli1data) > 0 {
+		if len(sli1data) < frameHeaderLen {
+			t.Fatalf("incomplete frame header: %x", sli1data)
+		}
+		header := parseFrameHeader(sli1data)
+		frameLen := frameHeaderLen + int(header.length)
+		if frameLen > len(sli1data) {
+			t.Fatalf("incomplete frame: %+v", header)
+		}
+		sli1frame = append(sli1frame, testFrame{header, sli1data[frameHeaderLen:frameLen]})
+		sli1data = sli1data[frameLen:]
+	}
+	return sli1frame
+}
+
+// frameTypes 帧的类型和 stream ID，比较的时候用
+func frameTypes(sli1frame []testFrame) []frameHeader {
+	sli1header := make([]frameHeader, 0, len(sli1frame))
+	for _, frame := range sli1frame {
+		sli1header = append(sli1header, frameHeader{frameType: frame.frameType, streamID: frame.streamID, flags: frame.flags})
+	}
+	return sli1header
+}
+
+// headersFrame 构造请求头的 HEADERS 帧，sli1kv 是键值对
+func headersFrame(streamID uint32, flags uint8, sli1kv ...string) []byte {
+	var sli1block []byte
+	for i := 0; i+1 < len(sli1kv); i += 2 {
+		sli1block = appendHeaderField(sli1block, sli1kv[i], sli1kv[i+1])
+	}
+	return appendFrame(nil, FrameHeaders, flags, streamID, sli1block)
+}
+
+// getHeaders 一个 GET 请求的 HEADERS 帧
+func getHeaders(streamID uint32, path string) []byte {
+	return headersFrame(streamID, FlagEndHeaders|FlagEndStream, ":method", "GET", ":scheme", "http", ":path", path, ":authority", "example.com")
+}
+
+// startConn 用 prior knowledge 开始一个连接，交换 SETTINGS
+func startConn(t *testing.T, sli1setting ...setting) *testConn {
+	t.Helper()
+	p1conn := newTestConn()
+	p1conn.mustRecv(t, append([]byte(ClientPreface), appendSettings(nil, sli1setting...)...))
+	sli1frame := p1conn.takeFrames(t)
+	if 2 != len(sli1frame) || FrameSettings != sli1frame[0].frameType || sli1frame[0].hasFlag(FlagAck) ||
+		FrameSettings != sli1frame[1].frameType || !sli1frame[1].hasFlag(FlagAck) {
+		t.Fatalf("frames after preface = %+v, want SETTINGS and SETTINGS ACK", frameTypes(sli1frame))
+	}
+	return p1conn
+}
+
+// decodeResponseHeaders 解码响应头块
+func decodeResponseHeaders(t *testing.T, sli1block []byte) map[string]string {
+	t.Helper()
+	mapHeader := make(map[string]string)
+	if err := newHpackDecoder().decode(sli1block, func(name string, value string) error {
+		mapHeader[name] = value
+		return nil
+	}); nil != err {
+		t.Fatal(err)
+	}
+	return mapHeader
+}
+
+// sendResponse 用 SetResponse 设置响应，和 SendResponse 一样通过 encode 发送
+func sendResponse(t *testing.T, p1conn *testConn, p1stream *Stream, body string) {
+	t.Helper()
+	resp := http.NewResponse()
+	resp.SetStatusCode(http.StatusOk)
+	resp.SetBody([]byte(body))
+	if _, err := encode(p1conn, p1stream.MakeResponse(resp)); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestPriorKnowledge(t *testing.T) {
+	p1conn := startConn(t)
+	sli1stream := p1conn.mustRecv(t, getHeaders(1, "/a%20b?x=1&x=2"))
+	if 1 != len(sli1stream) || 1 != sli1stream[0].GetID() {
+		t.Fatalf("streams = %v", sli1stream)
+	}
+	p1request := sli1stream[0].GetRequest()
+	if "GET" != p1request.Method || "/a b" != p1request.Path || 2 != len(p1request.MapQuery["x"]) ||
+		Version != p1request.Version || "example.com" != p1request.GetHeader("host") {
+		t.Fatalf("request = %+v", p1request)
+	}
+
+	// SetResponse 之后用空数据发送
+	p1conn.p1protocol.SetResponse(newTestResponse("hello"))
+	if _, err := encode(p1conn, nil); nil != err {
+		t.Fatal(err)
+	}
+	sli1frame := p1conn.takeFrames(t)
+	if 2 != len(sli1frame) || FrameHeaders != sli1frame[0].frameType || !sli1frame[0].hasFlag(FlagEndHeaders) || sli1frame[0].hasFlag(FlagEndStream) ||
+		FrameData != sli1frame[1].frameType || !sli1frame[1].hasFlag(FlagEndStream) || "hello" != string(sli1frame[1].sli1payload) {
+		t.Fatalf("response frames = %+v", frameTypes(sli1frame))
+	}
+	mapHeader := decodeResponseHeaders(t, sli1frame[0].sli1payload)
+	if "200" != mapHeader[":status"] || "5" != mapHeader["content-length"] {
+		t.Fatalf("response headers = %v", mapHeader)
+	}
+	// 发送完之后 stream 关闭了
+	if 0 != len(p1conn.p1protocol.p1state.mapStream) {
+		t.Fatalf("%d streams left", len(p1conn.p1protocol.p1state.mapStream))
+	}
+
+	// 请求体分几个 DATA 帧发送，每个都用 WINDOW_UPDATE 还给对端
+	sli1data := headersFrame(3, FlagEndHeaders, ":method", "POST", ":scheme", "http", ":path", "/p", "content-length", "11")
+	sli1data = appendFrame(sli1data, FrameData, 0, 3, []byte("hello "))
+	sli1data = appendFrame(sli1data, FrameData, FlagEndStream|FlagPadded, 3, []byte("\x02world\x00\x00"))
+	sli1stream = p1conn.mustRecv(t, sli1data)
+	if 1 != len(sli1stream) || "hello world" != string(sli1stream[0].GetRequest().Sli1Body) {
+		t.Fatalf("streams = %v", sli1stream)
+	}
+	want := []frameHeader{
+		{frameType: FrameWindowUpdate, streamID: 0},
+		{frameType: FrameWindowUpdate, streamID: 3},
+		{frameType: FrameWindowUpdate, streamID: 0},
+	}
+	if sli1frame = p1conn.takeFrames(t); !equalHeaders(want, frameTypes(sli1frame)) {
+		t.Fatalf("frames = %+v, want %+v", frameTypes(sli1frame), want)
+	}
+}
+
+func newTestResponse(body string) *http.Response {
+	resp := http.NewResponse()
+	resp.SetStatusCode(http.StatusOk)
+	resp.SetBody([]byte(body))
+	return resp
+}
+
+func equalHeaders(sli1want []frameHeader, sli1header []frameHeader) bool {
+	if len(sli1want) != len(sli1header) {
+		return false
+	}
+	for i := range sli1want {
+		if sli1want[i] != sli1header[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestPing PING 原样回复 ACK，收到的 ACK 忽略
+func TestPing(t *testing.T) {
+	p1conn := startConn(t)
+	p1conn.mustRecv(t, appendFrame(nil, FramePing, 0, 0, []byte("12345678")))
+	p1conn.mustRecv(t, appendFrame(nil, FramePing, FlagAck, 0, []byte("abcdefgh")))
+	sli1frame := p1conn.takeFrames(t)
+	if 1 != len(sli1frame) || FramePing != sli1frame[0].frameType || !sli1frame[0].hasFlag(FlagAck) || "12345678" != string(sli1frame[0].sli1payload) {
+		t.Fatalf("frames = %+v", frameTypes(sli1frame))
+	}
+}
+
+// TestConnError 连接错误回复 GOAWAY，错误码和 RFC 9113 的一致
+func TestConnError(t *testing.T) {
+	sli1test := []struct {
+		name      string
+		isNoStart bool
+		sli1data  []byte
+		errCode   uint32
+	}{
+		{"first frame not settings", true, append([]byte(ClientPreface), appendFrame(nil, FramePing, 0, 0, make([]byte, 8))...), ErrCodeProtocol},
+		{"frame too large", false, appendFrame(nil, FrameData, 0, 1, make([]byte, DefaultMaxFrameSize+1)), ErrCodeFrameSize},
+		{"push promise", false, appendFrame(nil, FramePushPromise, FlagEndHeaders, 1, make([]byte, 4)), ErrCodeProtocol},
+		{"ping on stream", false, appendFrame(nil, FramePing, 0, 1, make([]byte, 8)), ErrCodeProtocol},
+		{"ping length", false, appendFrame(nil, FramePing, 0, 0, make([]byte, 7)), ErrCodeFrameSize},
+		{"settings on stream", false, appendFrame(nil, FrameSettings, 0, 1, nil), ErrCodeProtocol},
+		{"settings length", false, appendFrame(nil, FrameSettings, 0, 0, make([]byte, 5)), ErrCodeFrameSize},
+		{"settings ack with payload", false, appendFrame(nil, FrameSettings, FlagAck, 0, make([]byte, 6)), ErrCodeFrameSize},
+		{"enable push 2", false, appendSettings(nil, setting{SettingEnablePush, 2}), ErrCodeProtocol},
+		{"initial window size too large", false, appendSettings(nil, setting{SettingInitialWindowSize, 1 << 31}), ErrCodeFlowControl},
+		{"max frame size too small", false, appendSettings(nil, setting{SettingMaxFrameSize, 16383}), ErrCodeProtocol},
+		{"max frame size too large", false, appendSettings(nil, setting{SettingMaxFrameSize, 1 << 24}), ErrCodeProtocol},
+		{"goaway on stream", false, appendFrame(nil, FrameGoAway, 0, 1, make([]byte, 8)), ErrCodeProtocol},
+		{"goaway length", false, appendFrame(nil, FrameGoAway, 0, 0, make([]byte, 7)), ErrCodeFrameSize},
+		{"priority on stream 0", false, appendFrame(nil, FramePriority, 0, 0, make([]byte, 5)), ErrCodeProtocol},
+		{"rst stream on idle stream", false, appendRSTStream(nil, 1, ErrCodeCancel), ErrCodeProtocol},
+		{"rst stream length", false, append(getHeaders(1, "/"), appendFrame(nil, FrameRSTStream, 0, 1, make([]byte, 3))...), ErrCodeFrameSize},
+		{"window update length", false, appendFrame(nil, FrameWindowUpdate, 0, 0, make([]byte, 3)), ErrCodeFrameSize},
+		{"window update 0 on connection", false, appendWindowUpdate(nil, 0, 0), ErrCodeProtocol},
+		{"connection window overflow", false, appendWindowUpdate(nil, 0, 1<<31-1), ErrCodeFlowControl},
+		{"headers on stream 0", false, getHeaders(0, "/"), ErrCodeProtocol},
+		{"even stream id", false, getHeaders(2, "/"), ErrCodeProtocol},
+		{"headers bad padding", false, appendFrame(nil, FrameHeaders, FlagEndHeaders|FlagPadded, 1, []byte{9, 0x82}), ErrCodeProtocol},
+		{"headers priority too short", false, appendFrame(nil, FrameHeaders, FlagEndHeaders|FlagPriority, 1, []byte{0, 0}), ErrCodeFrameSize},
+		{"continuation expected", false, append(headersFrame(1, 0, ":method", "GET"), appendFrame(nil, FramePing, 0, 0, make([]byte, 8))...), ErrCodeProtocol},
+		{"continuation on another stream", false, append(headersFrame(1, 0, ":method", "GET"), appendFrame(nil, FrameContinuation, FlagEndHeaders, 3, nil)...), ErrCodeProtocol},
+		{"unexpected continuation", false, appendFrame(nil, FrameContinuation, FlagEndHeaders, 1, nil), ErrCodeProtocol},
+		{"header block too large", false, append(headersFrame(1, 0, ":method", "GET"), appendFrame(nil, FrameContinuation, 0, 1, make([]byte, headerBlockSizeMax))...), ErrCodeFrameSize},
+		{"bad hpack", false, appendFrame(nil, FrameHeaders, FlagEndHeaders|FlagEndStream, 1, []byte{0x80}), ErrCodeCompression},
+		{"data on idle stream", false, appendFrame(nil, FrameData, FlagEndStream, 1, []byte("x")), ErrCodeProtocol},
+		{"data on stream 0", false, appendFrame(nil, FrameData, 0, 0, []byte("x")), ErrCodeProtocol},
+		{"data bad padding", false, append(headersFrame(1, FlagEndHeaders, ":method", "POST", ":scheme", "http", ":path", "/"),
+			appendFrame(nil, FrameData, FlagPadded, 1, []byte{5, 'x'})...), ErrCodeProtocol},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1conn := newTestConn()
+			if !t1test.isNoStart {
+				p1conn = startConn(t)
+			}
+			_, err := p1conn.recv(t1test.sli1data)
+			var t1connErr connError
+			if !goErrors.As(err, &t1connErr) || t1test.errCode != t1connErr.code {
+				t.Fatalf("recv() = %v, want connection error %d", err, t1test.errCode)
+			}
+			if protocol.ErrTypeFatal != classifyErr(p1conn, err) {
+				t.Fatal("connection error is not fatal")
+			}
+			// 没有交换过 SETTINGS 的连接，GOAWAY 前面是收到连接序言时发送的 SETTINGS
+			sli1frame := p1conn.takeFrames(t)
+			if 0 == len(sli1frame) {
+				t.Fatal("nothing written, want GOAWAY")
+			}
+			if last := sli1frame[len(sli1frame)-1]; FrameGoAway != last.frameType || t1test.errCode != binary.BigEndian.Uint32(last.sli1payload[4:]) {
+				t.Fatalf("written = %+v, want GOAWAY", frameTypes(sli1frame))
+			}
+		})
+	}
+}
+
+// TestStreamError stream 错误用 RST_STREAM 重置这个 stream，连接上的其他 stream 不受影响
+func TestStreamError(t *testing.T) {
+	sli1post := headersFrame(1, FlagEndHeaders, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "3")
+	sli1test := []struct {
+		name     string
+		sli1data []byte
+		streamID uint32
+		errCode  uint32
+	}{
+		{"priority length", appendFrame(nil, FramePriority, 0, 1, make([]byte, 4)), 1, ErrCodeFrameSize},
+		{"window update 0 on stream", append(getHeaders(1, "/"), appendWindowUpdate(nil, 1, 0)...), 1, ErrCodeProtocol},
+		{"stream window overflow", append(getHeaders(1, "/"), appendWindowUpdate(nil, 1, 1<<31-1)...), 1, ErrCodeFlowControl},
+		{"missing path", headersFrame(1, FlagEndHeaders|FlagEndStream, ":method", "GET", ":scheme", "http"), 1, ErrCodeProtocol},
+		{"missing method", headersFrame(1, FlagEndHeaders|FlagEndStream, ":scheme", "http", ":path", "/"), 1, ErrCodeProtocol},
+		{"data after end stream", append(getHeaders(1, "/"), appendFrame(nil, FrameData, 0, 1, []byte("x"))...), 1, ErrCodeStreamClosed},
+		{"headers after end stream", append(getHeaders(1, "/"), getHeaders(1, "/")...), 1, ErrCodeStreamClosed},
+		{"body longer than content length", append(sli1post, appendFrame(nil, FrameData, FlagEndStream, 1, []byte("abcd"))...), 1, ErrCodeProtocol},
+		{"body shorter than content length", append(sli1post, appendFrame(nil, FrameData, FlagEndStream, 1, []byte("ab"))...), 1, ErrCodeProtocol},
+		{"trailer without end stream", append(sli1post, headersFrame(1, FlagEndHeaders, "x-sum", "1")...), 1, ErrCodeProtocol},
+		{"pseudo header in trailer", append(sli1post, headersFrame(1, FlagEndHeaders|FlagEndStream, ":path", "/")...), 1, ErrCodeProtocol},
+		{"headers on a closed stream", append(append(getHeaders(3, "/"), appendRSTStream(nil, 3, ErrCodeCancel)...), getHeaders(1, "/")...), 1, ErrCodeStreamClosed},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1conn := startConn(t)
+			p1conn.mustRecv(t, t1test.sli1data)
+			var p1rst *testFrame
+			for _, frame := range p1conn.takeFrames(t) {
+				if FrameRSTStream == frame.frameType {
+					t1frame := frame
+					p1rst = &t1frame
+				}
+			}
+			if nil == p1rst || t1test.streamID != p1rst.streamID || t1test.errCode != binary.BigEndian.Uint32(p1rst.sli1payload) {
+				t.Fatalf("RST_STREAM = %+v, want stream %d error %d", p1rst, t1test.streamID, t1test.errCode)
+			}
+			// 连接还能用
+			if sli1stream := p1conn.mustRecv(t, getHeaders(101, "/")); 1 != len(sli1stream) {
+				t.Fatal("connection is not usable after a stream error")
+			}
+		})
+	}
+}
+
+// TestMaxConcurrentStreams 超过 MaxConcurrentStreams 的 stream 回复 REFUSED_STREAM
+func TestMaxConcurrentStreams(t *testing.T) {
+	p1conn := startConn(t)
+	var sli1data []byte
+	for i := 0; i < MaxConcurrentStreams; i++ {
+		sli1data = append(sli1data, headersFrame(uint32(2*i+1), FlagEndHeaders, ":method", "POST", ":scheme", "http", ":path", "/")...)
+	}
+	p1conn.mustRecv(t, sli1data)
+	if sli1frame := p1conn.takeFrames(t); 0 != len(sli1frame) {
+		t.Fatalf("frames = %+v", frameTypes(sli1frame))
+	}
+	p1conn.mustRecv(t, getHeaders(uint32(2*MaxConcurrentStreams+1), "/"))
+	sli1frame := p1conn.takeFrames(t)
+	if 1 != len(sli1frame) || FrameRSTStream != sli1frame[0].frameType || ErrCodeRefusedStream != binary.BigEndian.Uint32(sli1frame[0].sli1payload) {
+		t.Fatalf("frames = %+v, want REFUSED_STREAM", frameTypes(sli1frame))
+	}
+}
+
+// TestRefuse 请求有问题的，不交给 OnConnRequest，和 HTTP/1.1 一样回复错误的响应
+func TestRefuse(t *testing.T) {
+	p1conn := startConn(t)
+	sli1data := headersFrame(1, FlagEndHeaders|FlagEndStream, ":method", "GET", ":scheme", "http", ":path", "/%zz")
+	if sli1stream := p1conn.mustRecv(t, sli1data); 0 != len(sli1stream) {
+		t.Fatal("bad request should not be handed to OnConnRequest")
+	}
+	sli1frame := p1conn.takeFrames(t)
+	if 0 == len(sli1frame) || FrameHeaders != sli1frame[0].frameType {
+		t.Fatalf("frames = %+v", frameTypes(sli1frame))
+	}
+	if mapHeader := decodeResponseHeaders(t, sli1frame[0].sli1payload); "400" != mapHeader[":status"] || "" != mapHeader["connection"] {
+		t.Fatalf("response headers = %v", mapHeader)
+	}
+
+	// 请求体太大的，回复 413 之后用 NO_ERROR 重置，后面的数据不要了
+	sli1data = headersFrame(3, FlagEndHeaders, ":method", "POST", ":scheme", "http", ":path", "/")
+	for i := 0; i <= BodySizeMax/DefaultMaxFrameSize; i++ {
+		sli1data = appendFrame(sli1data, FrameData, 0, 3, make([]byte, DefaultMaxFrameSize))
+	}
+	// 发送窗口要够发送响应
+	sli1data = append(appendWindowUpdate(nil, 0, 1<<20), sli1data...)
+	if sli1stream := p1conn.mustRecv(t, sli1data); 0 != len(sli1stream) {
+		t.Fatal("request with a large body should not be handed to OnConnRequest")
+	}
+	isResponded, isReset := false, false
+	for _, frame := range p1conn.takeFrames(t) {
+		if 3 != frame.streamID {
+			continue
+		}
+		switch frame.frameType {
+		case FrameHeaders:
+			isResponded = "413" == decodeResponseHeaders(t, frame.sli1payload)[":status"]
+		case FrameRSTStream:
+			isReset = ErrCodeNo == binary.BigEndian.Uint32(frame.sli1payload)
+		}
+	}
+	if !isResponded || !isReset {
+		t.Fatalf("413 responded %v, reset %v", isResponded, isReset)
+	}
+}
+
+// TestApplySettings SETTINGS_INITIAL_WINDOW_SIZE 按差值调整已经有的 stream 的发送窗口，调大之后发送挡住的帧
+func TestApplySettings(t *testing.T) {
+	sli1test := []struct {
+		name        string
+		sli1setting []setting
+		isErr       bool
+		errCode     uint32
+		window      int64
+		initial     int64
+	}{
+		{"no settings", nil, false, 0, 100, DefaultInitialWindowSize},
+		{"bigger", []setting{{SettingInitialWindowSize, 65545}}, false, 0, 110, 65545},
+		{"smaller", []setting{{SettingInitialWindowSize, 65525}}, false, 0, 90, 65525},
+		{"negative window", []setting{{SettingInitialWindowSize, 0}}, false, 0, 100 - DefaultInitialWindowSize, 0},
+		{"last one wins", []setting{{SettingInitialWindowSize, 0}, {SettingInitialWindowSize, 65536}}, false, 0, 101, 65536},
+		{"max", []setting{{SettingInitialWindowSize, uint32(maxWindowSize)}}, false, 0, 100 + maxWindowSize - DefaultInitialWindowSize, maxWindowSize},
+		{"too large", []setting{{SettingInitialWindowSize, uint32(maxWindowSize) + 1}}, true, ErrCodeFlowControl, 0, 0},
+		{"enable push", []setting{{SettingEnablePush, 0}, {SettingEnablePush, 1}}, false, 0, 100, DefaultInitialWindowSize},
+		{"enable push 2", []setting{{SettingEnablePush, 2}}, true, ErrCodeProtocol, 0, 0},
+		{"max frame size", []setting{{SettingMaxFrameSize, maxFrameSizeLimit}}, false, 0, 100, DefaultInitialWindowSize},
+		{"max frame size too small", []setting{{SettingMaxFrameSize, uint32(DefaultMaxFrameSize) - 1}}, true, ErrCodeProtocol, 0, 0},
+		{"unknown ignored", []setting{{0xff, 1}, {SettingHeaderTableSize, 0}}, false, 0, 100, DefaultInitialWindowSize},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1state := NewHTTP2().p1state
+			p1stream := &Stream{id: 1, p1state: p1state, sendWindow: 100}
+			p1state.mapStream[1] = p1stream
+			_, err := p1state.applySettings(nil, t1test.sli1setting)
+			if t1test.isErr {
+				if t1err, ok := err.(connError); !ok || t1test.errCode != t1err.code {
+					t.Fatalf("applySettings() = %v, want connection error %d", err, t1test.errCode)
+				}
+				return
+			}
+			if nil != err || t1test.window != p1stream.sendWindow || t1test.initial != p1state.initialWindowSize {
+				t.Fatalf("applySettings() = %v, stream window %d, initial %d, want %d, %d", err, p1stream.sendWindow, p1state.initialWindowSize, t1test.window, t1test.initial)
+			}
+		})
+	}
+
+	// 调大之后 stream 的窗口超过最大值
+	p1state := NewHTTP2().p1state
+	p1state.mapStream[1] = &Stream{id: 1, p1state: p1state, sendWindow: maxWindowSize}
+	_, err := p1state.applySettings(nil, []setting{{SettingInitialWindowSize, uint32(DefaultInitialWindowSize) + 1}})
+	if t1err, ok := err.(connError); !ok || ErrCodeFlowControl != t1err.code {
+		t.Fatalf("applySettings() = %v, want FLOW_CONTROL_ERROR", err)
+	}
+
+	// 调大之后发送窗口不够时存起来的帧
+	p1state = NewHTTP2().p1state
+	p1stream := &Stream{id: 1, p1state: p1state, sendWindow: 0}
+	p1stream.sli1pending = [][]byte{appendFrame(nil, FrameData, FlagEndStream, 1, []byte("abc"))}
+	p1state.mapStream[1] = p1stream
+	sli1out, err := p1state.applySettings([]byte("x"), []setting{{SettingInitialWindowSize, uint32(DefaultInitialWindowSize) + 2}})
+	if nil != err || "x" != string(sli1out[:1]) {
+		t.Fatalf("applySettings() = %q, %v", sli1out, err)
+	}
+	if sli1frame := parseTestFrames(t, sli1out[1:]); 1 != len(sli1frame) || "ab" != string(sli1frame[0].sli1payload) || sli1frame[0].hasFlag(FlagEndStream) {
+		t.Fatalf("frames flushed = %+v", frameTypes(sli1frame))
+	}
+}
+
+// TestFlowControl 发送窗口不够的时候先发送一部分，WINDOW_UPDATE 或者 SETTINGS 调大窗口之后再发送剩下的
+func TestFlowControl(t *testing.T) {
+	p1conn := startConn(t, setting{SettingInitialWindowSize, 10})
+	p1stream := p1conn.mustRecv(t, getHeaders(1, "/"))[0]
+	sendResponse(t, p1conn, p1stream, strings.Repeat("a", 25))
+	sli1frame := p1conn.takeFrames(t)
+	if 2 != len(sli1frame) || FrameHeaders != sli1frame[0].frameType || 10 != sli1frame[1].length || sli1frame[1].hasFlag(FlagEndStream) {
+		t.Fatalf("frames = %+v, want HEADERS and 10 bytes of DATA", frameTypes(sli1frame))
+	}
+
+	// stream 的窗口
+	p1conn.mustRecv(t, appendWindowUpdate(nil, 1, 10))
+	if sli1frame = p1conn.takeFrames(t); 1 != len(sli1frame) || 10 != sli1frame[0].length || sli1frame[0].hasFlag(FlagEndStream) {
+		t.Fatalf("frames after WINDOW_UPDATE = %+v", frameTypes(sli1frame))
+	}
+	// 连接的窗口变大，stream 的窗口还是 0，不能发送
+	p1conn.mustRecv(t, appendWindowUpdate(nil, 0, 100))
+	if sli1frame = p1conn.takeFrames(t); 0 != len(sli1frame) {
+		t.Fatalf("frames after connection WINDOW_UPDATE = %+v", frameTypes(sli1frame))
+	}
+	// SETTINGS 调大初始窗口
+	p1conn.mustRecv(t, appendSettings(nil, setting{SettingInitialWindowSize, 100}))
+	sli1frame = p1conn.takeFrames(t)
+	if 2 != len(sli1frame) || FrameSettings != sli1frame[0].frameType || 5 != sli1frame[1].length || !sli1frame[1].hasFlag(FlagEndStream) {
+		t.Fatalf("frames after SETTINGS = %+v", frameTypes(sli1frame))
+	}
+	// 已经发送完的 stream 的 WINDOW_UPDATE 忽略
+	p1conn.mustRecv(t, appendWindowUpdate(nil, 1, 10))
+	if sli1frame = p1conn.takeFrames(t); 0 != len(sli1frame) {
+		t.Fatalf("frames after WINDOW_UPDATE on a closed stream = %+v", frameTypes(sli1frame))
+	}
+
+	// 连接的窗口挡住的，连接 WINDOW_UPDATE 之后按顺序发送
+	p1conn = startConn(t, setting{SettingInitialWindowSize, 1 << 20})
+	sli1stream := p1conn.mustRecv(t, append(getHeaders(1, "/"), getHeaders(3, "/")...))
+	sendResponse(t, p1conn, sli1stream[0], strings.Repeat("a", int(DefaultInitialWindowSize)+10))
+	sendResponse(t, p1conn, sli1stream[1], "b")
+	dataLen := 0
+	for _, frame := range p1conn.takeFrames(t) {
+		if FrameData == frame.frameType {
+			dataLen += int(frame.length)
+		}
+	}
+	if int(DefaultInitialWindowSize) != dataLen {
+		t.Fatalf("sent %d bytes of DATA, want %d", dataLen, DefaultInitialWindowSize)
+	}
+	p1conn.mustRecv(t, appendWindowUpdate(nil, 0, 11))
+	// 第 4 个 DATA 帧只发送了一部分，剩下的和最后一个帧按顺序发送
+	want := []frameHeader{
+		{frameType: FrameData, streamID: 1},
+		{frameType: FrameData, flags: FlagEndStream, streamID: 1},
+		{frameType: FrameData, flags: FlagEndStream, streamID: 3},
+	}
+	if sli1frame = p1conn.takeFrames(t); !equalHeaders(want, frameTypes(sli1frame)) {
+		t.Fatalf("frames after connection WINDOW_UPDATE = %+v, want %+v", frameTypes(sli1frame), want)
+	}
+}
+
+// TestRSTStream 对端重置之后，没发送的帧不再发送
+func TestRSTStream(t *testing.T) {
+	p1conn := startConn(t, setting{SettingInitialWindowSize, 1})
+	p1stream := p1conn.mustRecv(t, getHeaders(1, "/"))[0]
+	sendResponse(t, p1conn, p1stream, "hello")
+	p1conn.takeFrames(t)
+	p1conn.mustRecv(t, appendRSTStream(nil, 1, ErrCodeCancel))
+	p1conn.mustRecv(t, appendWindowUpdate(nil, 1, 100))
+	sendResponse(t, p1conn, p1stream, "again")
+	if sli1frame := p1conn.takeFrames(t); 0 != len(sli1frame) {
+		t.Fatalf("frames after RST_STREAM = %+v", frameTypes(sli1frame))
+	}
+}
+
+// makeUpgradeRequest 构造升级请求，settings 是 HTTP2-Settings 的值
+func makeUpgradeRequest(connection string, settings string) string {
+	return "GET /up?x=1 HTTP/1.1\r\nHost: example.com\r\nConnection: " + connection + "\r\nUpgrade: h2c\r\n" +
+		"HTTP2-Settings: " + settings + "\r\n\r\n"
+}
+
+// TestUpgrade h2c 升级：回复 101 和 SETTINGS，升级请求当成 stream 1 交给 OnConnRequest，
+// 响应等收到客户端的连接序言之后再发送
+func TestUpgrade(t *testing.T) {
+	settings := base64.RawURLEncoding.EncodeToString(appendSettings(nil, setting{SettingInitialWindowSize, 3})[frameHeaderLen:])
+	p1conn := newTestConn()
+	sli1stream := p1conn.mustRecv(t, []byte(makeUpgradeRequest("Upgrade, HTTP2-Settings", settings)))
+	if 1 != len(sli1stream) || 1 != sli1stream[0].GetID() {
+		t.Fatalf("streams = %v", sli1stream)
+	}
+	p1request := sli1stream[0].GetRequest()
+	if Version != p1request.Version || "/up" != p1request.Path || "" != p1request.GetHeader("upgrade") || "" != p1request.GetHeader("http2-settings") {
+		t.Fatalf("request = %+v", p1request)
+	}
+	sli1written := string(p1conn.TakeWritten())
+	const switching = "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"
+	if !strings.HasPrefix(sli1written, switching) {
+		t.Fatalf("written = %q", sli1written)
+	}
+	if sli1frame := parseTestFrames(t, []byte(sli1written[len(switching):])); 1 != len(sli1frame) || FrameSettings != sli1frame[0].frameType {
+		t.Fatalf("frames after 101 = %+v", frameTypes(sli1frame))
+	}
+
+	// 还没收到连接序言，响应先存起来
+	sendResponse(t, p1conn, sli1stream[0], "hello")
+	if 0 != len(p1conn.Written()) {
+		t.Fatalf("response sent before the preface: %q", p1conn.Written())
+	}
+	// 收到连接序言之后发送，HTTP2-Settings 设置的窗口只有 3 字节
+	p1conn.mustRecv(t, []byte(ClientPreface))
+	sli1frame := p1conn.takeFrames(t)
+	if 2 != len(sli1frame) || FrameHeaders != sli1frame[0].frameType || "hel" != string(sli1frame[1].sli1payload) {
+		t.Fatalf("frames after preface = %+v", frameTypes(sli1frame))
+	}
+	p1conn.mustRecv(t, appendSettings(nil))
+	if sli1frame = p1conn.takeFrames(t); 1 != len(sli1frame) || !sli1frame[0].hasFlag(FlagAck) {
+		t.Fatalf("frames after SETTINGS = %+v", frameTypes(sli1frame))
+	}
+	if sli1stream = p1conn.mustRecv(t, getHeaders(3, "/")); 1 != len(sli1stream) {
+		t.Fatal("stream 3 after upgrade")
+	}
+
+	// 升级之后连接序言不对的是连接错误
+	p1conn = newTestConn()
+	p1conn.mustRecv(t, []byte(makeUpgradeRequest("Upgrade, HTTP2-Settings", "")))
+	if _, err := p1conn.recv([]byte("GET / HTTP/1.1\r\n")); nil == err {
+		t.Fatal("HTTP/1.1 request after upgrade should be a connection error")
+	}
+}
+
+func TestUpgradeMalformed(t *testing.T) {
+	sli1test := []struct {
+		name    string
+		request string
+		isParse bool
+	}{
+		{"connection without http2-settings", makeUpgradeRequest("Upgrade", ""), false},
+		{"connection without upgrade", makeUpgradeRequest("HTTP2-Settings", ""), false},
+		{"not base64url", makeUpgradeRequest("Upgrade, HTTP2-Settings", "a+b/"), false},
+		{"settings length", makeUpgradeRequest("Upgrade, HTTP2-Settings", "AAAA"), false},
+		{"bad settings", makeUpgradeRequest("Upgrade, HTTP2-Settings", base64.RawURLEncoding.EncodeToString([]byte{0, 2, 0, 0, 0, 2})), false},
+		{"two http2-settings", "GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\nHTTP2-Settings: \r\n\r\n", false},
+		{"upgrade to websocket", "GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: websocket\r\nHTTP2-Settings: \r\n\r\n", false},
+		{"malformed http", "GET / HTTP/1.1\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n\r\n", true},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1conn := newTestConn()
+			sli1stream, err := p1conn.recv([]byte(t1test.request))
+			if nil == err || 0 != len(sli1stream) {
+				t.Fatalf("recv() = %v, %d streams, want an error", err, len(sli1stream))
+			}
+			var t1upgradeErr upgradeErr
+			if t1test.isParse == goErrors.As(err, &t1upgradeErr) {
+				t.Fatalf("recv() = %v", err)
+			}
+			if !strings.HasPrefix(string(p1conn.Written()), "HTTP/1.1 400 ") {
+				t.Fatalf("written = %q, want 400", p1conn.Written())
+			}
+		})
+	}
+}
+
+func TestSniff(t *testing.T) {
+	sli1test := []struct {
+		name   string
+		head   string
+		result uint8
+	}{
+		{"preface", ClientPreface, protocol.SniffMatch},
+		{"preface with frames", ClientPreface + "\x00\x00\x00\x04", protocol.SniffMatch},
+		{"part of preface", "PRI * HTTP/2.0\r\n", protocol.SniffNeedMore},
+		{"upgrade", makeUpgradeRequest("Upgrade, HTTP2-Settings", ""), protocol.SniffMatch},
+		{"upgrade case insensitive", "GET / HTTP/1.1\r\nupgrade: H2C\r\n\r\n", protocol.SniffMatch},
+		{"upgrade in a list", "GET / HTTP/1.1\r\nUpgrade: foo, h2c\r\n\r\n", protocol.SniffMatch},
+		{"header incomplete", "GET / HTTP/1.1\r\nUpgrade: h2c\r\n", protocol.SniffNeedMore},
+		{"method incomplete", "GE", protocol.SniffNeedMore},
+		{"plain http", "GET / HTTP/1.1\r\nHost: x\r\n\r\n", protocol.SniffNoMatch},
+		{"websocket", "GET / HTTP/1.1\r\nUpgrade: websocket\r\n\r\n", protocol.SniffNoMatch},
+		{"h2c in another header", "GET / HTTP/1.1\r\nX-Upgrade: h2c\r\n\r\n", protocol.SniffNoMatch},
+		{"tls", "\x16\x03\x01\x02\x00", protocol.SniffNoMatch},
+	}
+	for _, t1test := range sli1test {
+		if result := sniff([]byte(t1test.head)); t1test.result != result {
+			t.Errorf("%s: sniff() = %d, want %d", t1test.name, result, t1test.result)
+		}
+	}
+}
+
+// TestClientSide HTTP/2 只支持服务端
+func TestClientSide(t *testing.T) {
+	if err := newSideTestConn(protocol.SideClient).Connect(); ErrClientSide != err {
+		t.Fatalf("Connect() = %v, want ErrClientSide", err)
+	}
+}
@@ -0,0 +1,363 @@
+package http2
+
+import (
+	goErrors "errors"
+	goHttp "net/http"
+	"strconv"
+	"strings"
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+	"time"
+)
+
+// ErrWriterClosed Writer 已经 Close 了，不能再 Write
+var ErrWriterClosed = goErrors.New("http2 writer is closed.")
+
+// mapConnectionHeader 只对一跳有效的头字段，HTTP/2 里不能有（RFC 9113 8.2.2），响应中的会被去掉
+var mapConnectionHeader = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// Stream 一个 HTTP/2 的 stream，一个请求和它的响应。
+// 请求在 OnConnRequest 中用 GetRequest 获取，响应用 MakeResponse 或者 NewWriter 构造帧，再用 TCPConnection.SendResponse 发送
+type Stream struct {
+	// id stream ID
+	id uint32
+	// p1state 所属的连接
+	p1state *connState
+	// p1request 解码之后的请求，请求接收完之前为 nil
+	p1request *http.HTTP
+
+	// 下面的只在读数据的 goroutine 中用，请求接收完之后就不用了
+	// method 请求方法，:method
+	method string
+	// uri 请求目标，:path，CONNECT 请求是 :authority
+	uri string
+	// mapHeader 请求头，键名是小写
+	mapHeader map[string][]string
+	// mapTrailer 请求体后面的 trailer，键名是小写
+	mapTrailer map[string]string
+	// contentLength 请求头中的 content-length，没有的时候是 -1
+	contentLength int64
+	// sli1body 请求体，DATA 帧的数据拼起来的
+	sli1body []byte
+
+	// 下面的由 connState.mutex 保护
+	// isRecvEnd 对端是不是已经发送完了（END_STREAM）
+	isRecvEnd bool
+	// isDiscard 已经回复了错误的响应，对端后面发送的数据都不要了
+	isDiscard bool
+	// isSendEnd 这边是不是已经发送完了（END_STREAM），或者 stream 已经重置了，之后的帧不再发送
+	isSendEnd bool
+	// isBlocked 是不是在 connState.sli1blocked 中
+	isBlocked bool
+	// sendWindow 这个 stream 的发送窗口
+	sendWindow int64
+	// sli1pending 发送窗口不够，还没发送的帧，按顺序
+	sli1pending [][]byte
+}
+
+// GetID 获取 stream ID
+func (p1this *Stream) GetID() uint32 {
+	return p1this.id
+}
+
+// GetRequest 获取解码之后的请求，和 HTTP/1.1 的请求一样用，Version 是 "HTTP/2.0"
+func (p1this *Stream) GetRequest() *http.HTTP {
+	return p1this.p1request
+}
+
+// MakeResponse 构造响应的帧（HEADERS，有响应体的话后面是 DATA），用 TCPConnection.SendResponse 发送。
+// 和 http.Response.Encode 一样自动添加 date、server、content-type 和 content-length，HEAD 请求的响应不发送响应体。
+// Connection 这种只对一跳有效的响应头会被去掉，不用区分是不是 HTTP/2 的请求
+func (p1this *Stream) MakeResponse(p1response *http.Response) []byte {
+	sli1body := p1response.GetBody()
+	isBodyAllowed := isBodyAllowed(p1response.GetStatusCode())
+	if !isBodyAllowed {
+		sli1body = nil
+	}
+	contentLength := -1
+	if isBodyAllowed {
+		contentLength = len(sli1body)
+	}
+	sli1block := appendResponseHeader(make([]byte, 0, 128), p1response, len(sli1body) > 0, contentLength)
+	if nil != p1this.p1request && "HEAD" == p1this.p1request.Method {
+		sli1body = nil
+	}
+
+	sli1data := make([]byte, 0, len(sli1block)+len(sli1body)+2*frameHeaderLen)
+	sli1data = p1this.appendHeaders(sli1data, sli1block, 0 == len(sli1body))
+	if 0 == len(sli1body) {
+		// HEADERS 已经带上 END_STREAM 了，后面不能再有 DATA
+		return sli1data
+	}
+	return p1this.appendData(sli1data, sli1body, true)
+}
+
+// NewWriter 创建 Writer，分几次发送响应体，send 用来发送构造好的帧，比如 service.TCPConnection.SendResponsePart
+func (p1this *Stream) NewWriter(p1response *http.Response, send func(sli1data []byte, isEnd bool)) *Writer {
+	return &Writer{
+		p1stream:   p1this,
+		p1response: p1response,
+		send:       send,
+	}
+}
+
+// appendHeaders 把头块分成 HEADERS 和 CONTINUATION 帧，isEndStream 为 true 时这个 stream 上不再发送数据了
+func (p1this *Stream) appendHeaders(sli1data []byte, sli1block []byte, isEndStream bool) []byte {
+	frameType := FrameHeaders
+	flags := uint8(0)
+	if isEndStream {
+		flags = FlagEndStream
+	}
+	for {
+		sli1fragment := sli1block
+		if len(sli1fragment) > DefaultMaxFrameSize {
+			sli1fragment = sli1fragment[:DefaultMaxFrameSize]
+		} else {
+			flags |= FlagEndHeaders
+		}
+		sli1data = appendFrame(sli1data, frameType, flags, p1this.id, sli1fragment)
+		sli1block = sli1block[len(sli1fragment):]
+		if 0 == len(sli1block) {
+			return sli1data
+		}
+		frameType, flags = FrameContinuation, 0
+	}
+}
+
+// appendData 把数据分成 DATA 帧，isEndStream 为 true 时最后一个帧带上 END_STREAM，没有数据的时候是一个空的 DATA 帧
+func (p1this *Stream) appendData(sli1data []byte, sli1body []byte, isEndStream bool) []byte {
+	for len(sli1body) > 0 {
+		sli1fragment := sli1body
+		if len(sli1fragment) > DefaultMaxFrameSize {
+			sli1fragment = sli1fragment[:DefaultMaxFrameSize]
+		}
+		sli1body = sli1body[len(sli1fragment):]
+		flags := uint8(0)
+		if isEndStream && 0 == len(sli1body) {
+			flags = FlagEndStream
+		}
+		sli1data = appendFrame(sli1data, FrameData, flags, p1this.id, sli1fragment)
+		if 0 != flags {
+			return sli1data
+		}
+	}
+	if isEndStream {
+		sli1data = appendFrame(sli1data, FrameData, FlagEndStream, p1this.id, nil)
+	}
+	return sli1data
+}
+
+// isBodyAllowed 1xx、204、304 的响应只发 HEADERS 帧，带 END_STREAM，不发 DATA 帧
+func isBodyAllowed(statusCode uint16) bool {
+	return statusCode >= 200 && http.StatusNoContent != statusCode && http.StatusNotModified != statusCode
+}
+
+// appendResponseHeader 编码响应头，contentLength 为 -1 时不发送 content-length。
+// 没有设置 date、server 的时候自动添加，isWithBody 为 true 时没有设置 content-type 的用 http.DefaultContentType
+func appendResponseHeader(sli1block []byte, p1response *http.Response, isWithBody bool, contentLength int) []byte {
+	sli1block = appendHeaderField(sli1block, ":status", strconv.FormatUint(uint64(p1response.GetStatusCode()), 10))
+	if "" == p1response.GetHeader("Date") {
+		sli1block = appendHeaderField(sli1block, "date", time.Now().UTC().Format(goHttp.TimeFormat))
+	}
+	if "" != http.DefaultServer && "" == p1response.GetHeader("Server") {
+		sli1block = appendHeaderField(sli1block, "server", http.DefaultServer)
+	}
+	isContentTypeSet := false
+	p1response.RangeHeader(func(key string, val string) bool {
+		key = strings.ToLower(key)
+		if mapConnectionHeader[key] || "content-length" == key {
+			return true
+		}
+		isContentTypeSet = isContentTypeSet || "content-type" == key
+		sli1block = appendHeaderField(sli1block, key, val)
+		return true
+	})
+	if isWithBody && !isContentTypeSet {
+		sli1block = appendHeaderField(sli1block, "content-type", http.DefaultContentType)
+	}
+	if contentLength >= 0 {
+		sli1block = appendHeaderField(sli1block, "content-length", strconv.Itoa(contentLength))
+	}
+	return sli1block
+}
+
+// Writer 分几次发送响应体，响应体比较大或者边生成边发送的时候用，和 http.ChunkedWriter 一样用。
+// 响应头在第一次 Write（或者 Close）的时候发送，之后不能再修改 Response。响应体不压缩
+type Writer struct {
+	// p1stream 响应所在的 stream
+	p1stream *Stream
+	// p1response 响应头
+	p1response *http.Response
+	// send 发送构造好的帧，isEnd 为 true 时是这个响应的最后一部分
+	send func(sli1data []byte, isEnd bool)
+	// isHeaderSent 是否已经构造过响应头的 HEADERS 帧，之后的 Write 只发 DATA 帧
+	isHeaderSent bool
+	// isClosed 是否已经调用过 Close，已经发送了带 END_STREAM 的帧
+	isClosed bool
+	// mapTrailer 响应体后面的 trailer
+	mapTrailer map[string]string
+}
+
+// SetTrailer 设置 trailer，在 Close 之前调用
+func (p1this *Writer) SetTrailer(key string, val string) {
+	if nil == p1this.mapTrailer {
+		p1this.mapTrailer = make(map[string]string, 2)
+	}
+	p1this.mapTrailer[key] = val
+}
+
+// Write 发送一部分响应体，实现 io.Writer。sli1data 会被复制，返回之后调用方可以修改
+func (p1this *Writer) Write(sli1data []byte) (int, error) {
+	if p1this.isClosed {
+		return 0, ErrWriterClosed
+	}
+	if 0 == len(sli1data) {
+		return 0, nil
+	}
+	p1this.send(p1this.p1stream.appendData(p1this.header(false), sli1data, false), false)
+	return len(sli1data), nil
+}
+
+// Close 结束响应，有 trailer 的用 HEADERS 帧发送，重复调用只有第一次生效
+func (p1this *Writer) Close() error {
+	if p1this.isClosed {
+		return nil
+	}
+	p1this.isClosed = true
+	if !p1this.isHeaderSent && 0 == len(p1this.mapTrailer) {
+		p1this.send(p1this.header(true), true)
+		return nil
+	}
+	sli1data := p1this.header(false)
+	if 0 == len(p1this.mapTrailer) {
+		p1this.send(p1this.p1stream.appendData(sli1data, nil, true), true)
+		return nil
+	}
+	sli1block := make([]byte, 0, 64)
+	for key, val := range p1this.mapTrailer {
+		key = strings.ToLower(key)
+		if !mapConnectionHeader[key] {
+			sli1block = appendHeaderField(sli1block, key, val)
+		}
+	}
+	p1this.send(p1this.p1stream.appendHeaders(sli1data, sli1block, true), true)
+	return nil
+}
+
+// header 第一次调用的时候返回响应头的帧，之后返回空。isEndStream 为 true 时没有响应体
+func (p1this *Writer) header(isEndStream bool) []byte {
+	if p1this.isHeaderSent {
+		return nil
+	}
+	p1this.isHeaderSent = true
+	sli1block := appendResponseHeader(make([]byte, 0, 128), p1this.p1response, !isEndStream, -1)
+	return p1this.p1stream.appendHeaders(nil, sli1block, isEndStream)
+}
+
+// writeFrames 发送构造好的帧，帧头里有 stream ID，不用管是哪个请求的响应。
+// 已经关闭或者重置的 stream 的帧不发送；DATA 帧按发送窗口发送，窗口不够的先存起来，对端 WINDOW_UPDATE 之后再发送。
+// 在锁里面放进发送队列，保证同一个 stream 的帧按顺序发送
+func (p1this *connState) writeFrames(p1conn protocol.Conn, sli1msg []byte) error {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+
+	var sli1out []byte
+	for len(sli1msg) > 0 {
+		if len(sli1msg) < frameHeaderLen {
+			return ErrInvalidFrames
+		}
+		header := parseFrameHeader(sli1msg)
+		frameLen := frameHeaderLen + int(header.length)
+		if frameLen > len(sli1msg) {
+			return ErrInvalidFrames
+		}
+		sli1frame := sli1msg[:frameLen]
+		sli1msg = sli1msg[frameLen:]
+
+		if 0 == header.streamID {
+			sli1out = append(sli1out, sli1frame...)
+			continue
+		}
+		p1stream, ok := p1this.mapStream[header.streamID]
+		if !ok || p1stream.isSendEnd {
+			continue
+		}
+		p1stream.sli1pending = append(p1stream.sli1pending, sli1frame)
+		sli1out = p1this.flush(sli1out, p1stream)
+	}
+	if 0 == len(sli1out) {
+		return nil
+	}
+	return p1conn.WriteData(sli1out)
+}
+
+// flush 按发送窗口发送 stream 存起来的帧，加到 sli1out 后面，不能发送的时候 stream 放进 sli1blocked。在锁里面调用
+func (p1this *connState) flush(sli1out []byte, p1stream *Stream) []byte {
+	for len(p1stream.sli1pending) > 0 {
+		if p1this.isWaitPreface {
+			p1this.block(p1stream)
+			return sli1out
+		}
+		sli1frame := p1stream.sli1pending[0]
+		header := parseFrameHeader(sli1frame)
+		if FrameData == header.frameType && header.length > 0 {
+			length := int64(header.length)
+			window := p1this.sendWindow
+			if p1stream.sendWindow < window {
+				window = p1stream.sendWindow
+			}
+			if window <= 0 {
+				p1this.block(p1stream)
+				return sli1out
+			}
+			if window < length {
+				// 窗口不够，先发送一部分，END_STREAM 留给剩下的
+				sli1payload := sli1frame[frameHeaderLen:]
+				sli1out = appendFrame(sli1out, FrameData, header.flags&^FlagEndStream, header.streamID, sli1payload[:window])
+				p1stream.sli1pending[0] = appendFrame(nil, FrameData, header.flags, header.streamID, sli1payload[window:])
+				p1this.sendWindow -= window
+				p1stream.sendWindow -= window
+				continue
+			}
+			p1this.sendWindow -= length
+			p1stream.sendWindow -= length
+		}
+		sli1out = append(sli1out, sli1frame...)
+		p1stream.sli1pending = p1stream.sli1pending[1:]
+		if (FrameData == header.frameType || FrameHeaders == header.frameType) && header.hasFlag(FlagEndStream) {
+			p1stream.isSendEnd = true
+			p1stream.sli1pending = nil
+			if p1stream.isRecvEnd {
+				delete(p1this.mapStream, p1stream.id)
+			}
+		}
+	}
+	return sli1out
+}
+
+// block 帧现在还不能发送，stream 放进 sli1blocked。在锁里面调用
+func (p1this *connState) block(p1stream *Stream) {
+	if !p1stream.isBlocked {
+		p1stream.isBlocked = true
+		p1this.sli1blocked = append(p1this.sli1blocked, p1stream)
+	}
+}
+
+// flushBlocked 连接的发送窗口变大（或者收到连接序言）之后，按顺序发送被挡住的 stream 的帧。在锁里面调用
+func (p1this *connState) flushBlocked(sli1out []byte) []byte {
+	sli1blocked := p1this.sli1blocked
+	p1this.sli1blocked = nil
+	for _, p1stream := range sli1blocked {
+		p1stream.isBlocked = false
+		if !p1stream.isSendEnd {
+			sli1out = p1this.flush(sli1out, p1stream)
+		}
+	}
+	return sli1out
+}
@@ -0,0 +1,207 @@
+package http2
+
+import (
+	"strings"
+	"testing"
+
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+)
+
+// newTestStream 创建一个请求方法是 method 的 stream，不用经过连接
+func newTestStream(method string) *Stream {
+	p1request := http.NewHTTP()
+	p1request.Method = method
+	return &Stream{id: 1, p1state: NewHTTP2().p1state, p1request: p1request}
+}
+
+func TestMakeResponse(t *testing.T) {
+	sli1test := []struct {
+		name          string
+		method        string
+		statusCode    uint16
+		body          string
+		sli1frameType []uint8
+		contentLength string
+	}{
+		{"with body", "GET", http.StatusOk, "hello", []uint8{FrameHeaders, FrameData}, "5"},
+		{"empty body", "GET", http.StatusOk, "", []uint8{FrameHeaders}, "0"},
+		{"head", "HEAD", http.StatusOk, "hello", []uint8{FrameHeaders}, "5"},
+		{"no content", "GET", http.StatusNoContent, "hello", []uint8{FrameHeaders}, ""},
+		{"not modified", "GET", http.StatusNotModified, "hello", []uint8{FrameHeaders}, ""},
+		{"large body", "GET", http.StatusOk, strings.Repeat("a", 2*DefaultMaxFrameSize+1), []uint8{FrameHeaders, FrameData, FrameData, FrameData}, "32769"},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			resp := http.NewResponse()
+			resp.SetStatusCode(t1test.statusCode)
+			resp.SetHeader("Connection", "keep-alive")
+			resp.SetHeader("X-Custom", "1")
+			resp.SetBody([]byte(t1test.body))
+			sli1frame := parseTestFrames(t, newTestStream(t1test.method).MakeResponse(resp))
+			if len(t1test.sli1frameType) != len(sli1frame) {
+				t.Fatalf("frames = %+v", frameTypes(sli1frame))
+			}
+			body := ""
+			for i, frame := range sli1frame {
+				if t1test.sli1frameType[i] != frame.frameType || 1 != frame.streamID || int(frame.length) > DefaultMaxFrameSize {
+					t.Fatalf("frames = %+v", frameTypes(sli1frame))
+				}
+				// 只有最后一个帧有 END_STREAM
+				if (len(sli1frame)-1 == i) != frame.hasFlag(FlagEndStream) {
+					t.Fatalf("END_STREAM of frame %d = %v", i, frame.hasFlag(FlagEndStream))
+				}
+				if FrameData == frame.frameType {
+					body += string(frame.sli1payload)
+				}
+			}
+			if len(t1test.sli1frameType) > 1 && t1test.body != body {
+				t.Fatalf("body is %d bytes, want %d", len(body), len(t1test.body))
+			}
+			mapHeader := decodeResponseHeaders(t, sli1frame[0].sli1payload)
+			if t1test.contentLength != mapHeader["content-length"] || "1" != mapHeader["x-custom"] || "" != mapHeader["connection"] || "" == mapHeader["date"] {
+				t.Fatalf("response headers = %v", mapHeader)
+			}
+		})
+	}
+}
+
+// TestMakeResponseLargeHeader 响应头块比一个帧大的，分成 HEADERS 和 CONTINUATION
+func TestMakeResponseLargeHeader(t *testing.T) {
+	resp := http.NewResponse()
+	resp.SetStatusCode(http.StatusOk)
+	resp.SetHeader("X-Large", strings.Repeat("\x01", DefaultMaxFrameSize))
+	sli1frame := parseTestFrames(t, newTestStream("GET").MakeResponse(resp))
+	if 2 != len(sli1frame) || FrameHeaders != sli1frame[0].frameType || sli1frame[0].hasFlag(FlagEndHeaders) || !sli1frame[0].hasFlag(FlagEndStream) ||
+		FrameContinuation != sli1frame[1].frameType || !sli1frame[1].hasFlag(FlagEndHeaders) {
+		t.Fatalf("frames = %+v", frameTypes(sli1frame))
+	}
+	sli1block := append(append([]byte(nil), sli1frame[0].sli1payload...), sli1frame[1].sli1payload...)
+	if mapHeader := decodeResponseHeaders(t, sli1block); DefaultMaxFrameSize != len(mapHeader["x-large"]) {
+		t.Fatalf("x-large is %d bytes", len(mapHeader["x-large"]))
+	}
+}
+
+func TestWriter(t *testing.T) {
+	sli1test := []struct {
+		name          string
+		sli1write     []string
+		mapTrailer    map[string]string
+		sli1frameType []uint8
+	}{
+		{"no data", nil, nil, []uint8{FrameHeaders}},
+		{"empty writes skipped", []string{"", ""}, nil, []uint8{FrameHeaders}},
+		{"several writes", []string{"hello", " world"}, nil, []uint8{FrameHeaders, FrameData, FrameData, FrameData}},
+		{"trailer", []string{"hello"}, map[string]string{"X-Sum": "1", "Connection": "close"}, []uint8{FrameHeaders, FrameData, FrameHeaders}},
+		{"trailer without data", nil, map[string]string{"X-Sum": "1"}, []uint8{FrameHeaders, FrameHeaders}},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			var sli1sent []byte
+			endNum := 0
+			resp := http.NewResponse()
+			resp.SetStatusCode(http.StatusOk)
+			p1writer := newTestStream("GET").NewWriter(resp, func(sli1data []byte, isEnd bool) {
+				sli1sent = append(sli1sent, sli1data...)
+				if isEnd {
+					endNum++
+				}
+			})
+			for key, val := range t1test.mapTrailer {
+				p1writer.SetTrailer(key, val)
+			}
+			for _, data := range t1test.sli1write {
+				if _, err := p1writer.Write([]byte(data)); nil != err {
+					t.Fatal(err)
+				}
+			}
+			p1writer.Close()
+			p1writer.Close()
+			if _, err := p1writer.Write([]byte("x")); ErrWriterClosed != err {
+				t.Fatalf("Write after Close = %v, want ErrWriterClosed", err)
+			}
+			if 1 != endNum {
+				t.Fatalf("isEnd sent %d times, want 1", endNum)
+			}
+
+			sli1frame := parseTestFrames(t, sli1sent)
+			if len(t1test.sli1frameType) != len(sli1frame) {
+				t.Fatalf("frames = %+v", frameTypes(sli1frame))
+			}
+			body := ""
+			for i, frame := range sli1frame {
+				if t1test.sli1frameType[i] != frame.frameType || (len(sli1frame)-1 == i) != frame.hasFlag(FlagEndStream) {
+					t.Fatalf("frames = %+v", frameTypes(sli1frame))
+				}
+				if FrameData == frame.frameType {
+					body += string(frame.sli1payload)
+				}
+			}
+			if strings.Join(t1test.sli1write, "") != body {
+				t.Fatalf("body = %q", body)
+			}
+			if 0 != len(t1test.mapTrailer) {
+				mapTrailer := decodeResponseHeaders(t, sli1frame[len(sli1frame)-1].sli1payload)
+				if "1" != mapTrailer["x-sum"] || "" != mapTrailer["connection"] {
+					t.Fatalf("trailer = %v", mapTrailer)
+				}
+			}
+		})
+	}
+}
+
+// TestSetHeader 请求头的检查（RFC 9113 8.3）
+func TestSetHeader(t *testing.T) {
+	sli1test := []struct {
+		name   string
+		sli1kv []string
+		isErr  bool
+		uri    string
+	}{
+		{"get", []string{":method", "GET", ":scheme", "https", ":path", "/a", ":authority", "x"}, false, "/a"},
+		{"connect", []string{":method", "CONNECT", ":authority", "x:443"}, false, "x:443"},
+		{"te trailers", []string{":method", "GET", ":scheme", "http", ":path", "/", "te", "trailers"}, false, "/"},
+
+		{"no method", []string{":scheme", "http", ":path", "/"}, true, ""},
+		{"no scheme", []string{":method", "GET", ":path", "/"}, true, ""},
+		{"no path", []string{":method", "GET", ":scheme", "http"}, true, ""},
+		{"empty path", []string{":method", "GET", ":scheme", "http", ":path", ""}, true, ""},
+		{"connect with path", []string{":method", "CONNECT", ":authority", "x:443", ":path", "/"}, true, ""},
+		{"connect without authority", []string{":method", "CONNECT"}, true, ""},
+		{"pseudo header after regular", []string{":method", "GET", ":scheme", "http", "x-a", "1", ":path", "/"}, true, ""},
+		{"duplicate pseudo header", []string{":method", "GET", ":method", "POST", ":scheme", "http", ":path", "/"}, true, ""},
+		{"unknown pseudo header", []string{":method", "GET", ":scheme", "http", ":path", "/", ":status", "200"}, true, ""},
+		{"uppercase name", []string{":method", "GET", ":scheme", "http", ":path", "/", "X-A", "1"}, true, ""},
+		{"connection header", []string{":method", "GET", ":scheme", "http", ":path", "/", "connection", "keep-alive"}, true, ""},
+		{"transfer encoding", []string{":method", "GET", ":scheme", "http", ":path", "/", "transfer-encoding", "chunked"}, true, ""},
+		{"te not trailers", []string{":method", "GET", ":scheme", "http", ":path", "/", "te", "gzip"}, true, ""},
+		{"bad content length", []string{":method", "POST", ":scheme", "http", ":path", "/", "content-length", "-1"}, true, ""},
+		{"two content lengths", []string{":method", "POST", ":scheme", "http", ":path", "/", "content-length", "1", "content-length", "1"}, true, ""},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			var sli1field []hpackField
+			for i := 0; i+1 < len(t1test.sli1kv); i += 2 {
+				sli1field = append(sli1field, hpackField{t1test.sli1kv[i], t1test.sli1kv[i+1]})
+			}
+			p1stream := &Stream{contentLength: -1}
+			err := p1stream.setHeader(sli1field)
+			if t1test.isErr {
+				if http.ErrMalformedMsg != err {
+					t.Fatalf("setHeader() = %v, want ErrMalformedMsg", err)
+				}
+				return
+			}
+			if nil != err || t1test.uri != p1stream.uri {
+				t.Fatalf("setHeader() = %v, uri %q, want %q", err, p1stream.uri, t1test.uri)
+			}
+		})
+	}
+
+	// :authority 当成 host，分开发送的 cookie 合成一个
+	p1stream := &Stream{contentLength: -1}
+	err := p1stream.setHeader([]hpackField{{":method", "POST"}, {":scheme", "http"}, {":path", "/"}, {":authority", "x"},
+		{"cookie", "a=1"}, {"cookie", "b=2"}, {"content-length", "3"}})
+	if nil != err || "x" != p1stream.mapHeader["host"][0] || "a=1; b=2" != p1stream.mapHeader["cookie"][0] || 3 != p1stream.contentLength {
+		t.Fatalf("setHeader() = %v, mapHeader %v, contentLength %d", err, p1stream.mapHeader, p1stream.contentLength)
+	}
+}
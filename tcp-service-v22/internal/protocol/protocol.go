@@ -1,33 +1,54 @@
 package protocol
 
+import "sync"
+
 // 协议名称
 const (
   TCPStr       string = "tcp"
   HTTPStr      string = "http"
   StreamStr    string = "stream"
   WebSocketStr string = "websocket"
+  HTTP2Str     string = "http2"
 )
 
-// mapsupported 支持的协议
-var mapsupported map[string]bool
+const (
+  StrStream = "stream"
+)
 
-func init() {
-  mapsupported = map[string]bool{
-    TCPStr:       true,
-    HTTPStr:      true,
-    StreamStr:    true,
-    WebSocketStr: true,
-  }
-}
+const (
+  // DefaultMaxMsgSize 单条报文默认最大多少字节，1MB == 2^20 == 1048576。
+  DefaultMaxMsgSize int = 10 * 1048576
+)
 
-// IsSupported 判断协议是否支持
-func IsSupported(name string) bool {
-  _, ok := mapsupported[name]
-  return ok
-}
+const (
+  SideService uint8 = iota // 服务端的连接
+  SideClient               // 客户端的连接
+)
 
 const (
-  StrStream = "stream"
+  ErrTypeIncomplete       uint8 = iota // 报文不完整（没接收全），继续接收
+  ErrTypeFatal                         // 明显出错，关闭连接
+  ErrTypeHeaderIncomplete              // 报文头都不完整，继续接收（用于区分读报文头超时）
+)
+
+const (
+  TimeoutTypeIdle       uint8 = iota // 空闲超时，等待新报文的时候超时
+  TimeoutTypeReadHeader              // 读报文头超时，报文开始接收之后，报文头没有接收完
+  TimeoutTypeRead                    // 读报文超时，报文开始接收之后，整个报文没有接收完
+  TimeoutTypeWrite                   // 写超时
+)
+
+const (
+  MsgActionRequest     uint8 = iota // 交给 OnConnRequest 处理，然后继续处理缓冲区
+  MsgActionRequestStop              // 交给 OnConnRequest 处理，然后不再处理缓冲区中剩下的数据
+  MsgActionSkip                     // 协议内部已经处理了（比如握手），不交给 OnConnRequest
+  MsgActionRequestLast              // 交给 OnConnRequest 处理，这是连接上的最后一条请求，不再读取新数据，响应发送完之后关闭连接，详见 TCPConnection.SendResponse
+)
+
+const (
+  SniffNeedMore uint8 = iota // 数据不够，还判断不了，继续接收
+  SniffMatch                 // 是这个协议
+  SniffNoMatch               // 不是这个协议
 )
 
 // Protocol 协议
@@ -39,3 +60,149 @@ type Protocol interface {
   // Encode 报文编码
   Encode() ([]byte, error)
 }
+
+// Conn 协议钩子里能用到的 TCP 连接，服务端和客户端的 TCPConnection 都实现了这个接口
+type Conn interface {
+  // GetSide 连接是服务端的还是客户端的，详见 Side 开头的常量
+  GetSide() uint8
+  // GetName 连接所属的服务端（客户端）的名称
+  GetName() string
+  // IsDebug 是否是 debug 模式
+  IsDebug() bool
+  // GetProtocol 获取连接的协议实例
+  GetProtocol() Protocol
+  // IsSendMagic 客户端的连接建立之后，是不是先发送协议的 Magic（比如 Stream 协议的），
+  // 服务端一个端口支持多个协议时用它识别协议。服务端的连接返回 false
+  IsSendMagic() bool
+  // WriteData 直接发送数据，不经过编码
+  WriteData(sli1data []byte) error
+}
+
+// Codec 协议的编解码器，通过 Register 注册之后，服务端和客户端就可以用协议名称使用这个协议
+type Codec struct {
+  // NewProtocol 创建协议实例，每个 TCP 连接一个，必须有
+  NewProtocol func() Protocol
+  // OnConnConnect 连接建立之后调用，可以为 nil
+  OnConnConnect func(p1conn Conn) error
+  // OnMsgReady 从接收缓冲区中取出第 1 条完整的报文之后调用，负责解码。
+  // sli1msg 指向接收缓冲区，接收缓冲区会复用，sli1msg 只在这次调用和 OnConnRequest 返回之前有效。
+  // 返回值详见 MsgAction 开头的常量，返回 error 时会关闭连接。
+  // 为 nil 时，直接调用 Protocol.Decode，然后交给 OnConnRequest 处理。
+  OnMsgReady func(p1conn Conn, sli1msg []byte) (uint8, error)
+  // ClassifyErr FirstMsgLength 返回 error 时调用，判断错误类型，详见 ErrType 开头的常量。
+  // 为 nil 时，所有的错误都当成报文不完整。
+  ClassifyErr func(p1conn Conn, err error) uint8
+  // Encode 发送数据时调用，把 SendMsg 的参数变成要发送的数据。
+  // 为 nil 时，直接发送 SendMsg 的参数。
+  Encode func(p1conn Conn, sli1msg []byte) ([]byte, error)
+  // RejectMsg 服务端超过最大连接数拒绝连接时，回复给对端的消息，可以为 nil
+  RejectMsg func() []byte
+  // TimeoutMsg 读超时关闭连接之前，回复给对端的消息，超时类型详见 TimeoutType 开头的常量。
+  // 可以为 nil，返回空的时候不回复。
+  TimeoutMsg func(p1conn Conn, timeoutType uint8) []byte
+  // ErrMsg FirstMsgLength 返回明显出错（ErrTypeFatal）的 error，或者 OnMsgReady 返回 error 的时候，
+  // 关闭连接之前回复给对端的消息（比如 HTTP 的 400）。
+  // 排在已经收到的请求的响应后面发送。可以为 nil，返回空的时候不回复。
+  ErrMsg func(p1conn Conn, err error) []byte
+  // EOFMsgLength 对端关闭连接的时候，接收缓冲区中剩下的数据能不能当成一条完整的报文（比如 HTTP 没有长度的响应，
+  // 响应体到连接关闭为止），返回报文的长度，0 表示不能。可以为 nil
+  EOFMsgLength func(p1conn Conn, sli1recv []byte) uint64
+  // Clone 复制一份解码之后的协议实例，不能和原来的共用会被下一条报文覆盖的数据。
+  // 用 worker pool 异步处理请求的时候，每条报文复制一份交给 OnConnRequest，为 nil 时不能异步处理。
+  Clone func(p1protocol Protocol) Protocol
+  // Sniff 服务端一个端口支持多个协议时，根据连接开头的数据判断是不是这个协议，返回值详见 Sniff 开头的常量。
+  // sli1head 是连接开头收到的数据，可能不完整。为 nil 时这个协议不能被识别。
+  Sniff func(sli1head []byte) uint8
+  // IsMultiplexed 一个连接上同时有多个请求在处理，响应不用按请求的顺序发送（比如 HTTP/2 的多个 stream）。
+  // 为 true 时，SendResponse 的数据马上发送，不等前面的请求响应完。
+  // 不受 TCPService.SetMaxRequestNum 的限制；OnMsgReady 返回 MsgActionRequestLast 的，所有的请求都响应完之后关闭连接。
+  IsMultiplexed bool
+  // IsRequestResponse 每个请求都用 SendResponse 响应（比如 HTTP）。
+  // 为 true 时，服务端优雅关闭的时候，还有请求没响应完的连接等最后一个响应发送完再关闭，详见 TCPService.Shutdown
+  IsRequestResponse bool
+  // MaxMsgSize 单条报文最大多少字节，接收缓冲区最多扩容到这么大，超过的时候会关闭连接。
+  // 为 0 时，使用 DefaultMaxMsgSize。
+  MaxMsgSize int
+}
+
+var (
+  // mapCodec 注册的协议
+  mapCodec = make(map[string]*Codec)
+  // mapCodecMutex 保护 mapCodec
+  mapCodecMutex sync.RWMutex
+)
+
+// Register 注册协议，协议名称相同的，后注册的覆盖先注册的
+func Register(name string, p1codec *Codec) {
+  if nil == p1codec || nil == p1codec.NewProtocol {
+    panic("protocol: Register codec without NewProtocol, name: " + name)
+  }
+  mapCodecMutex.Lock()
+  defer mapCodecMutex.Unlock()
+  mapCodec[name] = p1codec
+}
+
+// GetCodec 获取注册的协议
+func GetCodec(name string) (*Codec, bool) {
+  mapCodecMutex.RLock()
+  defer mapCodecMutex.RUnlock()
+  p1codec, ok := mapCodec[name]
+  return p1codec, ok
+}
+
+// IsSupported 判断协议是否支持
+func IsSupported(name string) bool {
+  _, ok := GetCodec(name)
+  return ok
+}
+
+// MsgReady 调用 Codec.OnMsgReady，没有的话直接解码
+func (p1this *Codec) MsgReady(p1conn Conn, sli1msg []byte) (uint8, error) {
+  if nil == p1this.OnMsgReady {
+    err := p1conn.GetProtocol().Decode(sli1msg)
+    return MsgActionRequest, err
+  }
+  return p1this.OnMsgReady(p1conn, sli1msg)
+}
+
+// ErrType 调用 Codec.ClassifyErr，没有的话当成报文不完整
+func (p1this *Codec) ErrType(p1conn Conn, err error) uint8 {
+  if nil == p1this.ClassifyErr {
+    return ErrTypeIncomplete
+  }
+  return p1this.ClassifyErr(p1conn, err)
+}
+
+// MsgLengthAtEOF 调用 Codec.EOFMsgLength，没有的话返回 0
+func (p1this *Codec) MsgLengthAtEOF(p1conn Conn, sli1recv []byte) uint64 {
+  if nil == p1this.EOFMsgLength {
+    return 0
+  }
+  return p1this.EOFMsgLength(p1conn, sli1recv)
+}
+
+// CanSniff 协议能不能被识别，详见 Codec.Sniff
+func (p1this *Codec) CanSniff() bool {
+  return nil != p1this.Sniff
+}
+
+// CanClone 协议实例能不能复制，详见 Codec.Clone
+func (p1this *Codec) CanClone() bool {
+  return nil != p1this.Clone
+}
+
+// GetMaxMsgSize 获取单条报文最大多少字节，没有设置的话返回 DefaultMaxMsgSize
+func (p1this *Codec) GetMaxMsgSize() int {
+  if p1this.MaxMsgSize <= 0 {
+    return DefaultMaxMsgSize
+  }
+  return p1this.MaxMsgSize
+}
+
+// EncodeMsg 调用 Codec.Encode，没有的话直接返回参数
+func (p1this *Codec) EncodeMsg(p1conn Conn, sli1msg []byte) ([]byte, error) {
+  if nil == p1this.Encode {
+    return sli1msg, nil
+  }
+  return p1this.Encode(p1conn, sli1msg)
+}
@@ -0,0 +1,148 @@
+package protocoltest
+
+import (
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+)
+
+// Conn 测试协议钩子用的连接，实现 protocol.Conn。
+// 接收的数据按 service.TCPConnection.HandleBuffer 的流程交给 Codec 处理，发送的数据记下来
+type Conn struct {
+	side        uint8
+	isDebug     bool
+	isSendMagic bool
+	p1codec     *protocol.Codec
+	p1protocol  protocol.Protocol
+	// sli1recv 接收了还没处理的数据
+	sli1recv []byte
+	// sli1written 发送的数据
+	sli1written []byte
+	// isReadClosed 不再读取新数据（出错或者收到了最后一个请求）
+	isReadClosed bool
+}
+
+// NewConn 创建协议 name 的连接，协议要已经注册；p1protocol 为 nil 的时候用 Codec.NewProtocol 创建
+func NewConn(name string, side uint8, p1protocol protocol.Protocol) *Conn {
+	p1codec, ok := protocol.GetCodec(name)
+	if !ok {
+		panic("protocoltest: protocol is not registered: " + name)
+	}
+	if nil == p1protocol {
+		p1protocol = p1codec.NewProtocol()
+	}
+	return &Conn{side: side, p1codec: p1codec, p1protocol: p1protocol}
+}
+
+// SetDebugOn 打开 debug 模式
+func (p1this *Conn) SetDebugOn() {
+	p1this.isDebug = true
+}
+
+// SetSendMagicOn 客户端连上之后发送 Magic
+func (p1this *Conn) SetSendMagicOn() {
+	p1this.isSendMagic = true
+}
+
+func (p1this *Conn) GetSide() uint8 {
+	return p1this.side
+}
+
+func (p1this *Conn) GetName() string {
+	return "test"
+}
+
+func (p1this *Conn) IsDebug() bool {
+	return p1this.isDebug
+}
+
+func (p1this *Conn) GetProtocol() protocol.Protocol {
+	return p1this.p1protocol
+}
+
+func (p1this *Conn) IsSendMagic() bool {
+	return p1this.isSendMagic
+}
+
+// WriteData 发送的数据记下来，用 Written 或者 TakeWritten 获取
+func (p1this *Conn) WriteData(sli1data []byte) error {
+	p1this.sli1written = append(p1this.sli1written, sli1data...)
+	return nil
+}
+
+// Connect 连接建立，调用 Codec.OnConnConnect
+func (p1this *Conn) Connect() error {
+	if nil == p1this.p1codec.OnConnConnect {
+		return nil
+	}
+	return p1this.p1codec.OnConnConnect(p1this)
+}
+
+// Recv 接收数据，和 HandleBuffer 一样一条报文一条报文地交给 Codec 处理，要交给 OnConnRequest 的时候调用 onRequest。
+// 明显出错的时候，和 closeWithErrMsg 一样发送 Codec.ErrMsg 构造的回复，不再读取新数据，返回 error。
+// 处理过的报文所在的缓冲区会被覆盖，协议要留着的数据必须自己复制
+func (p1this *Conn) Recv(sli1data []byte, onRequest func()) error {
+	if p1this.isReadClosed {
+		return nil
+	}
+	p1this.sli1recv = append(p1this.sli1recv, sli1data...)
+	for len(p1this.sli1recv) > 0 {
+		firstMsgLength, err := p1this.p1protocol.FirstMsgLength(p1this.sli1recv)
+		if nil != err {
+			if protocol.ErrTypeFatal == p1this.p1codec.ErrType(p1this, err) {
+				p1this.closeWithErrMsg(err)
+				return err
+			}
+			return nil
+		}
+		if firstMsgLength > uint64(len(p1this.sli1recv)) {
+			return nil
+		}
+		sli1firstMsg := p1this.sli1recv[:firstMsgLength]
+		msgAction, err := p1this.p1codec.MsgReady(p1this, sli1firstMsg)
+		if nil != err {
+			p1this.closeWithErrMsg(err)
+			return err
+		}
+		if protocol.MsgActionSkip != msgAction {
+			onRequest()
+			if protocol.MsgActionRequestLast == msgAction {
+				p1this.isReadClosed = true
+				return nil
+			}
+		}
+
+		// 接收缓冲区会被复用
+		for i := range sli1firstMsg {
+			sli1firstMsg[i] = 0xFF
+		}
+		p1this.sli1recv = p1this.sli1recv[firstMsgLength:]
+		if protocol.MsgActionRequestStop == msgAction {
+			return nil
+		}
+	}
+	return nil
+}
+
+// closeWithErrMsg 发送 Codec.ErrMsg 构造的回复，不再读取新数据
+func (p1this *Conn) closeWithErrMsg(err error) {
+	p1this.isReadClosed = true
+	if nil != p1this.p1codec.ErrMsg {
+		p1this.WriteData(p1this.p1codec.ErrMsg(p1this, err))
+	}
+}
+
+// IsReadClosed 是不是不再读取新数据
+func (p1this *Conn) IsReadClosed() bool {
+	return p1this.isReadClosed
+}
+
+// Written 获取到现在为止发送的数据
+func (p1this *Conn) Written() []byte {
+	return p1this.sli1written
+}
+
+// TakeWritten 取出到现在为止发送的数据，之后从头记录
+func (p1this *Conn) TakeWritten() []byte {
+	sli1written := p1this.sli1written
+	p1this.sli1written = nil
+	return sli1written
+}
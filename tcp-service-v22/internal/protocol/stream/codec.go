@@ -0,0 +1,67 @@
+package stream
+
+import (
+	"bytes"
+	"fmt"
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+)
+
+func init() {
+	protocol.Register(protocol.StreamStr, &protocol.Codec{
+		NewProtocol:   func() protocol.Protocol { return NewStream() },
+		OnConnConnect: onConnConnect,
+		OnMsgReady:    onMsgReady,
+		Encode:        encode,
+		Clone:         func(p1protocol protocol.Protocol) protocol.Protocol { return p1protocol.(*Stream).Clone() },
+		Sniff:         sniff,
+	})
+}
+
+// onConnConnect 客户端打开了 SetSendMagicOn 的，连上服务端之后先发送 Magic，服务端一个端口支持多个协议时用它识别 Stream 协议
+func onConnConnect(p1conn protocol.Conn) error {
+	if protocol.SideClient != p1conn.GetSide() || !p1conn.IsSendMagic() {
+		return nil
+	}
+	return p1conn.WriteData(Magic)
+}
+
+// onMsgReady 解析自定义 Stream 协议的报文，解析之后由外部实现的 OnConnRequest 继续处理
+func onMsgReady(p1conn protocol.Conn, sli1msg []byte) (uint8, error) {
+	if bytes.Equal(sli1msg, Magic) {
+		// 连接开头的 Magic，不是请求
+		return protocol.MsgActionSkip, nil
+	}
+	t1p1protocol := p1conn.GetProtocol().(*Stream)
+	t1p1protocol.Decode(sli1msg)
+
+	if p1conn.IsDebug() {
+		fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleStreamMsg.Decode: ", p1conn.GetName()))
+		fmt.Println(fmt.Sprintf("%+v", t1p1protocol))
+	}
+
+	// 长链接，处理完一条消息后，不会关闭 TCP 连接
+	return protocol.MsgActionRequest, nil
+}
+
+// sniff 连接以 Magic 开头的是 Stream 协议
+func sniff(sli1head []byte) uint8 {
+	if len(sli1head) < len(Magic) {
+		if bytes.Equal(sli1head, Magic[:len(sli1head)]) {
+			return protocol.SniffNeedMore
+		}
+		return protocol.SniffNoMatch
+	}
+	if bytes.Equal(sli1head[:len(Magic)], Magic) {
+		return protocol.SniffMatch
+	}
+	return protocol.SniffNoMatch
+}
+
+// encode SendMsg 的参数不为空的时候打包参数，不用改连接的协议实例，多个 goroutine 可以同时发送；
+// 为空的时候打包 SetDecodeMsg 设置的数据
+func encode(p1conn protocol.Conn, sli1msg []byte) ([]byte, error) {
+	if len(sli1msg) > 0 {
+		return Pack(sli1msg)
+	}
+	return p1conn.GetProtocol().Encode()
+}
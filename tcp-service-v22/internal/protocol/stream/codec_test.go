@@ -0,0 +1,35 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/protocoltest"
+)
+
+// TestOnConnConnectMagic 只有打开了 SetSendMagicOn 的客户端连接才发送 Magic
+func TestOnConnConnectMagic(t *testing.T) {
+	sli1test := []struct {
+		side        uint8
+		isSendMagic bool
+		sli1want    []byte
+	}{
+		{protocol.SideClient, false, nil},
+		{protocol.SideClient, true, Magic},
+		{protocol.SideService, false, nil},
+		{protocol.SideService, true, nil},
+	}
+	for _, t1test := range sli1test {
+		p1conn := protocoltest.NewConn(protocol.StreamStr, t1test.side, nil)
+		if t1test.isSendMagic {
+			p1conn.SetSendMagicOn()
+		}
+		if err := p1conn.Connect(); nil != err {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(t1test.sli1want, p1conn.Written()) {
+			t.Errorf("side %d, isSendMagic %v: wrote %q, want %q", t1test.side, t1test.isSendMagic, p1conn.Written(), t1test.sli1want)
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package stream
 
 import (
+  "bytes"
   "encoding/binary"
   "errors"
 )
 
+// Magic 客户端（打开了 SetSendMagicOn 的）连上服务端之后先发送的数据，服务端一个端口支持多个协议时用它识别 Stream 协议。
+// 前 4 个字节当成长度的话超过 1GB，不会和正常的报文混淆。
+var Magic = []byte("STREAM/1\r\n")
+
 type Stream struct {
   // 解析状态
   ParseStatus uint8
@@ -25,6 +30,17 @@ func (p1this *Stream) FirstMsgLength(sli1recv []byte) (uint64, error) {
   if 0 >= recvLen {
     return 0, errors.New("STREAM_STATUS_NO_DATA")
   }
+  if Magic[0] == sli1recv[0] {
+    // 连接开头的 Magic，当成一条单独的报文
+    magicLen := uint32(len(Magic))
+    if recvLen < magicLen {
+      if bytes.Equal(sli1recv, Magic[:recvLen]) {
+        return 0, errors.New("STREAM_STATUS_NOT_FINISH")
+      }
+    } else if bytes.Equal(sli1recv[:magicLen], Magic) {
+      return uint64(magicLen), nil
+    }
+  }
   if 4 > recvLen {
     return 0, errors.New("STREAM_STATUS_NOT_FINISH")
   }
@@ -38,6 +54,13 @@ func (p1this *Stream) FirstMsgLength(sli1recv []byte) (uint64, error) {
   return uint64(4 + p1this.bodyLength), nil
 }
 
+// Clone 复制一份，请求报文指向接收缓冲区，需要复制
+func (p1this *Stream) Clone() *Stream {
+  t1stream := *p1this
+  t1stream.Sli1Msg = append([]byte(nil), p1this.Sli1Msg...)
+  return &t1stream
+}
+
 func (p1this *Stream) Decode(sli1msg []byte) error {
   p1this.DecodeMsg = string(sli1msg[4:])
   return nil
@@ -52,16 +75,19 @@ func (p1this *Stream) GetDecodeMsg() string {
 }
 
 func (p1this *Stream) Encode() ([]byte, error) {
-  var sli1msg []byte
+  return Pack([]byte(p1this.DecodeMsg))
+}
 
-  bodyLen := len(p1this.DecodeMsg)
+// Pack 把数据打包成一条报文：4 个字节的数据长度（大端字节序）加上数据
+func Pack(sli1body []byte) ([]byte, error) {
+  bodyLen := len(sli1body)
   if 0 >= bodyLen {
-    return sli1msg, errors.New("STREAM_STATUS_NO_DATA")
+    return nil, errors.New("STREAM_STATUS_NO_DATA")
   }
-  t1sli1BodyLen := make([]byte, 4)
+  sli1msg := make([]byte, 4, 4+bodyLen)
   // 把 uint32 格式的数据长度转换成大端字节序，放在最前面 4 个字节的位置上
-  binary.BigEndian.PutUint32(t1sli1BodyLen, uint32(bodyLen))
-  sli1msg = append(t1sli1BodyLen, p1this.DecodeMsg...)
+  binary.BigEndian.PutUint32(sli1msg, uint32(bodyLen))
+  sli1msg = append(sli1msg, sli1body...)
 
   return sli1msg, nil
 }
@@ -0,0 +1,178 @@
+package websocket
+
+import (
+	"bytes"
+	goErrors "errors"
+	"fmt"
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+)
+
+func init() {
+	protocol.Register(protocol.WebSocketStr, &protocol.Codec{
+		NewProtocol:   func() protocol.Protocol { return NewWebSocket() },
+		OnConnConnect: onConnConnect,
+		OnMsgReady:    onMsgReady,
+		ClassifyErr:   classifyErr,
+		ErrMsg:        errMsg,
+		Encode:        encode,
+		Clone:         func(p1protocol protocol.Protocol) protocol.Protocol { return p1protocol.(*WebSocket).Clone() },
+		Sniff:         sniff,
+	})
+}
+
+// onConnConnect 客户端连上服务端之后，发送握手消息
+func onConnConnect(p1conn protocol.Conn) error {
+	if protocol.SideClient != p1conn.GetSide() {
+		return nil
+	}
+	t1p1protocol := p1conn.GetProtocol().(*WebSocket)
+	// 握手的响应是客户端的 HTTP 连接解析的
+	t1p1protocol.p1HttpInner.SetClientSide()
+	sli1reqMsg, _ := t1p1protocol.MakeHandShakeReq()
+	return p1conn.WriteData(sli1reqMsg)
+}
+
+// onMsgReady 解析 WebSocket 报文，如果还没有握手成功，就走握手流程
+func onMsgReady(p1conn protocol.Conn, sli1msg []byte) (uint8, error) {
+	t1p1protocol := p1conn.GetProtocol().(*WebSocket)
+	err := t1p1protocol.Decode(sli1msg)
+
+	if p1conn.IsDebug() {
+		fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleWebSocketMsg.Decode: ", p1conn.GetName()))
+		fmt.Println(fmt.Sprintf("%+v", t1p1protocol))
+	}
+
+	if !t1p1protocol.IsHandshakeStatusNo() {
+		if nil != err {
+			return protocol.MsgActionSkip, err
+		}
+		return onFrame(p1conn, t1p1protocol)
+	}
+
+	if protocol.SideClient == p1conn.GetSide() {
+		// 握手消息，校验一下服务端响应的握手消息
+		err := t1p1protocol.CheckHandShakeResp()
+		if nil != err {
+			return protocol.MsgActionSkip, err
+		}
+		t1p1protocol.SetHandshakeStatusYes()
+		// 握手成功之后，发送测试消息
+		t1p1protocol.SetDecodeMsg(fmt.Sprintf("this is %s.", p1conn.GetName()))
+		sli1testMsg, _ := t1p1protocol.Encode()
+		p1conn.WriteData(sli1testMsg)
+		return protocol.MsgActionSkip, nil
+	}
+
+	sli1respMsg, err := t1p1protocol.CheckHandshakeReq()
+
+	if p1conn.IsDebug() {
+		fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleWebSocketMsg.CheckHandshakeReq: ", p1conn.GetName()))
+		fmt.Println(fmt.Sprintf("%+v", string(sli1respMsg)))
+	}
+
+	if nil != err {
+		// 关闭连接，errMsg 回复 400 给客户端
+		return protocol.MsgActionSkip, handshakeErr{err}
+	}
+
+	// 握手消息是通过 websocket.WebSocket 内部的 http.HTTP 处理的
+	// 走 SendMsg 方法会走编码逻辑，所以这里通过 WriteData 方法直接发送
+	err = p1conn.WriteData(sli1respMsg)
+	if nil == err {
+		t1p1protocol.SetHandshakeStatusYes()
+	}
+	return protocol.MsgActionRequest, nil
+}
+
+// onFrame 处理握手之后的帧：ping 回复 pong，pong 不用处理，关闭帧返回 ErrConnectionIsClosed，errMsg 回复关闭帧；
+// 控制帧可以插在分片消息的分片中间，分片消息接收完最后一个分片之后才交给 OnConnRequest。
+// 客户端收到的消息只在 debug 模式下交给 OnConnRequest，握手的 101 响应不交给 OnConnRequest
+func onFrame(p1conn protocol.Conn, t1p1protocol *WebSocket) (uint8, error) {
+	switch t1p1protocol.opcode {
+	case opcodePing:
+		return protocol.MsgActionSkip, p1conn.WriteData(t1p1protocol.appendFrame(nil, true, opcodePong, t1p1protocol.sli1payload))
+	case opcodePong:
+		return protocol.MsgActionSkip, nil
+	case opcodeClose:
+		return protocol.MsgActionSkip, ErrConnectionIsClosed
+	}
+	if !t1p1protocol.isMsgComplete {
+		return protocol.MsgActionSkip, nil
+	}
+	if protocol.SideClient == p1conn.GetSide() && !p1conn.IsDebug() {
+		return protocol.MsgActionSkip, nil
+	}
+	return protocol.MsgActionRequest, nil
+}
+
+// handshakeErr 握手请求不符合要求，回复 400 的时候带上原因
+type handshakeErr struct {
+	error
+}
+
+// errMsg 服务端握手阶段解析 HTTP 请求出错的时候，和 HTTP 一样回复，握手请求不符合要求的回复 400。
+// 握手之后回复关闭帧，WebSocket 的消息是用 SendMsg 发送的，不是请求的响应，所以关闭帧直接发送，不用排在响应后面
+func errMsg(p1conn protocol.Conn, err error) []byte {
+	t1p1protocol := p1conn.GetProtocol().(*WebSocket)
+	if !t1p1protocol.IsHandshakeStatusNo() {
+		p1conn.WriteData(t1p1protocol.closeMsg(err))
+		return nil
+	}
+	if protocol.SideService != p1conn.GetSide() {
+		return nil
+	}
+	var t1err handshakeErr
+	if goErrors.As(err, &t1err) {
+		resp := http.NewResponse()
+		resp.SetStatusCode(http.StatusBadRequest)
+		resp.SetHeader("Connection", "close")
+		resp.SetBody([]byte(fmt.Sprintf("this is %s. handshake err: %s", p1conn.GetName(), t1err.error)))
+		return resp.Encode()
+	}
+	return http.ParseErrMsg(err)
+}
+
+// classifyErr 握手阶段用 HTTP 的解析状态判断，握手之后违反协议、消息太大的算出错
+func classifyErr(p1conn protocol.Conn, err error) uint8 {
+	t1p1protocol := p1conn.GetProtocol().(*WebSocket)
+	if t1p1protocol.IsHandshakeStatusNo() {
+		switch t1p1protocol.p1HttpInner.ParseStatus {
+		case http.ParseStatusParseErr:
+			return protocol.ErrTypeFatal
+		case http.ParseStatusRecvBufferEmpty, http.ParseStatusNotHTTP:
+			return protocol.ErrTypeHeaderIncomplete
+		}
+		return protocol.ErrTypeIncomplete
+	}
+	if ErrDataIncomplete == err {
+		return protocol.ErrTypeIncomplete
+	}
+	return protocol.ErrTypeFatal
+}
+
+// sniff 判断连接开头的数据是不是 WebSocket 握手请求：请求头接收完整，并且有 "Upgrade: websocket"
+func sniff(sli1head []byte) uint8 {
+	result := http.SniffRequest(sli1head)
+	if protocol.SniffMatch != result {
+		return result
+	}
+	index := bytes.Index(sli1head, []byte("\r\n\r\n"))
+	if index < 0 {
+		return protocol.SniffNeedMore
+	}
+	for _, sli1line := range bytes.Split(sli1head[:index], []byte("\r\n"))[1:] {
+		sli1kv := bytes.SplitN(sli1line, []byte(":"), 2)
+		if 2 == len(sli1kv) && bytes.EqualFold(bytes.TrimSpace(sli1kv[0]), []byte("upgrade")) {
+			if bytes.Contains(bytes.ToLower(sli1kv[1]), []byte("websocket")) {
+				return protocol.SniffMatch
+			}
+		}
+	}
+	return protocol.SniffNoMatch
+}
+
+// encode 发送的是通过 SetDecodeMsg 设置的数据，SendMsg 的参数不用
+func encode(p1conn protocol.Conn, sli1msg []byte) ([]byte, error) {
+	return p1conn.GetProtocol().Encode()
+}
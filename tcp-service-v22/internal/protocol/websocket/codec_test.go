@@ -0,0 +1,300 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/protocoltest"
+)
+
+// testConn 测试用的连接，接收的数据按 HandleBuffer 的流程处理，p1protocol 是连接上的协议实例
+type testConn struct {
+	*protocoltest.Conn
+	p1protocol *WebSocket
+}
+
+// newTestConn 已经握手的服务端连接
+func newTestConn() *testConn {
+	return newSideTestConn(protocol.SideService, newHandshakeYes())
+}
+
+func newSideTestConn(side uint8, p1protocol *WebSocket) *testConn {
+	return &testConn{Conn: protocoltest.NewConn(protocol.WebSocketStr, side, p1protocol), p1protocol: p1protocol}
+}
+
+// recv 接收数据，返回交给 OnConnRequest 的消息。
+// 返回 error 的时候，ErrMsg 构造的回复已经发送（握手之后是关闭帧）
+func (p1this *testConn) recv(sli1data []byte) ([]string, error) {
+	var sli1msg []string
+	err := p1this.Recv(sli1data, func() {
+		sli1msg = append(sli1msg, p1this.p1protocol.DecodeMsg)
+	})
+	return sli1msg, err
+}
+
+// TestFragment 分片消息接收完最后一个分片才交给 OnConnRequest，控制帧可以插在分片中间
+func TestFragment(t *testing.T) {
+	sli1test := []struct {
+		name        string
+		sli1frame   [][]byte
+		sli1msg     []string
+		sli1written []testFrame
+	}{
+		{"one frame", [][]byte{maskFrame(true, opcodeText, "hello")}, []string{"hello"}, nil},
+		{"binary", [][]byte{maskFrame(true, opcodeBinary, "\x00\xff")}, []string{"\x00\xff"}, nil},
+		{"two fragments", [][]byte{
+			maskFrame(false, opcodeText, "hel"),
+			maskFrame(true, opcodeContinuation, "lo"),
+		}, []string{"hello"}, nil},
+		{"empty fragments", [][]byte{
+			maskFrame(false, opcodeText, ""),
+			maskFrame(false, opcodeContinuation, "a"),
+			maskFrame(true, opcodeContinuation, ""),
+		}, []string{"a"}, nil},
+		{"ping between fragments", [][]byte{
+			maskFrame(false, opcodeText, "hel"),
+			maskFrame(true, opcodePing, "p"),
+			maskFrame(true, opcodeContinuation, "lo"),
+		}, []string{"hello"}, []testFrame{{true, opcodePong, "p"}}},
+		{"pong between fragments", [][]byte{
+			maskFrame(false, opcodeBinary, "a"),
+			maskFrame(true, opcodePong, ""),
+			maskFrame(false, opcodeContinuation, "b"),
+			maskFrame(true, opcodeContinuation, "c"),
+		}, []string{"abc"}, nil},
+		{"messages after a fragmented message", [][]byte{
+			maskFrame(false, opcodeText, "a"),
+			maskFrame(true, opcodeContinuation, "b"),
+			maskFrame(true, opcodeText, "c"),
+			maskFrame(false, opcodeText, "d"),
+			maskFrame(true, opcodeContinuation, "e"),
+		}, []string{"ab", "c", "de"}, nil},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			// 一次全部接收，和一个字节一个字节地接收，结果一样
+			sli1data := bytes.Join(t1test.sli1frame, nil)
+			for _, step := range []int{len(sli1data), 1} {
+				p1conn := newTestConn()
+				var sli1msg []string
+				for i := 0; i < len(sli1data); i += step {
+					end := i + step
+					if end > len(sli1data) {
+						end = len(sli1data)
+					}
+					sli1got, err := p1conn.recv(sli1data[i:end])
+					if nil != err {
+						t.Fatalf("recv: %v", err)
+					}
+					sli1msg = append(sli1msg, sli1got...)
+				}
+				if strings.Join(t1test.sli1msg, "|") != strings.Join(sli1msg, "|") || len(t1test.sli1msg) != len(sli1msg) {
+					t.Fatalf("step %d: messages = %q, want %q", step, sli1msg, t1test.sli1msg)
+				}
+				sli1frame := parseFrames(t, p1conn.TakeWritten())
+				if len(t1test.sli1written) != len(sli1frame) {
+					t.Fatalf("step %d: written = %+v, want %+v", step, sli1frame, t1test.sli1written)
+				}
+				for i := range sli1frame {
+					if t1test.sli1written[i] != sli1frame[i] {
+						t.Fatalf("step %d: written %d = %+v, want %+v", step, i, sli1frame[i], t1test.sli1written[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestFragmentClone Clone 的时候分片消息接收到一半的数据留在连接上
+func TestFragmentClone(t *testing.T) {
+	p1conn := newTestConn()
+	if _, err := p1conn.recv(maskFrame(false, opcodeText, "a")); nil != err {
+		t.Fatal(err)
+	}
+	p1clone := p1conn.p1protocol.Clone()
+	if nil != p1clone.sli1fragment {
+		t.Fatalf("clone has fragment %q", p1clone.sli1fragment)
+	}
+	sli1msg, err := p1conn.recv(maskFrame(true, opcodeContinuation, "b"))
+	if nil != err || 1 != len(sli1msg) || "ab" != sli1msg[0] {
+		t.Fatalf("recv = %q, %v, want ab", sli1msg, err)
+	}
+}
+
+// TestMalformedFrame 违反协议的帧回复 1002 的关闭帧，消息太大的回复 1009，然后关闭连接
+func TestMalformedFrame(t *testing.T) {
+	sli1test := []struct {
+		name      string
+		sli1frame [][]byte
+		code      uint16
+	}{
+		{"fragmented ping", [][]byte{maskFrame(false, opcodePing, "")}, closeCodeProtocolError},
+		{"fragmented close", [][]byte{maskFrame(false, opcodeClose, "")}, closeCodeProtocolError},
+		{"ping larger than 125 bytes", [][]byte{maskFrame(true, opcodePing, strings.Repeat("a", 126))}, closeCodeProtocolError},
+		{"pong larger than 125 bytes", [][]byte{maskFrame(true, opcodePong, strings.Repeat("a", 200))}, closeCodeProtocolError},
+		{"unexpected continuation", [][]byte{maskFrame(true, opcodeContinuation, "a")}, closeCodeProtocolError},
+		{"unexpected continuation after a message", [][]byte{
+			maskFrame(false, opcodeText, "a"),
+			maskFrame(true, opcodeContinuation, "b"),
+			maskFrame(true, opcodeContinuation, "c"),
+		}, closeCodeProtocolError},
+		{"expected continuation", [][]byte{maskFrame(false, opcodeText, "a"), maskFrame(true, opcodeText, "b")}, closeCodeProtocolError},
+		{"expected continuation binary", [][]byte{maskFrame(false, opcodeText, "a"), maskFrame(true, opcodeBinary, "b")}, closeCodeProtocolError},
+		{"unknown data opcode", [][]byte{maskFrame(true, 0x03, "a")}, closeCodeProtocolError},
+		{"unknown control opcode", [][]byte{maskFrame(true, 0x0b, "")}, closeCodeProtocolError},
+		{"message too big", [][]byte{maskFrame(true, opcodeText, "12345678901")}, closeCodeMessageTooBig},
+		{"fragments too big", [][]byte{
+			maskFrame(false, opcodeText, "123456"),
+			maskFrame(true, opcodeContinuation, "78901"),
+		}, closeCodeMessageTooBig},
+		// 帧头接收完就校验，不用等数据接收完
+		{"message too big header only", [][]byte{maskFrame(true, opcodeText, strings.Repeat("a", 1000))[:8]}, closeCodeMessageTooBig},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1conn := newTestConn()
+			p1conn.p1protocol.SetMaxMessageSize(10)
+			_, err := p1conn.recv(bytes.Join(t1test.sli1frame, nil))
+			if nil == err {
+				t.Fatal("recv = nil, want an error")
+			}
+			if protocol.ErrTypeFatal != classifyErr(p1conn, err) {
+				t.Fatalf("classifyErr(%v) is not fatal", err)
+			}
+			sli1frame := parseFrames(t, p1conn.TakeWritten())
+			if 1 != len(sli1frame) || opcodeClose != sli1frame[0].opcode || len(sli1frame[0].payload) < 2 {
+				t.Fatalf("written = %+v, want a close frame", sli1frame)
+			}
+			if code := binary.BigEndian.Uint16([]byte(sli1frame[0].payload)); t1test.code != code {
+				t.Fatalf("close code = %d, want %d (%v)", code, t1test.code, err)
+			}
+		})
+	}
+}
+
+// TestClose 对端发来关闭帧，回复同样的状态码之后关闭连接
+func TestClose(t *testing.T) {
+	sli1test := []struct {
+		name    string
+		payload string
+		code    uint16
+	}{
+		{"with code", "\x03\xe9going away", 1001},
+		{"without code", "", closeCodeNormal},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1conn := newTestConn()
+			_, err := p1conn.recv(maskFrame(true, opcodeClose, t1test.payload))
+			if ErrConnectionIsClosed != err {
+				t.Fatalf("recv = %v, want ErrConnectionIsClosed", err)
+			}
+			sli1frame := parseFrames(t, p1conn.TakeWritten())
+			if 1 != len(sli1frame) || opcodeClose != sli1frame[0].opcode || 2 != len(sli1frame[0].payload) {
+				t.Fatalf("written = %+v, want a close frame with a code", sli1frame)
+			}
+			if code := binary.BigEndian.Uint16([]byte(sli1frame[0].payload)); t1test.code != code {
+				t.Fatalf("close code = %d, want %d", code, t1test.code)
+			}
+		})
+	}
+}
+
+// TestServiceHandshake 服务端收到握手请求回复 101，握手请求交给 OnConnRequest；不符合要求的回复 400
+func TestServiceHandshake(t *testing.T) {
+	sli1test := []struct {
+		name       string
+		req        string
+		statusCode string
+	}{
+		{"handshake", "GET /chat HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", "101"},
+		{"missing key", "GET /chat HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", "400"},
+		{"not websocket", "GET /chat HTTP/1.1\r\nHost: x\r\nUpgrade: h2c\r\nConnection: Upgrade\r\nSec-WebSocket-Key: a\r\n\r\n", "400"},
+		{"missing host", "GET /chat HTTP/1.1\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: a\r\n\r\n", "400"},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1conn := newSideTestConn(protocol.SideService, NewWebSocket())
+			sli1msg, err := p1conn.recv([]byte(t1test.req))
+			if !bytes.HasPrefix(p1conn.Written(), []byte("HTTP/1.1 "+t1test.statusCode+" ")) {
+				t.Fatalf("written = %q, want %s", p1conn.Written(), t1test.statusCode)
+			}
+			if "101" != t1test.statusCode {
+				if p1conn.p1protocol.IsHandshakeStatusYes() {
+					t.Fatal("handshake status is yes")
+				}
+				return
+			}
+			if nil != err || 1 != len(sli1msg) || !p1conn.p1protocol.IsHandshakeStatusYes() {
+				t.Fatalf("recv = %q, %v, handshake %v", sli1msg, err, p1conn.p1protocol.IsHandshakeStatusYes())
+			}
+			// 握手之后的数据按帧解析
+			p1conn.TakeWritten()
+			if sli1msg, err = p1conn.recv(maskFrame(true, opcodeText, "hi")); nil != err || 1 != len(sli1msg) || "hi" != sli1msg[0] {
+				t.Fatalf("recv = %q, %v, want hi", sli1msg, err)
+			}
+		})
+	}
+}
+
+// TestClientHandshake 客户端连上之后发送握手请求，收到 101 之后发送测试消息，101 不交给 OnConnRequest；
+// 不是 debug 模式的时候，之后收到的消息也不交给 OnConnRequest，ping 照常回复
+func TestClientHandshake(t *testing.T) {
+	p1conn := newSideTestConn(protocol.SideClient, NewWebSocket())
+	if err := p1conn.Connect(); nil != err {
+		t.Fatal(err)
+	}
+	p1service := NewWebSocket()
+	sli1req := p1conn.TakeWritten()
+	p1service.FirstMsgLength(sli1req)
+	p1service.Decode(sli1req)
+	sli1resp, err := p1service.CheckHandshakeReq()
+	if nil != err {
+		t.Fatalf("CheckHandshakeReq(%q): %v", sli1req, err)
+	}
+
+	sli1msg, err := p1conn.recv(sli1resp)
+	if nil != err || 0 != len(sli1msg) || !p1conn.p1protocol.IsHandshakeStatusYes() {
+		t.Fatalf("recv = %q, %v, handshake %v", sli1msg, err, p1conn.p1protocol.IsHandshakeStatusYes())
+	}
+	if sli1frame := parseFrames(t, p1conn.TakeWritten()); 1 != len(sli1frame) || "this is test." != sli1frame[0].payload {
+		t.Fatalf("written = %+v, want the test message", sli1frame)
+	}
+
+	p1service.SetHandshakeStatusYes()
+	p1service.SetDecodeMsg("echo")
+	sli1echo, _ := p1service.Encode()
+	sli1ping := p1service.appendFrame(nil, true, opcodePing, []byte("p"))
+	sli1msg, err = p1conn.recv(append(sli1echo, sli1ping...))
+	if nil != err || 0 != len(sli1msg) || "echo" != p1conn.p1protocol.DecodeMsg {
+		t.Fatalf("recv = %q, %v, DecodeMsg %q", sli1msg, err, p1conn.p1protocol.DecodeMsg)
+	}
+	if sli1frame := parseFrames(t, p1conn.TakeWritten()); 1 != len(sli1frame) || opcodePong != sli1frame[0].opcode {
+		t.Fatalf("written = %+v, want pong", sli1frame)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	sli1test := []struct {
+		name   string
+		head   string
+		result uint8
+	}{
+		{"handshake", "GET /chat HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", protocol.SniffMatch},
+		{"upgrade case insensitive", "GET / HTTP/1.1\r\nupgrade: WebSocket\r\n\r\n", protocol.SniffMatch},
+		{"header incomplete", "GET / HTTP/1.1\r\nUpgrade: websocket\r\n", protocol.SniffNeedMore},
+		{"method incomplete", "GE", protocol.SniffNeedMore},
+		{"plain http", "GET / HTTP/1.1\r\nHost: x\r\n\r\n", protocol.SniffNoMatch},
+		{"h2c", "GET / HTTP/1.1\r\nUpgrade: h2c\r\n\r\n", protocol.SniffNoMatch},
+		{"websocket in another header", "GET / HTTP/1.1\r\nX-Upgrade: websocket\r\n\r\n", protocol.SniffNoMatch},
+		{"tls", "\x16\x03\x01\x02\x00", protocol.SniffNoMatch},
+	}
+	for _, t1test := range sli1test {
+		if result := sniff([]byte(t1test.head)); t1test.result != result {
+			t.Errorf("%s: sniff() = %d, want %d", t1test.name, result, t1test.result)
+		}
+	}
+}
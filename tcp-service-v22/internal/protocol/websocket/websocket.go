@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"strings"
@@ -22,11 +23,18 @@ const (
 )
 
 const (
-	opcodeText   uint8 = 0x01 // 文本帧
-	opcodeBinary uint8 = 0x02 // 二进制帧
-	opcodeClose  uint8 = 0x08 // 连接断开
-	opcodePing   uint8 = 0x09 // ping
-	opcodePong   uint8 = 0x0A // pong
+	opcodeContinuation uint8 = 0x00 // 延续帧，分片消息除了第一个分片之外的分片
+	opcodeText         uint8 = 0x01 // 文本帧
+	opcodeBinary       uint8 = 0x02 // 二进制帧
+	opcodeClose        uint8 = 0x08 // 连接断开
+	opcodePing         uint8 = 0x09 // ping
+	opcodePong         uint8 = 0x0A // pong
+)
+
+const (
+	closeCodeNormal        uint16 = 1000 // 正常关闭
+	closeCodeProtocolError uint16 = 1002 // 对端违反了协议
+	closeCodeMessageTooBig uint16 = 1009 // 消息太大了
 )
 
 var (
@@ -36,6 +44,23 @@ var (
 	ErrConnectionIsClosed = errors.New("websocket connection is closed.")
 )
 
+var (
+	// DefaultMaxMessageSize 一条消息（所有分片加起来）默认最多多少字节，超过的回复关闭帧之后关闭连接，服务启动之前可以修改
+	DefaultMaxMessageSize int = protocol.DefaultMaxMsgSize
+	// DefaultFragmentSize 发送的消息默认超过多少字节的时候分片发送，0 表示不分片，服务启动之前可以修改
+	DefaultFragmentSize int = 0
+)
+
+// closeErr 对端违反了协议或者消息太大，回复带状态码的关闭帧之后关闭连接
+type closeErr struct {
+	code   uint16
+	reason string
+}
+
+func (p1this closeErr) Error() string {
+	return fmt.Sprintf("websocket close %d: %s", p1this.code, p1this.reason)
+}
+
 var _ protocol.Protocol = &WebSocket{}
 
 // WebSocket 协议
@@ -50,6 +75,8 @@ type WebSocket struct {
 
 	// SecWebSocketKey sec-websocket-key
 	SecWebSocketKey string
+	// Host 客户端握手请求的 Host，为空时用 localhost
+	Host string
 
 	// handshakeStatus 握手状态，详见 handshakeStatus 开头的常量
 	handshakeStatus uint8
@@ -76,9 +103,22 @@ type WebSocket struct {
 	// bodyLength 消息体长度
 	bodyLength uint64
 
+	// fragmentOpcode 正在接收的分片消息的 opcode（第一个分片的），0 表示没有分片消息在接收
+	fragmentOpcode uint8
+	// sli1fragment 分片消息已经接收的数据
+	sli1fragment []byte
+	// isMsgComplete 一条消息接收完了（没有分片的消息，或者最后一个分片）
+	isMsgComplete bool
+	// maxMessageSize 一条消息（所有分片加起来）最多多少字节
+	maxMessageSize int
+	// fragmentSize 发送的消息超过多少字节的时候分片发送，0 表示不分片
+	fragmentSize int
+
 	// Sli1Msg 请求报文
 	Sli1Msg []byte
-	// DecodeMsg 解析后的数据
+	// sli1payload 当前帧解析后的数据，控制帧（ping、关闭帧）要用
+	sli1payload []byte
+	// DecodeMsg 解析后的数据，分片的消息是所有分片拼起来的
 	DecodeMsg string
 }
 
@@ -87,9 +127,21 @@ func NewWebSocket() *WebSocket {
 		encodeType:      encodeTypeNoMusk,
 		p1HttpInner:     http.NewHTTP(),
 		handshakeStatus: handshakeStatusNo,
+		maxMessageSize:  DefaultMaxMessageSize,
+		fragmentSize:    DefaultFragmentSize,
 	}
 }
 
+// SetMaxMessageSize 设置一条消息（所有分片加起来）最多多少字节，默认是 DefaultMaxMessageSize
+func (p1this *WebSocket) SetMaxMessageSize(maxMessageSize int) {
+	p1this.maxMessageSize = maxMessageSize
+}
+
+// SetFragmentSize 设置发送的消息超过多少字节的时候分片发送，0 表示不分片，默认是 DefaultFragmentSize
+func (p1this *WebSocket) SetFragmentSize(fragmentSize int) {
+	p1this.fragmentSize = fragmentSize
+}
+
 func (p1this *WebSocket) FirstMsgLength(sli1recv []byte) (uint64, error) {
 	if handshakeStatusNo == p1this.handshakeStatus {
 		// 没有握手
@@ -104,15 +156,11 @@ func (p1this *WebSocket) FirstMsgLength(sli1recv []byte) (uint64, error) {
 
 		// 取 FIN，第 1 个字节的第 1 位
 		t1fin := sli1recv[0] & 0b10000000
-		if t1fin == 0b10000000 {
-			p1this.fin = true
-		}
+		p1this.fin = t1fin == 0b10000000
 
 		// 取 opcode，第 1 个字节的后 4 位
+		// 关闭帧也要接收完整，回复的关闭帧要带上对端的状态码
 		p1this.opcode = sli1recv[0] & 0b00001111
-		if opcodeClose == p1this.opcode {
-			return 0, ErrConnectionIsClosed
-		}
 
 		// 头部长度至少 2 字节
 		p1this.headerLength = 2
@@ -128,7 +176,7 @@ func (p1this *WebSocket) FirstMsgLength(sli1recv []byte) (uint64, error) {
 		}
 
 		// 取 Payload len，第 2 个字节的后 7 位
-		p1this.payloadLen8 = sli1recv[1] & 0b0111111
+		p1this.payloadLen8 = sli1recv[1] & 0b01111111
 		if 126 == p1this.payloadLen8 {
 			p1this.headerLength += 2
 		} else if 127 == p1this.payloadLen8 {
@@ -151,6 +199,7 @@ func (p1this *WebSocket) FirstMsgLength(sli1recv []byte) (uint64, error) {
 			msgLen = uint64(p1this.headerLength) + uint64(p1this.payloadLen16)
 		} else if 127 == p1this.payloadLen8 {
 			// Payload len 为 127，需要扩展 8 个字节
+			p1this.payloadLen64 = 0
 			p1this.payloadLen64 |= uint64(sli1recv[2]) << 56
 			p1this.payloadLen64 |= uint64(sli1recv[3]) << 48
 			p1this.payloadLen64 |= uint64(sli1recv[4]) << 40
@@ -164,6 +213,11 @@ func (p1this *WebSocket) FirstMsgLength(sli1recv []byte) (uint64, error) {
 			msgLen = uint64(p1this.headerLength) + uint64(p1this.payloadLen8)
 		}
 
+		// 帧头接收完就校验，消息太大的不用等数据接收完
+		if err := p1this.checkFrame(msgLen - uint64(p1this.headerLength)); nil != err {
+			return 0, err
+		}
+
 		p1this.bodyLength = msgLen
 		if msgLen > uint64(recvLen) {
 			// 计算出来的报文长度大于接收缓冲区中数据长度
@@ -176,6 +230,9 @@ func (p1this *WebSocket) FirstMsgLength(sli1recv []byte) (uint64, error) {
 			p1this.arr1MaskingKey[1] = sli1recv[p1this.headerLength-3]
 			p1this.arr1MaskingKey[2] = sli1recv[p1this.headerLength-2]
 			p1this.arr1MaskingKey[3] = sli1recv[p1this.headerLength-1]
+		} else {
+			// 没有 Masking-key 的，和全 0 的异或，数据不变
+			p1this.arr1MaskingKey = [4]byte{}
 		}
 
 		return msgLen, nil
@@ -184,6 +241,41 @@ func (p1this *WebSocket) FirstMsgLength(sli1recv []byte) (uint64, error) {
 	return 0, nil
 }
 
+// checkFrame 校验帧头：控制帧不能分片，数据不能超过 125 字节；
+// 分片消息的第一个分片是文本帧或者二进制帧，后面的是延续帧，中间只能插入控制帧；
+// 消息（所有分片加起来）不能超过 maxMessageSize
+func (p1this *WebSocket) checkFrame(payloadLen uint64) error {
+	switch p1this.opcode {
+	case opcodeClose, opcodePing, opcodePong:
+		if !p1this.fin || payloadLen > 125 {
+			return closeErr{closeCodeProtocolError, "invalid control frame"}
+		}
+		return nil
+	case opcodeContinuation:
+		if 0 == p1this.fragmentOpcode {
+			return closeErr{closeCodeProtocolError, "unexpected continuation frame"}
+		}
+	case opcodeText, opcodeBinary:
+		if 0 != p1this.fragmentOpcode {
+			return closeErr{closeCodeProtocolError, "expected continuation frame"}
+		}
+	default:
+		return closeErr{closeCodeProtocolError, fmt.Sprintf("unknown opcode %d", p1this.opcode)}
+	}
+	if uint64(len(p1this.sli1fragment))+payloadLen > uint64(p1this.maxMessageSize) {
+		return closeErr{closeCodeMessageTooBig, "message too big"}
+	}
+	return nil
+}
+
+// Clone 复制一份，请求报文指向接收缓冲区，需要复制；分片消息接收到一半的数据留在连接上
+func (p1this *WebSocket) Clone() *WebSocket {
+	t1webSocket := *p1this
+	t1webSocket.Sli1Msg = append([]byte(nil), p1this.Sli1Msg...)
+	t1webSocket.sli1fragment = nil
+	return &t1webSocket
+}
+
 func (p1this *WebSocket) Decode(sli1msg []byte) error {
 	if handshakeStatusNo == p1this.handshakeStatus {
 		// 没有握手
@@ -206,7 +298,28 @@ func (p1this *WebSocket) Decode(sli1msg []byte) error {
 			i++
 			j++
 		}
-		p1this.DecodeMsg = string(t1sli1msg)
+		p1this.sli1payload = t1sli1msg
+		p1this.isMsgComplete = false
+
+		// 控制帧不影响正在接收的分片消息
+		switch p1this.opcode {
+		case opcodeText, opcodeBinary:
+			if p1this.fin {
+				p1this.DecodeMsg = string(t1sli1msg)
+				p1this.isMsgComplete = true
+			} else {
+				p1this.fragmentOpcode = p1this.opcode
+				p1this.sli1fragment = t1sli1msg
+			}
+		case opcodeContinuation:
+			p1this.sli1fragment = append(p1this.sli1fragment, t1sli1msg...)
+			if p1this.fin {
+				p1this.DecodeMsg = string(p1this.sli1fragment)
+				p1this.isMsgComplete = true
+				p1this.fragmentOpcode = 0
+				p1this.sli1fragment = nil
+			}
+		}
 	}
 	return nil
 }
@@ -215,93 +328,74 @@ func (p1this *WebSocket) SetDecodeMsg(msg string) {
 	p1this.DecodeMsg = msg
 }
 
+// Encode 把 DecodeMsg 编码成文本帧，超过 fragmentSize 的分片发送：
+// 第一个分片是文本帧，后面的是延续帧，最后一个分片设置 FIN
 func (p1this *WebSocket) Encode() ([]byte, error) {
 	sli1body := []byte(p1this.DecodeMsg)
-	bodyLen := len(sli1body)
+	fragmentSize := p1this.fragmentSize
+	if fragmentSize <= 0 || len(sli1body) <= fragmentSize {
+		return p1this.appendFrame(nil, true, opcodeText, sli1body), nil
+	}
+
 	var sli1msg []byte
+	opcode := opcodeText
+	for len(sli1body) > fragmentSize {
+		sli1msg = p1this.appendFrame(sli1msg, false, opcode, sli1body[:fragmentSize])
+		sli1body = sli1body[fragmentSize:]
+		opcode = opcodeContinuation
+	}
+	return p1this.appendFrame(sli1msg, true, opcode, sli1body), nil
+}
 
-	if encodeTypeNoMusk == p1this.encodeType {
-		if bodyLen <= 125 {
-			sli1msg = make([]byte, 2)
-			sli1msg[0] = 0b10000000 | opcodeText
-			sli1msg[1] = 0b01111111 & uint8(bodyLen)
-		} else if bodyLen <= 65535 {
-			sli1msg = make([]byte, 4)
-			sli1msg[0] = 0b10000000 | opcodeText
-			sli1msg[1] = 126
-			sli1msg[2] = uint8(bodyLen >> 8)
-			sli1msg[3] = uint8(bodyLen >> 0)
-		} else {
-			sli1msg = make([]byte, 10)
-			sli1msg[0] = 0b10000000 | opcodeText
-			sli1msg[1] = 127
-			sli1msg[2] = uint8(bodyLen >> 56)
-			sli1msg[3] = uint8(bodyLen >> 48)
-			sli1msg[4] = uint8(bodyLen >> 40)
-			sli1msg[5] = uint8(bodyLen >> 32)
-			sli1msg[6] = uint8(bodyLen >> 24)
-			sli1msg[7] = uint8(bodyLen >> 16)
-			sli1msg[8] = uint8(bodyLen >> 8)
-			sli1msg[9] = uint8(bodyLen >> 0)
-		}
-		sli1msg = append(sli1msg, sli1body...)
+// appendFrame 构造一个 WebSocket 帧加到 sli1data 后面，客户端发送的帧按 RFC 6455 5.3 加 Masking-key 并掩码 payload
+func (p1this *WebSocket) appendFrame(sli1data []byte, fin bool, opcode uint8, sli1payload []byte) []byte {
+	var b0 uint8 = opcode
+	if fin {
+		b0 |= 0b10000000
+	}
+	var maskBit uint8 = 0
+	if encodeTypeUseMusk == p1this.encodeType {
+		maskBit = 0b10000000
+	}
 
+	payloadLen := len(sli1payload)
+	if payloadLen <= 125 {
+		sli1data = append(sli1data, b0, maskBit|uint8(payloadLen))
+	} else if payloadLen <= 65535 {
+		sli1data = append(sli1data, b0, maskBit|126)
+		sli1data = binary.BigEndian.AppendUint16(sli1data, uint16(payloadLen))
 	} else {
-		// 这里就直接设置 4 个 0b00000000
-		var arr1maskingKey [4]byte = [4]byte{0x00, 0x00, 0x00, 0x00}
-		var maskIndex int
-
-		if bodyLen <= 125 {
-			sli1msg = make([]byte, 6)
-			maskIndex = 6
-			sli1msg[0] = 0b10000000 | opcodeText
-			sli1msg[1] = 0b10000000 | uint8(bodyLen)
-			sli1msg[2] = arr1maskingKey[0]
-			sli1msg[3] = arr1maskingKey[1]
-			sli1msg[4] = arr1maskingKey[2]
-			sli1msg[5] = arr1maskingKey[3]
-			sli1msg = append(sli1msg, sli1body...)
-		} else if bodyLen <= 65535 {
-			sli1msg = make([]byte, 8)
-			maskIndex = 8
-			sli1msg[0] = 0b10000000 | opcodeText
-			sli1msg[1] = 126
-			sli1msg[2] = uint8(bodyLen >> 8)
-			sli1msg[3] = uint8(bodyLen >> 0)
-			sli1msg[4] = arr1maskingKey[0]
-			sli1msg[5] = arr1maskingKey[1]
-			sli1msg[6] = arr1maskingKey[2]
-			sli1msg[7] = arr1maskingKey[3]
-			sli1msg = append(sli1msg, sli1body...)
-		} else {
-			sli1msg = make([]byte, 14)
-			maskIndex = 14
-			sli1msg[0] = 0b10000000 | opcodeText
-			sli1msg[1] = 127
-			sli1msg[2] = uint8(bodyLen >> 56)
-			sli1msg[3] = uint8(bodyLen >> 48)
-			sli1msg[4] = uint8(bodyLen >> 40)
-			sli1msg[5] = uint8(bodyLen >> 32)
-			sli1msg[6] = uint8(bodyLen >> 24)
-			sli1msg[7] = uint8(bodyLen >> 16)
-			sli1msg[8] = uint8(bodyLen >> 8)
-			sli1msg[9] = uint8(bodyLen >> 0)
-			sli1msg[10] = arr1maskingKey[0]
-			sli1msg[11] = arr1maskingKey[1]
-			sli1msg[12] = arr1maskingKey[2]
-			sli1msg[13] = arr1maskingKey[3]
-			sli1msg = append(sli1msg, sli1body...)
-		}
+		sli1data = append(sli1data, b0, maskBit|127)
+		sli1data = binary.BigEndian.AppendUint64(sli1data, uint64(payloadLen))
+	}
 
-		var i, j = maskIndex, 0
-		for j < bodyLen {
-			sli1msg[i] = sli1msg[i] ^ arr1maskingKey[j&0b00000011]
-			i++
-			j++
-		}
+	if 0 == maskBit {
+		return append(sli1data, sli1payload...)
 	}
 
-	return sli1msg, nil
+	// 这里就直接设置 4 个 0b00000000
+	var arr1maskingKey [4]byte = [4]byte{0x00, 0x00, 0x00, 0x00}
+	sli1data = append(sli1data, arr1maskingKey[:]...)
+	for j := 0; j < payloadLen; j++ {
+		sli1data = append(sli1data, sli1payload[j]^arr1maskingKey[j&0b00000011])
+	}
+	return sli1data
+}
+
+// closeMsg 构造关闭帧：对端发来关闭帧的，回复同样的状态码；违反协议或者消息太大的，带上状态码和原因
+func (p1this *WebSocket) closeMsg(err error) []byte {
+	var sli1payload []byte
+	var t1closeErr closeErr
+	if errors.As(err, &t1closeErr) {
+		sli1payload = binary.BigEndian.AppendUint16(nil, t1closeErr.code)
+		sli1payload = append(sli1payload, t1closeErr.reason...)
+	} else if ErrConnectionIsClosed == err {
+		sli1payload = binary.BigEndian.AppendUint16(nil, closeCodeNormal)
+		if len(p1this.sli1payload) >= 2 {
+			sli1payload = p1this.sli1payload[:2]
+		}
+	}
+	return p1this.appendFrame(nil, true, opcodeClose, sli1payload)
 }
 
 // SetHandshakeStatusYes 设置握手状态为已握手
@@ -324,23 +418,24 @@ func (p1this *WebSocket) CheckHandshakeReq() ([]byte, error) {
 	var sli1msg []byte = []byte{}
 
 	// 判断请求头中 connection 和 upgrade 字段是否符合要求
-	connection, ok := p1this.p1HttpInner.MapHeader["connection"]
-	if !ok {
+	connection := p1this.p1HttpInner.GetHeader("connection")
+	if "" == connection {
 		return sli1msg, errors.New("http header missing connection.")
 	}
-	upgrade, ok := p1this.p1HttpInner.MapHeader["upgrade"]
-	if !ok {
+	upgrade := p1this.p1HttpInner.GetHeader("upgrade")
+	if "" == upgrade {
 		return sli1msg, errors.New("http header missing upgrade.")
 	}
-	upgradeIndex := strings.Index(connection, "Upgrade")
-	websocketIndex := strings.Index(upgrade, "websocket")
+	// 值不区分大小写，Connection 可能还有别的选项（比如 "keep-alive, Upgrade"）
+	upgradeIndex := strings.Index(strings.ToLower(connection), "upgrade")
+	websocketIndex := strings.Index(strings.ToLower(upgrade), "websocket")
 	if upgradeIndex < 0 || websocketIndex < 0 {
 		return sli1msg, errors.New("connection is not \"Upgrade\" or upgrade is not \"websocket\".")
 	}
 
 	// Sec-WebSocket-Accept
-	secWebSocketKey, ok := p1this.p1HttpInner.MapHeader["sec-websocket-key"]
-	if !ok {
+	secWebSocketKey := p1this.p1HttpInner.GetHeader("sec-websocket-key")
+	if "" == secWebSocketKey {
 		return sli1msg, errors.New("http header missing sec-webSocket-key.")
 	}
 
@@ -369,7 +464,13 @@ func (p1this *WebSocket) MakeHandShakeReq() ([]byte, error) {
 	md5str := md5.Sum([]byte(t1str))
 	p1this.SecWebSocketKey = base64.StdEncoding.EncodeToString(md5str[:])
 
+	host := p1this.Host
+	if "" == host {
+		host = "localhost"
+	}
+
 	msg := fmt.Sprintf("GET /chat HTTP/1.1\r\n")
+	msg += fmt.Sprintf("Host: %s\r\n", host)
 	msg += fmt.Sprintf("Upgrade: websocket\r\n")
 	msg += fmt.Sprintf("Connection: Upgrade\r\n")
 	msg += fmt.Sprintf("Sec-WebSocket-Key: %s\r\n", p1this.SecWebSocketKey)
@@ -380,22 +481,23 @@ func (p1this *WebSocket) MakeHandShakeReq() ([]byte, error) {
 
 // CheckHandShakeResp 校验握手消息（服务端对客户端申请协议升级的响应）
 func (this *WebSocket) CheckHandShakeResp() (err error) {
-	connection, ok := this.p1HttpInner.MapHeader["connection"]
-	if !ok {
+	connection := this.p1HttpInner.GetHeader("connection")
+	if "" == connection {
 		return errors.New("http header missing connection.")
 	}
-	upgrade, ok := this.p1HttpInner.MapHeader["upgrade"]
-	if !ok {
+	upgrade := this.p1HttpInner.GetHeader("upgrade")
+	if "" == upgrade {
 		return errors.New("http header missing upgrade.")
 	}
-	upgradeIndex := strings.Index(connection, "Upgrade")
-	websocketIndex := strings.Index(upgrade, "websocket")
+	// 值不区分大小写，Connection 可能还有别的选项（比如 "keep-alive, Upgrade"）
+	upgradeIndex := strings.Index(strings.ToLower(connection), "upgrade")
+	websocketIndex := strings.Index(strings.ToLower(upgrade), "websocket")
 	if upgradeIndex < 0 || websocketIndex < 0 {
 		return errors.New("connection is not \"Upgrade\" or upgrade is not \"websocket\".")
 	}
 
-	secWebsocketAccept, ok := this.p1HttpInner.MapHeader["sec-websocket-accept"]
-	if !ok {
+	secWebsocketAccept := this.p1HttpInner.GetHeader("sec-websocket-accept")
+	if "" == secWebsocketAccept {
 		return errors.New("http header missing sec-websocket-accept.")
 	}
 
@@ -0,0 +1,272 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// maskFrame 构造客户端发送的帧，客户端的帧都要带 Masking-key
+func maskFrame(fin bool, opcode uint8, payload string) []byte {
+	var b0 uint8 = opcode
+	if fin {
+		b0 |= 0b10000000
+	}
+	sli1data := []byte{b0}
+	payloadLen := len(payload)
+	if payloadLen <= 125 {
+		sli1data = append(sli1data, 0b10000000|uint8(payloadLen))
+	} else if payloadLen <= 65535 {
+		sli1data = append(sli1data, 0b10000000|126)
+		sli1data = binary.BigEndian.AppendUint16(sli1data, uint16(payloadLen))
+	} else {
+		sli1data = append(sli1data, 0b10000000|127)
+		sli1data = binary.BigEndian.AppendUint64(sli1data, uint64(payloadLen))
+	}
+	arr1maskingKey := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	sli1data = append(sli1data, arr1maskingKey[:]...)
+	for i := 0; i < payloadLen; i++ {
+		sli1data = append(sli1data, payload[i]^arr1maskingKey[i&0b00000011])
+	}
+	return sli1data
+}
+
+// newHandshakeYes 已经握手的 WebSocket
+func newHandshakeYes() *WebSocket {
+	p1webSocket := NewWebSocket()
+	p1webSocket.SetHandshakeStatusYes()
+	return p1webSocket
+}
+
+func TestFirstMsgLength(t *testing.T) {
+	sli1test := []struct {
+		name         string
+		sli1data     []byte
+		msgLen       uint64
+		headerLength uint8
+		payload      string
+	}{
+		// RFC 6455 5.7 的例子
+		{"unmasked", []byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}, 7, 2, "Hello"},
+		{"masked", []byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58}, 11, 6, "Hello"},
+		{"empty", []byte{0x81, 0x80, 0x01, 0x02, 0x03, 0x04}, 6, 6, ""},
+		{"125 bytes", maskFrame(true, opcodeText, strings.Repeat("a", 125)), 131, 6, strings.Repeat("a", 125)},
+		{"16 bit length", maskFrame(true, opcodeBinary, strings.Repeat("b", 256)), 264, 8, strings.Repeat("b", 256)},
+		{"64 bit length", maskFrame(true, opcodeBinary, strings.Repeat("c", 65536)), 65550, 14, strings.Repeat("c", 65536)},
+		{"data after the frame is not included", append(maskFrame(true, opcodeText, "a"), 0x81, 0x00), 7, 6, "a"},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1webSocket := newHandshakeYes()
+			msgLen, err := p1webSocket.FirstMsgLength(t1test.sli1data)
+			if nil != err || t1test.msgLen != msgLen || t1test.headerLength != p1webSocket.headerLength {
+				t.Fatalf("FirstMsgLength() = %d, %v, header %d, want %d, header %d", msgLen, err, p1webSocket.headerLength, t1test.msgLen, t1test.headerLength)
+			}
+			if err = p1webSocket.Decode(t1test.sli1data[:msgLen]); nil != err {
+				t.Fatal(err)
+			}
+			if !p1webSocket.isMsgComplete || t1test.payload != p1webSocket.DecodeMsg {
+				t.Fatalf("DecodeMsg = %q, complete %v, want %q", p1webSocket.DecodeMsg, p1webSocket.isMsgComplete, t1test.payload)
+			}
+		})
+	}
+}
+
+// TestFirstMsgLengthIncomplete 帧头或者数据没接收完
+func TestFirstMsgLengthIncomplete(t *testing.T) {
+	sli1frame := [][]byte{
+		maskFrame(true, opcodeText, "hello"),
+		maskFrame(true, opcodeText, strings.Repeat("a", 256)),
+		maskFrame(true, opcodeText, strings.Repeat("a", 65536)),
+	}
+	for _, sli1data := range sli1frame {
+		for _, recvLen := range []int{0, 1, 3, 9, len(sli1data) - 1} {
+			if _, err := newHandshakeYes().FirstMsgLength(sli1data[:recvLen]); ErrDataIncomplete != err {
+				t.Errorf("FirstMsgLength(%d of %d bytes) = %v, want ErrDataIncomplete", recvLen, len(sli1data), err)
+			}
+		}
+	}
+}
+
+// testFrame 解析出来的一个帧
+type testFrame struct {
+	fin     bool
+	opcode  uint8
+	payload string
+}
+
+// parseFrames 用客户端的 WebSocket 解析服务端发送的数据
+func parseFrames(t *testing.T, sli1data []byte) []testFrame {
+	t.Helper()
+	p1webSocket := newHandshakeYes()
+	var sli1frame []testFrame
+	for len(sli1data) > 0 {
+		msgLen, err := p1webSocket.FirstMsgLength(sli1data)
+		if nil != err {
+			t.Fatalf("FirstMsgLength(%x): %v", sli1data, err)
+		}
+		if p1webSocket.mask {
+			t.Fatalf("frame from the service is masked: %x", sli1data[:msgLen])
+		}
+		p1webSocket.Decode(sli1data[:msgLen])
+		sli1frame = append(sli1frame, testFrame{p1webSocket.fin, p1webSocket.opcode, string(p1webSocket.sli1payload)})
+		sli1data = sli1data[msgLen:]
+	}
+	return sli1frame
+}
+
+// TestEncode 超过 fragmentSize 的分片发送，解析回来拼起来和原来一样
+func TestEncode(t *testing.T) {
+	sli1test := []struct {
+		name         string
+		msg          string
+		fragmentSize int
+		sli1frame    []testFrame
+	}{
+		{"no fragment", "hello", 0, []testFrame{{true, opcodeText, "hello"}}},
+		{"not larger than fragment size", "hello", 5, []testFrame{{true, opcodeText, "hello"}}},
+		{"two fragments", "hello", 3, []testFrame{{false, opcodeText, "hel"}, {true, opcodeContinuation, "lo"}}},
+		{"three fragments", "hello!", 2, []testFrame{{false, opcodeText, "he"}, {false, opcodeContinuation, "ll"}, {true, opcodeContinuation, "o!"}}},
+		{"empty", "", 2, []testFrame{{true, opcodeText, ""}}},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1webSocket := NewWebSocket()
+			p1webSocket.SetFragmentSize(t1test.fragmentSize)
+			p1webSocket.SetDecodeMsg(t1test.msg)
+			sli1data, _ := p1webSocket.Encode()
+			sli1frame := parseFrames(t, sli1data)
+			if len(t1test.sli1frame) != len(sli1frame) {
+				t.Fatalf("frames = %+v, want %+v", sli1frame, t1test.sli1frame)
+			}
+			for i := range sli1frame {
+				if t1test.sli1frame[i] != sli1frame[i] {
+					t.Fatalf("frame %d = %+v, want %+v", i, sli1frame[i], t1test.sli1frame[i])
+				}
+			}
+		})
+	}
+}
+
+// TestAppendFrameLength 数据长度 125、126、65535、65536 的时候分别用 7 位、16 位、64 位的长度
+func TestAppendFrameLength(t *testing.T) {
+	sli1test := []struct {
+		payloadLen   int
+		headerLength int
+	}{
+		{0, 2},
+		{125, 2},
+		{126, 4},
+		{65535, 4},
+		{65536, 10},
+	}
+	for _, t1test := range sli1test {
+		sli1data := NewWebSocket().appendFrame(nil, true, opcodeBinary, bytes.Repeat([]byte("a"), t1test.payloadLen))
+		if t1test.headerLength+t1test.payloadLen != len(sli1data) {
+			t.Errorf("appendFrame(%d bytes) = %d bytes, want header %d", t1test.payloadLen, len(sli1data), t1test.headerLength)
+		}
+	}
+}
+
+// TestCloseMsg 回复的关闭帧：对端发来的状态码原样回复，没有状态码的回复 1000，违反协议和消息太大的带上原因
+func TestCloseMsg(t *testing.T) {
+	sli1test := []struct {
+		name        string
+		sli1payload []byte
+		err         error
+		code        uint16
+		reason      string
+	}{
+		{"peer close with code and reason", append([]byte{0x03, 0xe9}, "bye"...), ErrConnectionIsClosed, 1001, ""},
+		{"peer close without code", nil, ErrConnectionIsClosed, closeCodeNormal, ""},
+		{"protocol error", nil, closeErr{closeCodeProtocolError, "invalid control frame"}, closeCodeProtocolError, "invalid control frame"},
+		{"message too big", nil, closeErr{closeCodeMessageTooBig, "message too big"}, closeCodeMessageTooBig, "message too big"},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1webSocket := NewWebSocket()
+			p1webSocket.sli1payload = t1test.sli1payload
+			sli1frame := parseFrames(t, p1webSocket.closeMsg(t1test.err))
+			if 1 != len(sli1frame) || opcodeClose != sli1frame[0].opcode || !sli1frame[0].fin || len(sli1frame[0].payload) < 2 {
+				t.Fatalf("closeMsg() = %+v, want one close frame with a code", sli1frame)
+			}
+			code := binary.BigEndian.Uint16([]byte(sli1frame[0].payload))
+			if t1test.code != code || t1test.reason != sli1frame[0].payload[2:] {
+				t.Fatalf("close frame = %d %q, want %d %q", code, sli1frame[0].payload[2:], t1test.code, t1test.reason)
+			}
+		})
+	}
+}
+
+// TestHandshake 客户端构造的握手请求，服务端校验之后回复 101，客户端校验 Sec-WebSocket-Accept
+func TestHandshake(t *testing.T) {
+	p1client := NewWebSocket()
+	p1client.Host = "example.com"
+	p1client.p1HttpInner.SetClientSide()
+	sli1req, _ := p1client.MakeHandShakeReq()
+
+	p1service := NewWebSocket()
+	if _, err := p1service.FirstMsgLength(sli1req); nil != err {
+		t.Fatalf("FirstMsgLength(%q): %v", sli1req, err)
+	}
+	p1service.Decode(sli1req)
+	if "example.com" != p1service.p1HttpInner.GetHeader("host") {
+		t.Fatalf("Host = %q", p1service.p1HttpInner.GetHeader("host"))
+	}
+	sli1resp, err := p1service.CheckHandshakeReq()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if _, err = p1client.FirstMsgLength(sli1resp); nil != err {
+		t.Fatalf("FirstMsgLength(%q): %v", sli1resp, err)
+	}
+	p1client.Decode(sli1resp)
+	if err = p1client.CheckHandShakeResp(); nil != err {
+		t.Fatal(err)
+	}
+}
+
+// TestHandshakeAccept RFC 6455 1.3 的例子
+func TestHandshakeAccept(t *testing.T) {
+	req := "GET /chat HTTP/1.1\r\nHost: server.example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	p1webSocket := NewWebSocket()
+	p1webSocket.FirstMsgLength([]byte(req))
+	p1webSocket.Decode([]byte(req))
+	sli1resp, err := p1webSocket.CheckHandshakeReq()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(sli1resp, []byte("Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")) {
+		t.Fatalf("CheckHandshakeReq() = %q", sli1resp)
+	}
+}
+
+func TestCheckHandShakeRespMalformed(t *testing.T) {
+	sli1test := []struct {
+		name string
+		resp string
+	}{
+		{"missing connection", "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: wrong\r\n\r\n"},
+		{"missing upgrade", "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: wrong\r\n\r\n"},
+		{"not websocket", "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\nSec-WebSocket-Accept: wrong\r\n\r\n"},
+		{"missing accept", "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"},
+		{"wrong accept", "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n"},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1webSocket := NewWebSocket()
+			p1webSocket.p1HttpInner.SetClientSide()
+			p1webSocket.MakeHandShakeReq()
+			if _, err := p1webSocket.FirstMsgLength([]byte(t1test.resp)); nil != err {
+				t.Fatalf("FirstMsgLength(%q): %v", t1test.resp, err)
+			}
+			p1webSocket.Decode([]byte(t1test.resp))
+			if err := p1webSocket.CheckHandShakeResp(); nil == err {
+				t.Fatal("CheckHandShakeResp() = nil, want an error")
+			}
+		})
+	}
+}
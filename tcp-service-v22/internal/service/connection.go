@@ -1,76 +1,204 @@
 package service
 
 import (
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"tcp-service-go/tcp-service-v22/internal/protocol"
-	"tcp-service-go/tcp-service-v22/internal/protocol/http"
-	"tcp-service-go/tcp-service-v22/internal/protocol/stream"
-	"tcp-service-go/tcp-service-v22/internal/protocol/websocket"
+	"tcp-service-go/tcp-service-v22/internal/tool/proxyproto"
+	"tcp-service-go/tcp-service-v22/internal/tool/recvbuffer"
+	"tcp-service-go/tcp-service-v22/internal/tool/writequeue"
+	"time"
+
+	// 注册内置的协议
+	_ "tcp-service-go/tcp-service-v22/internal/protocol/http"
+	_ "tcp-service-go/tcp-service-v22/internal/protocol/http2"
+	_ "tcp-service-go/tcp-service-v22/internal/protocol/stream"
+	_ "tcp-service-go/tcp-service-v22/internal/protocol/websocket"
 )
 
-const (
-	// RecvBufferMax 接收缓冲区最大大小，1MB == 2^20 == 1048576。
-	// uint32，最大 2^32-1，差不多 4GB，理论上应该够用了，uint64 只会更大。
-	// 这里用 uint64 是因为 WebSocket 协议最大负荷可以是 2^64-1 个字节
-	RecvBufferMax uint64 = 10 * 1048576
-)
+var _ protocol.Conn = &TCPConnection{}
 
 // TCPConnection TCP 连接
 type TCPConnection struct {
-	// 连接状态，详见 RunStatus 开头的常量
-	runStatus uint8
+	// 连接 ID，由所属 TCP 服务端分配，单调递增
+	id uint64
+	// 连接状态，详见 RunStatus 开头的常量，用 atomic 读写
+	runStatus uint32
 
 	// TCP 连接所属 TCP 服务端
 	p1service *TCPService
 
 	// 协议名称
 	protocolName string
+	// 协议的编解码器
+	p1codec *protocol.Codec
 	// protocol.Protocol
 	p1protocol protocol.Protocol
+	// 一个端口支持多个协议时，识别出来的协议自己的回调，为 nil 时用 TCPService 的，详见 AddSniffProtocol
+	p1handler *ProtocolHandler
 
 	// net.Conn
 	p1conn net.Conn
-	// 接收缓冲区
-	sli1recvBuffer []byte
-	// 接收缓冲区最大大小
-	recvBufferMax uint64
-	// 接收缓冲区当前大小
-	recvBufferNow uint64
+	// 接收缓冲区，只在 HandleConnection 的 goroutine 中读写
+	p1recvBuffer *recvbuffer.RecvBuffer
+	// 发送队列，数据由发送队列的 goroutine 发送
+	p1writeQueue *writequeue.WriteQueue
+	// chanClosed 连接关闭（finishClose）之后关闭
+	chanClosed chan struct{}
+
+	// 当前报文开始接收的时间，用于计算读超时
+	msgStartTime time.Time
+	// 当前报文的报文头是不是已经接收完了
+	isMsgHeaderDone bool
+	// 当前读超时的类型，详见 protocol 包中 TimeoutType 开头的常量
+	readTimeoutType uint8
+	// 是否已经停止读取新数据，用 atomic 读写，详见 StopRead
+	isStopRead uint32
+
+	// 事件循环模式下，连接所属的事件循环，goroutine 模式下为 nil
+	p1loop *eventLoop
+	// 事件循环模式下，最后一次读到数据的时间，用于计算空闲超时，只在事件循环的 goroutine 中读写
+	lastReadTime time.Time
+
+	// 读的这边是不是已经决定关闭连接了，用 atomic 读写，详见 closeFromRead
+	isReadClosed uint32
+	// requestMutex 保护 requestNum 和 funcAfterRequest
+	requestMutex sync.Mutex
+	// requestNum worker pool 中还没处理完的请求数量
+	requestNum int
+	// funcAfterRequest worker pool 中的请求都处理完之后要做的事情，详见 AfterRequest
+	funcAfterRequest func()
+
+	// requestSeq 请求的序号，从 1 开始，每交给 OnConnRequest 一个请求加 1。请求视图中是这个请求的序号
+	requestSeq uint64
+	// isLastRequest 当前请求是不是连接上的最后一个请求，请求视图中是这个请求的
+	isLastRequest bool
+	// responseMutex 保护 requestSeq 的修改和 lastRequestSeq、nextResponseSeq、mapResponse
+	responseMutex sync.Mutex
+	// lastRequestSeq 最后一个请求的序号，它的响应发送完之后关闭连接，0 表示还没有最后一个请求
+	lastRequestSeq uint64
+	// nextResponseSeq 下一个要发送的响应是哪个请求的
+	nextResponseSeq uint64
+	// mapResponse 前面的请求还没响应完，先存起来的响应，键是请求序号，详见 SendResponsePart
+	mapResponse map[uint64]*pendingResponse
+
+	// p1origin 用 worker pool 异步处理请求时，交给 OnConnRequest 的是请求视图，p1origin 指向真正的连接。
+	// 请求视图有自己的协议实例（解码后的报文），发送数据、关闭连接等操作都转给真正的连接。
+	p1origin *TCPConnection
+}
+
+// pendingResponse 还不能发送的响应
+type pendingResponse struct {
+	// sli1part 响应的数据，分几次发送的有多个
+	sli1part [][]byte
+	// isEnd 是不是已经有响应的最后一部分了
+	isEnd bool
 }
 
-// NewTCPConnection 创建 TCPConnection
+// NewTCPConnection 创建 TCPConnection。
+// 识别过协议的连接，用识别出来的协议，识别协议时读到的数据放进接收缓冲区，详见 HandlePreload。
 func NewTCPConnection(p1service *TCPService, p1netConn net.Conn) *TCPConnection {
+	protocolName := p1service.protocolName
+	var p1handler *ProtocolHandler
+	var sli1head []byte
+	if t1p1sniffedConn, ok := p1netConn.(*sniffedConn); ok {
+		protocolName = t1p1sniffedConn.protocolName
+		p1handler = t1p1sniffedConn.p1handler
+		sli1head = t1p1sniffedConn.sli1head
+		p1netConn = t1p1sniffedConn.Conn
+	}
+
 	p1tcpConn := &TCPConnection{
-		runStatus:      RunStatusOn,
-		p1service:      p1service,
-		protocolName:   "",
-		p1protocol:     nil,
-		p1conn:         p1netConn,
-		sli1recvBuffer: make([]byte, RecvBufferMax),
-		recvBufferMax:  RecvBufferMax,
-		recvBufferNow:  0,
+		id:           p1service.NextConnID(),
+		runStatus:    uint32(RunStatusOn),
+		p1service:    p1service,
+		protocolName: "",
+		p1codec:      nil,
+		p1protocol:   nil,
+		p1conn:       p1netConn,
+		chanClosed:   make(chan struct{}),
+
+		nextResponseSeq: 1,
 	}
 
-	p1tcpConn.protocolName = p1service.protocolName
+	p1tcpConn.protocolName = protocolName
+	p1tcpConn.p1handler = p1handler
+	p1tcpConn.p1writeQueue = writequeue.NewWriteQueue(p1service.writeQueueSize, p1service.writeQueuePolicy, p1tcpConn.writeNow, p1tcpConn.onWriteError)
+
+	// 协议是否支持，在服务启动的时候已经判断过了
+	p1tcpConn.p1codec, _ = protocol.GetCodec(p1tcpConn.protocolName)
+	p1tcpConn.p1protocol = p1tcpConn.p1codec.NewProtocol()
 
-	switch p1tcpConn.protocolName {
-	case protocol.HTTPStr:
-		p1tcpConn.p1protocol = http.NewHTTP()
-	case protocol.StreamStr:
-		p1tcpConn.p1protocol = stream.NewStream()
-	case protocol.WebSocketStr:
-		p1tcpConn.p1protocol = websocket.NewWebSocket()
+	maxMsgSize := p1service.maxMsgSize
+	if maxMsgSize <= 0 {
+		maxMsgSize = p1tcpConn.p1codec.GetMaxMsgSize()
+	}
+	p1tcpConn.p1recvBuffer = recvbuffer.NewRecvBuffer(maxMsgSize)
+	for p1reader := bytes.NewReader(sli1head); p1reader.Len() > 0; {
+		if _, err := p1tcpConn.p1recvBuffer.ReadOnce(p1reader); nil != err {
+			break
+		}
+	}
+	if _, ok := p1netConn.(syscall.Conn); ok {
+		// TLS 连接读到的是密文，不能交给事件循环直接读 socket，还是一个连接一个 goroutine
+		p1tcpConn.p1loop = p1service.pickEventLoop(p1tcpConn.id)
 	}
 
 	return p1tcpConn
 }
 
+// ID 获取连接 ID
+func (p1this *TCPConnection) ID() uint64 {
+	return p1this.id
+}
+
 // IsRun TCP 连接是不是正在运行
 func (p1this *TCPConnection) IsRun() bool {
-	return RunStatusOn == p1this.runStatus
+	return uint32(RunStatusOn) == atomic.LoadUint32(&p1this.origin().runStatus)
+}
+
+// IsRequestView 是不是请求视图，详见 RequestView
+func (p1this *TCPConnection) IsRequestView() bool {
+	return nil != p1this.p1origin
+}
+
+// GetOrigin 获取真正的连接，不是请求视图的时候返回自己
+func (p1this *TCPConnection) GetOrigin() *TCPConnection {
+	return p1this.origin()
+}
+
+// origin 获取真正的连接
+func (p1this *TCPConnection) origin() *TCPConnection {
+	if nil != p1this.p1origin {
+		return p1this.p1origin
+	}
+	return p1this
+}
+
+// RequestView 创建请求视图，协议实例用 p1protocol，其他的和真正的连接共用
+func (p1this *TCPConnection) RequestView(p1protocol protocol.Protocol) *TCPConnection {
+	return &TCPConnection{
+		id:           p1this.id,
+		p1service:    p1this.p1service,
+		protocolName: p1this.protocolName,
+		p1codec:      p1this.p1codec,
+		p1protocol:   p1protocol,
+		p1handler:    p1this.p1handler,
+		p1conn:       p1this.p1conn,
+		p1writeQueue: p1this.p1writeQueue,
+		p1loop:       p1this.p1loop,
+		p1origin:     p1this.origin(),
+
+		requestSeq:    p1this.requestSeq,
+		isLastRequest: p1this.isLastRequest,
+	}
 }
 
 // TCPService.IsDebug
@@ -78,223 +206,547 @@ func (p1this *TCPConnection) IsDebug() bool {
 	return p1this.p1service.IsDebug()
 }
 
+// GetSide 服务端的连接
+func (p1this *TCPConnection) GetSide() uint8 {
+	return protocol.SideService
+}
+
+// IsSendMagic 服务端的连接不发送 Magic
+func (p1this *TCPConnection) IsSendMagic() bool {
+	return false
+}
+
+// GetName 获取连接所属服务端的名称
+func (p1this *TCPConnection) GetName() string {
+	return p1this.p1service.name
+}
+
+// 获取连接的协议名称
+func (p1this *TCPConnection) GetProtocolName() string {
+	return p1this.protocolName
+}
+
 // 获取连接的协议实例
 func (p1this *TCPConnection) GetProtocol() protocol.Protocol {
 	return p1this.p1protocol
 }
 
-// GetNetConnRemoteAddr 获取连接 IP 和端口
+// GetNetConnRemoteAddr 获取连接 IP 和端口，开启 PROXY protocol 时是头里真实的客户端地址
 func (p1this *TCPConnection) GetNetConnRemoteAddr() string {
 	return p1this.p1conn.RemoteAddr().String()
 }
 
-// HandleConnection 处理连接
+// GetProxyHeader 获取 PROXY protocol 头，没有开启 PROXY protocol 时返回 false
+func (p1this *TCPConnection) GetProxyHeader() (*proxyproto.Header, bool) {
+	p1netConn := p1this.p1conn
+	if t1p1tlsConn, ok := p1netConn.(*tls.Conn); ok {
+		p1netConn = t1p1tlsConn.NetConn()
+	}
+	if t1p1prefixConn, ok := p1netConn.(*prefixConn); ok {
+		p1netConn = t1p1prefixConn.Conn
+	}
+	t1p1proxyConn, ok := p1netConn.(*proxyproto.Conn)
+	if !ok {
+		return nil, false
+	}
+	return t1p1proxyConn.Header(), true
+}
+
+// GetTLSConnectionState 获取 TLS 连接的状态（协商的版本、SNI、对端证书等），不是 TLS 连接时返回 false。
+// 握手在第一次读写数据的时候进行，OnConnConnect 中还拿不到握手的结果。
+func (p1this *TCPConnection) GetTLSConnectionState() (tls.ConnectionState, bool) {
+	t1p1tlsConn, ok := p1this.p1conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return t1p1tlsConn.ConnectionState(), true
+}
+
+// HandleConnection 处理连接，一个连接一个 goroutine，阻塞在 Read 上
 func (p1this *TCPConnection) HandleConnection() {
+	// 连接处理结束之后，接收缓冲区还回去
+	defer p1this.p1recvBuffer.Release()
+
+	if !p1this.HandlePreload() {
+		return
+	}
 	for p1this.IsRun() {
+		p1this.SetReadDeadline()
 		// net.Conn.Read，系统调用，从 socket 读取数据
-		byteNum, err := p1this.p1conn.Read(p1this.sli1recvBuffer[p1this.recvBufferNow:])
-
-		if p1this.IsDebug() {
-			fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleConnection.byteNum: %d", p1this.p1service.name, byteNum))
-		}
-
-		if nil != err {
-			if err == io.EOF {
-				// 对端关闭了连接
-				p1this.CloseConnection()
-				return
-			}
-			p1this.p1service.OnServiceError(p1this.p1service, err)
+		byteNum, err := p1this.p1recvBuffer.ReadOnce(p1this.p1conn)
+		if !p1this.HandleRead(byteNum, err) {
 			return
 		}
+	}
+}
+
+// HandlePreload 处理识别协议时读到的数据（已经在接收缓冲区中了），返回 false 表示连接已经关闭，不用再读了
+func (p1this *TCPConnection) HandlePreload() bool {
+	byteNum := p1this.p1recvBuffer.Len()
+	if 0 == byteNum {
+		return true
+	}
+	p1this.lastReadTime = time.Now()
+	return p1this.HandleRead(byteNum, nil)
+}
 
-		p1this.recvBufferNow += uint64(byteNum)
+// HandleRead 处理一次读取的结果，返回 false 表示连接已经关闭，不用再读了。
+// goroutine 模式和事件循环模式共用，保证两种模式的回调一致。
+func (p1this *TCPConnection) HandleRead(byteNum int, err error) bool {
+	if p1this.IsDebug() {
+		fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleConnection.byteNum: %d", p1this.p1service.name, byteNum))
+	}
 
-		if p1this.IsDebug() {
-			fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleConnection.recvBufferNow: %d", p1this.p1service.name, p1this.recvBufferNow))
-			fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleConnection.sli1recvBuffer:", p1this.p1service.name))
-			fmt.Println(string(p1this.sli1recvBuffer[0:p1this.recvBufferNow]))
+	if nil != err {
+		if recvbuffer.ErrMsgTooLarge == err {
+			// 缓冲区已经最大了，还是放不下 1 条完整的报文
+			p1this.p1service.OnServiceError(p1this.p1service, err)
+			p1this.closeFromRead(p1this.CloseConnection)
+			return false
+		}
+		if err == io.EOF {
+			// 对端关闭了连接
+			p1this.closeFromRead(p1this.CloseConnection)
+			return false
+		}
+		if !p1this.IsRun() {
+			// 连接已经在别的 goroutine 里关闭了
+			return false
+		}
+		if !p1this.p1service.IsRun() {
+			// 服务端正在关闭，StopRead 打断了 Read，还在等响应的请求响应完之后再关闭
+			p1this.closeFromRead(p1this.closeAfterResponse)
+			return false
 		}
+		if t1err, ok := err.(net.Error); ok && t1err.Timeout() {
+			timeoutType := p1this.readTimeoutType
+			p1this.closeFromRead(func() {
+				if p1this.IsRun() {
+					p1this.HandleTimeout(timeoutType)
+				}
+			})
+			return false
+		}
+		p1this.p1service.OnServiceError(p1this.p1service, err)
+		// 出错的连接也要关闭，不然会一直留在连接池里
+		p1this.closeFromRead(p1this.CloseConnection)
+		return false
+	}
+
+	if byteNum > 0 && byteNum == p1this.p1recvBuffer.Len() {
+		// 新报文的第 1 个字节到了
+		p1this.StartMsg()
+	}
 
-		p1this.HandleBuffer()
+	if p1this.IsDebug() {
+		fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleConnection.recvBufferNow: %d", p1this.p1service.name, p1this.p1recvBuffer.Len()))
+		fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleConnection.sli1recvBuffer:", p1this.p1service.name))
+		fmt.Println(string(p1this.p1recvBuffer.Bytes()))
 	}
+
+	p1this.HandleBuffer()
+	return p1this.IsRun() && !p1this.IsReadClosed()
 }
 
 // HandleBuffer 处理缓冲区
 func (p1this *TCPConnection) HandleBuffer() {
-	sli1Copy := p1this.sli1recvBuffer[0:p1this.recvBufferNow]
-	for p1this.recvBufferNow > 0 {
-		firstMsgLength, err := p1this.p1protocol.FirstMsgLength(sli1Copy)
+	for p1this.p1recvBuffer.Len() > 0 {
+		sli1recv := p1this.p1recvBuffer.Bytes()
+		firstMsgLength, err := p1this.p1protocol.FirstMsgLength(sli1recv)
 		if nil != err {
-			if protocol.HTTPStr == p1this.protocolName {
-				// 处理 HTTP 解析异常
-				p1http := p1this.p1protocol.(*http.HTTP)
-				switch p1http.ParseStatus {
-				case http.ParseStatusRecvBufferEmpty,
-					http.ParseStatusNotHTTP,
-					http.ParseStatusIncomplete:
-					// 继续接收
-				case http.ParseStatusParseErr:
-					// 明显出错
-					p1this.CloseConnection()
-				}
+			errType := p1this.p1codec.ErrType(p1this, err)
+			if protocol.ErrTypeFatal == errType {
+				// 明显出错
+				p1this.closeWithErrMsg(err)
 			}
+			// 否则继续接收
+			p1this.isMsgHeaderDone = protocol.ErrTypeHeaderIncomplete != errType
 			break
 		}
-		// 取出第 1 条完整的消息
-		sli1firstMsg := p1this.sli1recvBuffer[0:firstMsgLength]
-
-		switch p1this.protocolName {
-		case protocol.HTTPStr:
-			// 这里模仿的是 HTTP 1.1 协议，短连接。
-			p1this.HandleHTTPMsg(sli1firstMsg)
-			p1this.p1service.OnConnRequest(p1this)
-
-			// ## v2 逻辑 ##
-			// v2 需要把消息返回给外部实现处理
-			// 所以这里不再负责响应消息和关闭 TCP 连接
-			// #### v2 逻辑 ####
-
-			// ## v1 逻辑 ##
-			// 直接响应一个固定的测试消息
-			// resp := http.NewResponse()
-			// resp.SetStatusCode(http.StatusOk)
-			// respStr := resp.MakeResponse(fmt.Sprintf("this is %s.", p1this.p1service.name))
-			// p1this.SendMsg([]byte(respStr))
-			// 处理完一条消息后，直接关闭 TCP 连接
-			// p1this.CloseConnection()
-			// #### v1 逻辑 ####
+		// 取出第 1 条完整的消息，交给协议处理
+		if firstMsgLength > uint64(len(sli1recv)) {
+			// 协议算出来的长度不对，当成没接收完
+			break
+		}
+		sli1firstMsg := sli1recv[0:firstMsgLength]
+		msgAction, err := p1this.p1codec.MsgReady(p1this, sli1firstMsg)
+		if nil != err {
+			p1this.closeWithErrMsg(err)
 			return
-		case protocol.StreamStr:
-			// 这里模仿的是自定义 Stream 协议，长链接
-			p1this.HandleStreamMsg(sli1firstMsg)
-			p1this.p1service.OnConnRequest(p1this)
-
-			// ## v2 逻辑 ##
-			// v2 需要把消息返回给外部实现处理
-			// 所以这里不再负责响应消息和关闭 TCP 连接
-			// #### v2 逻辑 ####
-
-			// ## v1 逻辑 ##
-			// 直接响应一个固定的测试消息
-			// t1p1protocol := p1this.p1protocol.(*stream.Stream)
-			// t1p1protocol.SetDecodeMsg(fmt.Sprintf("this is %s.", p1this.p1service.name))
-			// p1this.SendMsg([]byte{})
-			// #### v1 逻辑 ####
-
-			// 处理完一条消息后，不会关闭 TCP 连接
-		case protocol.WebSocketStr:
-			// 这里模仿的是 WebSocket 协议，长链接
-			err := p1this.HandleWebSocketMsg(sli1firstMsg)
-			if nil != err {
-				p1this.CloseConnection()
+		}
+		if protocol.MsgActionSkip != msgAction {
+			isLastRequest := p1this.nextRequest(msgAction)
+			// 把消息返回给外部实现处理，这里不负责响应消息和关闭 TCP 连接
+			p1this.DispatchRequest()
+			if isLastRequest {
+				// 最后一个请求，不再读取新数据，最后一个响应发送完之后关闭连接，详见 SendResponse
+				p1this.closeFromRead(func() {})
 				return
 			}
-			p1this.p1service.OnConnRequest(p1this)
-			// 如果握手成功，就直接响应一个固定的测试消息
-			// t1p1protocol := p1this.p1protocol.(*websocket.WebSocket)
-			// if t1p1protocol.IsHandshakeStatusYes() {
-			//   t1p1protocol.SetDecodeMsg(fmt.Sprintf("this is %s.", p1this.p1service.name))
-			//   p1this.SendMsg([]byte{})
-			// }
-			// 处理完一条消息后，不会关闭 TCP 连接
+		}
+		if !p1this.IsRun() || p1this.IsReadClosed() {
+			return
 		}
 
 		// 处理接收缓冲区中剩余的数据
-		p1this.sli1recvBuffer = p1this.sli1recvBuffer[firstMsgLength:]
-		// recvBufferNow 是 uint64 类型的，做减法的时候小心溢出
-		if p1this.recvBufferNow <= firstMsgLength {
-			p1this.recvBufferNow = 0
+		p1this.p1recvBuffer.Discard(int(firstMsgLength))
+		if 0 == p1this.p1recvBuffer.Len() {
 			break
 		} else {
-			p1this.recvBufferNow -= firstMsgLength
+			// 剩下的数据是下一条报文的
+			p1this.StartMsg()
+		}
+
+		if protocol.MsgActionRequestStop == msgAction {
+			return
 		}
 	}
 }
 
-// HandelHTTPMsg 处理 HTTP 消息
-func (p1this *TCPConnection) HandleHTTPMsg(sli1firstMsg []byte) {
-	t1p1protocol := p1this.p1protocol.(*http.HTTP)
-	t1p1protocol.Decode(sli1firstMsg)
+// nextRequest 给新请求分配序号，返回这个请求是不是连接上的最后一个请求。
+// 协议要求不再保持连接，或者请求数到了 TCPService 设置的最大值时，是最后一个请求。
+// 多路复用的协议停止读取的时候，对端已经发出来的请求没法处理，所以不限制请求数。
+func (p1this *TCPConnection) nextRequest(msgAction uint8) bool {
+	p1this.responseMutex.Lock()
+	defer p1this.responseMutex.Unlock()
+	p1this.requestSeq++
+	maxRequestNum := p1this.p1service.maxRequestNum
+	p1this.isLastRequest = protocol.MsgActionRequestLast == msgAction || (maxRequestNum > 0 && !p1this.p1codec.IsMultiplexed && p1this.requestSeq >= maxRequestNum)
+	if p1this.isLastRequest {
+		p1this.lastRequestSeq = p1this.requestSeq
+	}
+	return p1this.isLastRequest
+}
 
-	if p1this.IsDebug() {
-		fmt.Println(fmt.Sprintf("%s.TCPConnection.HandelHTTPMsg.Decode: ", p1this.p1service.name))
-		fmt.Println(fmt.Sprintf("%+v", t1p1protocol))
+// GetRequestSeq 获取当前请求的序号，在 OnConnRequest 中调用，异步响应时用它调用 SendResponse
+func (p1this *TCPConnection) GetRequestSeq() uint64 {
+	return p1this.requestSeq
+}
+
+// IsKeepAlive 当前请求响应之后是不是保持连接，在 OnConnRequest 中调用。
+// 返回 false 时是连接上的最后一个请求，响应可以带上告诉对端关闭连接的信息（比如 HTTP 的 "Connection: close"）。
+func (p1this *TCPConnection) IsKeepAlive() bool {
+	return !p1this.isLastRequest
+}
+
+// DispatchRequest 把解码之后的报文交给 OnConnRequest 处理。
+// 没有 worker pool（或者协议实例不能复制）时，在当前 goroutine 中处理。
+// 有的话，用复制的协议实例创建请求视图，交给 worker pool 异步处理，有序模式下同一个连接的请求按顺序处理。
+func (p1this *TCPConnection) DispatchRequest() {
+	p1workerPool := p1this.p1service.p1workerPool
+	if nil == p1workerPool || !p1this.p1codec.CanClone() {
+		p1this.onConnRequest()
+		return
+	}
+
+	p1view := p1this.RequestView(p1this.p1codec.Clone(p1this.p1protocol))
+	p1this.requestMutex.Lock()
+	p1this.requestNum++
+	p1this.requestMutex.Unlock()
+	err := p1workerPool.Submit(p1this.id, func() {
+		p1view.onConnRequest()
+		p1this.requestDone()
+	})
+	if nil == err {
+		return
+	}
+
+	// worker pool 满了，请求被拒绝。按协议回复一条消息（有的话），然后关闭连接
+	p1this.requestDone()
+	p1this.p1service.OnRequestRejected(p1view)
+	p1this.closeFromRead(func() {
+		if nil != p1this.p1codec.RejectMsg {
+			p1this.WriteData(p1this.p1codec.RejectMsg())
+		}
+		p1this.CloseConnection()
+	})
+}
+
+// requestDone worker pool 中的一个请求处理完了
+func (p1this *TCPConnection) requestDone() {
+	var funcAfterRequest func()
+	p1this.requestMutex.Lock()
+	p1this.requestNum--
+	if 0 == p1this.requestNum {
+		funcAfterRequest = p1this.funcAfterRequest
+		p1this.funcAfterRequest = nil
+	}
+	p1this.requestMutex.Unlock()
+	if nil != funcAfterRequest {
+		funcAfterRequest()
+	}
+}
+
+// AfterRequest f 在 worker pool 中这个连接的请求都处理完之后执行，没有还没处理完的请求时，马上在当前 goroutine 中执行
+func (p1this *TCPConnection) AfterRequest(f func()) {
+	p1this = p1this.origin()
+	p1this.requestMutex.Lock()
+	if 0 == p1this.requestNum {
+		p1this.requestMutex.Unlock()
+		f()
+		return
+	}
+	if nil == p1this.funcAfterRequest {
+		p1this.funcAfterRequest = f
+	} else {
+		funcBefore := p1this.funcAfterRequest
+		p1this.funcAfterRequest = func() {
+			funcBefore()
+			f()
+		}
+	}
+	p1this.requestMutex.Unlock()
+}
+
+// IsReadClosed 读的这边是不是已经决定关闭连接了，详见 closeFromRead
+func (p1this *TCPConnection) IsReadClosed() bool {
+	return 1 == atomic.LoadUint32(&p1this.origin().isReadClosed)
+}
+
+// closeWithErrMsg 报文明显出错，按协议回复一条消息（有的话），然后关闭连接。
+// 回复的消息当成最后一个请求的响应，排在已经收到的请求的响应后面，详见 SendResponse。
+func (p1this *TCPConnection) closeWithErrMsg(err error) {
+	var sli1msg []byte
+	if nil != p1this.p1codec.ErrMsg {
+		sli1msg = p1this.p1codec.ErrMsg(p1this, err)
 	}
+	if 0 == len(sli1msg) {
+		p1this.closeFromRead(p1this.CloseConnection)
+		return
+	}
+	p1this.nextRequest(protocol.MsgActionRequestLast)
+	p1this.closeFromRead(func() {})
+	p1this.writeResponse(p1this.requestSeq, sli1msg, true)
 }
 
-// HandleStreamMsg 处理自定义字节流消息
-func (p1this *TCPConnection) HandleStreamMsg(sli1firstMsg []byte) {
-	t1p1protocol := p1this.p1protocol.(*stream.Stream)
-	t1p1protocol.Decode(sli1firstMsg)
+// closeFromRead 读的这边要关闭连接（对端关闭、超时、出错等）。
+// 先停止读取新数据，等 worker pool 中这个连接的请求都处理完之后，再执行 f，保证已经收到的请求都能响应。
+// 只有第一次调用生效。
+func (p1this *TCPConnection) closeFromRead(f func()) {
+	if !atomic.CompareAndSwapUint32(&p1this.isReadClosed, 0, 1) {
+		return
+	}
+	if nil != p1this.p1loop {
+		p1this.p1loop.Pause(p1this)
+	}
+	p1this.AfterRequest(f)
+}
 
+// SendMsg 发送数据，数据经过协议编码之后再发送
+func (p1this *TCPConnection) SendMsg(sli1msg []byte) {
+	t1sli1msg, err := p1this.p1codec.EncodeMsg(p1this, sli1msg)
+	if nil != err {
+		p1this.p1service.OnServiceError(p1this.p1service, err)
+		return
+	}
 	if p1this.IsDebug() {
-		fmt.Println(fmt.Sprintf("%s.TCPConnection.HandelStreamMsg.Decode: ", p1this.p1service.name))
-		fmt.Println(fmt.Sprintf("%+v", t1p1protocol))
+		fmt.Println(fmt.Sprintf("%s.TCPConnection.SendMsg: ", p1this.p1service.name))
+		fmt.Println(string(t1sli1msg))
 	}
+	p1this.WriteData(t1sli1msg)
 }
 
-// HandleWebSocketMsg 处理 WebSocket 消息
-func (p1this *TCPConnection) HandleWebSocketMsg(sli1firstMsg []byte) error {
-	t1p1protocol := p1this.p1protocol.(*websocket.WebSocket)
-	t1p1protocol.Decode(sli1firstMsg)
+// SendResponse 按请求的顺序发送响应，数据经过协议编码之后再发送，requestSeq 是 GetRequestSeq 获取的请求序号。
+// 前面的请求还没响应完的时候，先存起来，前面的都发送了再发送（比如 HTTP pipelining）。
+// 每个请求都要响应，不然后面的响应一直发不出去。最后一个请求的响应发送之后关闭连接。
+func (p1this *TCPConnection) SendResponse(requestSeq uint64, sli1msg []byte) {
+	p1this.SendResponsePart(requestSeq, sli1msg, true)
+}
 
+// SendResponsePart 发送响应的一部分，响应比较大的时候可以分几次发送（比如 HTTP chunked 编码），isEnd 为 true 时是最后一部分。
+// 顺序和关闭连接的规则和 SendResponse 一样，前面的请求响应完之前，这个请求的数据先存起来。
+func (p1this *TCPConnection) SendResponsePart(requestSeq uint64, sli1msg []byte, isEnd bool) {
+	t1sli1msg, err := p1this.p1codec.EncodeMsg(p1this, sli1msg)
+	if nil != err {
+		p1this.p1service.OnServiceError(p1this.p1service, err)
+		return
+	}
 	if p1this.IsDebug() {
-		fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleWebSocketMsg.Decode: ", p1this.p1service.name))
-		fmt.Println(fmt.Sprintf("%+v", t1p1protocol))
+		fmt.Println(fmt.Sprintf("%s.TCPConnection.SendResponsePart: %d, %v", p1this.p1service.name, requestSeq, isEnd))
+		fmt.Println(string(t1sli1msg))
 	}
 
-	// 如果还没有握手成功，就走握手流程
-	if t1p1protocol.IsHandshakeStatusNo() {
-		sli1respMsg, err := t1p1protocol.CheckHandshakeReq()
+	p1this.origin().writeResponse(requestSeq, t1sli1msg, isEnd)
+}
 
-		if p1this.IsDebug() {
-			fmt.Println(fmt.Sprintf("%s.TCPConnection.HandleWebSocketMsg.CheckHandshakeReq: ", p1this.p1service.name))
-			fmt.Println(fmt.Sprintf("%+v", string(sli1respMsg)))
+// writeResponse 按请求的顺序发送响应的一部分，数据不经过编码，详见 SendResponsePart。
+// 多路复用的协议（Codec.IsMultiplexed）数据马上发送，只按请求的顺序记录哪些请求响应完了，用来判断什么时候关闭连接。
+// 锁里面只放进发送队列，发送队列满了的处理和关闭连接都在锁外面，OnConnClose 等回调里面可以再发送响应
+func (p1this *TCPConnection) writeResponse(requestSeq uint64, sli1data []byte, isEnd bool) {
+	isClose := false
+	var errPush error
+	push := func(t1sli1data []byte) {
+		if err := p1this.p1writeQueue.Push(t1sli1data); nil != err && nil == errPush {
+			errPush = err
 		}
+	}
+	p1this.responseMutex.Lock()
+	if requestSeq < p1this.nextResponseSeq || requestSeq > p1this.requestSeq {
+		// 已经响应完的，或者还没有的请求
+		p1this.responseMutex.Unlock()
+		return
+	}
+	if nil == p1this.mapResponse {
+		p1this.mapResponse = make(map[uint64]*pendingResponse)
+	}
+	p1response, ok := p1this.mapResponse[requestSeq]
+	if !ok {
+		p1response = &pendingResponse{}
+		p1this.mapResponse[requestSeq] = p1response
+	}
+	if len(sli1data) > 0 {
+		if p1this.p1codec.IsMultiplexed {
+			// 多路复用的协议，响应自己带着是哪个请求的，不用等前面的请求
+			push(sli1data)
+		} else {
+			p1response.sli1part = append(p1response.sli1part, sli1data)
+		}
+	}
+	p1response.isEnd = isEnd
+	for {
+		p1response, ok := p1this.mapResponse[p1this.nextResponseSeq]
+		if !ok {
+			break
+		}
+		// 在锁里面放进发送队列，保证发送的顺序
+		for _, t1sli1data := range p1response.sli1part {
+			push(t1sli1data)
+		}
+		p1response.sli1part = nil
+		if !p1response.isEnd {
+			// 这个请求还没响应完，后面的请求要等着
+			break
+		}
+		delete(p1this.mapResponse, p1this.nextResponseSeq)
+		isClose = p1this.nextResponseSeq == p1this.lastRequestSeq
+		p1this.nextResponseSeq++
+	}
+	p1this.responseMutex.Unlock()
 
-		if nil != err {
-			// 发送 400 给客户端，并且关闭连接
-			resp := http.NewResponse()
-			resp.SetStatusCode(http.StatusBadRequest)
-			respStr := resp.MakeResponse(fmt.Sprintf("this is %s. handshake err: %s", p1this.p1service.name, err))
-			p1this.WriteData([]byte(respStr))
+	if nil != errPush {
+		p1this.handleWriteErr(errPush)
+	}
+	if isClose {
+		p1this.CloseConnection()
+	}
+}
 
-			return err
-		} else {
-			// 握手消息是通过 websocket.WebSocket 内部的 http.HTTP 处理的
-			// 走 SendMsg 方法会判断成 WebSocket，走编码逻辑，所以这里通过 WriteData 方法直接发送
-			err = p1this.WriteData(sli1respMsg)
-			if nil == err {
-				t1p1protocol.SetHandshakeStatusYes()
+// StartMsg 开始接收新报文
+func (p1this *TCPConnection) StartMsg() {
+	p1this.msgStartTime = time.Now()
+	p1this.isMsgHeaderDone = false
+}
+
+// SetReadDeadline 根据接收缓冲区的状态设置读超时，详见 ReadDeadline
+func (p1this *TCPConnection) SetReadDeadline() {
+	// deadline 为零值时表示不限制
+	p1this.p1conn.SetReadDeadline(p1this.ReadDeadline(time.Now()))
+	if 1 == atomic.LoadUint32(&p1this.isStopRead) {
+		// StopRead 设置的超时不能被覆盖
+		p1this.p1conn.SetReadDeadline(time.Now())
+	}
+}
+
+// ReadDeadline 根据接收缓冲区的状态计算读超时的时间，同时记下超时类型，零值表示不限制。
+// 缓冲区为空时是从 idleStart 算起的空闲超时（请求都响应完之后是保持连接的空闲超时），否则是从报文开始接收时算起的读报文头超时或者读报文超时，取先到期的那个。
+func (p1this *TCPConnection) ReadDeadline(idleStart time.Time) time.Time {
+	p1service := p1this.p1service
+	var deadline time.Time
+	if 0 == p1this.p1recvBuffer.Len() {
+		idleTimeout := p1service.idleTimeout
+		if p1this.requestSeq > 0 && p1service.keepAliveTimeout > 0 && !p1this.hasPendingResponse() {
+			// 处理过的请求都响应完了，等下一个请求用保持连接的空闲超时；
+			// 还有请求在等响应的时候，对端在等，不算保持连接的空闲
+			idleTimeout = p1service.keepAliveTimeout
+		}
+		if idleTimeout > 0 {
+			deadline = idleStart.Add(idleTimeout)
+			p1this.readTimeoutType = protocol.TimeoutTypeIdle
+		}
+	} else {
+		if p1service.readTimeout > 0 {
+			deadline = p1this.msgStartTime.Add(p1service.readTimeout)
+			p1this.readTimeoutType = protocol.TimeoutTypeRead
+		}
+		if !p1this.isMsgHeaderDone && p1service.readHeaderTimeout > 0 {
+			t1deadline := p1this.msgStartTime.Add(p1service.readHeaderTimeout)
+			if deadline.IsZero() || t1deadline.Before(deadline) {
+				deadline = t1deadline
+				p1this.readTimeoutType = protocol.TimeoutTypeReadHeader
 			}
 		}
 	}
+	return deadline
+}
 
-	return nil
+// hasPendingResponse 有没有还没响应完的请求，没有用 SendResponse 响应的协议（比如 Stream）一直是有的
+func (p1this *TCPConnection) hasPendingResponse() bool {
+	p1this.responseMutex.Lock()
+	defer p1this.responseMutex.Unlock()
+	return p1this.nextResponseSeq <= p1this.requestSeq
 }
 
-// SendMsg 发送数据
-func (p1this *TCPConnection) SendMsg(sli1msg []byte) {
-	switch p1this.protocolName {
-	case protocol.HTTPStr:
-		if p1this.IsDebug() {
-			fmt.Println(fmt.Sprintf("%s.TCPConnection.SendMsg: ", p1this.p1service.name))
-			fmt.Println(string(sli1msg))
+// closeAfterResponse 服务端优雅关闭，请求都用 SendResponse 响应的协议（Codec.IsRequestResponse），
+// 还有请求没响应完的时候，当前的请求当成最后一个请求，它的响应发送完之后再关闭连接，Shutdown 的 ctx 到期的时候强制关闭。
+// 其他的协议不知道还有没有响应要发送，马上关闭
+func (p1this *TCPConnection) closeAfterResponse() {
+	if p1this.p1codec.IsRequestResponse {
+		p1this.responseMutex.Lock()
+		if 0 == p1this.lastRequestSeq {
+			p1this.lastRequestSeq = p1this.requestSeq
+		}
+		p1this.responseMutex.Unlock()
+		if p1this.hasPendingResponse() {
+			// 最后一个响应发送完之后关闭，详见 writeResponse
+			return
 		}
-		p1this.WriteData(sli1msg)
-	case protocol.StreamStr:
-		t1sli1msg, _ := p1this.p1protocol.Encode()
-		if p1this.IsDebug() {
-			fmt.Println(fmt.Sprintf("%s.TCPConnection.SendMsg: ", p1this.p1service.name))
-			fmt.Println(string(t1sli1msg))
+	}
+	p1this.CloseConnection()
+}
+
+// HandleTimeout 处理超时，先触发 OnConnTimeout，读超时的时候按协议回复一条消息，然后关闭连接
+func (p1this *TCPConnection) HandleTimeout(timeoutType uint8) {
+	p1this.p1service.OnConnTimeout(p1this, timeoutType)
+	if protocol.TimeoutTypeWrite != timeoutType && nil != p1this.p1codec.TimeoutMsg {
+		sli1msg := p1this.p1codec.TimeoutMsg(p1this, timeoutType)
+		if len(sli1msg) > 0 {
+			p1this.WriteData(sli1msg)
 		}
-		p1this.WriteData(t1sli1msg)
 	}
+	p1this.CloseConnection()
+}
+
+// GetWriteQueueLen 获取发送队列中待发送的数据有多少条
+func (p1this *TCPConnection) GetWriteQueueLen() int {
+	return p1this.p1writeQueue.Len()
 }
 
-// WriteData 发送数据
+// WriteData 发送数据，数据不经过编码，放进发送队列之后就返回，调用方不能再修改 sli1data。
+// 发送队列满了的时候，按 TCPService 设置的策略处理，详见 writequeue 包中 Policy 开头的常量。
 func (p1this *TCPConnection) WriteData(sli1data []byte) error {
+	err := p1this.p1writeQueue.Push(sli1data)
+	if nil != err {
+		p1this.handleWriteErr(err)
+	}
+	return err
+}
+
+// handleWriteErr 放进发送队列出错之后的处理，发送队列满了的时候报错，PolicyClose 时关闭连接
+func (p1this *TCPConnection) handleWriteErr(err error) {
+	if writequeue.ErrQueueFull != err {
+		return
+	}
+	p1this.p1service.OnServiceError(p1this.p1service, err)
+	if writequeue.PolicyClose == p1this.p1service.writeQueuePolicy {
+		p1this.CloseConnection()
+	}
+}
+
+// writeNow 发送数据，只在发送队列的 goroutine 中调用
+func (p1this *TCPConnection) writeNow(sli1data []byte) error {
+	if p1this.p1service.writeTimeout > 0 {
+		p1this.p1conn.SetWriteDeadline(time.Now().Add(p1this.p1service.writeTimeout))
+	}
 	// net.Conn.Write，系统调用，用 socket 发送数据
 	byteNum, err := p1this.p1conn.Write(sli1data)
 
@@ -303,21 +755,94 @@ func (p1this *TCPConnection) WriteData(sli1data []byte) error {
 	}
 
 	if nil != err {
-		p1this.p1service.OnServiceError(p1this.p1service, err)
-		p1this.CloseConnection()
+		return err
 	}
-
 	if byteNum != len(sli1data) {
 		return errors.New("write byte != data length")
 	}
 	return nil
 }
 
-// CloseConnection 关闭连接
+// onWriteError 发送出错，只在发送队列的 goroutine 中调用
+func (p1this *TCPConnection) onWriteError(err error) {
+	if !p1this.IsRun() {
+		// 连接已经关闭了（比如强制关闭）
+		return
+	}
+	if t1err, ok := err.(net.Error); ok && t1err.Timeout() {
+		p1this.HandleTimeout(protocol.TimeoutTypeWrite)
+		return
+	}
+	p1this.p1service.OnServiceError(p1this.p1service, err)
+	p1this.CloseConnection()
+}
+
+// StopRead 打断阻塞中的 Read，并且不再读取新数据，用于优雅关闭
+func (p1this *TCPConnection) StopRead() {
+	p1this = p1this.origin()
+	atomic.StoreUint32(&p1this.isStopRead, 1)
+	p1this.p1conn.SetReadDeadline(time.Now())
+}
+
+// ForceClose 强制关闭连接，不等发送队列中的数据发送完
+func (p1this *TCPConnection) ForceClose() {
+	p1this = p1this.origin()
+	// 先关闭 net.Conn，阻塞中的 Write 会马上出错返回
+	p1this.p1conn.Close()
+	p1this.CloseConnection()
+}
+
+// CloseConnection 关闭连接，可以在任意 goroutine 中调用，重复调用只有第一次生效
 func (p1this *TCPConnection) CloseConnection() {
-	p1this.runStatus = RunStatusOff
-	p1this.recvBufferNow = 0
+	p1this = p1this.origin()
+	if !atomic.CompareAndSwapUint32(&p1this.runStatus, uint32(RunStatusOn), uint32(RunStatusOff)) {
+		return
+	}
+	// 接收缓冲区只在 HandleConnection（或者事件循环）的 goroutine 中读写，这里不动它
+	p1this.p1writeQueue.Close()
+	if nil != p1this.p1loop && p1this.p1loop.Remove(p1this) {
+		// 事件循环模式下，不能在事件循环的 goroutine 中等待发送完，剩下的在新 goroutine 中处理
+		go func() {
+			defer p1this.p1service.wgConn.Done()
+			p1this.finishClose()
+		}()
+		return
+	}
+	p1this.finishClose()
+}
+
+// onConnConnect 调用连接建立事件回调，识别出来的协议有自己的回调时用协议的
+func (p1this *TCPConnection) onConnConnect() {
+	if nil != p1this.p1handler && nil != p1this.p1handler.OnConnConnect {
+		p1this.p1handler.OnConnConnect(p1this)
+		return
+	}
+	p1this.p1service.OnConnConnect(p1this)
+}
+
+// onConnRequest 调用接收到完整的报文事件回调，识别出来的协议有自己的回调时用协议的
+func (p1this *TCPConnection) onConnRequest() {
+	if nil != p1this.p1handler && nil != p1this.p1handler.OnConnRequest {
+		p1this.p1handler.OnConnRequest(p1this)
+		return
+	}
+	p1this.p1service.OnConnRequest(p1this)
+}
+
+// onConnClose 调用连接关闭事件回调，识别出来的协议有自己的回调时用协议的
+func (p1this *TCPConnection) onConnClose() {
+	if nil != p1this.p1handler && nil != p1this.p1handler.OnConnClose {
+		p1this.p1handler.OnConnClose(p1this)
+		return
+	}
 	p1this.p1service.OnConnClose(p1this)
+}
+
+// finishClose 先把发送队列中的数据发送完，再关闭连接
+func (p1this *TCPConnection) finishClose() {
+	p1this.p1writeQueue.Flush()
+	p1this.onConnClose()
 	p1this.p1conn.Close()
 	p1this.p1service.DeleteConnection(p1this)
+	close(p1this.chanClosed)
 }
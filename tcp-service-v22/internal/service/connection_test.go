@@ -0,0 +1,201 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+	"tcp-service-go/tcp-service-v22/internal/tool/writequeue"
+)
+
+// BenchmarkIdleConnMemory 打开 N 个连接，每个连接收发一条消息之后空闲，报告每个连接占用多少内存。
+// B/conn 是堆和 goroutine 栈增加的字节数（包括测试中客户端那一头的连接），recvbuf-B/conn 是服务端接收缓冲区的大小。
+func BenchmarkIdleConnMemory(b *testing.B) {
+	for _, connNum := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("conn=%d", connNum), func(b *testing.B) {
+			p1service := newTestService()
+			p1service.SetMaxConnNum(uint32(connNum))
+			address := startTestService(b, p1service)
+			for i := 0; i < b.N; i++ {
+				benchmarkIdleConnMemory(b, p1service, address, connNum)
+			}
+		})
+	}
+}
+
+func benchmarkIdleConnMemory(b *testing.B, p1service *TCPService, address string, connNum int) {
+	b.StopTimer()
+	memBefore := inuseBytes()
+	b.StartTimer()
+
+	sli1conn := make([]net.Conn, 0, connNum)
+	defer func() {
+		b.StopTimer()
+		for _, p1conn := range sli1conn {
+			p1conn.Close()
+		}
+		// 下一轮开始之前，这一轮的连接都关闭了
+		waitFor(b, "connections to close", func() bool { return 0 == p1service.GetNowConnNum() })
+		b.StartTimer()
+	}()
+	for i := 0; i < connNum; i++ {
+		p1conn, err := net.Dial("tcp4", address)
+		if nil != err {
+			b.Fatal("dial:", err)
+		}
+		sli1conn = append(sli1conn, p1conn)
+		if err = writeStreamMsg(p1conn, "ping"); nil != err {
+			b.Fatal("write:", err)
+		}
+		if _, err = readStreamMsg(p1conn); nil != err {
+			b.Fatal("read:", err)
+		}
+	}
+
+	b.StopTimer()
+	memAfter := inuseBytes()
+	recvBufferSize := 0
+	p1service.GetConnPool().Range(func(p1conn *TCPConnection) bool {
+		recvBufferSize += p1conn.p1recvBuffer.Size()
+		return true
+	})
+	b.ReportMetric(float64(memAfter-memBefore)/float64(connNum), "B/conn")
+	b.ReportMetric(float64(recvBufferSize)/float64(connNum), "recvbuf-B/conn")
+}
+
+// inuseBytes GC 之后，正在使用的堆和 goroutine 栈的大小
+func inuseBytes() int64 {
+	runtime.GC()
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return int64(memStats.HeapInuse + memStats.StackInuse)
+}
+
+// TestWriteResponseQueueFull 按顺序发送响应的时候发送队列满了，PolicyClose 关闭连接，
+// 关闭连接在 responseMutex 外面，OnConnClose 里面还可以调用 SendResponse
+func TestWriteResponseQueueFull(t *testing.T) {
+	p1service := newTestService()
+	p1service.SetWriteQueueSize(1)
+	p1service.SetWriteQueuePolicy(writequeue.PolicyClose)
+	chanErr := make(chan error, 4)
+	p1service.OnServiceError = func(_ *TCPService, err error) { chanErr <- err }
+	p1service.OnConnClose = func(p1conn *TCPConnection) {
+		p1conn.SendResponse(1, []byte("after close"))
+	}
+
+	p1serverConn, p1clientConn := net.Pipe()
+	defer p1clientConn.Close()
+	p1conn := NewTCPConnection(p1service, p1serverConn)
+	p1conn.requestSeq = 3
+	// 第 1 个请求的响应发送之前，后面的先存起来
+	p1conn.writeResponse(2, []byte("b"), true)
+	p1conn.writeResponse(3, []byte("c"), true)
+
+	chanDone := make(chan struct{})
+	go func() {
+		defer close(chanDone)
+		// 对端不读，队列里放不下 3 个响应
+		p1conn.writeResponse(1, []byte("a"), true)
+	}()
+	// 关闭连接的时候要等发送完，对端晚一点开始读
+	time.Sleep(50 * time.Millisecond)
+	go io.Copy(io.Discard, p1clientConn)
+	select {
+	case <-chanDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeResponse did not return")
+	}
+	if err := <-chanErr; writequeue.ErrQueueFull != err {
+		t.Fatalf("OnServiceError(%v), want ErrQueueFull", err)
+	}
+	if p1conn.IsRun() {
+		t.Fatal("connection is not closed")
+	}
+}
+
+// TestTimeout 空闲、读报文头、读报文、写超时的时候触发 OnConnTimeout 然后关闭连接，读超时的 HTTP 连接先回复 408
+func TestTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	sli1test := []struct {
+		name        string
+		setTimeout  func(*TCPService)
+		request     string
+		bodySize    int
+		timeoutType uint8
+		resp        string
+	}{
+		{"idle", func(p1service *TCPService) { p1service.SetIdleTimeout(timeout) },
+			"", 0, protocol.TimeoutTypeIdle, ""},
+		{"keep-alive", func(p1service *TCPService) { p1service.SetKeepAliveTimeout(timeout) },
+			"GET / HTTP/1.1\r\nHost: x\r\n\r\n", 2, protocol.TimeoutTypeIdle, "HTTP/1.1 200 "},
+		{"read header", func(p1service *TCPService) { p1service.SetReadHeaderTimeout(timeout) },
+			"GET / HTTP/1.1\r\nHost: x\r\n", 0, protocol.TimeoutTypeReadHeader, "HTTP/1.1 408 "},
+		{"read", func(p1service *TCPService) { p1service.SetReadTimeout(timeout) },
+			"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\n12345", 0, protocol.TimeoutTypeRead, "HTTP/1.1 408 "},
+		{"read header before read", func(p1service *TCPService) {
+			p1service.SetReadTimeout(time.Minute)
+			p1service.SetReadHeaderTimeout(timeout)
+		}, "GET / HTTP/1.1\r\n", 0, protocol.TimeoutTypeReadHeader, "HTTP/1.1 408 "},
+		// 对端不读，响应比 socket 的缓冲区大得多，写会卡住
+		{"write", func(p1service *TCPService) { p1service.SetWriteTimeout(timeout) },
+			"GET / HTTP/1.1\r\nHost: x\r\n\r\n", 64 << 20, protocol.TimeoutTypeWrite, ""},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1service := NewTCPService(protocol.HTTPStr, "127.0.0.1", 0)
+			t1test.setTimeout(p1service)
+			chanTimeout := make(chan uint8, 1)
+			p1service.OnConnTimeout = func(_ *TCPConnection, timeoutType uint8) {
+				chanTimeout <- timeoutType
+			}
+			p1service.OnConnRequest = func(p1conn *TCPConnection) {
+				resp := http.NewResponse()
+				resp.SetStatusCode(http.StatusOk)
+				resp.SetBody(bytes.Repeat([]byte("a"), t1test.bodySize))
+				sli1resp, _ := p1conn.GetProtocol().(*http.HTTP).EncodeResponse(resp)
+				p1conn.SendResponse(p1conn.GetRequestSeq(), sli1resp)
+			}
+			address := startTestService(t, p1service)
+
+			p1conn, err := net.Dial("tcp4", address)
+			if nil != err {
+				t.Fatal("dial:", err)
+			}
+			defer p1conn.Close()
+			if protocol.TimeoutTypeWrite == t1test.timeoutType {
+				p1conn.(*net.TCPConn).SetReadBuffer(4096)
+			}
+			if _, err = p1conn.Write([]byte(t1test.request)); nil != err {
+				t.Fatal("write:", err)
+			}
+			select {
+			case timeoutType := <-chanTimeout:
+				if t1test.timeoutType != timeoutType {
+					t.Fatalf("OnConnTimeout(%d), want %d", timeoutType, t1test.timeoutType)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnConnTimeout is not called")
+			}
+			waitFor(t, "the connection to close", func() bool { return 0 == p1service.GetConnPool().Len() })
+			if protocol.TimeoutTypeWrite == t1test.timeoutType {
+				return
+			}
+
+			p1conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			sli1resp, err := io.ReadAll(p1conn)
+			if nil != err || !strings.HasPrefix(string(sli1resp), t1test.resp) || ("" == t1test.resp && 0 != len(sli1resp)) {
+				t.Fatalf("response = %q, %v, want %q", sli1resp, err, t1test.resp)
+			}
+			if "HTTP/1.1 408 " == t1test.resp && !strings.Contains(string(sli1resp), "Connection: close\r\n") {
+				t.Fatalf("response = %q, want Connection: close", sli1resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// eventLoopWaitMs 每次 EpollWait 最多等多久，到期之后扫描一遍连接，处理超时和 StopRead
+const eventLoopWaitMs int = 100
+
+// eventLoopEventMax 每次 EpollWait 最多返回多少个事件
+const eventLoopEventMax int = 256
+
+// eventLoop 基于 epoll 的事件循环，一个事件循环一个 goroutine，负责多个连接的读取和报文处理。
+// 连接就绪的时候读一次数据，然后和 goroutine 模式一样交给 HandleRead 处理。
+type eventLoop struct {
+	// p1service 所属 TCP 服务端
+	p1service *TCPService
+	// epollFd epoll 实例
+	epollFd int
+	// isStop 是否已经停止，用 atomic 读写
+	isStop uint32
+
+	// mutex 保护 mapFdConn 和 mapIDFd
+	mutex sync.Mutex
+	// mapFdConn 文件描述符和连接的关系
+	mapFdConn map[int]*eventLoopConn
+	// mapIDFd 连接 ID 和文件描述符的关系
+	mapIDFd map[uint64]int
+}
+
+// eventLoopConn 事件循环中的连接
+type eventLoopConn struct {
+	p1conn *TCPConnection
+	// reader 直接用系统调用读数据，不会阻塞
+	reader rawConnReader
+}
+
+// rawConnReader 用 syscall.RawConn 读数据，没有数据的时候返回 syscall.EAGAIN，不会阻塞
+type rawConnReader struct {
+	p1rawConn syscall.RawConn
+}
+
+// Read 实现 io.Reader
+func (p1this rawConnReader) Read(sli1data []byte) (int, error) {
+	var byteNum int
+	var errRead error
+	err := p1this.p1rawConn.Read(func(fd uintptr) bool {
+		byteNum, errRead = syscall.Read(int(fd), sli1data)
+		// 返回 true，不交给 Go 的 netpoll 等待
+		return true
+	})
+	if nil != err {
+		return 0, err
+	}
+	if byteNum < 0 {
+		byteNum = 0
+	}
+	if nil != errRead {
+		return byteNum, errRead
+	}
+	if 0 == byteNum && len(sli1data) > 0 {
+		// 对端关闭了连接
+		return 0, io.EOF
+	}
+	return byteNum, nil
+}
+
+// newEventLoop 创建事件循环
+func newEventLoop(p1service *TCPService) (*eventLoop, error) {
+	epollFd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if nil != err {
+		return nil, err
+	}
+	return &eventLoop{
+		p1service: p1service,
+		epollFd:   epollFd,
+		mapFdConn: make(map[int]*eventLoopConn),
+		mapIDFd:   make(map[uint64]int),
+	}, nil
+}
+
+// Add 把连接交给事件循环，连接已经关闭或者事件循环已经停止的时候返回 error
+func (p1this *eventLoop) Add(p1conn *TCPConnection) error {
+	t1p1syscallConn, ok := p1conn.p1conn.(syscall.Conn)
+	if !ok {
+		return errors.New("event loop: connection does not support syscall.Conn")
+	}
+	p1rawConn, err := t1p1syscallConn.SyscallConn()
+	if nil != err {
+		return err
+	}
+	fd := -1
+	err = p1rawConn.Control(func(t1fd uintptr) {
+		fd = int(t1fd)
+	})
+	if nil != err {
+		return err
+	}
+
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	if 1 == atomic.LoadUint32(&p1this.isStop) {
+		return errors.New("event loop is stopped.")
+	}
+	if !p1conn.IsRun() {
+		// 在 OnConnConnect 里面就被关闭了
+		return errors.New("event loop: connection is closed.")
+	}
+
+	p1conn.lastReadTime = time.Now()
+	p1this.mapFdConn[fd] = &eventLoopConn{p1conn: p1conn, reader: rawConnReader{p1rawConn: p1rawConn}}
+	p1this.mapIDFd[p1conn.ID()] = fd
+	if p1conn.IsReadClosed() {
+		// 处理识别协议时读到的数据的时候，已经决定关闭连接了，不再接收事件，关闭的时候再移除
+		return nil
+	}
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(fd)}
+	err = syscall.EpollCtl(p1this.epollFd, syscall.EPOLL_CTL_ADD, fd, &event)
+	if nil != err {
+		delete(p1this.mapFdConn, fd)
+		delete(p1this.mapIDFd, p1conn.ID())
+		return err
+	}
+	return nil
+}
+
+// Remove 把连接从事件循环中移除，连接不在事件循环中时返回 false。
+// 在关闭 net.Conn 之前调用，避免文件描述符被复用之后收到旧连接的事件。
+func (p1this *eventLoop) Remove(p1conn *TCPConnection) bool {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	fd, ok := p1this.mapIDFd[p1conn.ID()]
+	if !ok {
+		return false
+	}
+	delete(p1this.mapIDFd, p1conn.ID())
+	delete(p1this.mapFdConn, fd)
+	syscall.EpollCtl(p1this.epollFd, syscall.EPOLL_CTL_DEL, fd, nil)
+	return true
+}
+
+// Pause 不再接收连接的事件，连接还留在事件循环中，关闭的时候再移除
+func (p1this *eventLoop) Pause(p1conn *TCPConnection) {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	fd, ok := p1this.mapIDFd[p1conn.ID()]
+	if !ok {
+		return
+	}
+	syscall.EpollCtl(p1this.epollFd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+// Get 用文件描述符查找连接
+func (p1this *eventLoop) Get(fd int) (*eventLoopConn, bool) {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	p1loopConn, ok := p1this.mapFdConn[fd]
+	return p1loopConn, ok
+}
+
+// Snapshot 获取当前所有连接
+func (p1this *eventLoop) Snapshot() []*eventLoopConn {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	sli1loopConn := make([]*eventLoopConn, 0, len(p1this.mapFdConn))
+	for _, p1loopConn := range p1this.mapFdConn {
+		sli1loopConn = append(sli1loopConn, p1loopConn)
+	}
+	return sli1loopConn
+}
+
+// Run 事件循环，Stop 之后退出
+func (p1this *eventLoop) Run() {
+	defer syscall.Close(p1this.epollFd)
+
+	sli1event := make([]syscall.EpollEvent, eventLoopEventMax)
+	lastScanTime := time.Now()
+	for 0 == atomic.LoadUint32(&p1this.isStop) {
+		eventNum, err := syscall.EpollWait(p1this.epollFd, sli1event, eventLoopWaitMs)
+		if nil != err && syscall.EINTR != err {
+			p1this.p1service.OnServiceError(p1this.p1service, err)
+			return
+		}
+		for i := 0; i < eventNum; i++ {
+			p1loopConn, ok := p1this.Get(int(sli1event[i].Fd))
+			if !ok {
+				// 连接已经移除了
+				continue
+			}
+			p1this.HandleEvent(p1loopConn)
+		}
+
+		now := time.Now()
+		if now.Sub(lastScanTime) >= time.Duration(eventLoopWaitMs)*time.Millisecond {
+			lastScanTime = now
+			p1this.Scan(now)
+		}
+	}
+}
+
+// HandleEvent 连接就绪，读一次数据，然后处理
+func (p1this *eventLoop) HandleEvent(p1loopConn *eventLoopConn) {
+	p1conn := p1loopConn.p1conn
+	if !p1conn.IsRun() || p1conn.IsReadClosed() {
+		return
+	}
+	if 1 == atomic.LoadUint32(&p1conn.isStopRead) {
+		// 服务端正在关闭，不再读取新数据
+		p1conn.closeFromRead(p1conn.closeAfterResponse)
+		return
+	}
+	byteNum, err := p1conn.p1recvBuffer.ReadOnce(p1loopConn.reader)
+	if syscall.EAGAIN == err || syscall.EINTR == err {
+		// 没有数据，等下一次事件
+		return
+	}
+	p1conn.lastReadTime = time.Now()
+	p1conn.HandleRead(byteNum, err)
+	if 0 == p1conn.p1recvBuffer.Len() || !p1conn.IsRun() {
+		// 空闲的连接不占接收缓冲区
+		p1conn.p1recvBuffer.Release()
+	}
+}
+
+// Scan 扫描一遍连接，处理超时和 StopRead
+func (p1this *eventLoop) Scan(now time.Time) {
+	for _, p1loopConn := range p1this.Snapshot() {
+		p1conn := p1loopConn.p1conn
+		if !p1conn.IsRun() || p1conn.IsReadClosed() {
+			continue
+		}
+		if 1 == atomic.LoadUint32(&p1conn.isStopRead) {
+			// 服务端正在关闭，和 goroutine 模式一样，手上的报文已经处理完了，等请求都处理完、响应完之后关闭
+			p1conn.closeFromRead(p1conn.closeAfterResponse)
+			continue
+		}
+		deadline := p1conn.ReadDeadline(p1conn.lastReadTime)
+		if !deadline.IsZero() && now.After(deadline) {
+			timeoutType := p1conn.readTimeoutType
+			p1conn.closeFromRead(func() {
+				if p1conn.IsRun() {
+					p1conn.HandleTimeout(timeoutType)
+				}
+			})
+		}
+	}
+}
+
+// Stop 停止事件循环，调用之前需要先关闭所有的连接
+func (p1this *eventLoop) Stop() {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	atomic.StoreUint32(&p1this.isStop, 1)
+}
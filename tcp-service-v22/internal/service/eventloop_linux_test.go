@@ -0,0 +1,79 @@
+//go:build linux
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+)
+
+// BenchmarkEcho 对比 epoll 事件循环和一个连接一个 goroutine 两种模式。
+// 旁边挂着 idle 个空闲连接，RunParallel 的每个 goroutine 用自己的连接一问一答，
+// 报告每条消息的耗时，以及空闲连接每个占用多少内存（B/idle-conn）。
+func BenchmarkEcho(b *testing.B) {
+	sli1mode := []struct {
+		name         string
+		eventLoopNum int
+	}{
+		{"goroutine", 0},
+		{"epoll", runtime.NumCPU()},
+	}
+	for _, t1mode := range sli1mode {
+		for _, idleNum := range []int{0, 1000} {
+			eventLoopNum := t1mode.eventLoopNum
+			b.Run(fmt.Sprintf("%s/idle=%d", t1mode.name, idleNum), func(b *testing.B) {
+				benchmarkEcho(b, eventLoopNum, idleNum)
+			})
+		}
+	}
+}
+
+func benchmarkEcho(b *testing.B, eventLoopNum int, idleNum int) {
+	p1service := newTestService()
+	p1service.SetEventLoopNum(eventLoopNum)
+	p1service.SetMaxConnNum(uint32(idleNum + 256))
+	address := startTestService(b, p1service)
+
+	memBefore := inuseBytes()
+	sli1idle := make([]net.Conn, 0, idleNum)
+	defer func() {
+		for _, p1conn := range sli1idle {
+			p1conn.Close()
+		}
+	}()
+	for i := 0; i < idleNum; i++ {
+		p1conn, err := net.Dial("tcp4", address)
+		if nil != err {
+			b.Fatal("dial:", err)
+		}
+		sli1idle = append(sli1idle, p1conn)
+	}
+	waitFor(b, "idle connections", func() bool { return uint32(idleNum) == p1service.GetNowConnNum() })
+	idleBytes := inuseBytes() - memBefore
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		p1conn, err := net.Dial("tcp4", address)
+		if nil != err {
+			b.Error("dial:", err)
+			return
+		}
+		defer p1conn.Close()
+		for pb.Next() {
+			if err = writeStreamMsg(p1conn, "ping"); nil != err {
+				b.Error("write:", err)
+				return
+			}
+			if _, err = readStreamMsg(p1conn); nil != err {
+				b.Error("read:", err)
+				return
+			}
+		}
+	})
+	// ResetTimer 会清掉之前报告的指标，最后再报告
+	if idleNum > 0 {
+		b.ReportMetric(float64(idleBytes)/float64(idleNum), "B/idle-conn")
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package service
+
+import "errors"
+
+// eventLoop 事件循环只支持 Linux，其他系统只能用 goroutine 模式
+type eventLoop struct{}
+
+// newEventLoop 创建事件循环，不支持
+func newEventLoop(p1service *TCPService) (*eventLoop, error) {
+	return nil, errors.New("event loop is only supported on linux.")
+}
+
+// Add 把连接交给事件循环，不支持
+func (p1this *eventLoop) Add(p1conn *TCPConnection) error {
+	return errors.New("event loop is only supported on linux.")
+}
+
+// Remove 把连接从事件循环中移除
+func (p1this *eventLoop) Remove(p1conn *TCPConnection) bool {
+	return false
+}
+
+// Pause 不再接收连接的事件
+func (p1this *eventLoop) Pause(p1conn *TCPConnection) {}
+
+// Run 事件循环
+func (p1this *eventLoop) Run() {}
+
+// Stop 停止事件循环
+func (p1this *eventLoop) Stop() {}
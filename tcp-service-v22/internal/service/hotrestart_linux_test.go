@@ -0,0 +1,115 @@
+//go:build linux
+
+package service
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"tcp-service-go/tcp-service-v22/internal/protocol/stream"
+	"tcp-service-go/tcp-service-v22/internal/tool/hotrestart"
+)
+
+// hotRestartURL 热重启测试的服务端监听的地址，子进程用同样的地址取出继承的 listener
+const hotRestartURL string = "tcp4://127.0.0.1:0"
+
+// TestMain 热重启测试用 hotrestart.Restart 启动的子进程也是测试程序，带着继承的 listener 的时候按子进程运行
+func TestMain(m *testing.M) {
+	if "" != os.Getenv(hotrestart.EnvListenKeys) {
+		runHotRestartChild()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// newHotRestartService 创建热重启测试的服务端，响应的时候在前面加上 name，区分是哪个进程处理的
+func newHotRestartService(name string) *TCPService {
+	p1service := newTestService()
+	p1service.SetListenURL(hotRestartURL)
+	p1service.OnConnRequest = func(p1conn *TCPConnection) {
+		p1conn.SendMsg([]byte(name + ":" + p1conn.GetProtocol().(*stream.Stream).GetDecodeMsg()))
+	}
+	return p1service
+}
+
+// runHotRestartChild 子进程用继承的 listener 提供服务，收到 SIGTERM 之后退出
+func runHotRestartChild() {
+	p1service := newHotRestartService("child")
+	go p1service.Start()
+
+	chanSignal := make(chan os.Signal, 1)
+	signal.Notify(chanSignal, syscall.SIGTERM)
+	<-chanSignal
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p1service.Shutdown(ctx)
+	os.Exit(0)
+}
+
+// TestHotRestart 有连接的时候热重启，子进程继承 listener 接收新连接，
+// 已有的连接在旧进程中继续处理，旧进程优雅关闭之后新连接都由子进程处理
+func TestHotRestart(t *testing.T) {
+	p1service := newHotRestartService("parent")
+	address := startTestService(t, p1service)
+
+	p1conn, err := net.Dial("tcp4", address)
+	if nil != err {
+		t.Fatal("dial:", err)
+	}
+	defer p1conn.Close()
+	if resp := request(t, p1conn, "before"); "parent:before" != resp {
+		t.Fatalf("response before restart = %q", resp)
+	}
+
+	p1process, err := hotrestart.Restart()
+	if nil != err {
+		t.Fatal("restart:", err)
+	}
+	chanExit := make(chan error, 1)
+	go func() {
+		_, err := p1process.Wait()
+		chanExit <- err
+	}()
+	defer func() {
+		p1process.Signal(syscall.SIGTERM)
+		select {
+		case <-chanExit:
+		case <-time.After(10 * time.Second):
+			p1process.Kill()
+			t.Error("child process did not exit")
+		}
+	}()
+
+	// 重启之后，已有的连接还是旧进程处理
+	if resp := request(t, p1conn, "after"); "parent:after" != resp {
+		t.Fatalf("response on the old connection after restart = %q", resp)
+	}
+
+	// 旧进程优雅关闭，已有的空闲连接关闭，listener 不会删掉，继续由子进程 Accept
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = p1service.Shutdown(ctx); nil != err {
+		t.Fatal("shutdown:", err)
+	}
+	p1conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = readStreamMsg(p1conn); nil == err {
+		t.Fatal("old connection should be closed after shutdown")
+	}
+
+	for i := 0; i < 10; i++ {
+		p1newConn, err := net.Dial("tcp4", address)
+		if nil != err {
+			t.Fatal("dial after restart:", err)
+		}
+		resp := request(t, p1newConn, "new")
+		p1newConn.Close()
+		if "child:new" != resp {
+			t.Fatalf("response on a new connection = %q, want child:new", resp)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package service
+
+import "sync"
+
+// ConnPool TCP 连接（TCPConnection）池，并发安全，用连接 ID 区分连接
+type ConnPool struct {
+	// rwMutex 保护 mapConn
+	rwMutex sync.RWMutex
+	// mapConn 连接 ID 和 TCP 连接的关系
+	mapConn map[uint64]*TCPConnection
+}
+
+// NewConnPool 创建 ConnPool
+func NewConnPool() *ConnPool {
+	return &ConnPool{
+		mapConn: make(map[uint64]*TCPConnection),
+	}
+}
+
+// Add 添加连接
+func (p1this *ConnPool) Add(p1conn *TCPConnection) {
+	p1this.rwMutex.Lock()
+	defer p1this.rwMutex.Unlock()
+	p1this.mapConn[p1conn.ID()] = p1conn
+}
+
+// Delete 移除连接，连接不在池子里时返回 false
+func (p1this *ConnPool) Delete(p1conn *TCPConnection) bool {
+	p1this.rwMutex.Lock()
+	defer p1this.rwMutex.Unlock()
+	if _, ok := p1this.mapConn[p1conn.ID()]; !ok {
+		return false
+	}
+	delete(p1this.mapConn, p1conn.ID())
+	return true
+}
+
+// Get 用连接 ID 查找连接
+func (p1this *ConnPool) Get(id uint64) (*TCPConnection, bool) {
+	p1this.rwMutex.RLock()
+	defer p1this.rwMutex.RUnlock()
+	p1conn, ok := p1this.mapConn[id]
+	return p1conn, ok
+}
+
+// Len 连接数量
+func (p1this *ConnPool) Len() int {
+	p1this.rwMutex.RLock()
+	defer p1this.rwMutex.RUnlock()
+	return len(p1this.mapConn)
+}
+
+// Range 遍历连接，f 返回 false 时停止遍历。
+// 遍历的是调用时的快照，f 里面可以关闭连接。
+func (p1this *ConnPool) Range(f func(p1conn *TCPConnection) bool) {
+	for _, p1conn := range p1this.Snapshot() {
+		if !f(p1conn) {
+			return
+		}
+	}
+}
+
+// Snapshot 获取当前所有连接
+func (p1this *ConnPool) Snapshot() []*TCPConnection {
+	p1this.rwMutex.RLock()
+	defer p1this.rwMutex.RUnlock()
+	sli1conn := make([]*TCPConnection, 0, len(p1this.mapConn))
+	for _, p1conn := range p1this.mapConn {
+		sli1conn = append(sli1conn, p1conn)
+	}
+	return sli1conn
+}
+
+// Broadcast 给所有连接发送数据，数据不经过协议编码，需要调用方先编码好
+func (p1this *ConnPool) Broadcast(sli1data []byte) {
+	p1this.Range(func(p1conn *TCPConnection) bool {
+		if p1conn.IsRun() {
+			p1conn.WriteData(sli1data)
+		}
+		return true
+	})
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"tcp-service-go/tcp-service-v22/internal/protocol/stream"
+)
+
+// TestConnPoolConcurrent 多个 goroutine 同时添加、删除、查找和遍历连接
+func TestConnPoolConcurrent(t *testing.T) {
+	p1pool := NewConnPool()
+	const goroutineNum = 8
+	const connNum = 200
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutineNum; i++ {
+		wg.Add(1)
+		go func(base uint64) {
+			defer wg.Done()
+			for j := uint64(1); j <= connNum; j++ {
+				p1conn := &TCPConnection{id: base + j}
+				p1pool.Add(p1conn)
+				if t1p1conn, ok := p1pool.Get(p1conn.id); !ok || t1p1conn != p1conn {
+					t.Errorf("Get(%d) = %v, %v", p1conn.id, t1p1conn, ok)
+				}
+				p1pool.Range(func(*TCPConnection) bool { return true })
+				p1pool.Snapshot()
+				p1pool.Len()
+				if 0 == j%2 && !p1pool.Delete(p1conn) {
+					t.Errorf("Delete(%d) = false", p1conn.id)
+				}
+			}
+		}(uint64(i) * connNum)
+	}
+	wg.Wait()
+
+	if goroutineNum*connNum/2 != p1pool.Len() {
+		t.Fatalf("Len() = %d, want %d", p1pool.Len(), goroutineNum*connNum/2)
+	}
+	// 同一个连接删除两次，第二次返回 false
+	p1conn, _ := p1pool.Get(1)
+	if !p1pool.Delete(p1conn) || p1pool.Delete(p1conn) {
+		t.Fatal("Delete twice should return true then false")
+	}
+}
+
+// TestServicePoolConcurrent 很多连接同时收发，请求交给 worker pool 处理，同时遍历连接池和广播。
+// 用 go test -race 运行，检查连接池、请求视图和响应顺序的数据竞争。
+func TestServicePoolConcurrent(t *testing.T) {
+	for _, isUnordered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unordered=%v", isUnordered), func(t *testing.T) {
+			testServicePoolConcurrent(t, isUnordered)
+		})
+	}
+}
+
+func testServicePoolConcurrent(t *testing.T, isUnordered bool) {
+	const connNum = 32
+	const msgNum = 50
+
+	p1service := newTestService()
+	// 队列放得下所有请求，满了的时候会拒绝请求关闭连接
+	p1service.SetWorkerPool(4, connNum*msgNum, isUnordered)
+	var idMutex sync.Mutex
+	mapConnID := make(map[uint64]bool)
+	p1service.OnConnConnect = func(p1conn *TCPConnection) {
+		idMutex.Lock()
+		defer idMutex.Unlock()
+		if mapConnID[p1conn.ID()] {
+			t.Errorf("duplicate connection id %d", p1conn.ID())
+		}
+		mapConnID[p1conn.ID()] = true
+	}
+	address := startTestService(t, p1service)
+
+	sli1broadcast, _ := stream.Pack([]byte("broadcast"))
+	chanStopBroadcast := make(chan struct{})
+	var wgBroadcast sync.WaitGroup
+	wgBroadcast.Add(1)
+	go func() {
+		defer wgBroadcast.Done()
+		for {
+			select {
+			case <-chanStopBroadcast:
+				return
+			default:
+			}
+			p1service.GetConnPool().Range(func(p1conn *TCPConnection) bool {
+				p1conn.ID()
+				return true
+			})
+			p1service.GetConnPool().Broadcast(sli1broadcast)
+			p1service.GetNowConnNum()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < connNum; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p1conn, err := net.Dial("tcp4", address)
+			if nil != err {
+				t.Error("dial:", err)
+				return
+			}
+			defer p1conn.Close()
+			// 一次发送所有消息，有序模式下响应的顺序和请求一样
+			for j := 0; j < msgNum; j++ {
+				if err = writeStreamMsg(p1conn, fmt.Sprintf("%d-%d", i, j)); nil != err {
+					t.Error("write:", err)
+					return
+				}
+			}
+			mapReceived := make(map[string]bool, msgNum)
+			for len(mapReceived) < msgNum {
+				msg, err := readStreamMsg(p1conn)
+				if nil != err {
+					t.Error("read:", err)
+					return
+				}
+				if "broadcast" == msg {
+					continue
+				}
+				if !isUnordered && fmt.Sprintf("%d-%d", i, len(mapReceived)) != msg {
+					t.Errorf("conn %d: got %q, want %d-%d", i, msg, i, len(mapReceived))
+					return
+				}
+				mapReceived[msg] = true
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(chanStopBroadcast)
+	wgBroadcast.Wait()
+
+	// 客户端都关闭之后，连接池清空
+	waitFor(t, "connections to close", func() bool {
+		return 0 == p1service.GetConnPool().Len() && 0 == p1service.GetNowConnNum()
+	})
+	idMutex.Lock()
+	defer idMutex.Unlock()
+	if connNum != len(mapConnID) {
+		t.Fatalf("%d connections connected, want %d", len(mapConnID), connNum)
+	}
+}
@@ -1,13 +1,24 @@
 package service
 
 import (
+	"context"
+	"crypto/tls"
 	goErrors "errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"runtime"
-	"strconv"
+	"sync"
+	"time"
+	"sync/atomic"
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/tool/hotrestart"
+	"tcp-service-go/tcp-service-v22/internal/tool/netaddr"
+	"tcp-service-go/tcp-service-v22/internal/tool/proxyproto"
+	"tcp-service-go/tcp-service-v22/internal/tool/workerpool"
+	"tcp-service-go/tcp-service-v22/internal/tool/writequeue"
 
 	pkgErrors "github.com/pkg/errors"
 )
@@ -22,10 +33,19 @@ const (
   DebugStatusOn               // debug 开
 )
 
+const (
+  AdmitPolicyClose uint8 = iota // 超过最大连接数，直接关闭新连接
+  AdmitPolicyReply              // 超过最大连接数，按协议回复一条拒绝消息（比如 HTTP 503）之后，关闭新连接
+  AdmitPolicyQueue              // 超过最大连接数，新连接进入等待队列，有空位了再处理，队列满了直接关闭新连接
+)
+
 // TCPService 默认属性值
 
 const defaultName string = "default-service"
 
+// rejectReplyTimeout AdmitPolicyReply 回复拒绝消息最多等多久，TLS 握手读 ClientHello 也算在里面
+const rejectReplyTimeout time.Duration = time.Second
+
 // TCPService 默认方法
 
 func defaultOnServiceStart(p1service *TCPService) {
@@ -41,6 +61,24 @@ func defaultOnServiceError(p1service *TCPService, err error) {
   fmt.Println(fmt.Sprintf("%s", err))
 }
 
+func defaultOnConnRejected(p1service *TCPService, p1netConn net.Conn) {
+  if p1service.IsDebug() {
+    fmt.Println(fmt.Sprintf("%s.OnConnRejected, ip: %s", p1service.name, p1netConn.RemoteAddr().String()))
+  }
+}
+
+func defaultOnConnTimeout(p1conn *TCPConnection, timeoutType uint8) {
+  if p1conn.p1service.IsDebug() {
+    fmt.Println(fmt.Sprintf("%s.OnConnTimeout, timeoutType: %d", p1conn.p1service.name, timeoutType))
+  }
+}
+
+func defaultOnRequestRejected(p1conn *TCPConnection) {
+  if p1conn.p1service.IsDebug() {
+    fmt.Println(fmt.Sprintf("%s.OnRequestRejected", p1conn.p1service.name))
+  }
+}
+
 func defaultOnConnConnect(p1conn *TCPConnection) {
   if p1conn.p1service.IsDebug() {
     fmt.Println(fmt.Sprintf("%s.OnConnConnect", p1conn.p1service.name))
@@ -63,8 +101,8 @@ func defaultOnConnClose(p1conn *TCPConnection) {
 type TCPService struct {
   // name 服务端名称
   name string
-  // runStatus 运行状态，详见 RunStatus 开头的常量
-  runStatus uint8
+  // runStatus 运行状态，详见 RunStatus 开头的常量，用 atomic 读写
+  runStatus uint32
   // debugStatus debug 开关状态，详见 DebugStatus 开头的常量
   debugStatus uint8
 
@@ -75,20 +113,89 @@ type TCPService struct {
   address string
   // port 端口号
   port uint16
-  // p1listener net.Listener
-  p1listener net.Listener
-
-  // mapConnPool TCP 连接（TCPConnection）池
-  mapConnPool map[string]*TCPConnection
+  // sli1listenURL 监听的地址，URL 形式，为空时监听 address 和 port（IPv4）
+  sli1listenURL []string
+  // reusePortNum 每个 TCP 地址用 SO_REUSEPORT 打开几个 listener，小于等于 1 表示不用
+  reusePortNum int
+  // sli1listener 所有的 net.Listener，Start 的时候创建，接收的连接放在同一个连接池
+  sli1listener []net.Listener
+
+  // mutex 保护 sli1listener，保证服务关闭之后不会再有新连接开始处理
+  mutex sync.Mutex
+  // wgConn 正在处理的 TCP 连接，连接关闭之后 Done
+  wgConn sync.WaitGroup
+
+  // p1connPool TCP 连接（TCPConnection）池
+  p1connPool *ConnPool
+  // lastConnID 最后一个分配出去的连接 ID，连接 ID 从 1 开始单调递增
+  lastConnID uint64
   // maxConnNum TCP 连接，最大连接数
   maxConnNum uint32
-  // nowConnNum TCP 连接，当前连接数
+  // nowConnNum TCP 连接，当前连接数（包括已经占了位置，还没放进连接池的）
   nowConnNum uint32
 
+  // admitPolicy 超过最大连接数时的处理策略，详见 AdmitPolicy 开头的常量
+  admitPolicy uint8
+  // pendingQueueSize 等待队列的大小，AdmitPolicyQueue 时使用
+  pendingQueueSize uint32
+  // chanPendingConn 等待队列，AdmitPolicyQueue 时使用
+  chanPendingConn chan net.Conn
+  // rejectedConnNum 被拒绝的 TCP 连接数
+  rejectedConnNum uint64
+
+  // idleTimeout 空闲超时，等待新报文的最长时间，0 表示不限制
+  idleTimeout time.Duration
+  // keepAliveTimeout 保持连接的空闲超时，请求都响应完之后等待下一个请求的最长时间，0 表示用 idleTimeout
+  keepAliveTimeout time.Duration
+  // maxRequestNum 每个连接最多处理多少个请求，到了之后不再读取新数据，响应发送完之后关闭连接，0 表示不限制
+  maxRequestNum uint64
+  // readHeaderTimeout 读报文头超时，从报文的第 1 个字节开始计算，0 表示不限制
+  readHeaderTimeout time.Duration
+  // readTimeout 读报文超时，从报文的第 1 个字节开始计算，0 表示不限制
+  readTimeout time.Duration
+  // writeTimeout 写超时，每次发送数据的最长时间，0 表示不限制
+  writeTimeout time.Duration
+  // maxMsgSize 单条报文最大多少字节，0 表示使用协议的设置，详见 protocol.Codec.MaxMsgSize
+  maxMsgSize int
+  // writeQueueSize 每个连接的发送队列能放多少条数据
+  writeQueueSize int
+  // writeQueuePolicy 发送队列满了怎么办，详见 writequeue 包中 Policy 开头的常量
+  writeQueuePolicy uint8
+
+  // p1tlsConfig TLS 配置，nil 表示不加密
+  p1tlsConfig *tls.Config
+  // isProxyProtocol 连接是否以 PROXY protocol 头开始（服务端在 L4 负载均衡后面）
+  isProxyProtocol bool
+  // sli1sniffProtocol 一个端口支持多个协议时，需要识别的协议，按顺序判断
+  sli1sniffProtocol []sniffProtocol
+  // isSniffPlaintext 设置了 TLS 配置的时候，识别协议是不是也接收不加密的连接
+  isSniffPlaintext bool
+
+  // eventLoopNum 事件循环的数量，0 表示不用事件循环，一个连接一个 goroutine
+  eventLoopNum int
+  // sli1eventLoop 事件循环，Start 的时候创建
+  sli1eventLoop []*eventLoop
+
+  // workerNum worker pool 中 worker 的数量，0 表示不用 worker pool，OnConnRequest 在读数据的 goroutine 中执行
+  workerNum int
+  // workerQueueSize worker pool 中每个任务队列能放多少个请求
+  workerQueueSize int
+  // isWorkerUnordered 是否允许同一个连接的请求被并行处理，不保证顺序
+  isWorkerUnordered bool
+  // p1workerPool worker pool，Start 的时候创建
+  p1workerPool *workerpool.WorkerPool
+
   // OnServiceStart 服务端启动事件回调
   OnServiceStart func(*TCPService)
   // OnServiceError 服务端错误事件回调
   OnServiceError func(*TCPService, error)
+  // OnConnRejected TCP 连接，超过最大连接数被拒绝事件回调，回调之后连接会被关闭
+  OnConnRejected func(*TCPService, net.Conn)
+  // OnConnTimeout TCP 连接，超时事件回调，超时类型详见 protocol 包中 TimeoutType 开头的常量，回调之后连接会被关闭
+  OnConnTimeout func(*TCPConnection, uint8)
+  // OnRequestRejected TCP 连接，worker pool 满了请求被拒绝事件回调，参数是请求视图。
+  // 回调之后按协议回复 RejectMsg（有的话），等这个连接之前的请求都处理完之后关闭连接
+  OnRequestRejected func(*TCPConnection)
   // OnConnConnect TCP 连接，连接事件回调
   OnConnConnect func(*TCPConnection)
   // OnConnRequest TCP 连接，请求事件回调
@@ -101,21 +208,32 @@ type TCPService struct {
 func NewTCPService(protocolName string, address string, port uint16) *TCPService {
   return &TCPService{
     name:         defaultName,
-    runStatus:    RunStatusOn,
+    runStatus:    uint32(RunStatusOn),
     debugStatus:  DebugStatusOff,
     protocolName: protocolName,
     address:      address,
     port:         port,
 
-    mapConnPool: make(map[string]*TCPConnection),
-    maxConnNum:  1024,
-    nowConnNum:  0,
-
-    OnServiceStart: defaultOnServiceStart,
-    OnServiceError: defaultOnServiceError,
-    OnConnConnect:  defaultOnConnConnect,
-    OnConnRequest:  defaultOnConnRequest,
-    OnConnClose:    defaultOnConnClose,
+    p1connPool: NewConnPool(),
+    lastConnID: 0,
+    maxConnNum: 1024,
+    nowConnNum: 0,
+
+    admitPolicy:      AdmitPolicyClose,
+    pendingQueueSize: 128,
+    rejectedConnNum:  0,
+
+    writeQueueSize:   writequeue.DefaultSize,
+    writeQueuePolicy: writequeue.PolicyBlock,
+
+    OnServiceStart:    defaultOnServiceStart,
+    OnServiceError:    defaultOnServiceError,
+    OnConnRejected:    defaultOnConnRejected,
+    OnConnTimeout:     defaultOnConnTimeout,
+    OnRequestRejected: defaultOnRequestRejected,
+    OnConnConnect:     defaultOnConnConnect,
+    OnConnRequest:     defaultOnConnRequest,
+    OnConnClose:       defaultOnConnClose,
   }
 }
 
@@ -131,7 +249,7 @@ func (p1this *TCPService) GetName() string {
 
 // IsRun 服务是不是正在运行
 func (p1this *TCPService) IsRun() bool {
-  return RunStatusOn == p1this.runStatus
+  return uint32(RunStatusOn) == atomic.LoadUint32(&p1this.runStatus)
 }
 
 // SetDebugStatusOn 打开 debug
@@ -144,22 +262,273 @@ func (p1this *TCPService) IsDebug() bool {
   return DebugStatusOn == p1this.debugStatus
 }
 
+// SetMaxConnNum 设置最大连接数
+func (p1this *TCPService) SetMaxConnNum(maxConnNum uint32) {
+  p1this.maxConnNum = maxConnNum
+}
+
+// GetNowConnNum 获取当前连接数
+func (p1this *TCPService) GetNowConnNum() uint32 {
+  return atomic.LoadUint32(&p1this.nowConnNum)
+}
+
+// GetConnPool 获取 TCP 连接池
+func (p1this *TCPService) GetConnPool() *ConnPool {
+  return p1this.p1connPool
+}
+
+// SetAdmitPolicy 设置超过最大连接数时的处理策略，详见 AdmitPolicy 开头的常量
+func (p1this *TCPService) SetAdmitPolicy(admitPolicy uint8) {
+  p1this.admitPolicy = admitPolicy
+}
+
+// SetPendingQueueSize 设置等待队列的大小，AdmitPolicyQueue 时使用，需要在服务启动之前设置
+func (p1this *TCPService) SetPendingQueueSize(pendingQueueSize uint32) {
+  p1this.pendingQueueSize = pendingQueueSize
+}
+
+// GetPendingConnNum 获取等待队列中的连接数
+func (p1this *TCPService) GetPendingConnNum() int {
+  return len(p1this.chanPendingConn)
+}
+
+// GetRejectedConnNum 获取被拒绝的连接数
+func (p1this *TCPService) GetRejectedConnNum() uint64 {
+  return atomic.LoadUint64(&p1this.rejectedConnNum)
+}
+
+// SetIdleTimeout 设置空闲超时
+func (p1this *TCPService) SetIdleTimeout(idleTimeout time.Duration) {
+  p1this.idleTimeout = idleTimeout
+}
+
+// SetKeepAliveTimeout 设置保持连接的空闲超时（比如 HTTP 的 keep-alive），请求都响应完之后用它代替空闲超时
+func (p1this *TCPService) SetKeepAliveTimeout(keepAliveTimeout time.Duration) {
+  p1this.keepAliveTimeout = keepAliveTimeout
+}
+
+// SetMaxRequestNum 设置每个连接最多处理多少个请求，用于按请求响应的协议（比如 HTTP），多路复用的协议不限制，详见 TCPConnection.SendResponse
+func (p1this *TCPService) SetMaxRequestNum(maxRequestNum uint64) {
+  p1this.maxRequestNum = maxRequestNum
+}
+
+// SetReadHeaderTimeout 设置读报文头超时（比如 HTTP 的请求头）
+func (p1this *TCPService) SetReadHeaderTimeout(readHeaderTimeout time.Duration) {
+  p1this.readHeaderTimeout = readHeaderTimeout
+}
+
+// SetReadTimeout 设置读报文超时（比如 HTTP 的请求头加请求体）
+func (p1this *TCPService) SetReadTimeout(readTimeout time.Duration) {
+  p1this.readTimeout = readTimeout
+}
+
+// SetWriteTimeout 设置写超时
+func (p1this *TCPService) SetWriteTimeout(writeTimeout time.Duration) {
+  p1this.writeTimeout = writeTimeout
+}
+
+// SetMaxMsgSize 设置单条报文最大多少字节，接收缓冲区最多扩容到这么大，0 表示使用协议的设置
+func (p1this *TCPService) SetMaxMsgSize(maxMsgSize int) {
+  p1this.maxMsgSize = maxMsgSize
+}
+
+// SetWriteQueueSize 设置每个连接的发送队列能放多少条数据
+func (p1this *TCPService) SetWriteQueueSize(writeQueueSize int) {
+  p1this.writeQueueSize = writeQueueSize
+}
+
+// SetWriteQueuePolicy 设置发送队列满了怎么办，详见 writequeue 包中 Policy 开头的常量
+func (p1this *TCPService) SetWriteQueuePolicy(writeQueuePolicy uint8) {
+  p1this.writeQueuePolicy = writeQueuePolicy
+}
+
+// SetListenURL 设置监听的地址，可以同时监听多个，所有地址的连接共用连接池和最大连接数。
+// 地址是 URL 形式，比如 "tcp://[::]:9501"、"tcp4://127.0.0.1:9501"、"unix:///run/gw.sock"。
+// 设置之后不再监听 NewTCPService 的 address 和 port。
+func (p1this *TCPService) SetListenURL(sli1rawURL ...string) {
+  p1this.sli1listenURL = sli1rawURL
+}
+
+// SetReusePortNum 设置每个 TCP 地址用 SO_REUSEPORT 打开几个 listener，只支持 Linux。
+// 每个 listener 一个 goroutine Accept，由内核把新连接分配到不同的 listener，连接数和最大连接数还是所有 listener 一起算。
+// Unix domain socket 的地址不受影响，还是一个 listener。
+func (p1this *TCPService) SetReusePortNum(reusePortNum int) {
+  p1this.reusePortNum = reusePortNum
+}
+
+// SetTLSConfig 设置 TLS 配置，设置之后连接都用 TLS 加密。
+// 证书、双向认证、按 SNI 选择证书等配置可以用 tlsconfig 包创建。
+// TLS 连接不支持事件循环，设置了事件循环时，TLS 连接还是一个连接一个 goroutine。
+func (p1this *TCPService) SetTLSConfig(p1tlsConfig *tls.Config) {
+  p1this.p1tlsConfig = p1tlsConfig
+}
+
+// SetProxyProtocolOn 开启 PROXY protocol，支持 v1 和 v2。
+// 每个连接先读 PROXY protocol 头，格式错误的连接直接关闭，GetNetConnRemoteAddr 返回头里真实的客户端地址。
+// 读头的超时时间用读报文头超时，没有设置时用 proxyproto.DefaultReadTimeout。
+func (p1this *TCPService) SetProxyProtocolOn() {
+  p1this.isProxyProtocol = true
+}
+
+// AddSniffProtocol 添加需要识别的协议，添加之后一个端口支持多个协议。
+// 连接开头的数据按添加的顺序交给协议的 Codec.Sniff 判断，都不是的时候当成服务端的协议（NewTCPService 的 protocolName）。
+// WebSocket 的握手请求也是 HTTP 请求，要在 HTTP 之前添加。
+// 设置了 TLS 配置的时候，以 TLS 握手开头的连接先握手，然后识别 TLS 里面的协议，
+// 不是 TLS 的连接直接关闭，要接收的话调用 SetSniffPlaintextOn。
+// p1handler 是这个协议自己的回调，可以为 nil，为 nil 的回调用 TCPService 的。
+func (p1this *TCPService) AddSniffProtocol(protocolName string, p1handler *ProtocolHandler) {
+  p1codec, _ := protocol.GetCodec(protocolName)
+  p1this.sli1sniffProtocol = append(p1this.sli1sniffProtocol, sniffProtocol{
+    protocolName: protocolName,
+    p1codec:      p1codec,
+    p1handler:    p1handler,
+  })
+}
+
+// SetSniffPlaintextOn 设置了 TLS 配置并且识别协议的时候，不是 TLS 握手开头的连接也接收，不加密处理。
+// 默认不接收，防止配置了 TLS 的端口被不加密的连接绕过。
+func (p1this *TCPService) SetSniffPlaintextOn() {
+  p1this.isSniffPlaintext = true
+}
+
+// SetEventLoopNum 设置事件循环的数量，只支持 Linux。
+// 大于 0 时，连接由 epoll 事件循环处理，不再一个连接一个 goroutine，适合大量空闲的长连接。
+// 事件循环中 OnConnRequest 等回调会阻塞同一个事件循环中的其他连接，不要在回调里做耗时的操作。
+func (p1this *TCPService) SetEventLoopNum(eventLoopNum int) {
+  p1this.eventLoopNum = eventLoopNum
+}
+
+// SetWorkerPool 设置 worker pool，workerNum 为 0 表示不用 worker pool。
+// 用 worker pool 的时候，OnConnRequest 在 worker 的 goroutine 中执行，参数是请求视图，详见 TCPConnection.RequestView。
+// 默认同一个连接的请求按顺序处理，isUnordered 为 true 时，同一个连接的请求可以并行处理。
+func (p1this *TCPService) SetWorkerPool(workerNum int, queueSize int, isUnordered bool) {
+  p1this.workerNum = workerNum
+  p1this.workerQueueSize = queueSize
+  p1this.isWorkerUnordered = isUnordered
+}
+
+// GetWorkerPoolStats 获取 worker pool 的运行指标，没有 worker pool 的时候返回 false
+func (p1this *TCPService) GetWorkerPoolStats() (workerpool.Stats, bool) {
+  if nil == p1this.p1workerPool {
+    return workerpool.Stats{}, false
+  }
+  return p1this.p1workerPool.GetStats(), true
+}
+
 // Start 服务启动
 func (p1this *TCPService) Start() {
   p1this.StartInfo()
 
-  t1address := p1this.address + ":" + strconv.Itoa(int(p1this.port))
-  listener, err := net.Listen("tcp4", t1address)
+  if !protocol.IsSupported(p1this.protocolName) {
+    err := goErrors.New("protocol not supported: " + p1this.protocolName)
+    p1this.OnServiceError(p1this, pkgErrors.WithMessage(err, fmt.Sprintf("%s.Start", p1this.name)))
+    return
+  }
+  for _, t1sniff := range p1this.sli1sniffProtocol {
+    if nil == t1sniff.p1codec || !t1sniff.p1codec.CanSniff() {
+      err := goErrors.New("protocol can not be sniffed: " + t1sniff.protocolName)
+      p1this.OnServiceError(p1this, pkgErrors.WithMessage(err, fmt.Sprintf("%s.Start", p1this.name)))
+      return
+    }
+  }
+
+  sli1listener, err := p1this.Listen()
   if nil != err {
     p1this.OnServiceError(p1this, pkgErrors.WithMessage(err, fmt.Sprintf("%s.Start", p1this.name)))
     return
   }
 
-  p1this.p1listener = listener
-  defer p1this.p1listener.Close()
+  p1this.mutex.Lock()
+  if !p1this.IsRun() {
+    // 启动之前就已经关闭了
+    p1this.mutex.Unlock()
+    closeListener(sli1listener)
+    return
+  }
+  p1this.sli1listener = sli1listener
+  p1this.mutex.Unlock()
+  defer closeListener(sli1listener)
+
+  if AdmitPolicyQueue == p1this.admitPolicy {
+    p1this.chanPendingConn = make(chan net.Conn, p1this.pendingQueueSize)
+  }
+
+  if p1this.workerNum > 0 {
+    p1this.p1workerPool = workerpool.NewWorkerPool(p1this.workerNum, p1this.workerQueueSize, !p1this.isWorkerUnordered)
+  }
+
+  if p1this.eventLoopNum > 0 {
+    err = p1this.StartEventLoop()
+    if nil != err {
+      p1this.OnServiceError(p1this, pkgErrors.WithMessage(err, fmt.Sprintf("%s.Start", p1this.name)))
+      return
+    }
+  }
 
   p1this.OnServiceStart(p1this)
-  p1this.StartListen()
+
+  // 每个 listener 一个 goroutine 接收连接，都退出之后 Start 返回
+  var wgListen sync.WaitGroup
+  for _, listener := range sli1listener {
+    wgListen.Add(1)
+    go func(listener net.Listener) {
+      defer wgListen.Done()
+      p1this.StartListen(listener)
+    }(listener)
+  }
+  wgListen.Wait()
+}
+
+// Listen 监听所有的地址，有一个失败的时候，已经监听的都关闭。
+// 热重启启动的进程，优先使用从父进程继承的 listener，详见 hotrestart 包。
+func (p1this *TCPService) Listen() ([]net.Listener, error) {
+  sli1addr := []netaddr.Addr{netaddr.FromHostPort(p1this.address, p1this.port)}
+  if len(p1this.sli1listenURL) > 0 {
+    sli1addr = make([]netaddr.Addr, 0, len(p1this.sli1listenURL))
+    for _, rawURL := range p1this.sli1listenURL {
+      addr, err := netaddr.Parse(rawURL)
+      if nil != err {
+        return nil, err
+      }
+      sli1addr = append(sli1addr, addr)
+    }
+  }
+
+  sli1listener := make([]net.Listener, 0, len(sli1addr))
+  for _, addr := range sli1addr {
+    listenNum := 1
+    if p1this.reusePortNum > 1 && netaddr.SchemeUnix != addr.Network {
+      listenNum = p1this.reusePortNum
+    }
+    sli1t1listener := hotrestart.Take(addr.String(), listenNum)
+    if 0 == len(sli1t1listener) {
+      var err error
+      if listenNum > 1 {
+        sli1t1listener, err = netaddr.ListenReusePort(addr, listenNum)
+      } else {
+        var listener net.Listener
+        listener, err = netaddr.Listen(addr)
+        sli1t1listener = []net.Listener{listener}
+      }
+      if nil != err {
+        closeListener(sli1listener)
+        return nil, err
+      }
+    }
+    for _, listener := range sli1t1listener {
+      hotrestart.Register(addr.String(), listener)
+      sli1listener = append(sli1listener, listener)
+    }
+  }
+  return sli1listener, nil
+}
+
+// closeListener 关闭所有的 listener
+func closeListener(sli1listener []net.Listener) {
+  for _, listener := range sli1listener {
+    hotrestart.Unregister(listener)
+    listener.Close()
+  }
 }
 
 // StartInfo 输出服务配置和环境参数
@@ -170,51 +539,332 @@ func (p1this *TCPService) StartInfo() {
   log.Println("os.Getpid()=", os.Getpid())
 }
 
-// StartListen 开始监听
-func (p1this *TCPService) StartListen() {
+// StartListen 从 listener 接收连接
+func (p1this *TCPService) StartListen(listener net.Listener) {
   for p1this.IsRun() {
     // net.Listener.Accept，系统调用，获取 TCP 连接
-    p1netConn, err := p1this.p1listener.Accept()
+    p1netConn, err := listener.Accept()
     if nil != err {
+      if !p1this.IsRun() {
+        // Shutdown 关闭了 listener
+        return
+      }
       p1this.OnServiceError(p1this, pkgErrors.WithMessage(err, fmt.Sprintf("%s.StartListen", p1this.name)))
       return
     }
-    // 判断 TCP 连接当前数量是否超过最大连接数
-    if p1this.nowConnNum >= p1this.maxConnNum {
-      err = goErrors.New("nowConnNum >= maxConnNum")
-      p1this.OnServiceError(p1this, pkgErrors.WithMessage(err, fmt.Sprintf("%s.StartListen", p1this.name)))
+    p1this.AdmitConnection(p1netConn)
+  }
+}
+
+// AdmitConnection 判断连接数，没超过最大连接数就占一个位置，开始处理连接，超过的按 admitPolicy 处理。
+// 在读 PROXY protocol 头、识别协议之前就占位置，还在等客户端发数据的连接也算在最大连接数里面。
+func (p1this *TCPService) AdmitConnection(p1netConn net.Conn) {
+  if !p1this.ReserveConnSlot() {
+    p1this.AdmitOverLimit(p1netConn)
+    return
+  }
+  p1this.AcceptConnection(p1netConn)
+}
+
+// AcceptConnection 已经占了位置的连接，开始 TLS（或者读 PROXY protocol 头、识别协议），然后开始处理连接
+func (p1this *TCPService) AcceptConnection(p1netConn net.Conn) {
+  if p1this.isProxyProtocol || p1this.IsSniffMode() {
+    // 读 PROXY protocol 头、识别协议都要等客户端发数据，不能卡住 Accept
+    go p1this.PrepareConnection(p1netConn)
+    return
+  }
+  if nil != p1this.p1tlsConfig {
+    // listener 不用 tls.NewListener 包装，热重启的时候要把原始的 listener 交给子进程
+    p1netConn = tls.Server(p1netConn, p1this.p1tlsConfig)
+  }
+  p1this.StartConnection(p1netConn)
+}
+
+// PrepareConnection 读取 PROXY protocol 头、识别协议，然后和普通连接一样处理。
+// 头格式错误、超时或者对端关闭的时候关闭连接，释放 AdmitConnection 占的位置。
+func (p1this *TCPService) PrepareConnection(p1netConn net.Conn) {
+  remoteAddr := p1netConn.RemoteAddr().String()
+  p1preparedConn := p1netConn
+  var err error
+  if p1this.isProxyProtocol {
+    p1preparedConn, err = proxyproto.NewConn(p1preparedConn, p1this.readHeaderTimeout)
+    if nil != err {
+      p1this.OnServiceError(p1this, pkgErrors.WithMessage(err, fmt.Sprintf("%s.PrepareConnection, ip: %s", p1this.name, remoteAddr)))
+      p1this.abortPrepare(p1netConn)
+      return
+    }
+  }
+  if p1this.IsSniffMode() {
+    // 识别协议的时候，TLS 在 SniffConnection 中处理
+    p1preparedConn, err = p1this.SniffConnection(p1preparedConn)
+    if nil != err {
+      if io.EOF != err {
+        p1this.OnServiceError(p1this, pkgErrors.WithMessage(err, fmt.Sprintf("%s.PrepareConnection, ip: %s", p1this.name, remoteAddr)))
+      }
+      p1this.abortPrepare(p1netConn)
+      return
+    }
+  } else if nil != p1this.p1tlsConfig {
+    // PROXY protocol 头在 TLS 握手之前
+    p1preparedConn = tls.Server(p1preparedConn, p1this.p1tlsConfig)
+  }
+  p1this.StartConnection(p1preparedConn)
+}
+
+// abortPrepare 读 PROXY protocol 头、识别协议失败，关闭连接，位置让给等待队列中的连接
+func (p1this *TCPService) abortPrepare(p1netConn net.Conn) {
+  p1netConn.Close()
+  p1this.ReleaseConnSlot()
+  p1this.AdmitPending()
+}
+
+// StartConnection 创建 TCPConnection，开始处理连接
+func (p1this *TCPService) StartConnection(p1netConn net.Conn) {
+  p1this.mutex.Lock()
+  if !p1this.IsRun() {
+    // 服务已经关闭了，不再处理新连接
+    p1this.mutex.Unlock()
+    p1this.ReleaseConnSlot()
+    p1netConn.Close()
+    return
+  }
+  p1TCPConn := NewTCPConnection(p1this, p1netConn)
+  p1this.AddConnection(p1TCPConn)
+  p1this.wgConn.Add(1)
+  p1this.mutex.Unlock()
+
+  p1TCPConn.onConnConnect()
+  if nil != p1TCPConn.p1loop && p1TCPConn.p1recvBuffer.Len() > 0 {
+    // 识别协议时读到的数据，先在新 goroutine 中处理，再交给事件循环
+    go func() {
+      p1TCPConn.HandlePreload()
+      p1this.AddToEventLoop(p1TCPConn)
+    }()
+    return
+  }
+  if nil != p1TCPConn.p1loop {
+    p1this.AddToEventLoop(p1TCPConn)
+    return
+  }
+  go func() {
+    defer p1this.wgConn.Done()
+    p1TCPConn.HandleConnection()
+    // 不再读取之后，连接可能还在等响应发送完，和事件循环模式一样，连接关闭之后才算处理完
+    <-p1TCPConn.chanClosed
+  }()
+}
+
+// AddToEventLoop 事件循环模式，连接交给事件循环处理，连接关闭的时候 wgConn.Done
+func (p1this *TCPService) AddToEventLoop(p1TCPConn *TCPConnection) {
+  err := p1TCPConn.p1loop.Add(p1TCPConn)
+  if nil != err {
+    if p1TCPConn.IsRun() {
+      p1this.OnServiceError(p1this, pkgErrors.WithMessage(err, fmt.Sprintf("%s.StartConnection", p1this.name)))
     }
+    p1TCPConn.CloseConnection()
+    p1this.wgConn.Done()
+  }
+}
 
-    p1TCPConn := NewTCPConnection(p1this, p1netConn)
-    p1this.AddConnection(p1TCPConn)
-    p1this.OnConnConnect(p1TCPConn)
-    go p1TCPConn.HandleConnection()
+// Shutdown 优雅关闭服务端。
+// 停止接收新连接，等正在执行的 OnConnRequest 处理完，发送完待发送的数据，触发 OnConnClose 之后关闭连接。
+// 请求都用 SendResponse 响应的协议（比如 HTTP），还有请求在异步处理的连接，等响应发送完之后再关闭。
+// ctx 到期的时候，还没关闭的连接会被强制关闭，这时返回 ctx.Err()。
+func (p1this *TCPService) Shutdown(ctx context.Context) error {
+  p1this.mutex.Lock()
+  atomic.StoreUint32(&p1this.runStatus, uint32(RunStatusOff))
+  sli1listener := p1this.sli1listener
+  p1this.mutex.Unlock()
+
+  // 停止接收新连接，等待队列中的连接直接关闭
+  closeListener(sli1listener)
+  p1this.ClosePending()
+  // 连接都关闭之后，停止事件循环
+  defer p1this.StopEventLoop()
+
+  // 打断阻塞中的 Read，HandleConnection 处理完手上的消息之后，就会关闭连接退出
+  p1this.p1connPool.Range(func(p1conn *TCPConnection) bool {
+    p1conn.StopRead()
+    return true
+  })
+
+  chanDone := make(chan struct{})
+  go func() {
+    p1this.wgConn.Wait()
+    // 不会再有新的请求了，等 worker pool 中的请求处理完
+    if nil != p1this.p1workerPool {
+      p1this.p1workerPool.Stop()
+    }
+    close(chanDone)
+  }()
+
+  select {
+  case <-chanDone:
+    return nil
+  case <-ctx.Done():
+    // 时间到了，强制关闭
+    p1this.p1connPool.Range(func(p1conn *TCPConnection) bool {
+      p1conn.ForceClose()
+      return true
+    })
+    return ctx.Err()
   }
 }
 
-// AddConnection 添加连接
+// ClosePending 关闭等待队列中的连接
+func (p1this *TCPService) ClosePending() {
+  if nil == p1this.chanPendingConn {
+    return
+  }
+  for {
+    select {
+    case p1netConn := <-p1this.chanPendingConn:
+      p1this.RejectConnection(p1netConn)
+    default:
+      return
+    }
+  }
+}
+
+// AdmitOverLimit 超过最大连接数时，按 admitPolicy 处理新连接
+func (p1this *TCPService) AdmitOverLimit(p1netConn net.Conn) {
+  switch p1this.admitPolicy {
+  case AdmitPolicyQueue:
+    select {
+    case p1this.chanPendingConn <- p1netConn:
+      // 进入等待队列，等有连接关闭之后再处理
+      // 进入队列之前可能已经有连接关闭了，这里再试一次
+      p1this.AdmitPending()
+      return
+    default:
+      // 队列满了，直接关闭
+    }
+  case AdmitPolicyReply:
+    // 还没读 PROXY protocol 头、识别协议，按服务端的协议回复。
+    // TLS 的连接要先握手，PROXY protocol 头和识别协议的时候不知道连接是不是 TLS 的，不回复
+    p1codec, ok := protocol.GetCodec(p1this.protocolName)
+    if nil != p1this.p1tlsConfig {
+      if p1this.isProxyProtocol || p1this.IsSniffMode() {
+        ok = false
+      } else {
+        p1netConn = tls.Server(p1netConn, p1this.p1tlsConfig)
+      }
+    }
+    if ok && nil != p1codec.RejectMsg {
+      // 对端不读数据、TLS 握手不发 ClientHello 的时候写会卡住，不能在 Accept 的 goroutine 中回复
+      go p1this.replyReject(p1netConn, p1codec.RejectMsg())
+      return
+    }
+  }
+  p1this.RejectConnection(p1netConn)
+}
+
+// replyReject 回复拒绝消息之后拒绝连接，读写都最多等 rejectReplyTimeout
+func (p1this *TCPService) replyReject(p1netConn net.Conn, sli1msg []byte) {
+  p1netConn.SetDeadline(time.Now().Add(rejectReplyTimeout))
+  p1netConn.Write(sli1msg)
+  p1this.RejectConnection(p1netConn)
+}
+
+// RejectConnection 拒绝连接
+func (p1this *TCPService) RejectConnection(p1netConn net.Conn) {
+  atomic.AddUint64(&p1this.rejectedConnNum, 1)
+  p1this.OnConnRejected(p1this, p1netConn)
+  p1netConn.Close()
+}
+
+// AdmitPending 有空位了，从等待队列中取出一个连接开始处理
+func (p1this *TCPService) AdmitPending() {
+  if nil == p1this.chanPendingConn || !p1this.IsRun() {
+    return
+  }
+  if !p1this.ReserveConnSlot() {
+    return
+  }
+  select {
+  case p1netConn := <-p1this.chanPendingConn:
+    p1this.AcceptConnection(p1netConn)
+  default:
+    p1this.ReleaseConnSlot()
+  }
+}
+
+// ReserveConnSlot 当前连接数没有超过最大连接数时，占一个位置，返回 true
+func (p1this *TCPService) ReserveConnSlot() bool {
+  for {
+    nowConnNum := atomic.LoadUint32(&p1this.nowConnNum)
+    if nowConnNum >= p1this.maxConnNum {
+      return false
+    }
+    if atomic.CompareAndSwapUint32(&p1this.nowConnNum, nowConnNum, nowConnNum+1) {
+      return true
+    }
+  }
+}
+
+// ReleaseConnSlot 释放 ReserveConnSlot 占的位置
+func (p1this *TCPService) ReleaseConnSlot() {
+  atomic.AddUint32(&p1this.nowConnNum, ^uint32(0))
+}
+
+// StartEventLoop 创建并启动事件循环
+func (p1this *TCPService) StartEventLoop() error {
+  sli1eventLoop := make([]*eventLoop, 0, p1this.eventLoopNum)
+  for i := 0; i < p1this.eventLoopNum; i++ {
+    p1loop, err := newEventLoop(p1this)
+    if nil != err {
+      for _, t1p1loop := range sli1eventLoop {
+        // 已经停止的事件循环，Run 会马上退出，释放 epoll 实例
+        t1p1loop.Stop()
+        go t1p1loop.Run()
+      }
+      return err
+    }
+    sli1eventLoop = append(sli1eventLoop, p1loop)
+  }
+  for _, p1loop := range sli1eventLoop {
+    go p1loop.Run()
+  }
+  p1this.sli1eventLoop = sli1eventLoop
+  return nil
+}
+
+// StopEventLoop 停止事件循环
+func (p1this *TCPService) StopEventLoop() {
+  for _, p1loop := range p1this.sli1eventLoop {
+    p1loop.Stop()
+  }
+}
+
+// pickEventLoop 按连接 ID 给连接分配事件循环，没有事件循环时返回 nil
+func (p1this *TCPService) pickEventLoop(id uint64) *eventLoop {
+  if 0 == len(p1this.sli1eventLoop) {
+    return nil
+  }
+  return p1this.sli1eventLoop[id%uint64(len(p1this.sli1eventLoop))]
+}
+
+// NextConnID 分配连接 ID
+func (p1this *TCPService) NextConnID() uint64 {
+  return atomic.AddUint64(&p1this.lastConnID, 1)
+}
+
+// AddConnection 添加连接，连接数在 ReserveConnSlot 的时候已经加过了
 func (p1this *TCPService) AddConnection(p1conn *TCPConnection) {
   // 用 Linux C 编码时，可以通过 socket 的文件描述符区分 TCP 连接
   // 在 go 中也可以获得文件描述符，但是文件描述符不是唯一的，不能用于区分
-  if p1this.IsDebug() {
-    fd, err := p1conn.p1conn.(*net.TCPConn).File()
-    fmt.Println("net.TCPConn.File", fd.Fd(), err)
-  }
-
-  addrStr := p1conn.p1conn.RemoteAddr().String()
-  p1this.nowConnNum++
-  p1this.mapConnPool[addrStr] = p1conn
+  // 所以这里用服务端分配的连接 ID 区分 TCP 连接，远端地址也不一定是唯一的
+  p1this.p1connPool.Add(p1conn)
 
   if p1this.IsDebug() {
-    fmt.Println("net.TCPConn.RemoteAddr.String", addrStr)
+    fmt.Println("TCPConnection.ID", p1conn.ID(), "net.TCPConn.RemoteAddr.String", p1conn.GetNetConnRemoteAddr())
   }
 }
 
 // DeleteConnection 移除连接
 func (p1this *TCPService) DeleteConnection(p1conn *TCPConnection) {
-  addrStr := p1conn.p1conn.RemoteAddr().String()
-  if _, ok := p1this.mapConnPool[addrStr]; ok {
-    delete(p1this.mapConnPool, addrStr)
-    p1this.nowConnNum--
+  if p1this.p1connPool.Delete(p1conn) {
+    p1this.ReleaseConnSlot()
+    p1this.AdmitPending()
   }
 }
@@ -0,0 +1,415 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+	"tcp-service-go/tcp-service-v22/internal/protocol/stream"
+)
+
+// newTestService 创建监听 127.0.0.1 随机端口的 Stream 协议服务端，收到的消息原样发回去
+func newTestService() *TCPService {
+	p1service := NewTCPService(protocol.StreamStr, "127.0.0.1", 0)
+	p1service.OnConnConnect = func(*TCPConnection) {}
+	p1service.OnConnClose = func(*TCPConnection) {}
+	p1service.OnConnRequest = func(p1conn *TCPConnection) {
+		p1conn.SendMsg([]byte(p1conn.GetProtocol().(*stream.Stream).GetDecodeMsg()))
+	}
+	return p1service
+}
+
+// startTestService 启动服务端，返回第一个 listener 的地址，测试结束的时候关闭服务端
+func startTestService(t testing.TB, p1service *TCPService) string {
+	t.Helper()
+	chanStart := make(chan struct{})
+	p1service.OnServiceStart = func(*TCPService) { close(chanStart) }
+	chanError := make(chan error, 1)
+	p1service.OnServiceError = func(_ *TCPService, err error) {
+		select {
+		case chanError <- err:
+		default:
+		}
+	}
+	chanStop := make(chan struct{})
+	go func() {
+		defer close(chanStop)
+		p1service.Start()
+	}()
+	select {
+	case <-chanStart:
+	case err := <-chanError:
+		t.Fatal("start:", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("start: timeout")
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := p1service.Shutdown(ctx); nil != err {
+			t.Error("shutdown:", err)
+		}
+		<-chanStop
+	})
+
+	p1service.mutex.Lock()
+	defer p1service.mutex.Unlock()
+	return p1service.sli1listener[0].Addr().String()
+}
+
+// writeStreamMsg 按 Stream 协议打包之后发送
+func writeStreamMsg(p1conn net.Conn, msg string) error {
+	sli1msg, err := stream.Pack([]byte(msg))
+	if nil != err {
+		return err
+	}
+	_, err = p1conn.Write(sli1msg)
+	return err
+}
+
+// readStreamMsg 读取一条 Stream 协议的报文，返回数据部分
+func readStreamMsg(p1conn net.Conn) (string, error) {
+	sli1head := make([]byte, 4)
+	if _, err := io.ReadFull(p1conn, sli1head); nil != err {
+		return "", err
+	}
+	sli1body := make([]byte, binary.BigEndian.Uint32(sli1head))
+	if _, err := io.ReadFull(p1conn, sli1body); nil != err {
+		return "", err
+	}
+	return string(sli1body), nil
+}
+
+// request 发送一条消息，返回响应
+func request(t *testing.T, p1conn net.Conn, msg string) string {
+	t.Helper()
+	p1conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeStreamMsg(p1conn, msg); nil != err {
+		t.Fatal("write:", err)
+	}
+	resp, err := readStreamMsg(p1conn)
+	if nil != err {
+		t.Fatal("read:", err)
+	}
+	return resp
+}
+
+// waitFor 轮询直到 f 返回 true，超时的时候测试失败
+func waitFor(t testing.TB, what string, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestTLSConfig 生成 127.0.0.1 的自签名证书，返回服务端的 TLS 配置，客户端不验证证书
+func newTestTLSConfig(t testing.TB) *tls.Config {
+	t.Helper()
+	p1key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	p1template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	sli1der, err := x509.CreateCertificate(rand.Reader, p1template, p1template, &p1key.PublicKey, p1key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{sli1der}, PrivateKey: p1key}}}
+}
+
+// TestShutdownPendingResponse 优雅关闭的时候，HTTP 连接上异步处理的请求响应完之后再关闭，ctx 到期的时候强制关闭；
+// Stream 协议不知道还有没有响应要发送，马上关闭
+func TestShutdownPendingResponse(t *testing.T) {
+	sli1test := []struct {
+		name         string
+		eventLoopNum int
+		isRespond    bool
+	}{
+		{"goroutine", 0, true},
+		{"event loop", 1, true},
+		{"no response before the deadline", 0, false},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			chanRespond := make(chan func(), 1)
+			p1service := NewTCPService(protocol.HTTPStr, "127.0.0.1", 0)
+			p1service.SetEventLoopNum(t1test.eventLoopNum)
+			p1service.OnConnRequest = func(p1conn *TCPConnection) {
+				p1http := p1conn.GetProtocol().(*http.HTTP).Clone()
+				requestSeq := p1conn.GetRequestSeq()
+				chanRespond <- func() {
+					resp := http.NewResponse()
+					resp.SetStatusCode(http.StatusOk)
+					resp.SetBody([]byte("done"))
+					sli1resp, _ := p1http.EncodeResponse(resp)
+					p1conn.SendResponse(requestSeq, sli1resp)
+				}
+			}
+			address := startTestService(t, p1service)
+
+			p1conn, err := net.Dial("tcp4", address)
+			if nil != err {
+				t.Fatal("dial:", err)
+			}
+			defer p1conn.Close()
+			if _, err = p1conn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n")); nil != err {
+				t.Fatal("write:", err)
+			}
+			var respond func()
+			select {
+			case respond = <-chanRespond:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the request")
+			}
+
+			timeout := 5 * time.Second
+			if !t1test.isRespond {
+				timeout = 300 * time.Millisecond
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			chanShutdown := make(chan error, 1)
+			go func() {
+				chanShutdown <- p1service.Shutdown(ctx)
+			}()
+			select {
+			case err = <-chanShutdown:
+				t.Fatalf("Shutdown() = %v before the response", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			if t1test.isRespond {
+				respond()
+			}
+			p1conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			sli1resp, _ := io.ReadAll(p1conn)
+			err = <-chanShutdown
+			if t1test.isRespond {
+				if nil != err || !strings.HasPrefix(string(sli1resp), "HTTP/1.1 200 ") || !strings.HasSuffix(string(sli1resp), "done") {
+					t.Fatalf("Shutdown() = %v, response = %q", err, sli1resp)
+				}
+				return
+			}
+			if context.DeadlineExceeded != err || 0 != len(sli1resp) {
+				t.Fatalf("Shutdown() = %v, response = %q, want the deadline exceeded", err, sli1resp)
+			}
+		})
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		p1service := newTestService()
+		address := startTestService(t, p1service)
+		p1conn, err := net.Dial("tcp4", address)
+		if nil != err {
+			t.Fatal("dial:", err)
+		}
+		defer p1conn.Close()
+		if resp := request(t, p1conn, "a"); "a" != resp {
+			t.Fatalf("response = %q", resp)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		startTime := time.Now()
+		if err = p1service.Shutdown(ctx); nil != err || time.Since(startTime) > time.Second {
+			t.Fatalf("Shutdown() = %v after %v", err, time.Since(startTime))
+		}
+	})
+}
+
+// TestAdmitReplyTLS 超过最大连接数的 TLS 连接不发 ClientHello 的时候，不能卡住 Accept，
+// 后面的连接照样收到 503，不发数据的连接最多等 rejectReplyTimeout 就关闭
+func TestAdmitReplyTLS(t *testing.T) {
+	p1service := NewTCPService(protocol.HTTPStr, "127.0.0.1", 0)
+	p1service.SetTLSConfig(newTestTLSConfig(t))
+	p1service.SetMaxConnNum(1)
+	p1service.SetAdmitPolicy(AdmitPolicyReply)
+	address := startTestService(t, p1service)
+
+	p1holdConn, err := net.Dial("tcp4", address)
+	if nil != err {
+		t.Fatal("dial:", err)
+	}
+	defer p1holdConn.Close()
+	waitFor(t, "the first connection", func() bool { return 1 == p1service.GetConnPool().Len() })
+
+	p1silentConn, err := net.Dial("tcp4", address)
+	if nil != err {
+		t.Fatal("dial:", err)
+	}
+	defer p1silentConn.Close()
+
+	startTime := time.Now()
+	p1tlsConn, err := tls.Dial("tcp4", address, &tls.Config{InsecureSkipVerify: true})
+	if nil != err {
+		t.Fatal("tls dial:", err)
+	}
+	defer p1tlsConn.Close()
+	p1tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	sli1resp, _ := io.ReadAll(p1tlsConn)
+	if !strings.HasPrefix(string(sli1resp), "HTTP/1.1 503 ") || time.Since(startTime) >= rejectReplyTimeout {
+		t.Fatalf("response after %v = %q, want a 503 without waiting for the silent connection", time.Since(startTime), sli1resp)
+	}
+
+	p1silentConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = p1silentConn.Read(make([]byte, 1)); nil == err {
+		t.Fatal("silent connection is not closed")
+	}
+	if elapsed := time.Since(startTime); elapsed > 3*rejectReplyTimeout {
+		t.Fatalf("silent connection closed after %v", elapsed)
+	}
+	waitFor(t, "rejected connections", func() bool { return 2 == p1service.GetRejectedConnNum() })
+}
+
+// dialTest 连接服务端，测试结束的时候关闭
+func dialTest(t *testing.T, address string) net.Conn {
+	t.Helper()
+	p1conn, err := net.Dial("tcp4", address)
+	if nil != err {
+		t.Fatal("dial:", err)
+	}
+	t.Cleanup(func() { p1conn.Close() })
+	return p1conn
+}
+
+// isClosedWithoutData 对端关闭了连接，没有发数据
+func isClosedWithoutData(p1conn net.Conn) bool {
+	p1conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	sli1data, err := io.ReadAll(p1conn)
+	return nil == err && 0 == len(sli1data)
+}
+
+// TestAdmitClose 超过最大连接数的新连接直接关闭，有连接关闭之后新连接照常处理
+func TestAdmitClose(t *testing.T) {
+	p1service := newTestService()
+	p1service.SetMaxConnNum(1)
+	address := startTestService(t, p1service)
+
+	p1holdConn := dialTest(t, address)
+	if resp := request(t, p1holdConn, "a"); "a" != resp {
+		t.Fatalf("response = %q", resp)
+	}
+	if !isClosedWithoutData(dialTest(t, address)) {
+		t.Fatal("connection over the limit is not closed")
+	}
+	if 1 != p1service.GetRejectedConnNum() {
+		t.Fatalf("GetRejectedConnNum() = %d, want 1", p1service.GetRejectedConnNum())
+	}
+
+	p1holdConn.Close()
+	waitFor(t, "the first connection to close", func() bool { return 0 == p1service.GetNowConnNum() })
+	if resp := request(t, dialTest(t, address), "b"); "b" != resp {
+		t.Fatalf("response = %q", resp)
+	}
+}
+
+// TestAdmitReply 超过最大连接数的 HTTP 连接回复 503 之后关闭
+func TestAdmitReply(t *testing.T) {
+	p1service := NewTCPService(protocol.HTTPStr, "127.0.0.1", 0)
+	p1service.SetMaxConnNum(1)
+	p1service.SetAdmitPolicy(AdmitPolicyReply)
+	address := startTestService(t, p1service)
+
+	dialTest(t, address)
+	waitFor(t, "the first connection", func() bool { return 1 == p1service.GetConnPool().Len() })
+	p1conn := dialTest(t, address)
+	p1conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	sli1resp, err := io.ReadAll(p1conn)
+	if nil != err || !strings.HasPrefix(string(sli1resp), "HTTP/1.1 503 ") || !strings.Contains(string(sli1resp), "Connection: close\r\n") {
+		t.Fatalf("response = %q, %v, want a 503 with Connection: close", sli1resp, err)
+	}
+	if 1 != p1service.GetRejectedConnNum() {
+		t.Fatalf("GetRejectedConnNum() = %d, want 1", p1service.GetRejectedConnNum())
+	}
+}
+
+// TestAdmitQueue 超过最大连接数的新连接进入等待队列，有连接关闭之后按顺序处理，队列满了直接关闭
+func TestAdmitQueue(t *testing.T) {
+	p1service := newTestService()
+	p1service.SetMaxConnNum(1)
+	p1service.SetAdmitPolicy(AdmitPolicyQueue)
+	p1service.SetPendingQueueSize(1)
+	address := startTestService(t, p1service)
+
+	p1holdConn := dialTest(t, address)
+	if resp := request(t, p1holdConn, "a"); "a" != resp {
+		t.Fatalf("response = %q", resp)
+	}
+	p1pendingConn := dialTest(t, address)
+	waitFor(t, "the pending connection", func() bool { return 1 == p1service.GetPendingConnNum() })
+	if err := writeStreamMsg(p1pendingConn, "b"); nil != err {
+		t.Fatal("write:", err)
+	}
+	// 队列满了
+	if !isClosedWithoutData(dialTest(t, address)) {
+		t.Fatal("connection over the pending queue is not closed")
+	}
+	if 1 != p1service.GetRejectedConnNum() {
+		t.Fatalf("GetRejectedConnNum() = %d, want 1", p1service.GetRejectedConnNum())
+	}
+
+	// 等待中的连接发的数据，开始处理之后照样响应
+	p1pendingConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := readStreamMsg(p1pendingConn); nil == err {
+		t.Fatal("pending connection is handled before a slot is free")
+	}
+	p1holdConn.Close()
+	p1pendingConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if resp, err := readStreamMsg(p1pendingConn); nil != err || "b" != resp {
+		t.Fatalf("pending connection response = %q, %v", resp, err)
+	}
+	if 0 != p1service.GetPendingConnNum() || 1 != p1service.GetNowConnNum() {
+		t.Fatalf("GetPendingConnNum() = %d, GetNowConnNum() = %d", p1service.GetPendingConnNum(), p1service.GetNowConnNum())
+	}
+}
+
+// TestAdmitQueueShutdown Shutdown 的时候，等待队列中的连接直接关闭，算作被拒绝的连接
+func TestAdmitQueueShutdown(t *testing.T) {
+	p1service := newTestService()
+	p1service.SetMaxConnNum(1)
+	p1service.SetAdmitPolicy(AdmitPolicyQueue)
+	address := startTestService(t, p1service)
+
+	p1holdConn := dialTest(t, address)
+	if resp := request(t, p1holdConn, "a"); "a" != resp {
+		t.Fatalf("response = %q", resp)
+	}
+	p1pendingConn := dialTest(t, address)
+	waitFor(t, "the pending connection", func() bool { return 1 == p1service.GetPendingConnNum() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p1service.Shutdown(ctx); nil != err {
+		t.Fatal("Shutdown:", err)
+	}
+	if !isClosedWithoutData(p1pendingConn) {
+		t.Fatal("pending connection is not closed")
+	}
+	if 0 != p1service.GetPendingConnNum() || 1 != p1service.GetRejectedConnNum() {
+		t.Fatalf("GetPendingConnNum() = %d, GetRejectedConnNum() = %d", p1service.GetPendingConnNum(), p1service.GetRejectedConnNum())
+	}
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"crypto/tls"
+	goErrors "errors"
+	"io"
+	"net"
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"time"
+)
+
+const (
+	// sniffSizeMax 识别协议最多读多少字节，读满了还判断不了的，当成服务端的协议
+	sniffSizeMax int = 8 * 1024
+	// sniffTimeout 识别协议的默认超时时间，设置了读报文头超时的时候用读报文头超时
+	sniffTimeout time.Duration = 5 * time.Second
+	// tlsRecordTypeHandshake TLS 握手记录的第 1 个字节，ClientHello 以它开头
+	tlsRecordTypeHandshake byte = 0x16
+)
+
+// ErrNotTLS 设置了 TLS 配置的端口，识别协议的时候收到了不是 TLS 握手开头的连接，详见 TCPService.SetSniffPlaintextOn
+var ErrNotTLS = goErrors.New("sniff: connection does not start with a TLS handshake")
+
+// ProtocolHandler 一个端口支持多个协议时，识别出来的协议自己的回调，为 nil 的回调用 TCPService 的
+type ProtocolHandler struct {
+	// OnConnConnect TCP 连接，连接建立事件回调
+	OnConnConnect func(*TCPConnection)
+	// OnConnRequest TCP 连接，接收到完整的报文事件回调
+	OnConnRequest func(*TCPConnection)
+	// OnConnClose TCP 连接，连接关闭事件回调
+	OnConnClose func(*TCPConnection)
+}
+
+// sniffProtocol 需要识别的协议
+type sniffProtocol struct {
+	protocolName string
+	p1codec      *protocol.Codec
+	p1handler    *ProtocolHandler
+}
+
+// sniffedConn 识别过协议的连接，NewTCPConnection 用识别出来的协议创建 TCPConnection
+type sniffedConn struct {
+	net.Conn
+	// protocolName 识别出来的协议
+	protocolName string
+	// p1handler 协议的回调，为 nil 时用 TCPService 的
+	p1handler *ProtocolHandler
+	// sli1head 识别协议时读到的数据，放进接收缓冲区
+	sli1head []byte
+}
+
+// Read 先返回识别协议时读到的数据，再读连接
+func (p1this *sniffedConn) Read(sli1data []byte) (int, error) {
+	if len(p1this.sli1head) > 0 {
+		byteNum := copy(sli1data, p1this.sli1head)
+		p1this.sli1head = p1this.sli1head[byteNum:]
+		return byteNum, nil
+	}
+	return p1this.Conn.Read(sli1data)
+}
+
+// prefixConn 先返回 sli1prefix 再读连接，识别出 TLS 之后，读到的 ClientHello 要还给 TLS 握手
+type prefixConn struct {
+	net.Conn
+	sli1prefix []byte
+}
+
+// Read 先返回 sli1prefix，再读连接
+func (p1this *prefixConn) Read(sli1data []byte) (int, error) {
+	if len(p1this.sli1prefix) > 0 {
+		byteNum := copy(sli1data, p1this.sli1prefix)
+		p1this.sli1prefix = p1this.sli1prefix[byteNum:]
+		return byteNum, nil
+	}
+	return p1this.Conn.Read(sli1data)
+}
+
+// IsSniffMode 是不是一个端口支持多个协议，详见 AddSniffProtocol
+func (p1this *TCPService) IsSniffMode() bool {
+	return len(p1this.sli1sniffProtocol) > 0
+}
+
+// SniffConnection 读连接开头的数据，识别协议。
+// 设置了 TLS 配置的时候，以 TLS 握手开头的连接先握手，然后识别 TLS 里面的协议；
+// 不是 TLS 握手开头的，没有 SetSniffPlaintextOn 时返回 ErrNotTLS。
+// 按 AddSniffProtocol 的顺序判断，都不是的时候当成服务端的协议（NewTCPService 的 protocolName）。
+func (p1this *TCPService) SniffConnection(p1netConn net.Conn) (net.Conn, error) {
+	timeout := p1this.readHeaderTimeout
+	if timeout <= 0 {
+		timeout = sniffTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	p1netConn.SetReadDeadline(deadline)
+
+	isTLSChecked := false
+	sli1head := make([]byte, 0, sniffSizeMax)
+	for {
+		byteNum, err := p1netConn.Read(sli1head[len(sli1head):cap(sli1head)])
+		sli1head = sli1head[:len(sli1head)+byteNum]
+		isEOF := false
+		if nil != err {
+			if io.EOF != err || 0 == len(sli1head) {
+				return nil, err
+			}
+			// 对端发完数据就关闭了写，用已经读到的数据判断
+			isEOF = true
+		}
+		if 0 == byteNum && !isEOF {
+			continue
+		}
+
+		if !isTLSChecked && nil != p1this.p1tlsConfig {
+			// 第 1 个字节就能判断是不是 TLS
+			isTLSChecked = true
+			if tlsRecordTypeHandshake == sli1head[0] {
+				p1netConn = tls.Server(&prefixConn{Conn: p1netConn, sli1prefix: sli1head}, p1this.p1tlsConfig)
+				p1netConn.SetReadDeadline(deadline)
+				sli1head = make([]byte, 0, sniffSizeMax)
+				continue
+			}
+			if !p1this.isSniffPlaintext {
+				return nil, ErrNotTLS
+			}
+		}
+
+		p1sniff, isDone := p1this.matchProtocol(sli1head, len(sli1head) == cap(sli1head) || isEOF)
+		if isDone {
+			p1netConn.SetReadDeadline(time.Time{})
+			p1sniffedConn := &sniffedConn{Conn: p1netConn, protocolName: p1this.protocolName, sli1head: sli1head}
+			if nil != p1sniff {
+				p1sniffedConn.protocolName = p1sniff.protocolName
+				p1sniffedConn.p1handler = p1sniff.p1handler
+			}
+			return p1sniffedConn, nil
+		}
+	}
+}
+
+// matchProtocol 按顺序判断是哪个协议，前面的协议还需要更多数据的时候，不判断后面的协议。
+// isFinal 为 true 时不会再有更多数据了，需要更多数据的当成不是。
+// 返回 nil, true 表示都不是。
+func (p1this *TCPService) matchProtocol(sli1head []byte, isFinal bool) (*sniffProtocol, bool) {
+	for i := range p1this.sli1sniffProtocol {
+		p1sniff := &p1this.sli1sniffProtocol[i]
+		switch p1sniff.p1codec.Sniff(sli1head) {
+		case protocol.SniffMatch:
+			return p1sniff, true
+		case protocol.SniffNeedMore:
+			if !isFinal {
+				return nil, false
+			}
+		}
+	}
+	return nil, true
+}
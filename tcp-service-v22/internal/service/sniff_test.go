@@ -0,0 +1,243 @@
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"tcp-service-go/tcp-service-v22/internal/protocol"
+	"tcp-service-go/tcp-service-v22/internal/protocol/http"
+	"tcp-service-go/tcp-service-v22/internal/protocol/stream"
+)
+
+// wsHandshake WebSocket 的握手请求
+const wsHandshake = "GET /chat HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+
+// newSniffService 创建一个端口支持 WebSocket、Stream、HTTP 的服务端，HTTP 是服务端的协议，识别不出来的都当成 HTTP。
+// HTTP 请求回复 200，Stream 消息原样发回去，连接建立的时候把识别出来的协议放进 chanProtocol
+func newSniffService(chanProtocol chan string) *TCPService {
+	p1service := NewTCPService(protocol.HTTPStr, "127.0.0.1", 0)
+	p1service.OnConnConnect = func(p1conn *TCPConnection) {
+		chanProtocol <- p1conn.GetProtocolName()
+	}
+	p1service.OnConnClose = func(*TCPConnection) {}
+	p1service.OnConnRequest = func(p1conn *TCPConnection) {
+		resp := http.NewResponse()
+		resp.SetStatusCode(http.StatusOk)
+		resp.SetBody([]byte("http"))
+		sli1resp, _ := p1conn.GetProtocol().(*http.HTTP).EncodeResponse(resp)
+		p1conn.SendResponse(p1conn.GetRequestSeq(), sli1resp)
+	}
+	// 握手由协议回复 101，握手请求不用处理
+	p1service.AddSniffProtocol(protocol.WebSocketStr, &ProtocolHandler{OnConnRequest: func(*TCPConnection) {}})
+	p1service.AddSniffProtocol(protocol.StreamStr, &ProtocolHandler{OnConnRequest: func(p1conn *TCPConnection) {
+		p1conn.SendMsg([]byte(p1conn.GetProtocol().(*stream.Stream).GetDecodeMsg()))
+	}})
+	return p1service
+}
+
+// waitProtocol 等下一个连接建立，返回识别出来的协议
+func waitProtocol(t *testing.T, chanProtocol chan string) string {
+	t.Helper()
+	select {
+	case protocolName := <-chanProtocol:
+		return protocolName
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the connection")
+	}
+	return ""
+}
+
+// streamRequest 打开了 SetSendMagicOn 的 Stream 客户端发送的数据：Magic 和一条消息
+func streamRequest(msg string) []byte {
+	sli1msg, _ := stream.Pack([]byte(msg))
+	return append(append([]byte{}, stream.Magic...), sli1msg...)
+}
+
+// TestSniffProtocol 一个端口上按连接开头的数据识别 WebSocket、Stream，都不是的当成 HTTP，用识别出来的协议的回调处理
+func TestSniffProtocol(t *testing.T) {
+	sli1packed, _ := stream.Pack([]byte("hi"))
+	sli1test := []struct {
+		name         string
+		request      string
+		protocolName string
+		resp         string
+	}{
+		{"http", "GET / HTTP/1.1\r\nHost: x\r\n\r\n", protocol.HTTPStr, "HTTP/1.1 200 "},
+		{"websocket", wsHandshake, protocol.WebSocketStr, "HTTP/1.1 101 "},
+		{"stream", string(streamRequest("hi")), protocol.StreamStr, string(sli1packed)},
+	}
+	chanProtocol := make(chan string, 10)
+	address := startTestService(t, newSniffService(chanProtocol))
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1conn, err := net.Dial("tcp4", address)
+			if nil != err {
+				t.Fatal("dial:", err)
+			}
+			defer p1conn.Close()
+			p1conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err = p1conn.Write([]byte(t1test.request)); nil != err {
+				t.Fatal("write:", err)
+			}
+			sli1resp := make([]byte, len(t1test.resp))
+			if _, err = io.ReadFull(p1conn, sli1resp); nil != err || t1test.resp != string(sli1resp) {
+				t.Fatalf("response = %q, %v, want %q", sli1resp, err, t1test.resp)
+			}
+			if protocolName := waitProtocol(t, chanProtocol); t1test.protocolName != protocolName {
+				t.Fatalf("protocol = %s, want %s", protocolName, t1test.protocolName)
+			}
+		})
+	}
+}
+
+// TestSniffNeedMoreEOF 识别的协议还要更多数据的时候对端关闭了写，用已经读到的数据判断，都不是的当成服务端的协议
+func TestSniffNeedMoreEOF(t *testing.T) {
+	sli1test := []struct {
+		name    string
+		request string
+	}{
+		{"websocket header incomplete", "GET /chat HTTP/1.1\r\nUpgrade: websocket\r\n"},
+		{"part of stream magic", string(stream.Magic[:3])},
+	}
+	chanProtocol := make(chan string, 10)
+	p1service := newSniffService(chanProtocol)
+	// 不能等读报文头超时
+	p1service.SetReadHeaderTimeout(time.Minute)
+	address := startTestService(t, p1service)
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			p1conn, err := net.Dial("tcp4", address)
+			if nil != err {
+				t.Fatal("dial:", err)
+			}
+			defer p1conn.Close()
+			p1conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err = p1conn.Write([]byte(t1test.request)); nil != err {
+				t.Fatal("write:", err)
+			}
+			p1conn.(*net.TCPConn).CloseWrite()
+			if protocolName := waitProtocol(t, chanProtocol); protocol.HTTPStr != protocolName {
+				t.Fatalf("protocol = %s, want %s", protocolName, protocol.HTTPStr)
+			}
+			// 请求不完整，HTTP 连接处理完 EOF 之后关闭
+			if _, err = io.ReadAll(p1conn); nil != err {
+				t.Fatal("connection is not closed:", err)
+			}
+		})
+	}
+}
+
+// TestSniffSizeMax 读满 sniffSizeMax 字节还判断不了的，不再等数据，当成服务端的协议
+func TestSniffSizeMax(t *testing.T) {
+	chanProtocol := make(chan string, 10)
+	p1service := newSniffService(chanProtocol)
+	p1service.SetReadHeaderTimeout(time.Minute)
+	address := startTestService(t, p1service)
+
+	p1conn, err := net.Dial("tcp4", address)
+	if nil != err {
+		t.Fatal("dial:", err)
+	}
+	defer p1conn.Close()
+	// WebSocket 的头一直没有结束，一直需要更多数据
+	sli1data := []byte("GET /chat HTTP/1.1\r\nUpgrade: websocket\r\nX-Pad: " + strings.Repeat("a", sniffSizeMax))
+	p1conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = p1conn.Write(sli1data); nil != err {
+		t.Fatal("write:", err)
+	}
+	if protocolName := waitProtocol(t, chanProtocol); protocol.HTTPStr != protocolName {
+		t.Fatalf("protocol = %s, want %s", protocolName, protocol.HTTPStr)
+	}
+}
+
+// TestSniffTLS 设置了 TLS 配置的时候，TLS 握手开头的连接先握手，再识别 TLS 里面的协议，读到的 ClientHello 还给握手
+func TestSniffTLS(t *testing.T) {
+	chanProtocol := make(chan string, 10)
+	p1service := newSniffService(chanProtocol)
+	p1service.SetTLSConfig(newTestTLSConfig(t))
+	address := startTestService(t, p1service)
+
+	sli1test := []struct {
+		request      string
+		protocolName string
+		resp         string
+	}{
+		{"GET / HTTP/1.1\r\nHost: x\r\n\r\n", protocol.HTTPStr, "HTTP/1.1 200 "},
+		{string(streamRequest("hi")), protocol.StreamStr, "hi"},
+	}
+	for _, t1test := range sli1test {
+		p1conn, err := tls.Dial("tcp4", address, &tls.Config{InsecureSkipVerify: true})
+		if nil != err {
+			t.Fatal("tls dial:", err)
+		}
+		p1conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = p1conn.Write([]byte(t1test.request)); nil != err {
+			t.Fatal("write:", err)
+		}
+		sli1resp := make([]byte, 64)
+		byteNum, err := io.ReadAtLeast(p1conn, sli1resp, len(t1test.resp))
+		if nil != err || !bytes.Contains(sli1resp[:byteNum], []byte(t1test.resp)) {
+			t.Fatalf("%s: response = %q, %v, want %q", t1test.protocolName, sli1resp[:byteNum], err, t1test.resp)
+		}
+		if protocolName := waitProtocol(t, chanProtocol); t1test.protocolName != protocolName {
+			t.Fatalf("protocol = %s, want %s", protocolName, t1test.protocolName)
+		}
+		p1conn.Close()
+	}
+}
+
+// TestSniffNotTLS 设置了 TLS 配置的时候，不是 TLS 的连接返回 ErrNotTLS 并关闭，SetSniffPlaintextOn 之后照常识别
+func TestSniffNotTLS(t *testing.T) {
+	const request = "GET / HTTP/1.1\r\nHost: x\r\n\r\n"
+	p1service := newSniffService(make(chan string, 10))
+	p1service.SetTLSConfig(newTestTLSConfig(t))
+	p1serverConn, p1clientConn := net.Pipe()
+	go p1clientConn.Write([]byte(request))
+	if _, err := p1service.SniffConnection(p1serverConn); ErrNotTLS != err {
+		t.Fatalf("SniffConnection() = %v, want ErrNotTLS", err)
+	}
+	p1serverConn.Close()
+	p1clientConn.Close()
+
+	for _, isPlaintext := range []bool{false, true} {
+		chanProtocol := make(chan string, 10)
+		p1service = newSniffService(chanProtocol)
+		p1service.SetTLSConfig(newTestTLSConfig(t))
+		if isPlaintext {
+			p1service.SetSniffPlaintextOn()
+		}
+		address := startTestService(t, p1service)
+		p1conn, err := net.Dial("tcp4", address)
+		if nil != err {
+			t.Fatal("dial:", err)
+		}
+		p1conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = p1conn.Write([]byte(request)); nil != err {
+			t.Fatal("write:", err)
+		}
+		sli1resp := make([]byte, len("HTTP/1.1 200 "))
+		_, err = io.ReadFull(p1conn, sli1resp)
+		p1conn.Close()
+		if !isPlaintext {
+			if io.EOF != err {
+				t.Fatalf("plaintext connection read = %q, %v, want it closed", sli1resp, err)
+			}
+			if 0 != p1service.GetConnPool().Len() {
+				t.Fatal("plaintext connection is added to the pool")
+			}
+			continue
+		}
+		if nil != err || "HTTP/1.1 200 " != string(sli1resp) {
+			t.Fatalf("plaintext response = %q, %v", sli1resp, err)
+		}
+		if protocolName := waitProtocol(t, chanProtocol); protocol.HTTPStr != protocolName {
+			t.Fatalf("protocol = %s, want %s", protocolName, protocol.HTTPStr)
+		}
+	}
+}
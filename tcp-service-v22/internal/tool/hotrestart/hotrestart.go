@@ -0,0 +1,159 @@
+package hotrestart
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// EnvListenKeys 环境变量，热重启时父进程用它告诉子进程继承了哪些 listener。
+// 值是 listener 的 key，用 "\n" 分隔，第 i 个 key 对应的文件描述符是 3+i（os.StartProcess 的 Files 中 stdin、stdout、stderr 之后的）。
+const EnvListenKeys string = "TCP_SERVICE_LISTEN_KEYS"
+
+// firstInheritedFd 第一个继承的文件描述符
+const firstInheritedFd int = 3
+
+// filer 可以导出文件描述符的 listener，*net.TCPListener 和 *net.UnixListener 都是
+type filer interface {
+	File() (*os.File, error)
+}
+
+// registeredListener 注册的 listener
+type registeredListener struct {
+	key      string
+	listener net.Listener
+}
+
+var (
+	// mutex 保护下面的变量
+	mutex sync.Mutex
+	// isInheritedParsed 是否已经解析过继承的 listener
+	isInheritedParsed bool
+	// mapInherited 继承的 listener，key 和 listener 的关系，同一个 key 可以有多个（SO_REUSEPORT）
+	mapInherited map[string][]net.Listener
+	// sli1registered 当前正在使用的 listener，热重启时交给子进程
+	sli1registered []registeredListener
+)
+
+// Take 取出继承的 key 对应的 listener，最多 num 个，没有继承的时候返回空。
+// 取出的 listener 交给调用方，不会再被别人取到。
+func Take(key string, num int) []net.Listener {
+	mutex.Lock()
+	defer mutex.Unlock()
+	parseInherited()
+
+	sli1listener := mapInherited[key]
+	if num > len(sli1listener) {
+		num = len(sli1listener)
+	}
+	sli1take := sli1listener[:num:num]
+	mapInherited[key] = sli1listener[num:]
+	return sli1take
+}
+
+// parseInherited 解析环境变量，把继承的文件描述符转换成 listener，只在第一次调用时执行
+func parseInherited() {
+	if isInheritedParsed {
+		return
+	}
+	isInheritedParsed = true
+	mapInherited = make(map[string][]net.Listener)
+
+	value := os.Getenv(EnvListenKeys)
+	// 子进程再热重启的时候，会重新设置
+	os.Unsetenv(EnvListenKeys)
+	if "" == value {
+		return
+	}
+	for i, key := range strings.Split(value, "\n") {
+		p1file := os.NewFile(uintptr(firstInheritedFd+i), key)
+		if nil == p1file {
+			continue
+		}
+		listener, err := net.FileListener(p1file)
+		// net.FileListener 复制了文件描述符，原来的关掉
+		p1file.Close()
+		if nil != err {
+			continue
+		}
+		mapInherited[key] = append(mapInherited[key], listener)
+	}
+}
+
+// Register 注册正在使用的 listener，热重启时交给子进程，子进程用同样的 key 调用 Take 取出来
+func Register(key string, listener net.Listener) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	sli1registered = append(sli1registered, registeredListener{key: key, listener: listener})
+}
+
+// Unregister 取消注册，listener 关闭之前调用
+func Unregister(listener net.Listener) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, t1registered := range sli1registered {
+		if t1registered.listener == listener {
+			sli1registered = append(sli1registered[:i], sli1registered[i+1:]...)
+			return
+		}
+	}
+}
+
+// Restart 用同样的命令行参数启动一个新进程，把注册的 listener 交给它，返回新进程。
+// 新进程开始 Accept 之前，新连接在 socket 的队列中等着，不会被拒绝。
+// 调用方（旧进程）之后应该优雅关闭服务，处理完已有的连接再退出。
+func Restart() (*os.Process, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sli1file := make([]*os.File, 0, len(sli1registered))
+	defer func() {
+		// 子进程已经继承了，父进程中复制出来的文件描述符关掉
+		for _, p1file := range sli1file {
+			p1file.Close()
+		}
+	}()
+	sli1key := make([]string, 0, len(sli1registered))
+	for _, t1registered := range sli1registered {
+		t1filer, ok := t1registered.listener.(filer)
+		if !ok {
+			return nil, errors.New("listener does not support File: " + t1registered.key)
+		}
+		p1file, err := t1filer.File()
+		if nil != err {
+			return nil, err
+		}
+		sli1file = append(sli1file, p1file)
+		sli1key = append(sli1key, t1registered.key)
+	}
+
+	path, err := os.Executable()
+	if nil != err {
+		return nil, err
+	}
+	sli1env := make([]string, 0, len(os.Environ())+1)
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, EnvListenKeys+"=") {
+			sli1env = append(sli1env, env)
+		}
+	}
+	sli1env = append(sli1env, EnvListenKeys+"="+strings.Join(sli1key, "\n"))
+
+	p1process, err := os.StartProcess(path, os.Args, &os.ProcAttr{
+		Env:   sli1env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, sli1file...),
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	// Unix domain socket 的文件现在归子进程用，旧进程关闭 listener 的时候不能删
+	for _, t1registered := range sli1registered {
+		if p1unixListener, ok := t1registered.listener.(*net.UnixListener); ok {
+			p1unixListener.SetUnlinkOnClose(false)
+		}
+	}
+	return p1process, nil
+}
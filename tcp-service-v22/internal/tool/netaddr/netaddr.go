@@ -0,0 +1,134 @@
+package netaddr
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	SchemeTCP  string = "tcp"  // IPv4 和 IPv6
+	SchemeTCP4 string = "tcp4" // 只用 IPv4
+	SchemeTCP6 string = "tcp6" // 只用 IPv6
+	SchemeUnix string = "unix" // Unix domain socket
+)
+
+// Addr 监听或者连接的地址
+type Addr struct {
+	// Network net.Listen 和 net.Dial 的 network 参数，详见 Scheme 开头的常量
+	Network string
+	// Address net.Listen 和 net.Dial 的 address 参数，TCP 是 "host:port"，Unix domain socket 是文件路径
+	Address string
+}
+
+// Parse 解析 URL 形式的地址，比如 "tcp://[::]:9501"、"tcp4://127.0.0.1:9501"、"unix:///run/gw.sock"
+func Parse(rawURL string) (Addr, error) {
+	index := strings.Index(rawURL, "://")
+	if index <= 0 {
+		return Addr{}, errors.New("address must be a URL like tcp://host:port or unix:///path: " + rawURL)
+	}
+	addr := Addr{
+		Network: strings.ToLower(rawURL[:index]),
+		Address: rawURL[index+3:],
+	}
+	switch addr.Network {
+	case SchemeTCP, SchemeTCP4, SchemeTCP6:
+		_, port, err := net.SplitHostPort(addr.Address)
+		if nil != err {
+			return Addr{}, err
+		}
+		if _, err = strconv.ParseUint(port, 10, 16); nil != err {
+			return Addr{}, errors.New("invalid port: " + rawURL)
+		}
+	case SchemeUnix:
+		if "" == addr.Address {
+			return Addr{}, errors.New("empty unix socket path: " + rawURL)
+		}
+	default:
+		return Addr{}, errors.New("scheme not supported: " + rawURL)
+	}
+	return addr, nil
+}
+
+// FromHostPort IPv4 的地址，兼容 NewTCPService 和 NewTCPClient 的 address 和 port 参数
+func FromHostPort(host string, port uint16) Addr {
+	return Addr{
+		Network: SchemeTCP4,
+		Address: net.JoinHostPort(host, strconv.Itoa(int(port))),
+	}
+}
+
+// String 转换成 URL 形式
+func (p1this Addr) String() string {
+	return p1this.Network + "://" + p1this.Address
+}
+
+// Host 地址中的 host 部分，Unix domain socket 没有 host，返回空字符串
+func (p1this Addr) Host() string {
+	if SchemeUnix == p1this.Network {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p1this.Address)
+	if nil != err {
+		return ""
+	}
+	return host
+}
+
+// Listen 开始监听。
+// Unix domain socket 的文件已经存在的时候，如果没有进程在监听（上次没有正常退出留下的），先删掉再监听。
+func Listen(addr Addr) (net.Listener, error) {
+	if SchemeUnix == addr.Network {
+		removeStaleSocket(addr.Address)
+	}
+	return net.Listen(addr.Network, addr.Address)
+}
+
+// ListenReusePort 用 SO_REUSEPORT 在同一个地址上打开 num 个 listener，只支持 Linux 的 TCP 地址。
+// 每个 listener 一个 goroutine Accept，内核把新连接分配给不同的 listener。
+// 端口为 0 的时候，后面的 listener 用第一个 listener 分配到的端口。
+func ListenReusePort(addr Addr, num int) ([]net.Listener, error) {
+	if SchemeUnix == addr.Network {
+		return nil, errors.New("SO_REUSEPORT is not supported for unix socket: " + addr.String())
+	}
+	listenConfig := net.ListenConfig{Control: reusePortControl}
+	address := addr.Address
+	sli1listener := make([]net.Listener, 0, num)
+	for i := 0; i < num; i++ {
+		listener, err := listenConfig.Listen(context.Background(), addr.Network, address)
+		if nil != err {
+			for _, t1listener := range sli1listener {
+				t1listener.Close()
+			}
+			return nil, err
+		}
+		if 0 == i {
+			address = listener.Addr().String()
+		}
+		sli1listener = append(sli1listener, listener)
+	}
+	return sli1listener, nil
+}
+
+// Dial 建立连接
+func Dial(addr Addr) (net.Conn, error) {
+	return net.Dial(addr.Network, addr.Address)
+}
+
+// removeStaleSocket 删除没有进程在监听的 socket 文件
+func removeStaleSocket(path string) {
+	fileInfo, err := os.Stat(path)
+	if nil != err || 0 == fileInfo.Mode()&os.ModeSocket {
+		return
+	}
+	p1conn, err := net.Dial(SchemeUnix, path)
+	if nil == err {
+		// 还有进程在监听，不能删，交给 net.Listen 报错
+		p1conn.Close()
+		return
+	}
+	os.Remove(path)
+}
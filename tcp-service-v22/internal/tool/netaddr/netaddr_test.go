@@ -0,0 +1,95 @@
+package netaddr
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	sli1test := []struct {
+		rawURL  string
+		network string
+		address string
+		host    string
+		isErr   bool
+	}{
+		{rawURL: "tcp://0.0.0.0:9501", network: SchemeTCP, address: "0.0.0.0:9501", host: "0.0.0.0"},
+		{rawURL: "tcp4://127.0.0.1:9501", network: SchemeTCP4, address: "127.0.0.1:9501", host: "127.0.0.1"},
+		{rawURL: "tcp6://[::1]:9501", network: SchemeTCP6, address: "[::1]:9501", host: "::1"},
+		{rawURL: "tcp://[::]:9501", network: SchemeTCP, address: "[::]:9501", host: "::"},
+		{rawURL: "tcp://[fe80::1%eth0]:0", network: SchemeTCP, address: "[fe80::1%eth0]:0", host: "fe80::1%eth0"},
+		{rawURL: "TCP4://localhost:80", network: SchemeTCP4, address: "localhost:80", host: "localhost"},
+		{rawURL: "tcp://:9501", network: SchemeTCP, address: ":9501", host: ""},
+		{rawURL: "unix:///run/gw.sock", network: SchemeUnix, address: "/run/gw.sock", host: ""},
+		{rawURL: "unix://gw.sock", network: SchemeUnix, address: "gw.sock", host: ""},
+
+		{rawURL: "tcp6://::1:9501", isErr: true},
+		{rawURL: "tcp://[::1]", isErr: true},
+		{rawURL: "tcp://127.0.0.1", isErr: true},
+		{rawURL: "tcp://127.0.0.1:65536", isErr: true},
+		{rawURL: "tcp://127.0.0.1:http", isErr: true},
+		{rawURL: "unix://", isErr: true},
+		{rawURL: "http://127.0.0.1:80", isErr: true},
+		{rawURL: "udp://127.0.0.1:53", isErr: true},
+		{rawURL: "127.0.0.1:9501", isErr: true},
+		{rawURL: "://127.0.0.1:9501", isErr: true},
+	}
+	for _, t1test := range sli1test {
+		addr, err := Parse(t1test.rawURL)
+		if t1test.isErr {
+			if nil == err {
+				t.Errorf("Parse(%q) = %+v, want an error", t1test.rawURL, addr)
+			}
+			continue
+		}
+		if nil != err {
+			t.Errorf("Parse(%q): %v", t1test.rawURL, err)
+			continue
+		}
+		if t1test.network != addr.Network || t1test.address != addr.Address || t1test.host != addr.Host() {
+			t.Errorf("Parse(%q) = %+v, host %q", t1test.rawURL, addr, addr.Host())
+		}
+	}
+}
+
+func TestFromHostPort(t *testing.T) {
+	addr := FromHostPort("127.0.0.1", 9501)
+	if "tcp4://127.0.0.1:9501" != addr.String() {
+		t.Fatalf("FromHostPort() = %s", addr)
+	}
+	if t1addr, err := Parse(addr.String()); nil != err || addr != t1addr {
+		t.Fatalf("Parse(%s) = %+v, %v", addr, t1addr, err)
+	}
+}
+
+// TestListenUnix 上次没有正常退出留下的 socket 文件先删掉再监听，还有进程在监听的返回错误
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	addr := Addr{Network: SchemeUnix, Address: path}
+
+	// 关闭的时候不删除文件，模拟没有正常退出
+	p1listener, err := Listen(addr)
+	if nil != err {
+		t.Fatal("Listen:", err)
+	}
+	p1listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	p1listener.Close()
+	if _, err = os.Stat(path); nil != err {
+		t.Fatal("socket file is removed:", err)
+	}
+
+	if p1listener, err = Listen(addr); nil != err {
+		t.Fatal("Listen with a stale socket file:", err)
+	}
+	defer p1listener.Close()
+	if _, err = Listen(addr); nil == err {
+		t.Fatal("Listen() should fail when another listener is using the socket")
+	}
+	p1conn, err := Dial(addr)
+	if nil != err {
+		t.Fatal("Dial:", err)
+	}
+	p1conn.Close()
+}
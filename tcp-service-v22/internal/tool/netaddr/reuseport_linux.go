@@ -0,0 +1,22 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !sparc64
+
+package netaddr
+
+import (
+	"syscall"
+)
+
+// soReusePort Linux 的 SO_REUSEPORT，syscall 包中没有这个常量（mips、sparc 的值不一样，这两种架构不支持）
+const soReusePort int = 0xf
+
+// reusePortControl 在 bind 之前设置 SO_REUSEPORT，多个 socket 可以监听同一个端口，由内核分配新连接
+func reusePortControl(network string, address string, p1rawConn syscall.RawConn) error {
+	var errSet error
+	err := p1rawConn.Control(func(fd uintptr) {
+		errSet = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if nil != err {
+		return err
+	}
+	return errSet
+}
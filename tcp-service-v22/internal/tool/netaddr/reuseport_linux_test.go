@@ -0,0 +1,82 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !sparc64
+
+package netaddr
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestListenReusePort 两个 listener 监听同一个端口，端口为 0 的时候用第一个分配到的端口，内核把新连接分给两个 listener
+func TestListenReusePort(t *testing.T) {
+	sli1listener, err := ListenReusePort(Addr{Network: SchemeTCP4, Address: "127.0.0.1:0"}, 2)
+	if nil != err {
+		t.Fatal("ListenReusePort:", err)
+	}
+	defer func() {
+		for _, p1listener := range sli1listener {
+			p1listener.Close()
+		}
+	}()
+	if 2 != len(sli1listener) || sli1listener[0].Addr().String() != sli1listener[1].Addr().String() {
+		t.Fatalf("listeners = %v", sli1listener)
+	}
+	address := sli1listener[0].Addr().String()
+	// 没有设置 SO_REUSEPORT 的 socket 不能监听同一个端口
+	if p1listener, err := net.Listen(SchemeTCP4, address); nil == err {
+		p1listener.Close()
+		t.Fatal("net.Listen() on a SO_REUSEPORT port should fail")
+	}
+
+	var mutex sync.Mutex
+	sli1acceptNum := make([]int, len(sli1listener))
+	for i, p1listener := range sli1listener {
+		i, p1listener := i, p1listener
+		go func() {
+			for {
+				p1conn, err := p1listener.Accept()
+				if nil != err {
+					return
+				}
+				mutex.Lock()
+				sli1acceptNum[i]++
+				mutex.Unlock()
+				p1conn.Close()
+			}
+		}()
+	}
+	// 按源端口的哈希分配，连接多了两个 listener 都会分到
+	const connNum = 64
+	for i := 0; i < connNum; i++ {
+		p1conn, err := net.Dial(SchemeTCP4, address)
+		if nil != err {
+			t.Fatal("dial:", err)
+		}
+		p1conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		acceptNum0, acceptNum1 := sli1acceptNum[0], sli1acceptNum[1]
+		mutex.Unlock()
+		if connNum == acceptNum0+acceptNum1 {
+			if 0 == acceptNum0 || 0 == acceptNum1 {
+				t.Fatalf("accepted %d and %d connections, want both listeners used", acceptNum0, acceptNum1)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("accepted %d of %d connections", acceptNum0+acceptNum1, connNum)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestListenReusePortUnix Unix domain socket 不支持 SO_REUSEPORT
+func TestListenReusePortUnix(t *testing.T) {
+	if _, err := ListenReusePort(Addr{Network: SchemeUnix, Address: "/tmp/x.sock"}, 2); nil == err {
+		t.Fatal("ListenReusePort(unix) should fail")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le || sparc64
+
+package netaddr
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl 只支持 Linux（不包括 mips、sparc）
+func reusePortControl(network string, address string, p1rawConn syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is only supported on linux")
+}
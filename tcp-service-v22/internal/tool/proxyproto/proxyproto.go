@@ -0,0 +1,265 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultReadTimeout 读 PROXY protocol 头的默认超时时间
+	DefaultReadTimeout time.Duration = 5 * time.Second
+
+	// v1HeaderMax v1 的头最多 107 个字节（包括 "\r\n"）
+	v1HeaderMax int = 107
+	// v2HeaderLen v2 固定部分的长度：12 字节签名、版本和命令、地址族和传输协议、2 字节长度
+	v2HeaderLen int = 16
+)
+
+const (
+	CommandLocal uint8 = iota // 负载均衡自己发起的连接（比如健康检查），没有真实的客户端地址
+	CommandProxy              // 代理的连接，有真实的客户端地址
+)
+
+var (
+	// v1Prefix v1 的头以 "PROXY " 开头
+	v1Prefix = []byte("PROXY ")
+	// v2Signature v2 的头以这 12 个字节开头
+	v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+	// ErrMalformedHeader PROXY protocol 头格式错误
+	ErrMalformedHeader = errors.New("malformed PROXY protocol header.")
+)
+
+// Header PROXY protocol 头
+type Header struct {
+	// Version 版本，1 或者 2
+	Version uint8
+	// Command 命令，详见 Command 开头的常量，v1 的 UNKNOWN 当作 CommandLocal
+	Command uint8
+	// SourceAddr 真实的客户端地址，CommandLocal 或者地址族未知的时候为 nil
+	SourceAddr net.Addr
+	// DestAddr 客户端连接的地址（负载均衡的地址），CommandLocal 或者地址族未知的时候为 nil
+	DestAddr net.Addr
+	// TLV v2 地址后面的扩展字段，没有解析，原样保留
+	TLV []byte
+}
+
+// ReadHeader 从 r 中读取 PROXY protocol 头，只读头的字节，后面的数据留在 r 中
+func ReadHeader(r io.Reader) (*Header, error) {
+	// v1 的头最短 15 个字节（"PROXY UNKNOWN\r\n"），v2 的签名 12 个字节，先读 12 个字节判断版本
+	sli1head := make([]byte, len(v2Signature), v2HeaderLen)
+	if _, err := io.ReadFull(r, sli1head); nil != err {
+		return nil, err
+	}
+	if bytes.Equal(sli1head, v2Signature) {
+		return readV2(r, sli1head)
+	}
+	if bytes.HasPrefix(sli1head, v1Prefix) {
+		return readV1(r, sli1head)
+	}
+	return nil, ErrMalformedHeader
+}
+
+// readV1 读取 v1 的头，v1 的头没有长度，一个字节一个字节地读到 "\r\n"，不会多读
+func readV1(r io.Reader, sli1head []byte) (*Header, error) {
+	sli1line := append(make([]byte, 0, v1HeaderMax), sli1head...)
+	sli1byte := make([]byte, 1)
+	for !bytes.HasSuffix(sli1line, []byte("\r\n")) {
+		if len(sli1line) >= v1HeaderMax {
+			return nil, ErrMalformedHeader
+		}
+		if _, err := io.ReadFull(r, sli1byte); nil != err {
+			return nil, err
+		}
+		sli1line = append(sli1line, sli1byte[0])
+	}
+
+	// PROXY TCP4 源地址 目标地址 源端口 目标端口
+	sli1field := strings.Split(string(sli1line[:len(sli1line)-2]), " ")
+	if len(sli1field) < 2 {
+		return nil, ErrMalformedHeader
+	}
+	p1header := &Header{Version: 1, Command: CommandProxy}
+	switch sli1field[1] {
+	case "UNKNOWN":
+		// 后面的内容忽略
+		p1header.Command = CommandLocal
+		return p1header, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ErrMalformedHeader
+	}
+	if 6 != len(sli1field) {
+		return nil, ErrMalformedHeader
+	}
+	isIPv4 := "TCP4" == sli1field[1]
+	p1source, err := parseV1Addr(sli1field[2], sli1field[4], isIPv4)
+	if nil != err {
+		return nil, err
+	}
+	p1dest, err := parseV1Addr(sli1field[3], sli1field[5], isIPv4)
+	if nil != err {
+		return nil, err
+	}
+	p1header.SourceAddr = p1source
+	p1header.DestAddr = p1dest
+	return p1header, nil
+}
+
+// parseV1Addr 解析 v1 的 IP 和端口，IP 的版本要和 TCP4、TCP6 一致
+func parseV1Addr(ip string, port string, isIPv4 bool) (*net.TCPAddr, error) {
+	t1ip := net.ParseIP(ip)
+	if nil == t1ip || isIPv4 != (nil != t1ip.To4() && !strings.Contains(ip, ":")) {
+		return nil, ErrMalformedHeader
+	}
+	t1port, err := strconv.ParseUint(port, 10, 16)
+	if nil != err {
+		return nil, ErrMalformedHeader
+	}
+	return &net.TCPAddr{IP: t1ip, Port: int(t1port)}, nil
+}
+
+// readV2 读取 v2 的头。
+// 有地址的时候传输协议只能是 STREAM，DGRAM、UNSPEC 的返回 ErrMalformedHeader；AF_UNSPEC 地址未知，不管传输协议
+func readV2(r io.Reader, sli1head []byte) (*Header, error) {
+	sli1head = sli1head[:v2HeaderLen]
+	if _, err := io.ReadFull(r, sli1head[len(v2Signature):]); nil != err {
+		return nil, err
+	}
+	verCmd, famProto := sli1head[12], sli1head[13]
+	if 0x20 != verCmd&0xF0 {
+		return nil, ErrMalformedHeader
+	}
+	sli1body := make([]byte, binary.BigEndian.Uint16(sli1head[14:16]))
+	if _, err := io.ReadFull(r, sli1body); nil != err {
+		return nil, err
+	}
+
+	p1header := &Header{Version: 2}
+	switch verCmd & 0x0F {
+	case 0x00:
+		// LOCAL 命令，地址忽略
+		p1header.Command = CommandLocal
+		return p1header, nil
+	case 0x01:
+		p1header.Command = CommandProxy
+	default:
+		return nil, ErrMalformedHeader
+	}
+
+	var addrLen int
+	switch famProto >> 4 {
+	case 0x0:
+		// AF_UNSPEC，地址未知
+		p1header.TLV = sli1body
+		return p1header, nil
+	case 0x1:
+		addrLen = 4
+	case 0x2:
+		addrLen = 16
+	case 0x3:
+		addrLen = 108
+	default:
+		return nil, ErrMalformedHeader
+	}
+	if 0x1 != famProto&0x0F {
+		// 连接是 TCP 或者 Unix domain socket 的 stream，UDP 之类的代理不支持
+		return nil, ErrMalformedHeader
+	}
+	if 0x3 == famProto>>4 {
+		// AF_UNIX，源地址和目标地址各 108 字节
+		if len(sli1body) < 2*addrLen {
+			return nil, ErrMalformedHeader
+		}
+		p1header.SourceAddr = &net.UnixAddr{Name: unixPath(sli1body[:addrLen]), Net: "unix"}
+		p1header.DestAddr = &net.UnixAddr{Name: unixPath(sli1body[addrLen : 2*addrLen]), Net: "unix"}
+		p1header.TLV = sli1body[2*addrLen:]
+		return p1header, nil
+	}
+	// AF_INET、AF_INET6，源地址、目标地址、源端口、目标端口
+	if len(sli1body) < 2*addrLen+4 {
+		return nil, ErrMalformedHeader
+	}
+	p1header.SourceAddr = &net.TCPAddr{
+		IP:   net.IP(sli1body[:addrLen]),
+		Port: int(binary.BigEndian.Uint16(sli1body[2*addrLen:])),
+	}
+	p1header.DestAddr = &net.TCPAddr{
+		IP:   net.IP(sli1body[addrLen : 2*addrLen]),
+		Port: int(binary.BigEndian.Uint16(sli1body[2*addrLen+2:])),
+	}
+	p1header.TLV = sli1body[2*addrLen+4:]
+	return p1header, nil
+}
+
+// unixPath 去掉 Unix domain socket 路径后面补的 0
+func unixPath(sli1path []byte) string {
+	if index := bytes.IndexByte(sli1path, 0); index >= 0 {
+		sli1path = sli1path[:index]
+	}
+	return string(sli1path)
+}
+
+// Conn 读过 PROXY protocol 头的连接，RemoteAddr 和 LocalAddr 返回头里的地址
+type Conn struct {
+	net.Conn
+	// p1header PROXY protocol 头
+	p1header *Header
+}
+
+// NewConn 读取 PROXY protocol 头，返回包装之后的连接。
+// timeout 是读头的超时时间，小于等于 0 时用 DefaultReadTimeout，读完之后清除 read deadline。
+func NewConn(p1netConn net.Conn, timeout time.Duration) (*Conn, error) {
+	if timeout <= 0 {
+		timeout = DefaultReadTimeout
+	}
+	p1netConn.SetReadDeadline(time.Now().Add(timeout))
+	p1header, err := ReadHeader(p1netConn)
+	if nil != err {
+		return nil, err
+	}
+	p1netConn.SetReadDeadline(time.Time{})
+	return &Conn{Conn: p1netConn, p1header: p1header}, nil
+}
+
+// Header 获取 PROXY protocol 头
+func (p1this *Conn) Header() *Header {
+	return p1this.p1header
+}
+
+// RemoteAddr 真实的客户端地址，头里没有的时候（比如负载均衡的健康检查）返回连接的地址
+func (p1this *Conn) RemoteAddr() net.Addr {
+	if nil != p1this.p1header.SourceAddr {
+		return p1this.p1header.SourceAddr
+	}
+	return p1this.Conn.RemoteAddr()
+}
+
+// LocalAddr 客户端连接的地址，头里没有的时候返回连接的地址
+func (p1this *Conn) LocalAddr() net.Addr {
+	if nil != p1this.p1header.DestAddr {
+		return p1this.p1header.DestAddr
+	}
+	return p1this.Conn.LocalAddr()
+}
+
+// PeerAddr 直接连接的对端地址（负载均衡的地址）
+func (p1this *Conn) PeerAddr() net.Addr {
+	return p1this.Conn.RemoteAddr()
+}
+
+// SyscallConn 实现 syscall.Conn，头已经读完了，没有缓存的数据，可以直接读 socket（事件循环模式）
+func (p1this *Conn) SyscallConn() (syscall.RawConn, error) {
+	t1p1syscallConn, ok := p1this.Conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("connection does not support syscall.Conn")
+	}
+	return t1p1syscallConn.SyscallConn()
+}
@@ -0,0 +1,175 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v2Header 构造 v2 的头，sli1body 是地址和 TLV
+func v2Header(verCmd byte, famProto byte, sli1body []byte) []byte {
+	sli1data := append([]byte{}, v2Signature...)
+	sli1data = append(sli1data, verCmd, famProto)
+	sli1data = binary.BigEndian.AppendUint16(sli1data, uint16(len(sli1body)))
+	return append(sli1data, sli1body...)
+}
+
+// v2Addr 构造 AF_INET、AF_INET6 的地址部分：源地址、目标地址、源端口、目标端口
+func v2Addr(sourceIP string, destIP string, sourcePort uint16, destPort uint16) []byte {
+	t1sourceIP, t1destIP := net.ParseIP(sourceIP), net.ParseIP(destIP)
+	if nil != t1sourceIP.To4() {
+		t1sourceIP, t1destIP = t1sourceIP.To4(), t1destIP.To4()
+	}
+	sli1body := append(append([]byte{}, t1sourceIP...), t1destIP...)
+	sli1body = binary.BigEndian.AppendUint16(sli1body, sourcePort)
+	return binary.BigEndian.AppendUint16(sli1body, destPort)
+}
+
+// v2UnixAddr 构造 AF_UNIX 的地址部分，路径补 0 到 108 字节
+func v2UnixAddr(sourcePath string, destPath string) []byte {
+	sli1body := make([]byte, 216)
+	copy(sli1body, sourcePath)
+	copy(sli1body[108:], destPath)
+	return sli1body
+}
+
+func TestReadHeader(t *testing.T) {
+	// UNKNOWN 后面的内容忽略，用来凑 v1 头的长度
+	v1Max := "PROXY UNKNOWN " + strings.Repeat("x", v1HeaderMax-len("PROXY UNKNOWN \r\n")) + "\r\n"
+	sli1test := []struct {
+		name    string
+		input   []byte
+		err     error
+		version uint8
+		command uint8
+		source  string
+		dest    string
+		tlv     string
+	}{
+		{name: "v1 tcp4", input: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"),
+			version: 1, command: CommandProxy, source: "192.168.0.1:56324", dest: "192.168.0.11:443"},
+		{name: "v1 tcp6", input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			version: 1, command: CommandProxy, source: "[2001:db8::1]:56324", dest: "[2001:db8::2]:443"},
+		{name: "v1 unknown", input: []byte("PROXY UNKNOWN\r\n"), version: 1, command: CommandLocal},
+		{name: "v1 unknown with addresses", input: []byte("PROXY UNKNOWN ffff:: ffff:: 1 2\r\n"), version: 1, command: CommandLocal},
+		{name: "v1 107 bytes", input: []byte(v1Max), version: 1, command: CommandLocal},
+		{name: "v1 over 107 bytes", input: []byte("PROXY UNKNOWN x" + v1Max[len("PROXY UNKNOWN "):]), err: ErrMalformedHeader},
+		{name: "v1 no crlf", input: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n"), err: io.EOF},
+		{name: "v1 tcp4 with ipv6", input: []byte("PROXY TCP4 2001:db8::1 2001:db8::2 1 2\r\n"), err: ErrMalformedHeader},
+		{name: "v1 tcp4 with mapped ipv6", input: []byte("PROXY TCP4 ::ffff:1.2.3.4 ::ffff:5.6.7.8 1 2\r\n"), err: ErrMalformedHeader},
+		{name: "v1 tcp6 with ipv4", input: []byte("PROXY TCP6 1.2.3.4 5.6.7.8 1 2\r\n"), err: ErrMalformedHeader},
+		{name: "v1 bad ip", input: []byte("PROXY TCP4 1.2.3 5.6.7.8 1 2\r\n"), err: ErrMalformedHeader},
+		{name: "v1 port too large", input: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 65536 2\r\n"), err: ErrMalformedHeader},
+		{name: "v1 negative port", input: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 -2\r\n"), err: ErrMalformedHeader},
+		{name: "v1 port not a number", input: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 http 2\r\n"), err: ErrMalformedHeader},
+		{name: "v1 missing port", input: []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n"), err: ErrMalformedHeader},
+		{name: "v1 double space", input: []byte("PROXY TCP4  1.2.3.4 5.6.7.8 1 2\r\n"), err: ErrMalformedHeader},
+		{name: "v1 udp", input: []byte("PROXY UDP4 1.2.3.4 5.6.7.8 1 2\r\n"), err: ErrMalformedHeader},
+		{name: "not proxy protocol", input: []byte("GET / HTTP/1.1\r\n\r\n"), err: ErrMalformedHeader},
+		{name: "too short", input: []byte("PROXY "), err: io.ErrUnexpectedEOF},
+
+		{name: "v2 local", input: v2Header(0x20, 0x00, nil), version: 2, command: CommandLocal},
+		{name: "v2 local ignores addresses", input: v2Header(0x20, 0x11, v2Addr("10.0.0.1", "10.0.0.2", 1, 2)),
+			version: 2, command: CommandLocal},
+		{name: "v2 inet", input: v2Header(0x21, 0x11, append(v2Addr("10.0.0.1", "10.0.0.2", 56324, 443), 0x01, 0x00, 0x01, 'x')),
+			version: 2, command: CommandProxy, source: "10.0.0.1:56324", dest: "10.0.0.2:443", tlv: "\x01\x00\x01x"},
+		{name: "v2 inet6", input: v2Header(0x21, 0x21, v2Addr("2001:db8::1", "2001:db8::2", 56324, 443)),
+			version: 2, command: CommandProxy, source: "[2001:db8::1]:56324", dest: "[2001:db8::2]:443"},
+		{name: "v2 unix", input: v2Header(0x21, 0x31, v2UnixAddr("/run/src.sock", "/run/dest.sock")),
+			version: 2, command: CommandProxy, source: "/run/src.sock", dest: "/run/dest.sock"},
+		{name: "v2 unspec", input: v2Header(0x21, 0x00, []byte("tlv")), version: 2, command: CommandProxy, tlv: "tlv"},
+		{name: "v2 dgram", input: v2Header(0x21, 0x12, v2Addr("10.0.0.1", "10.0.0.2", 1, 2)), err: ErrMalformedHeader},
+		{name: "v2 unspec transport", input: v2Header(0x21, 0x10, v2Addr("10.0.0.1", "10.0.0.2", 1, 2)), err: ErrMalformedHeader},
+		{name: "v2 unix dgram", input: v2Header(0x21, 0x32, v2UnixAddr("/a", "/b")), err: ErrMalformedHeader},
+		{name: "v2 bad family", input: v2Header(0x21, 0x41, v2Addr("10.0.0.1", "10.0.0.2", 1, 2)), err: ErrMalformedHeader},
+		{name: "v2 version 1", input: v2Header(0x11, 0x11, v2Addr("10.0.0.1", "10.0.0.2", 1, 2)), err: ErrMalformedHeader},
+		{name: "v2 version 3", input: v2Header(0x31, 0x11, v2Addr("10.0.0.1", "10.0.0.2", 1, 2)), err: ErrMalformedHeader},
+		{name: "v2 bad command", input: v2Header(0x22, 0x11, v2Addr("10.0.0.1", "10.0.0.2", 1, 2)), err: ErrMalformedHeader},
+		{name: "v2 inet addresses too short", input: v2Header(0x21, 0x11, make([]byte, 11)), err: ErrMalformedHeader},
+		{name: "v2 inet6 addresses too short", input: v2Header(0x21, 0x21, v2Addr("10.0.0.1", "10.0.0.2", 1, 2)), err: ErrMalformedHeader},
+		{name: "v2 unix addresses too short", input: v2Header(0x21, 0x31, make([]byte, 215)), err: ErrMalformedHeader},
+		{name: "v2 truncated fixed part", input: v2Header(0x21, 0x11, nil)[:14], err: io.ErrUnexpectedEOF},
+		{name: "v2 truncated body", input: v2Header(0x21, 0x11, v2Addr("10.0.0.1", "10.0.0.2", 1, 2))[:20], err: io.ErrUnexpectedEOF},
+	}
+	for _, t1test := range sli1test {
+		t.Run(t1test.name, func(t *testing.T) {
+			// 头后面的数据不能被读走
+			const rest = "GET / HTTP/1.1\r\n"
+			p1reader := bytes.NewReader(append(append([]byte{}, t1test.input...), rest...))
+			if nil != t1test.err {
+				// 出错的情况只给头的数据，没读完就结束的时候返回 io.EOF 或者 io.ErrUnexpectedEOF
+				p1reader = bytes.NewReader(t1test.input)
+			}
+			p1header, err := ReadHeader(p1reader)
+			if t1test.err != err {
+				t.Fatalf("ReadHeader() = %+v, %v, want %v", p1header, err, t1test.err)
+			}
+			if nil != err {
+				return
+			}
+			if sli1rest, _ := io.ReadAll(p1reader); rest != string(sli1rest) {
+				t.Fatalf("data after the header = %q, want %q", sli1rest, rest)
+			}
+			if t1test.version != p1header.Version || t1test.command != p1header.Command || t1test.tlv != string(p1header.TLV) {
+				t.Fatalf("ReadHeader() = %+v", p1header)
+			}
+			if source := addrString(p1header.SourceAddr); t1test.source != source {
+				t.Fatalf("SourceAddr = %q, want %q", source, t1test.source)
+			}
+			if dest := addrString(p1header.DestAddr); t1test.dest != dest {
+				t.Fatalf("DestAddr = %q, want %q", dest, t1test.dest)
+			}
+		})
+	}
+}
+
+// addrString 地址为 nil 的时候返回空字符串
+func addrString(p1addr net.Addr) string {
+	if nil == p1addr {
+		return ""
+	}
+	return p1addr.String()
+}
+
+// TestNewConn RemoteAddr、LocalAddr 用头里的地址，头后面的数据从连接中读出来，读头超时返回错误
+func TestNewConn(t *testing.T) {
+	p1serverConn, p1clientConn := net.Pipe()
+	defer p1serverConn.Close()
+	defer p1clientConn.Close()
+	go p1clientConn.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nhello"))
+
+	p1conn, err := NewConn(p1serverConn, time.Second)
+	if nil != err {
+		t.Fatal("NewConn:", err)
+	}
+	if "192.168.0.1:56324" != p1conn.RemoteAddr().String() || "192.168.0.11:443" != p1conn.LocalAddr().String() {
+		t.Fatalf("RemoteAddr() = %v, LocalAddr() = %v", p1conn.RemoteAddr(), p1conn.LocalAddr())
+	}
+	if p1serverConn.RemoteAddr() != p1conn.PeerAddr() {
+		t.Fatalf("PeerAddr() = %v", p1conn.PeerAddr())
+	}
+	sli1data := make([]byte, 5)
+	if _, err = io.ReadFull(p1conn, sli1data); nil != err || "hello" != string(sli1data) {
+		t.Fatalf("read after the header = %q, %v", sli1data, err)
+	}
+
+	// LOCAL 命令没有地址，用连接的地址
+	p1serverConn2, p1clientConn2 := net.Pipe()
+	defer p1serverConn2.Close()
+	defer p1clientConn2.Close()
+	go p1clientConn2.Write(v2Header(0x20, 0x00, nil))
+	if p1conn, err = NewConn(p1serverConn2, time.Second); nil != err || p1serverConn2.RemoteAddr() != p1conn.RemoteAddr() {
+		t.Fatalf("NewConn(LOCAL) = %v, %v", p1conn, err)
+	}
+
+	p1serverConn3, p1clientConn3 := net.Pipe()
+	defer p1serverConn3.Close()
+	defer p1clientConn3.Close()
+	if _, err = NewConn(p1serverConn3, 50*time.Millisecond); nil == err {
+		t.Fatal("NewConn() without a header should time out")
+	}
+}
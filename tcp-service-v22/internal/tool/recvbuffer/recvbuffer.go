@@ -0,0 +1,160 @@
+package recvbuffer
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	// InitSize 缓冲区初始大小，空闲的连接只占这么多内存
+	InitSize int = 4 * 1024
+	// PoolSizeMax 缓冲区不超过这么大的时候，用完放回 sync.Pool 复用，更大的直接丢掉
+	PoolSizeMax int = 1024 * 1024
+	// poolNum sync.Pool 分多少级，InitSize<<(poolNum-1) == PoolSizeMax
+	poolNum int = 9
+)
+
+var (
+	// ErrMsgTooLarge 缓冲区已经扩容到最大，还是放不下 1 条完整的报文
+	ErrMsgTooLarge = errors.New("message too large.")
+)
+
+// arr1pool 按容量分级的 sync.Pool，第 i 个放容量为 InitSize<<i 的缓冲区
+var arr1pool [poolNum]sync.Pool
+
+// getBuffer 获取容量至少为 size 的缓冲区
+func getBuffer(size int) []byte {
+	index, capacity := 0, InitSize
+	for capacity < size {
+		index++
+		capacity <<= 1
+	}
+	if index < poolNum {
+		if t1p1buffer, ok := arr1pool[index].Get().(*[]byte); ok {
+			return *t1p1buffer
+		}
+	}
+	return make([]byte, capacity)
+}
+
+// putBuffer 缓冲区放回 sync.Pool，容量不是 InitSize 的 2 的幂次倍的不要
+func putBuffer(sli1buffer []byte) {
+	index, ok := poolIndex(cap(sli1buffer))
+	if !ok {
+		return
+	}
+	sli1buffer = sli1buffer[:cap(sli1buffer)]
+	arr1pool[index].Put(&sli1buffer)
+}
+
+// poolIndex 容量为 capacity 的缓冲区放在第几个 sync.Pool，
+// 不是 InitSize 的 2 的幂次倍或者超过 PoolSizeMax 的，返回 false
+func poolIndex(capacity int) (int, bool) {
+	index, t1capacity := 0, InitSize
+	for t1capacity < capacity && index < poolNum {
+		index++
+		t1capacity <<= 1
+	}
+	return index, index < poolNum && t1capacity == capacity
+}
+
+// RecvBuffer 接收缓冲区，不是并发安全的，只在 TCP 连接读数据的 goroutine 中使用。
+// 从 InitSize 开始，放不下的时候先把数据移到头部，还放不下再扩容，最大到 maxSize。
+// 数据处理完之后，扩容过的缓冲区会还回去，换回小的。
+type RecvBuffer struct {
+	// sli1buffer 缓冲区，为 nil 的时候表示还没有获取或者已经释放了
+	sli1buffer []byte
+	// start 未处理的数据从哪里开始
+	start int
+	// end 未处理的数据到哪里结束
+	end int
+	// maxSize 缓冲区最大多少字节
+	maxSize int
+}
+
+// NewRecvBuffer 创建 RecvBuffer，真正的缓冲区在第一次读数据的时候才获取
+func NewRecvBuffer(maxSize int) *RecvBuffer {
+	if maxSize < InitSize {
+		maxSize = InitSize
+	}
+	return &RecvBuffer{
+		maxSize: maxSize,
+	}
+}
+
+// ReadOnce 从 r 读一次数据追加到未处理的数据后面。
+// 缓冲区满了而且已经是最大的时候，返回 ErrMsgTooLarge。
+func (p1this *RecvBuffer) ReadOnce(r io.Reader) (int, error) {
+	if err := p1this.makeRoom(); nil != err {
+		return 0, err
+	}
+	byteNum, err := r.Read(p1this.sli1buffer[p1this.end:])
+	p1this.end += byteNum
+	return byteNum, err
+}
+
+// Bytes 未处理的数据，下一次 ReadOnce 或者 Discard 之前有效
+func (p1this *RecvBuffer) Bytes() []byte {
+	return p1this.sli1buffer[p1this.start:p1this.end]
+}
+
+// Len 未处理的数据有多少字节
+func (p1this *RecvBuffer) Len() int {
+	return p1this.end - p1this.start
+}
+
+// Size 缓冲区当前大小
+func (p1this *RecvBuffer) Size() int {
+	return len(p1this.sli1buffer)
+}
+
+// Discard 丢弃前 n 个字节的数据（已经处理完的报文）
+func (p1this *RecvBuffer) Discard(n int) {
+	if n >= p1this.Len() {
+		p1this.start, p1this.end = 0, 0
+		if len(p1this.sli1buffer) > InitSize {
+			// 大报文处理完了，换回小的缓冲区
+			p1this.Release()
+		}
+		return
+	}
+	p1this.start += n
+}
+
+// Release 缓冲区还回去，连接关闭的时候调用
+func (p1this *RecvBuffer) Release() {
+	if nil != p1this.sli1buffer {
+		putBuffer(p1this.sli1buffer)
+	}
+	p1this.sli1buffer = nil
+	p1this.start, p1this.end = 0, 0
+}
+
+// makeRoom 保证缓冲区尾部有空位
+func (p1this *RecvBuffer) makeRoom() error {
+	if nil == p1this.sli1buffer {
+		p1this.sli1buffer = getBuffer(InitSize)
+	}
+	if p1this.end < len(p1this.sli1buffer) {
+		return nil
+	}
+	if p1this.start > 0 {
+		// 把未处理的数据移到头部
+		p1this.end = copy(p1this.sli1buffer, p1this.sli1buffer[p1this.start:p1this.end])
+		p1this.start = 0
+		return nil
+	}
+	if len(p1this.sli1buffer) >= p1this.maxSize {
+		return ErrMsgTooLarge
+	}
+	newSize := len(p1this.sli1buffer) * 2
+	if newSize > p1this.maxSize {
+		newSize = p1this.maxSize
+	}
+	sli1new := getBuffer(newSize)[:newSize]
+	copy(sli1new, p1this.sli1buffer[:p1this.end])
+	putBuffer(p1this.sli1buffer)
+	p1this.sli1buffer = sli1new
+	return nil
+}
@@ -0,0 +1,139 @@
+package recvbuffer
+
+import (
+	"bytes"
+	"testing"
+)
+
+// fill 读数据直到缓冲区满了，返回读到的数据
+func fill(t *testing.T, p1buffer *RecvBuffer, b byte) []byte {
+	t.Helper()
+	sli1data := bytes.Repeat([]byte{b}, p1buffer.Size()-p1buffer.end)
+	byteNum, err := p1buffer.ReadOnce(bytes.NewReader(sli1data))
+	if nil != err || byteNum != len(sli1data) {
+		t.Fatalf("ReadOnce() = %d, %v, want %d", byteNum, err, len(sli1data))
+	}
+	return sli1data
+}
+
+func TestPoolIndex(t *testing.T) {
+	sli1test := []struct {
+		capacity int
+		index    int
+		ok       bool
+	}{
+		{InitSize, 0, true},
+		{InitSize * 2, 1, true},
+		{InitSize * 8, 3, true},
+		{PoolSizeMax, poolNum - 1, true},
+		{0, 0, false},
+		{InitSize - 1, 0, false},
+		{InitSize + 1, 1, false},
+		{InitSize * 3, 2, false},
+		{PoolSizeMax * 2, poolNum, false},
+	}
+	for _, t1test := range sli1test {
+		index, ok := poolIndex(t1test.capacity)
+		if ok != t1test.ok || (ok && index != t1test.index) {
+			t.Errorf("poolIndex(%d) = %d, %v, want %d, %v", t1test.capacity, index, ok, t1test.index, t1test.ok)
+		}
+	}
+}
+
+// TestPutBufferRejectsOddCapacity 容量不是 InitSize 的 2 的幂次倍的缓冲区不能放回去，不然 getBuffer 会拿到比要求的小的缓冲区
+func TestPutBufferRejectsOddCapacity(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		putBuffer(make([]byte, InitSize*3))
+		putBuffer(make([]byte, InitSize+1))
+		putBuffer(make([]byte, PoolSizeMax*2))
+	}
+	for i := 0; i < 100; i++ {
+		for _, size := range []int{InitSize, InitSize * 2, InitSize * 4, PoolSizeMax} {
+			if sli1buffer := getBuffer(size); cap(sli1buffer) != size || len(sli1buffer) != size {
+				t.Fatalf("getBuffer(%d) returned len %d cap %d", size, len(sli1buffer), cap(sli1buffer))
+			}
+		}
+	}
+}
+
+// TestMakeRoomCompact 缓冲区满了，前面有处理完的数据的时候，未处理的数据移到头部，不扩容
+func TestMakeRoomCompact(t *testing.T) {
+	p1buffer := NewRecvBuffer(InitSize * 4)
+	if err := p1buffer.makeRoom(); nil != err {
+		t.Fatal(err)
+	}
+	sli1data := fill(t, p1buffer, 'a')
+	p1buffer.Discard(100)
+
+	if err := p1buffer.makeRoom(); nil != err {
+		t.Fatal(err)
+	}
+	if InitSize != p1buffer.Size() {
+		t.Fatalf("Size() = %d, want %d", p1buffer.Size(), InitSize)
+	}
+	if 0 != p1buffer.start || !bytes.Equal(sli1data[100:], p1buffer.Bytes()) {
+		t.Fatalf("start = %d, data not moved to head", p1buffer.start)
+	}
+}
+
+// TestMakeRoomGrow 缓冲区满了，都是未处理的数据的时候扩容一倍，不超过 maxSize，到了 maxSize 返回 ErrMsgTooLarge
+func TestMakeRoomGrow(t *testing.T) {
+	// maxSize 不是 InitSize 的 2 的幂次倍，最后一次扩容到 maxSize
+	maxSize := InitSize * 3
+	p1buffer := NewRecvBuffer(maxSize)
+	var sli1all []byte
+	for _, size := range []int{InitSize, InitSize * 2, maxSize} {
+		if err := p1buffer.makeRoom(); nil != err {
+			t.Fatalf("makeRoom() at size %d: %v", p1buffer.Size(), err)
+		}
+		if size != p1buffer.Size() {
+			t.Fatalf("Size() = %d, want %d", p1buffer.Size(), size)
+		}
+		sli1all = append(sli1all, fill(t, p1buffer, byte('a'+len(sli1all)%26))...)
+		if !bytes.Equal(sli1all, p1buffer.Bytes()) {
+			t.Fatalf("data lost when growing to %d", size)
+		}
+	}
+	if err := p1buffer.makeRoom(); ErrMsgTooLarge != err {
+		t.Fatalf("makeRoom() = %v, want ErrMsgTooLarge", err)
+	}
+	if _, err := p1buffer.ReadOnce(bytes.NewReader([]byte("x"))); ErrMsgTooLarge != err {
+		t.Fatalf("ReadOnce() = %v, want ErrMsgTooLarge", err)
+	}
+}
+
+// TestDiscardRelease 数据都处理完了，扩容过的缓冲区还回去，InitSize 大小的留着下次用
+func TestDiscardRelease(t *testing.T) {
+	p1buffer := NewRecvBuffer(InitSize * 4)
+	if _, err := p1buffer.ReadOnce(bytes.NewReader([]byte("hello"))); nil != err {
+		t.Fatal(err)
+	}
+	p1buffer.Discard(2)
+	if "llo" != string(p1buffer.Bytes()) {
+		t.Fatalf("Bytes() = %q, want %q", p1buffer.Bytes(), "llo")
+	}
+	p1buffer.Discard(3)
+	if 0 != p1buffer.Len() || InitSize != p1buffer.Size() {
+		t.Fatalf("Len() = %d, Size() = %d, want 0, %d", p1buffer.Len(), p1buffer.Size(), InitSize)
+	}
+
+	fill(t, p1buffer, 'a')
+	if err := p1buffer.makeRoom(); nil != err {
+		t.Fatal(err)
+	}
+	if InitSize*2 != p1buffer.Size() {
+		t.Fatalf("Size() = %d, want %d", p1buffer.Size(), InitSize*2)
+	}
+	p1buffer.Discard(p1buffer.Len())
+	if 0 != p1buffer.Size() || nil != p1buffer.sli1buffer {
+		t.Fatalf("Size() = %d after discarding all data of a grown buffer, want 0", p1buffer.Size())
+	}
+	// 释放之后还能继续用
+	if _, err := p1buffer.ReadOnce(bytes.NewReader([]byte("again"))); nil != err || "again" != string(p1buffer.Bytes()) {
+		t.Fatalf("ReadOnce() after Release = %v, %q", err, p1buffer.Bytes())
+	}
+	p1buffer.Release()
+	if 0 != p1buffer.Len() || 0 != p1buffer.Size() {
+		t.Fatalf("Len() = %d, Size() = %d after Release", p1buffer.Len(), p1buffer.Size())
+	}
+}
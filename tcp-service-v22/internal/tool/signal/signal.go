@@ -4,15 +4,34 @@ import (
   "log"
   "os"
   "os/signal"
+  "syscall"
 )
 
-// WaitForShutdown 等待退出
-func WaitForShutdown() {
+// WaitForShutdown 等待退出，返回收到的信号
+func WaitForShutdown() os.Signal {
   // 等待系统信号
   chansignal := make(chan os.Signal, 1)
-  // os.Interrupt == SIGINT（ctrl+c）
-  signal.Notify(chansignal, os.Interrupt)
-  // 如果没有收到 SIGINT 信号，就会阻塞在这里
-  <-chansignal
-  log.Println("get SIGINT signal, shutdown immediately...")
+  // os.Interrupt == SIGINT（ctrl+c），SIGTERM（kill 默认发送的信号）
+  signal.Notify(chansignal, os.Interrupt, syscall.SIGTERM)
+  defer signal.Stop(chansignal)
+  // 如果没有收到 SIGINT 或者 SIGTERM 信号，就会阻塞在这里
+  sig := <-chansignal
+  log.Println("get", sig, "signal, shutdown gracefully...")
+  return sig
+}
+
+// WaitForShutdownOrRestart 等待退出或者热重启，返回收到的信号，收到 SIGHUP 或者 SIGUSR2 时 isRestart 为 true
+func WaitForShutdownOrRestart() (sig os.Signal, isRestart bool) {
+  chansignal := make(chan os.Signal, 1)
+  signal.Notify(chansignal, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, sli1restartSignal...)...)
+  defer signal.Stop(chansignal)
+  sig = <-chansignal
+  for _, restartSignal := range sli1restartSignal {
+    if sig == restartSignal {
+      log.Println("get", sig, "signal, restart...")
+      return sig, true
+    }
+  }
+  log.Println("get", sig, "signal, shutdown gracefully...")
+  return sig, false
 }
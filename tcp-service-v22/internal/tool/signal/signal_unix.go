@@ -0,0 +1,11 @@
+//go:build !windows
+
+package signal
+
+import (
+  "os"
+  "syscall"
+)
+
+// sli1restartSignal 热重启的信号
+var sli1restartSignal = []os.Signal{syscall.SIGHUP, syscall.SIGUSR2}
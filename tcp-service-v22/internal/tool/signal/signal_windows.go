@@ -0,0 +1,8 @@
+package signal
+
+import (
+  "os"
+)
+
+// sli1restartSignal Windows 不支持热重启
+var sli1restartSignal = []os.Signal{}
@@ -0,0 +1,135 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// NewServerConfig 创建服务端用的 tls.Config，证书和私钥都是 PEM 格式的文件
+func NewServerConfig(certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if nil != err {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// NewClientConfig 创建客户端用的 tls.Config。
+// caFile 为空时用系统的根证书校验服务端；certFile 和 keyFile 不为空时，带上客户端证书（双向认证）；
+// serverName 用于校验服务端证书和 SNI，为空时 TCPClient 会用连接的地址。
+func NewClientConfig(caFile string, certFile string, keyFile string, serverName string) (*tls.Config, error) {
+	p1config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if "" != caFile {
+		p1pool, err := LoadCertPool(caFile)
+		if nil != err {
+			return nil, err
+		}
+		p1config.RootCAs = p1pool
+	}
+	if "" != certFile || "" != keyFile {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if nil != err {
+			return nil, err
+		}
+		p1config.Certificates = []tls.Certificate{cert}
+	}
+	return p1config, nil
+}
+
+// LoadCertPool 从 PEM 格式的文件中加载 CA 证书，可以有多个文件，一个文件里也可以有多个证书
+func LoadCertPool(sli1caFile ...string) (*x509.CertPool, error) {
+	p1pool := x509.NewCertPool()
+	for _, caFile := range sli1caFile {
+		sli1pem, err := os.ReadFile(caFile)
+		if nil != err {
+			return nil, err
+		}
+		if !p1pool.AppendCertsFromPEM(sli1pem) {
+			return nil, errors.New("no certificate found in: " + caFile)
+		}
+	}
+	return p1pool, nil
+}
+
+// RequireClientCert 服务端开启双向认证，客户端必须带上 p1clientCAs 签发的证书
+func RequireClientCert(p1config *tls.Config, p1clientCAs *x509.CertPool) {
+	p1config.ClientAuth = tls.RequireAndVerifyClientCert
+	p1config.ClientCAs = p1clientCAs
+}
+
+// CertSelector 按 SNI 选择服务端证书，并发安全，运行中可以替换证书。
+// 用法：p1config.GetCertificate = p1selector.GetCertificate
+type CertSelector struct {
+	// rwMutex 保护 mapCert 和 p1default
+	rwMutex sync.RWMutex
+	// mapCert 域名和证书的关系，域名都是小写的，泛域名用 "*.example.com" 的形式
+	mapCert map[string]*tls.Certificate
+	// p1default 找不到对应域名（或者客户端没有发送 SNI）时用的证书
+	p1default *tls.Certificate
+}
+
+// NewCertSelector 创建 CertSelector
+func NewCertSelector() *CertSelector {
+	return &CertSelector{
+		mapCert: make(map[string]*tls.Certificate),
+	}
+}
+
+// Add 添加域名对应的证书，证书和私钥都是 PEM 格式的文件，同一个证书可以对应多个域名
+func (p1this *CertSelector) Add(certFile string, keyFile string, sli1serverName ...string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if nil != err {
+		return err
+	}
+	p1this.AddCert(&cert, sli1serverName...)
+	return nil
+}
+
+// AddCert 添加域名对应的证书
+func (p1this *CertSelector) AddCert(p1cert *tls.Certificate, sli1serverName ...string) {
+	p1this.rwMutex.Lock()
+	defer p1this.rwMutex.Unlock()
+	for _, serverName := range sli1serverName {
+		p1this.mapCert[strings.ToLower(serverName)] = p1cert
+	}
+}
+
+// SetDefault 设置默认证书
+func (p1this *CertSelector) SetDefault(p1cert *tls.Certificate) {
+	p1this.rwMutex.Lock()
+	defer p1this.rwMutex.Unlock()
+	p1this.p1default = p1cert
+}
+
+// GetCertificate 实现 tls.Config.GetCertificate。
+// 先找完全一样的域名，再找泛域名，都找不到时用默认证书。
+func (p1this *CertSelector) GetCertificate(p1hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p1this.rwMutex.RLock()
+	defer p1this.rwMutex.RUnlock()
+
+	serverName := strings.TrimSuffix(strings.ToLower(p1hello.ServerName), ".")
+	if "" != serverName {
+		if p1cert, ok := p1this.mapCert[serverName]; ok {
+			return p1cert, nil
+		}
+		if index := strings.IndexByte(serverName, '.'); index > 0 {
+			if p1cert, ok := p1this.mapCert["*"+serverName[index:]]; ok {
+				return p1cert, nil
+			}
+		}
+	}
+	if nil != p1this.p1default {
+		return p1this.p1default, nil
+	}
+	return nil, errors.New("no certificate for server name: " + serverName)
+}
@@ -0,0 +1,259 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert 测试用的证书，证书和私钥都写到了 PEM 格式的文件里
+type testCert struct {
+	certFile string
+	keyFile  string
+	p1cert   *x509.Certificate
+	p1key    *ecdsa.PrivateKey
+}
+
+// newTestCert 生成证书，p1parent 为 nil 的时候是自签名的 CA 证书，否则用 p1parent 签发
+func newTestCert(t *testing.T, name string, p1parent *testCert, sli1dnsName ...string) *testCert {
+	t.Helper()
+	p1key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	p1template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     sli1dnsName,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	p1signCert, p1signKey := p1template, p1key
+	if nil == p1parent {
+		p1template.IsCA = true
+		p1template.BasicConstraintsValid = true
+	} else {
+		p1signCert, p1signKey = p1parent.p1cert, p1parent.p1key
+	}
+	sli1der, err := x509.CreateCertificate(rand.Reader, p1template, p1signCert, &p1key.PublicKey, p1signKey)
+	if nil != err {
+		t.Fatal(err)
+	}
+	p1cert, err := x509.ParseCertificate(sli1der)
+	if nil != err {
+		t.Fatal(err)
+	}
+	sli1keyDer, err := x509.MarshalECPrivateKey(p1key)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	p1testCert := &testCert{
+		certFile: filepath.Join(dir, name+".pem"),
+		keyFile:  filepath.Join(dir, name+".key"),
+		p1cert:   p1cert,
+		p1key:    p1key,
+	}
+	writePEM(t, p1testCert.certFile, "CERTIFICATE", sli1der)
+	writePEM(t, p1testCert.keyFile, "EC PRIVATE KEY", sli1keyDer)
+	return p1testCert
+}
+
+func writePEM(t *testing.T, file string, blockType string, sli1der []byte) {
+	t.Helper()
+	sli1pem := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: sli1der})
+	if err := os.WriteFile(file, sli1pem, 0600); nil != err {
+		t.Fatal(err)
+	}
+}
+
+// handshake 在本机的随机端口上握手，返回服务端和客户端的错误
+func handshake(t *testing.T, p1serverConfig *tls.Config, p1clientConfig *tls.Config) (errServer error, errClient error) {
+	t.Helper()
+	p1listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer p1listener.Close()
+
+	chanErr := make(chan error, 1)
+	go func() {
+		p1conn, err := p1listener.Accept()
+		if nil != err {
+			chanErr <- err
+			return
+		}
+		defer p1conn.Close()
+		p1conn.SetDeadline(time.Now().Add(5 * time.Second))
+		chanErr <- tls.Server(p1conn, p1serverConfig).Handshake()
+	}()
+
+	p1conn, err := net.Dial("tcp4", p1listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer p1conn.Close()
+	p1conn.SetDeadline(time.Now().Add(5 * time.Second))
+	errClient = tls.Client(p1conn, p1clientConfig).Handshake()
+	if nil != errClient {
+		// 客户端先失败了，让服务端的握手也结束
+		p1conn.Close()
+	}
+	errServer = <-chanErr
+	return errServer, errClient
+}
+
+func TestHandshake(t *testing.T) {
+	p1ca := newTestCert(t, "ca", nil)
+	p1server := newTestCert(t, "server", p1ca, "localhost")
+	p1client := newTestCert(t, "client", p1ca)
+	// 另一个 CA 签发的客户端证书，服务端不认
+	p1otherCA := newTestCert(t, "other-ca", nil)
+	p1otherClient := newTestCert(t, "other-client", p1otherCA)
+
+	p1serverConfig, err := NewServerConfig(p1server.certFile, p1server.keyFile)
+	if nil != err {
+		t.Fatal(err)
+	}
+	p1clientConfig, err := NewClientConfig(p1ca.certFile, "", "", "localhost")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if errServer, errClient := handshake(t, p1serverConfig, p1clientConfig); nil != errServer || nil != errClient {
+		t.Fatalf("handshake: server %v, client %v", errServer, errClient)
+	}
+
+	// 服务端证书的域名不对，客户端校验失败
+	p1wrongNameConfig, err := NewClientConfig(p1ca.certFile, "", "", "example.com")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, errClient := handshake(t, p1serverConfig, p1wrongNameConfig); nil == errClient {
+		t.Fatal("handshake with wrong server name should fail")
+	}
+
+	// 不信任的 CA
+	p1untrustedConfig, err := NewClientConfig(p1otherCA.certFile, "", "", "localhost")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, errClient := handshake(t, p1serverConfig, p1untrustedConfig); nil == errClient {
+		t.Fatal("handshake with untrusted CA should fail")
+	}
+
+	// 双向认证
+	p1clientCAs, err := LoadCertPool(p1ca.certFile)
+	if nil != err {
+		t.Fatal(err)
+	}
+	RequireClientCert(p1serverConfig, p1clientCAs)
+	if errServer, _ := handshake(t, p1serverConfig, p1clientConfig); nil == errServer {
+		t.Fatal("handshake without client certificate should fail")
+	}
+	p1mutualConfig, err := NewClientConfig(p1ca.certFile, p1client.certFile, p1client.keyFile, "localhost")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if errServer, errClient := handshake(t, p1serverConfig, p1mutualConfig); nil != errServer || nil != errClient {
+		t.Fatalf("mutual handshake: server %v, client %v", errServer, errClient)
+	}
+	p1otherConfig, err := NewClientConfig(p1ca.certFile, p1otherClient.certFile, p1otherClient.keyFile, "localhost")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if errServer, _ := handshake(t, p1serverConfig, p1otherConfig); nil == errServer {
+		t.Fatal("handshake with client certificate of another CA should fail")
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	p1ca := newTestCert(t, "ca", nil)
+	p1server := newTestCert(t, "server", p1ca, "localhost")
+	p1other := newTestCert(t, "other", p1ca, "localhost")
+	missingFile := filepath.Join(t.TempDir(), "missing.pem")
+	notPEMFile := filepath.Join(t.TempDir(), "not.pem")
+	if err := os.WriteFile(notPEMFile, []byte("not a certificate"), 0600); nil != err {
+		t.Fatal(err)
+	}
+
+	sli1test := []struct {
+		name string
+		f    func() error
+	}{
+		{"server missing cert", func() error { _, err := NewServerConfig(missingFile, p1server.keyFile); return err }},
+		{"server missing key", func() error { _, err := NewServerConfig(p1server.certFile, missingFile); return err }},
+		{"server key mismatch", func() error { _, err := NewServerConfig(p1server.certFile, p1other.keyFile); return err }},
+		{"server not pem", func() error { _, err := NewServerConfig(notPEMFile, notPEMFile); return err }},
+		{"client missing ca", func() error { _, err := NewClientConfig(missingFile, "", "", ""); return err }},
+		{"client ca not pem", func() error { _, err := NewClientConfig(notPEMFile, "", "", ""); return err }},
+		{"client key without cert", func() error { _, err := NewClientConfig("", "", p1server.keyFile, ""); return err }},
+		{"client key mismatch", func() error {
+			_, err := NewClientConfig(p1ca.certFile, p1server.certFile, p1other.keyFile, "")
+			return err
+		}},
+		{"cert pool missing", func() error { _, err := LoadCertPool(p1ca.certFile, missingFile); return err }},
+		{"cert pool not pem", func() error { _, err := LoadCertPool(notPEMFile); return err }},
+		{"selector missing cert", func() error { return NewCertSelector().Add(missingFile, p1server.keyFile, "localhost") }},
+	}
+	for _, t1test := range sli1test {
+		if err := t1test.f(); nil == err {
+			t.Errorf("%s: expected an error", t1test.name)
+		}
+	}
+}
+
+func TestCertSelector(t *testing.T) {
+	p1ca := newTestCert(t, "ca", nil)
+	p1selector := NewCertSelector()
+	if _, err := p1selector.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"}); nil == err {
+		t.Fatal("GetCertificate without any certificate should fail")
+	}
+
+	p1exact := newTestCert(t, "exact", p1ca, "a.example.com")
+	if err := p1selector.Add(p1exact.certFile, p1exact.keyFile, "A.Example.com"); nil != err {
+		t.Fatal(err)
+	}
+	p1wildcard := &tls.Certificate{}
+	p1default := &tls.Certificate{}
+	p1selector.AddCert(p1wildcard, "*.example.com")
+	p1selector.SetDefault(p1default)
+
+	sli1test := []struct {
+		serverName string
+		p1want     *tls.Certificate
+	}{
+		{"b.example.com", p1wildcard},
+		{"B.EXAMPLE.COM.", p1wildcard},
+		{"example.com", p1default},
+		{"x.b.example.com", p1default},
+		{"", p1default},
+	}
+	for _, t1test := range sli1test {
+		p1cert, err := p1selector.GetCertificate(&tls.ClientHelloInfo{ServerName: t1test.serverName})
+		if nil != err || p1cert != t1test.p1want {
+			t.Errorf("GetCertificate(%q) = %p, %v, want %p", t1test.serverName, p1cert, err, t1test.p1want)
+		}
+	}
+	for _, serverName := range []string{"a.example.com", "A.EXAMPLE.COM."} {
+		p1cert, err := p1selector.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if nil != err || 0 == len(p1cert.Certificate) {
+			t.Fatalf("GetCertificate(%q) = %v, %v", serverName, p1cert, err)
+		}
+		if p1leaf, err := x509.ParseCertificate(p1cert.Certificate[0]); nil != err || "exact" != p1leaf.Subject.CommonName {
+			t.Errorf("GetCertificate(%q) returned the wrong certificate", serverName)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package workerpool
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultQueueSize 每个 worker 的任务队列默认能放多少个任务
+	DefaultQueueSize int = 256
+)
+
+var (
+	// ErrPoolFull 任务队列满了，任务被拒绝
+	ErrPoolFull = errors.New("worker pool is full.")
+	// ErrPoolStopped worker pool 已经停止
+	ErrPoolStopped = errors.New("worker pool is stopped.")
+)
+
+// Stats worker pool 的运行指标
+type Stats struct {
+	// WorkerNum worker 的数量
+	WorkerNum int
+	// BusyNum 正在执行任务的 worker 数量
+	BusyNum int
+	// QueueLen 排队中的任务数量
+	QueueLen int
+	// QueueCap 任务队列总共能放多少个任务
+	QueueCap int
+	// SubmittedNum 提交成功的任务数量
+	SubmittedNum uint64
+	// RejectedNum 被拒绝的任务数量
+	RejectedNum uint64
+	// CompletedNum 执行完的任务数量
+	CompletedNum uint64
+}
+
+// WorkerPool 固定数量的 worker，执行提交的任务。
+// 有序模式下，key 相同的任务交给同一个 worker，按提交的顺序执行；无序模式下，任务交给任意一个空闲的 worker。
+type WorkerPool struct {
+	// isOrdered 是否是有序模式
+	isOrdered bool
+	// sli1chanTask 有序模式下每个 worker 一个任务队列，无序模式下只有 1 个，所有 worker 共用
+	sli1chanTask []chan func()
+	// workerNum worker 的数量
+	workerNum int
+	// queueSize 每个任务队列能放多少个任务
+	queueSize int
+
+	// rwMutex 保护 isStopped，保证停止之后不会再往任务队列里放任务
+	rwMutex sync.RWMutex
+	// isStopped 是否已经停止
+	isStopped bool
+	// wgWorker 正在运行的 worker
+	wgWorker sync.WaitGroup
+
+	// busyNum 正在执行任务的 worker 数量，用 atomic 读写
+	busyNum int64
+	// submittedNum 提交成功的任务数量，用 atomic 读写
+	submittedNum uint64
+	// rejectedNum 被拒绝的任务数量，用 atomic 读写
+	rejectedNum uint64
+	// completedNum 执行完的任务数量，用 atomic 读写
+	completedNum uint64
+}
+
+// NewWorkerPool 创建 WorkerPool，并且启动 worker
+func NewWorkerPool(workerNum int, queueSize int, isOrdered bool) *WorkerPool {
+	if workerNum <= 0 {
+		workerNum = 1
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	p1pool := &WorkerPool{
+		isOrdered: isOrdered,
+		workerNum: workerNum,
+		queueSize: queueSize,
+	}
+
+	chanNum := 1
+	if isOrdered {
+		chanNum = workerNum
+	}
+	p1pool.sli1chanTask = make([]chan func(), chanNum)
+	for i := range p1pool.sli1chanTask {
+		p1pool.sli1chanTask[i] = make(chan func(), queueSize)
+	}
+
+	p1pool.wgWorker.Add(workerNum)
+	for i := 0; i < workerNum; i++ {
+		go p1pool.run(p1pool.sli1chanTask[i%chanNum])
+	}
+	return p1pool
+}
+
+// IsOrdered 是否是有序模式
+func (p1this *WorkerPool) IsOrdered() bool {
+	return p1this.isOrdered
+}
+
+// Submit 提交任务，不会阻塞，任务队列满了返回 ErrPoolFull。
+// 有序模式下，key 相同的任务按提交的顺序执行，无序模式下 key 不用。
+func (p1this *WorkerPool) Submit(key uint64, task func()) error {
+	p1this.rwMutex.RLock()
+	defer p1this.rwMutex.RUnlock()
+	if p1this.isStopped {
+		return ErrPoolStopped
+	}
+
+	chanTask := p1this.sli1chanTask[key%uint64(len(p1this.sli1chanTask))]
+	select {
+	case chanTask <- task:
+		atomic.AddUint64(&p1this.submittedNum, 1)
+		return nil
+	default:
+		atomic.AddUint64(&p1this.rejectedNum, 1)
+		return ErrPoolFull
+	}
+}
+
+// Stop 停止接收新任务，等排队中的任务执行完之后返回
+func (p1this *WorkerPool) Stop() {
+	p1this.rwMutex.Lock()
+	if !p1this.isStopped {
+		p1this.isStopped = true
+		for _, chanTask := range p1this.sli1chanTask {
+			close(chanTask)
+		}
+	}
+	p1this.rwMutex.Unlock()
+	p1this.wgWorker.Wait()
+}
+
+// GetStats 获取运行指标
+func (p1this *WorkerPool) GetStats() Stats {
+	queueLen := 0
+	for _, chanTask := range p1this.sli1chanTask {
+		queueLen += len(chanTask)
+	}
+	return Stats{
+		WorkerNum:    p1this.workerNum,
+		BusyNum:      int(atomic.LoadInt64(&p1this.busyNum)),
+		QueueLen:     queueLen,
+		QueueCap:     len(p1this.sli1chanTask) * p1this.queueSize,
+		SubmittedNum: atomic.LoadUint64(&p1this.submittedNum),
+		RejectedNum:  atomic.LoadUint64(&p1this.rejectedNum),
+		CompletedNum: atomic.LoadUint64(&p1this.completedNum),
+	}
+}
+
+// run worker，任务队列关闭并且取完之后退出
+func (p1this *WorkerPool) run(chanTask chan func()) {
+	defer p1this.wgWorker.Done()
+	for task := range chanTask {
+		atomic.AddInt64(&p1this.busyNum, 1)
+		task()
+		atomic.AddInt64(&p1this.busyNum, -1)
+		atomic.AddUint64(&p1this.completedNum, 1)
+	}
+}
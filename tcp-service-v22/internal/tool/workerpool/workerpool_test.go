@@ -0,0 +1,127 @@
+package workerpool
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestOrdered 有序模式下 key 相同的任务按提交的顺序执行，任务自己慢一点也不会被后面的超过
+func TestOrdered(t *testing.T) {
+	const keyNum = 5
+	const taskNum = 200
+	p1pool := NewWorkerPool(4, taskNum*keyNum, true)
+
+	var mutex sync.Mutex
+	mapDone := make(map[uint64][]int, keyNum)
+	for i := 0; i < taskNum; i++ {
+		for key := uint64(0); key < keyNum; key++ {
+			i, key := i, key
+			err := p1pool.Submit(key, func() {
+				if 0 == i%10 {
+					time.Sleep(time.Millisecond)
+				}
+				mutex.Lock()
+				mapDone[key] = append(mapDone[key], i)
+				mutex.Unlock()
+			})
+			if nil != err {
+				t.Fatal("Submit:", err)
+			}
+		}
+	}
+	p1pool.Stop()
+
+	for key := uint64(0); key < keyNum; key++ {
+		if taskNum != len(mapDone[key]) {
+			t.Fatalf("key %d: %d tasks done, want %d", key, len(mapDone[key]), taskNum)
+		}
+		for i, done := range mapDone[key] {
+			if i != done {
+				t.Fatalf("key %d: task %d done at position %d", key, done, i)
+			}
+		}
+	}
+}
+
+// TestUnordered 无序模式下所有 worker 共用一个队列，一个任务卡住的时候别的 worker 接着执行后面的任务
+func TestUnordered(t *testing.T) {
+	p1pool := NewWorkerPool(2, 0, false)
+	defer p1pool.Stop()
+	if p1pool.IsOrdered() {
+		t.Fatal("IsOrdered() = true")
+	}
+	chanRelease := make(chan struct{})
+	chanDone := make(chan struct{})
+	p1pool.Submit(0, func() { <-chanRelease })
+	p1pool.Submit(0, func() { close(chanDone) })
+	select {
+	case <-chanDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second task waits for the first one")
+	}
+	close(chanRelease)
+}
+
+// TestSubmitFull 任务队列满了返回 ErrPoolFull，停止之后返回 ErrPoolStopped，GetStats 记下提交、拒绝、执行完的数量
+func TestSubmitFull(t *testing.T) {
+	p1pool := NewWorkerPool(1, 2, true)
+	chanRelease := make(chan struct{})
+	chanBusy := make(chan struct{})
+	if err := p1pool.Submit(0, func() {
+		close(chanBusy)
+		<-chanRelease
+	}); nil != err {
+		t.Fatal("Submit:", err)
+	}
+	<-chanBusy
+	for i := 0; i < 2; i++ {
+		if err := p1pool.Submit(0, func() {}); nil != err {
+			t.Fatal("Submit:", err)
+		}
+	}
+	if err := p1pool.Submit(0, func() {}); ErrPoolFull != err {
+		t.Fatalf("Submit() = %v, want ErrPoolFull", err)
+	}
+
+	t1stats := p1pool.GetStats()
+	if (Stats{WorkerNum: 1, BusyNum: 1, QueueLen: 2, QueueCap: 2, SubmittedNum: 3, RejectedNum: 1}) != t1stats {
+		t.Fatalf("GetStats() = %+v", t1stats)
+	}
+
+	close(chanRelease)
+	p1pool.Stop()
+	if err := p1pool.Submit(0, func() {}); ErrPoolStopped != err {
+		t.Fatalf("Submit() after Stop = %v, want ErrPoolStopped", err)
+	}
+	t1stats = p1pool.GetStats()
+	if 0 != t1stats.BusyNum || 0 != t1stats.QueueLen || 3 != t1stats.CompletedNum || 1 != t1stats.RejectedNum {
+		t.Fatalf("GetStats() after Stop = %+v", t1stats)
+	}
+}
+
+// TestStopDrain Stop 等排队中的任务都执行完之后返回，重复调用不会出错
+func TestStopDrain(t *testing.T) {
+	for _, isOrdered := range []bool{true, false} {
+		p1pool := NewWorkerPool(3, 100, isOrdered)
+		var mutex sync.Mutex
+		doneNum := 0
+		for i := 0; i < 100; i++ {
+			if err := p1pool.Submit(uint64(i), func() {
+				time.Sleep(100 * time.Microsecond)
+				mutex.Lock()
+				doneNum++
+				mutex.Unlock()
+			}); nil != err {
+				t.Fatal("Submit:", err)
+			}
+		}
+		p1pool.Stop()
+		p1pool.Stop()
+		mutex.Lock()
+		if 100 != doneNum {
+			t.Fatalf("ordered=%v: %d tasks done after Stop, want 100", isOrdered, doneNum)
+		}
+		mutex.Unlock()
+	}
+}
@@ -0,0 +1,177 @@
+package writequeue
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	PolicyBlock uint8 = iota // 队列满了，发送方阻塞等待
+	PolicyDrop               // 队列满了，丢弃要发送的数据
+	PolicyClose              // 队列满了，关闭连接
+)
+
+const (
+	// DefaultSize 队列默认能放多少条数据
+	DefaultSize int = 1024
+	// CoalesceMax 一次系统调用最多合并多少字节，单条数据比这个大的时候单独发送
+	CoalesceMax int = 64 * 1024
+)
+
+var (
+	// ErrQueueClosed 队列已经关闭
+	ErrQueueClosed = errors.New("write queue is closed.")
+	// ErrQueueFull 队列满了，数据被丢弃
+	ErrQueueFull = errors.New("write queue is full.")
+)
+
+// WriteQueue 发送队列。
+// 每个 TCP 连接一个，有数据的时候启动一个发送 goroutine，把队列中的小数据合并之后再发送，队列空了 goroutine 就退出。
+type WriteQueue struct {
+	// mutex 保护下面所有的字段
+	mutex sync.Mutex
+	// p1cond 队列有空位、队列发送完了的时候通知
+	p1cond *sync.Cond
+
+	// sli2data 待发送的数据
+	sli2data [][]byte
+	// size 队列能放多少条数据
+	size int
+	// policy 队列满了怎么办，详见 Policy 开头的常量
+	policy uint8
+	// isWriting 发送 goroutine 是否在运行
+	isWriting bool
+	// isClosed 队列是否已经关闭
+	isClosed bool
+
+	// sli1coalesce 合并数据用的缓冲区，只在发送 goroutine 中使用
+	sli1coalesce []byte
+
+	// write 真正发送数据的方法，只在发送 goroutine 中调用
+	write func(sli1data []byte) error
+	// onError write 出错之后调用，这时队列中剩下的数据会被丢弃
+	onError func(err error)
+}
+
+// NewWriteQueue 创建 WriteQueue
+func NewWriteQueue(size int, policy uint8, write func([]byte) error, onError func(error)) *WriteQueue {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	p1queue := &WriteQueue{
+		sli2data: make([][]byte, 0, 4),
+		size:     size,
+		policy:   policy,
+		write:    write,
+		onError:  onError,
+	}
+	p1queue.p1cond = sync.NewCond(&p1queue.mutex)
+	return p1queue
+}
+
+// Push 把数据放进队列。
+// 队列满了的时候，PolicyBlock 会阻塞到有空位，PolicyDrop 和 PolicyClose 返回 ErrQueueFull，PolicyClose 时调用方需要关闭连接。
+func (p1this *WriteQueue) Push(sli1data []byte) error {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+
+	for !p1this.isClosed && len(p1this.sli2data) >= p1this.size {
+		if PolicyBlock != p1this.policy {
+			return ErrQueueFull
+		}
+		p1this.p1cond.Wait()
+	}
+	if p1this.isClosed {
+		return ErrQueueClosed
+	}
+
+	p1this.sli2data = append(p1this.sli2data, sli1data)
+	if !p1this.isWriting {
+		p1this.isWriting = true
+		go p1this.run()
+	}
+	return nil
+}
+
+// Len 队列中待发送的数据有多少条
+func (p1this *WriteQueue) Len() int {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	return len(p1this.sli2data)
+}
+
+// Close 关闭队列，不再接收新数据，已经在队列中的数据会继续发送
+func (p1this *WriteQueue) Close() {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	p1this.isClosed = true
+	p1this.p1cond.Broadcast()
+}
+
+// Flush 等待队列中的数据全部发送完（或者发送出错）
+func (p1this *WriteQueue) Flush() {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	for p1this.isWriting {
+		p1this.p1cond.Wait()
+	}
+}
+
+// run 发送 goroutine
+func (p1this *WriteQueue) run() {
+	for {
+		p1this.mutex.Lock()
+		if 0 == len(p1this.sli2data) {
+			// 发送完了，合并用的缓冲区也不留着，空闲的连接不占内存
+			p1this.sli1coalesce = nil
+			p1this.isWriting = false
+			p1this.p1cond.Broadcast()
+			p1this.mutex.Unlock()
+			return
+		}
+		sli1data := p1this.coalesce()
+		p1this.p1cond.Broadcast()
+		p1this.mutex.Unlock()
+
+		err := p1this.write(sli1data)
+		if nil != err {
+			p1this.mutex.Lock()
+			p1this.sli2data = p1this.sli2data[:0]
+			p1this.isWriting = false
+			p1this.p1cond.Broadcast()
+			p1this.mutex.Unlock()
+			p1this.onError(err)
+			return
+		}
+	}
+}
+
+// coalesce 从队列头部取出数据，能合并的合并成一条，调用时需要持有 mutex
+func (p1this *WriteQueue) coalesce() []byte {
+	sli1first := p1this.sli2data[0]
+	num := 1
+	total := len(sli1first)
+	for num < len(p1this.sli2data) && total+len(p1this.sli2data[num]) <= CoalesceMax {
+		total += len(p1this.sli2data[num])
+		num++
+	}
+
+	var sli1data []byte
+	if 1 == num {
+		sli1data = sli1first
+	} else {
+		p1this.sli1coalesce = p1this.sli1coalesce[:0]
+		for _, t1sli1data := range p1this.sli2data[:num] {
+			p1this.sli1coalesce = append(p1this.sli1coalesce, t1sli1data...)
+		}
+		sli1data = p1this.sli1coalesce
+	}
+
+	// 取出来的数据从队列中移除，移动剩下的数据，避免底层数组一直变大
+	remain := copy(p1this.sli2data, p1this.sli2data[num:])
+	for i := remain; i < len(p1this.sli2data); i++ {
+		p1this.sli2data[i] = nil
+	}
+	p1this.sli2data = p1this.sli2data[:remain]
+	return sli1data
+}
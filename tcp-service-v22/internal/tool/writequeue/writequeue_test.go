@@ -0,0 +1,241 @@
+package writequeue
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWriter 记录每次 write 的数据，write 等 chanRelease 关闭之后才返回，测试可以让发送 goroutine 卡在 write 中
+type testWriter struct {
+	mutex     sync.Mutex
+	sli2write [][]byte
+	// chanWriting 每次开始 write 的时候通知
+	chanWriting chan struct{}
+	// chanRelease 关闭之后 write 不再等待
+	chanRelease chan struct{}
+	// err 不为 nil 时 write 返回这个错误
+	err error
+}
+
+func newTestWriter() *testWriter {
+	return &testWriter{
+		chanWriting: make(chan struct{}, 100),
+		chanRelease: make(chan struct{}),
+	}
+}
+
+func (p1this *testWriter) write(sli1data []byte) error {
+	p1this.chanWriting <- struct{}{}
+	<-p1this.chanRelease
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	// 合并用的缓冲区会被复用，要复制
+	p1this.sli2write = append(p1this.sli2write, append([]byte{}, sli1data...))
+	return p1this.err
+}
+
+// written 获取到现在为止每次 write 的数据
+func (p1this *testWriter) written() [][]byte {
+	p1this.mutex.Lock()
+	defer p1this.mutex.Unlock()
+	return p1this.sli2write
+}
+
+// waitWriting 等发送 goroutine 开始 write
+func (p1this *testWriter) waitWriting(t *testing.T) {
+	t.Helper()
+	select {
+	case <-p1this.chanWriting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for write")
+	}
+}
+
+// isDone 等一会儿看 chanDone 有没有关闭，用来判断阻塞的调用有没有返回
+func isDone(chanDone chan struct{}, wait time.Duration) bool {
+	select {
+	case <-chanDone:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+// TestCoalesce 发送 goroutine 在 write 的时候放进来的数据，下一次合并发送，一次最多 CoalesceMax 字节，比这个大的单独发送
+func TestCoalesce(t *testing.T) {
+	p1writer := newTestWriter()
+	p1queue := NewWriteQueue(0, PolicyBlock, p1writer.write, func(error) {})
+
+	sli2push := [][]byte{
+		[]byte("first"),
+		bytes.Repeat([]byte("a"), 30*1024),
+		bytes.Repeat([]byte("b"), 30*1024),
+		bytes.Repeat([]byte("c"), 30*1024),
+		bytes.Repeat([]byte("d"), CoalesceMax+1),
+		[]byte("x"),
+		[]byte("y"),
+	}
+	for i, sli1data := range sli2push {
+		if err := p1queue.Push(sli1data); nil != err {
+			t.Fatal("Push:", err)
+		}
+		if 0 == i {
+			// 第 1 条单独发送，write 卡住的时候后面的都在队列里
+			p1writer.waitWriting(t)
+		}
+	}
+	close(p1writer.chanRelease)
+	p1queue.Flush()
+
+	sli1wantLen := []int{5, 60 * 1024, 30 * 1024, CoalesceMax + 1, 2}
+	sli2write := p1writer.written()
+	if len(sli1wantLen) != len(sli2write) {
+		t.Fatalf("%d writes, want %d", len(sli2write), len(sli1wantLen))
+	}
+	for i, sli1data := range sli2write {
+		if sli1wantLen[i] != len(sli1data) {
+			t.Fatalf("write %d: %d bytes, want %d", i, len(sli1data), sli1wantLen[i])
+		}
+	}
+	if !bytes.Equal(bytes.Join(sli2push, nil), bytes.Join(sli2write, nil)) {
+		t.Fatal("data is reordered")
+	}
+}
+
+// TestPolicy 队列满了的时候，PolicyBlock 等到有空位，PolicyDrop 和 PolicyClose 返回 ErrQueueFull，数据不发送
+func TestPolicy(t *testing.T) {
+	t.Run("block", func(t *testing.T) {
+		p1writer := newTestWriter()
+		p1queue := NewWriteQueue(1, PolicyBlock, p1writer.write, func(error) {})
+		p1queue.Push([]byte("1"))
+		p1writer.waitWriting(t)
+		p1queue.Push([]byte("2"))
+
+		chanDone := make(chan struct{})
+		var err error
+		go func() {
+			defer close(chanDone)
+			err = p1queue.Push([]byte("3"))
+		}()
+		if isDone(chanDone, 50*time.Millisecond) {
+			t.Fatal("Push() returned when the queue is full")
+		}
+		close(p1writer.chanRelease)
+		if !isDone(chanDone, 5*time.Second) || nil != err {
+			t.Fatalf("Push() = %v after the queue has room", err)
+		}
+		p1queue.Flush()
+		if "123" != string(bytes.Join(p1writer.written(), nil)) {
+			t.Fatalf("written %q", p1writer.written())
+		}
+	})
+
+	for _, policy := range []uint8{PolicyDrop, PolicyClose} {
+		p1writer := newTestWriter()
+		p1queue := NewWriteQueue(1, policy, p1writer.write, func(error) {})
+		p1queue.Push([]byte("1"))
+		p1writer.waitWriting(t)
+		if err := p1queue.Push([]byte("2")); nil != err {
+			t.Fatalf("policy %d: Push() = %v", policy, err)
+		}
+		if err := p1queue.Push([]byte("3")); ErrQueueFull != err {
+			t.Fatalf("policy %d: Push() = %v, want ErrQueueFull", policy, err)
+		}
+		if 1 != p1queue.Len() {
+			t.Fatalf("policy %d: Len() = %d", policy, p1queue.Len())
+		}
+		close(p1writer.chanRelease)
+		p1queue.Flush()
+		if "12" != string(bytes.Join(p1writer.written(), nil)) {
+			t.Fatalf("policy %d: written %q", policy, p1writer.written())
+		}
+	}
+}
+
+// TestFlush Flush 等正在 write 的数据和队列中的数据都发送完，Close 之后已经在队列中的还会发送
+func TestFlush(t *testing.T) {
+	p1writer := newTestWriter()
+	p1queue := NewWriteQueue(0, PolicyBlock, p1writer.write, func(error) {})
+	p1queue.Push([]byte("1"))
+	p1writer.waitWriting(t)
+	p1queue.Push([]byte("2"))
+	p1queue.Close()
+	if err := p1queue.Push([]byte("3")); ErrQueueClosed != err {
+		t.Fatalf("Push() after Close = %v, want ErrQueueClosed", err)
+	}
+
+	chanDone := make(chan struct{})
+	go func() {
+		defer close(chanDone)
+		p1queue.Flush()
+	}()
+	if isDone(chanDone, 50*time.Millisecond) {
+		t.Fatal("Flush() returned during a write")
+	}
+	close(p1writer.chanRelease)
+	if !isDone(chanDone, 5*time.Second) {
+		t.Fatal("Flush() did not return")
+	}
+	if "12" != string(bytes.Join(p1writer.written(), nil)) {
+		t.Fatalf("written %q", p1writer.written())
+	}
+}
+
+// TestCloseBlockedPush PolicyBlock 阻塞的 Push 在 Close 之后返回 ErrQueueClosed
+func TestCloseBlockedPush(t *testing.T) {
+	p1writer := newTestWriter()
+	defer close(p1writer.chanRelease)
+	p1queue := NewWriteQueue(1, PolicyBlock, p1writer.write, func(error) {})
+	p1queue.Push([]byte("1"))
+	p1writer.waitWriting(t)
+	p1queue.Push([]byte("2"))
+
+	chanErr := make(chan error, 1)
+	go func() {
+		chanErr <- p1queue.Push([]byte("3"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	p1queue.Close()
+	select {
+	case err := <-chanErr:
+		if ErrQueueClosed != err {
+			t.Fatalf("Push() = %v, want ErrQueueClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocked Push() did not return after Close")
+	}
+}
+
+// TestWriteError write 出错之后丢掉队列中剩下的数据，调用 onError，Flush 马上返回
+func TestWriteError(t *testing.T) {
+	errWrite := errors.New("broken pipe")
+	p1writer := newTestWriter()
+	p1writer.err = errWrite
+	var sli1err []error
+	chanError := make(chan struct{})
+	p1queue := NewWriteQueue(0, PolicyBlock, p1writer.write, func(err error) {
+		sli1err = append(sli1err, err)
+		close(chanError)
+	})
+	p1queue.Push([]byte("1"))
+	p1writer.waitWriting(t)
+	p1queue.Push([]byte("2"))
+	p1queue.Push([]byte("3"))
+	close(p1writer.chanRelease)
+
+	select {
+	case <-chanError:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onError is not called")
+	}
+	p1queue.Flush()
+	if 1 != len(sli1err) || errWrite != sli1err[0] {
+		t.Fatalf("onError(%v)", sli1err)
+	}
+	if 0 != p1queue.Len() || "1" != string(bytes.Join(p1writer.written(), nil)) {
+		t.Fatalf("Len() = %d, written %q", p1queue.Len(), p1writer.written())
+	}
+}